@@ -0,0 +1,362 @@
+package chatserver
+
+import (
+	"errors"
+	"fmt"
+	"go-telnet-mod/telsh"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// The admin console. It's a telsh shell (from go-telnet-mod) served on a Unix
+// domain socket, so only someone who can get at the socket file on the
+// server -- nobody over the network -- can use it. You connect with e.g.
+// "nc -U /path/to/admin.sock" and type commands; "help" lists them.
+//
+// Like the metrics endpoint, the console never reads another goroutine's
+// state directly. It asks the channel master, which answers for itself and
+// passes questions on to the shards and doppelgangers (and the shards to the
+// chat channels), which answer the console directly. The exceptions are
+// "backlog", which looks at the lengths of the channel master's and the
+// shards' incoming go channels itself (len() on a go channel is safe from
+// any goroutine) so that it still says something useful when the channel
+// master is stuck -- which is when you'd most want to look -- and "cluster",
+// which reads the cluster membership (which has its own mutex).
+//
+// Every request gives up after adminTimeout. Each command runs in its own
+// goroutine (telsh does that), so a stuck daemon can't hang the console.
+//
+
+const adminTimeout = 2 * time.Second
+
+var adminModeNames = map[int]string{
+	loginUsernameMode:        "login: user name",
+	loginNewUserYNMode:       "login: new user?",
+	loginNewPassword1Mode:    "login: new password",
+	loginNewPassword2Mode:    "login: new password again",
+	loginRegularPasswordMode: "login: password",
+	loginCommandMode:         "chat",
+}
+
+const adminDefaultKickMessage = "You have been disconnected by the administrator."
+
+type adminConsole struct {
+	chatServer          *ChatServer
+	chanMasterFromAdmin chan messageFromAdminToChannelMaster
+}
+
+func newAdminShell(chatServer *ChatServer, chanMasterFromAdmin chan messageFromAdminToChannelMaster) *telsh.ShellHandler {
+	console := &adminConsole{chatServer: chatServer, chanMasterFromAdmin: chanMasterFromAdmin}
+	shell := telsh.NewShellHandler()
+	shell.WelcomeMessage = "\r\nwtelnet admin console. Type help for commands, exit to leave.\r\n"
+	shell.Prompt = "wtelnet> "
+	shell.MustRegister("help", telsh.Help(shell))
+	shell.MustRegisterHandlerFunc("channels", console.channels)
+	shell.MustRegisterHandlerFunc("members", console.members)
+	shell.MustRegisterHandlerFunc("sessions", console.sessions)
+	shell.MustRegisterHandlerFunc("backlog", console.backlog)
+	shell.MustRegisterHandlerFunc("kick", console.kick)
+	shell.MustRegisterHandlerFunc("cluster", console.cluster)
+	return shell
+}
+
+//
+// Sends a request to the channel master and waits for its reply. The
+// callback is buffered so the channel master never blocks answering, even
+// if we've given up.
+//
+func (console *adminConsole) ask(operation int, doppelgangerID int64, parameter string, deadline *time.Timer) (adminReplyFromChannelMaster, error) {
+	var request messageFromAdminToChannelMaster
+	request.operation = operation
+	request.doppelgangerID = doppelgangerID
+	request.parameter = parameter
+	request.adminCallback = make(chan adminReplyFromChannelMaster, 1)
+	select {
+	case console.chanMasterFromAdmin <- request:
+	case <-deadline.C:
+		return adminReplyFromChannelMaster{}, errors.New("channel master did not take the request in time; it may be stuck (try backlog)")
+	}
+	select {
+	case reply := <-request.adminCallback:
+		return reply, nil
+	case <-deadline.C:
+		return adminReplyFromChannelMaster{}, errors.New("channel master did not answer in time; it may be stuck (try backlog)")
+	}
+}
+
+func adminPrintf(stdout io.Writer, format string, args ...interface{}) {
+	io.WriteString(stdout, strings.Replace(fmt.Sprintf(format, args...), "\n", "\r\n", -1))
+}
+
+//
+// Collects the answers from the shards the channel master passed a question
+// about chat channels on to. incomplete says some didn't answer in time.
+//
+func collectShardReplies(reply adminReplyFromChannelMaster, deadline *time.Timer) ([]adminShardReply, bool) {
+	shards := make([]adminShardReply, 0, reply.asked)
+	for len(shards) < reply.asked {
+		select {
+		case shard := <-reply.shardCallback:
+			shards = append(shards, shard)
+		case <-deadline.C:
+			return shards, true
+		}
+	}
+	return shards, false
+}
+
+func adminStatusLine(stdout io.Writer, reply adminReplyFromChannelMaster) {
+	adminPrintf(stdout, "%d doppelgangers", reply.doppelgangers)
+	if reply.shuttingDown {
+		adminPrintf(stdout, ", shutting down")
+	}
+	adminPrintf(stdout, "\n")
+}
+
+//
+// channels: every shard's runningChatchannelMap.
+//
+func (console *adminConsole) channels(stdin io.ReadCloser, stdout io.WriteCloser, stderr io.WriteCloser, args ...string) error {
+	deadline := time.NewTimer(adminTimeout)
+	defer deadline.Stop()
+	reply, err := console.ask(fromAdminToChannelMasterOpChatChannels, 0, "", deadline)
+	if err != nil {
+		adminPrintf(stdout, "%s\n", err)
+		return nil
+	}
+	shards, incomplete := collectShardReplies(reply, deadline)
+	chatChannels := make([]adminChatChannelEntry, 0)
+	shardOf := make(map[int64]int)
+	chatChannelsClosing := 0
+	for _, shard := range shards {
+		for _, entry := range shard.chatChannels {
+			chatChannels = append(chatChannels, entry)
+			shardOf[entry.chatChannelID] = shard.shard
+		}
+		chatChannelsClosing += shard.chatChannelsClosing
+	}
+	sort.Slice(chatChannels, func(ii, jj int) bool {
+		return chatChannels[ii].chatChannelID < chatChannels[jj].chatChannelID
+	})
+	adminPrintf(stdout, "%-12s %6s %8s %14s\n", "CHANNEL ID", "SHARD", "MEMBERS", "QUEUE")
+	for _, entry := range chatChannels {
+		adminPrintf(stdout, "%-12d %6d %8d %14s\n", entry.chatChannelID, shardOf[entry.chatChannelID], entry.memberCount, strconv.Itoa(entry.queueLength)+"/"+strconv.Itoa(entry.queueCapacity))
+	}
+	adminPrintf(stdout, "%d running chat channels, %d closing, ", len(chatChannels), chatChannelsClosing)
+	adminStatusLine(stdout, reply)
+	if incomplete {
+		adminPrintf(stdout, "Only %d of %d shards answered in time; the rest may be stuck (try backlog).\n", len(shards), reply.asked)
+	}
+	return nil
+}
+
+//
+// members: each running chat channel's member list, from the chat channel
+// itself.
+//
+func (console *adminConsole) members(stdin io.ReadCloser, stdout io.WriteCloser, stderr io.WriteCloser, args ...string) error {
+	deadline := time.NewTimer(adminTimeout)
+	defer deadline.Stop()
+	reply, err := console.ask(fromAdminToChannelMasterOpMembers, 0, "", deadline)
+	if err != nil {
+		adminPrintf(stdout, "%s\n", err)
+		return nil
+	}
+	shards, shardsIncomplete := collectShardReplies(reply, deadline)
+	chatChannels := make([]adminChatChannelMembers, 0)
+	asked := 0
+	incomplete := false
+	for _, shard := range shards {
+		asked += shard.membersAsked
+		answered := 0
+		for answered < shard.membersAsked && !incomplete {
+			select {
+			case chatChannel := <-shard.membersCallback:
+				chatChannels = append(chatChannels, chatChannel)
+				answered++
+			case <-deadline.C:
+				incomplete = true
+			}
+		}
+	}
+	sort.Slice(chatChannels, func(ii, jj int) bool {
+		return chatChannels[ii].chatChannelName < chatChannels[jj].chatChannelName
+	})
+	for _, chatChannel := range chatChannels {
+		adminPrintf(stdout, "#%s (channel ID %d), %d members\n", chatChannel.chatChannelName, chatChannel.chatChannelID, len(chatChannel.members))
+		sort.Slice(chatChannel.members, func(ii, jj int) bool {
+			return chatChannel.members[ii].userName < chatChannel.members[jj].userName
+		})
+		for _, member := range chatChannel.members {
+			adminPrintf(stdout, "    %-20s user ID %-8d doppelganger ID %d\n", member.userName, member.userID, member.doppelgangerID)
+		}
+	}
+	if shardsIncomplete {
+		adminPrintf(stdout, "Only %d of %d shards answered in time; the rest may be stuck (try backlog).\n", len(shards), reply.asked)
+	}
+	if incomplete {
+		adminPrintf(stdout, "Only %d of %d chat channels answered in time; the rest may be stuck.\n", len(chatChannels), asked)
+	}
+	return nil
+}
+
+//
+// sessions: every doppelganger, logged in or not, described by itself.
+//
+func (console *adminConsole) sessions(stdin io.ReadCloser, stdout io.WriteCloser, stderr io.WriteCloser, args ...string) error {
+	deadline := time.NewTimer(adminTimeout)
+	defer deadline.Stop()
+	reply, err := console.ask(fromAdminToChannelMasterOpSessions, 0, "", deadline)
+	if err != nil {
+		adminPrintf(stdout, "%s\n", err)
+		return nil
+	}
+	sessions := make([]adminSessionEntry, 0, reply.asked)
+	incomplete := false
+	for len(sessions) < reply.asked && !incomplete {
+		select {
+		case session := <-reply.sessionsCallback:
+			sessions = append(sessions, session)
+		case <-deadline.C:
+			incomplete = true
+		}
+	}
+	sort.Slice(sessions, func(ii, jj int) bool {
+		return sessions[ii].lastInput.After(sessions[jj].lastInput)
+	})
+	now := time.Now()
+	adminPrintf(stdout, "%-20s %-16s %-22s %-26s %-20s %8s %6s\n", "DOPPELGANGER ID", "USER", "REMOTE ADDRESS", "MODE", "CHANNEL", "IDLE", "QUEUE")
+	for _, session := range sessions {
+		userName := session.userName
+		if session.userID == 0 {
+			userName = "-"
+		}
+		mode, known := adminModeNames[session.mode]
+		if !known {
+			mode = strconv.Itoa(session.mode)
+		}
+		if session.away {
+			mode += " (away)"
+		}
+		chatChannelName := "-"
+		if session.chatChannelID != 0 {
+			chatChannelName = "#" + session.chatChannelName
+		}
+		adminPrintf(stdout, "%-20d %-16s %-22s %-26s %-20s %8s %6d\n", session.doppelgangerID, userName, session.remoteAddr, mode, chatChannelName, now.Sub(session.lastInput).Round(time.Second), session.queueLength)
+	}
+	adminPrintf(stdout, "%d sessions answered, ", len(sessions))
+	adminStatusLine(stdout, reply)
+	if incomplete {
+		adminPrintf(stdout, "Only %d of %d doppelgangers answered in time; the rest may be stuck.\n", len(sessions), reply.asked)
+	}
+	if reply.asked < reply.doppelgangers {
+		adminPrintf(stdout, "%d doppelgangers were too busy to be asked.\n", reply.doppelgangers-reply.asked)
+	}
+	return nil
+}
+
+//
+// backlog: how full the go channels are. The channel master's and the
+// shards' own queues we can see without asking anyone.
+//
+func (console *adminConsole) backlog(stdin io.ReadCloser, stdout io.WriteCloser, stderr io.WriteCloser, args ...string) error {
+	adminPrintf(stdout, "%-40s %14s\n", "QUEUE", "LENGTH")
+	adminPrintf(stdout, "%-40s %14s\n", "channel master <- doppelgangers", strconv.Itoa(len(console.chatServer.chanMasterFromDoppelgangerGoChan))+"/"+strconv.Itoa(cap(console.chatServer.chanMasterFromDoppelgangerGoChan)))
+	adminPrintf(stdout, "%-40s %14s\n", "channel master <- chat channels", strconv.Itoa(len(console.chatServer.chanMasterFromChatChannelGoChan))+"/"+strconv.Itoa(cap(console.chatServer.chanMasterFromChatChannelGoChan)))
+	for _, shard := range console.chatServer.channelMasterShards {
+		shardName := "shard " + strconv.Itoa(shard.index)
+		adminPrintf(stdout, "%-40s %14s\n", shardName+" <- doppelgangers", strconv.Itoa(len(shard.fromDoppelganger))+"/"+strconv.Itoa(cap(shard.fromDoppelganger)))
+		adminPrintf(stdout, "%-40s %14s\n", shardName+" <- chat channels", strconv.Itoa(len(shard.fromChatChannel))+"/"+strconv.Itoa(cap(shard.fromChatChannel)))
+		adminPrintf(stdout, "%-40s %14s\n", shardName+" <- channel master", strconv.Itoa(len(shard.fromChannelMaster))+"/"+strconv.Itoa(cap(shard.fromChannelMaster)))
+	}
+	deadline := time.NewTimer(adminTimeout)
+	defer deadline.Stop()
+	reply, err := console.ask(fromAdminToChannelMasterOpChatChannels, 0, "", deadline)
+	if err != nil {
+		adminPrintf(stdout, "%s\n", err)
+		return nil
+	}
+	shards, incomplete := collectShardReplies(reply, deadline)
+	chatChannels := make([]adminChatChannelEntry, 0)
+	for _, shard := range shards {
+		chatChannels = append(chatChannels, shard.chatChannels...)
+	}
+	sort.Slice(chatChannels, func(ii, jj int) bool {
+		return chatChannels[ii].chatChannelID < chatChannels[jj].chatChannelID
+	})
+	for _, entry := range chatChannels {
+		adminPrintf(stdout, "%-40s %14s\n", "chat channel "+strconv.FormatInt(entry.chatChannelID, 10)+" <- channel master", strconv.Itoa(entry.queueLength)+"/"+strconv.Itoa(entry.queueCapacity))
+	}
+	if incomplete {
+		adminPrintf(stdout, "Only %d of %d shards answered in time; the rest may be stuck.\n", len(shards), reply.asked)
+	}
+	adminPrintf(stdout, "Doppelganger queues are in the QUEUE column of sessions.\n")
+	return nil
+}
+
+//
+// kick <doppelganger ID> [message]: hang up on one session, telling the user
+// why first.
+//
+func (console *adminConsole) kick(stdin io.ReadCloser, stdout io.WriteCloser, stderr io.WriteCloser, args ...string) error {
+	if len(args) == 0 {
+		adminPrintf(stdout, "Usage: kick <doppelganger ID> [message]\n")
+		return nil
+	}
+	doppelgangerID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		adminPrintf(stdout, "%q is not a doppelganger ID (see sessions).\n", args[0])
+		return nil
+	}
+	message := adminDefaultKickMessage
+	if len(args) > 1 {
+		message = strings.Join(args[1:], " ")
+	}
+	deadline := time.NewTimer(adminTimeout)
+	defer deadline.Stop()
+	reply, err := console.ask(fromAdminToChannelMasterOpDisconnect, doppelgangerID, message, deadline)
+	if err != nil {
+		adminPrintf(stdout, "%s\n", err)
+		return nil
+	}
+	if !reply.found {
+		adminPrintf(stdout, "No session with doppelganger ID %d.\n", doppelgangerID)
+		return nil
+	}
+	if !reply.delivered {
+		adminPrintf(stdout, "Doppelganger ID %d is already being disconnected; the user won't see your message.\n", doppelgangerID)
+		return nil
+	}
+	adminPrintf(stdout, "Disconnecting doppelganger ID %d.\n", doppelgangerID)
+	return nil
+}
+
+//
+// cluster: this node and the other nodes, and whether we're connected to
+// them. Users on other nodes show up in sessions with "cluster node" and the
+// node's name as their remote address.
+//
+func (console *adminConsole) cluster(stdin io.ReadCloser, stdout io.WriteCloser, stderr io.WriteCloser, args ...string) error {
+	if console.chatServer.cluster == nil {
+		adminPrintf(stdout, "Not in a cluster (cluster_node is not set).\n")
+		return nil
+	}
+	now := time.Now()
+	adminPrintf(stdout, "%-20s %-22s %-6s %10s\n", "NODE", "ADDRESS", "STATE", "SINCE")
+	for _, node := range clusterStatus(console.chatServer) {
+		name := node.node
+		if node.self {
+			name += " (self)"
+		}
+		state := "down"
+		if node.up {
+			state = "up"
+		}
+		adminPrintf(stdout, "%-20s %-22s %-6s %10s\n", name, node.addr, state, now.Sub(node.since).Round(time.Second))
+	}
+	return nil
+}
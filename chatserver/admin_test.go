@@ -0,0 +1,57 @@
+package chatserver
+
+import (
+	"net"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+//
+// The admin console on a Unix socket, the way the daemon serves it, driven
+// like a Telnet test client.
+//
+func (server *testServer) dialAdmin() *testClient {
+	path := filepath.Join(server.t.TempDir(), "admin.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		server.t.Fatal(err)
+	}
+	server.t.Cleanup(func() {
+		listener.Close()
+	})
+	go server.chatServer.ServeAdmin(listener)
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		server.t.Fatal(err)
+	}
+	console := server.startClient("admin", conn, 4096)
+	console.expect(`wtelnet> `)
+	return console
+}
+
+//
+// sessions, channels and members show a user on a chat channel, and kick
+// hangs up on them, telling them why.
+//
+func TestAdminConsole(t *testing.T) {
+	server := startTestServer(t, nil)
+	alice := server.logIn("alice", "secret")
+	alice.send("/create lounge")
+	alice.expect(`created\.`)
+	alice.send("/join lounge")
+	alice.expect(`You have joined #lounge`)
+	console := server.dialAdmin()
+	console.send("sessions")
+	session := regexp.MustCompile(`([0-9]+) +alice +127\.0\.0\.1:[0-9]+ +chat +#lounge `).FindStringSubmatch(console.expect(`[0-9]+ +alice +127\.0\.0\.1:[0-9]+ +chat +#lounge `))
+	console.expect(`1 sessions answered, 1 doppelgangers`)
+	console.send("channels")
+	console.expect(`1 running chat channels, 0 closing, 1 doppelgangers`)
+	console.send("members")
+	console.expect(`#lounge \(channel ID [0-9]+\), 1 members`)
+	console.expect(`alice +user ID [0-9]+ +doppelganger ID ` + session[1])
+	console.send("kick " + session[1] + " Time for bed")
+	console.expect(`Disconnecting doppelganger ID ` + session[1] + `\.`)
+	alice.expect(`Time for bed`)
+	alice.expectHangUp()
+}
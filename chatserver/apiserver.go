@@ -0,0 +1,539 @@
+package chatserver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// The HTTP API, for bots and other programs that would rather not pretend
+// to be a Telnet user. Every request needs an API token, which a user makes
+// for themselves with /apitoken, and which the request acts as that user
+// with:
+//
+//	Authorization: Bearer <token>
+//
+//	GET  /api/channels                        every chat channel, with how
+//	                                          many are on it
+//	GET  /api/who                             who's logged in, and where
+//	GET  /api/channels/<name>/history?limit=N the latest messages (all we
+//	                                          have if there's no limit)
+//	POST /api/channels/<name>/messages        {"text": "..."} -- say it on
+//	                                          the chat channel, as the
+//	                                          token's user
+//
+// Answers are JSON, errors plain text, same as the web gateway's. Like the
+// metrics endpoint and the admin console, the API never reads another
+// goroutine's state: it asks the channel master, which passes questions on
+// to the shards and doppelgangers (and the shards to the chat channels),
+// which answer the API directly. Each request gives up after apiTimeout, and
+// says so with a 503 -- or for channels and who, answers with what it has
+// and "incomplete": true.
+//
+// Chat channels remember the latest chat_history messages, and a chat
+// channel's shard keeps them while nobody's on it. A message posted to a
+// chat channel nobody's on is still said -- it's in the conversation log
+// and the history -- unless the server is shutting down (a 503). In a
+// cluster, each node only knows about its own users and the chat channels
+// it runs; history and messages for a chat channel another node runs get a
+// 421 saying which.
+//
+
+const apiTimeout = 2 * time.Second
+
+//
+// Longest body a post can have.
+//
+const apiMaxPost = 8192
+
+const apiPrefix = "/api/"
+
+type apiChatChannel struct {
+	Name    string `json:"name"`
+	Members int    `json:"members"`
+}
+
+type apiChatChannelList struct {
+	Channels   []apiChatChannel `json:"channels"`
+	Incomplete bool             `json:"incomplete,omitempty"`
+}
+
+type apiUser struct {
+	User        string `json:"user"`
+	Channel     string `json:"channel,omitempty"`
+	Away        bool   `json:"away,omitempty"`
+	IdleSeconds int64  `json:"idle_seconds"`
+}
+
+type apiWho struct {
+	Users      []apiUser `json:"users"`
+	Incomplete bool      `json:"incomplete,omitempty"`
+}
+
+type apiMessage struct {
+	Time string `json:"time"`
+	User string `json:"user,omitempty"`
+	Text string `json:"text"`
+	Said string `json:"said,omitempty"`
+}
+
+type apiHistory struct {
+	Channel  string       `json:"channel"`
+	Messages []apiMessage `json:"messages"`
+}
+
+type apiPostRequest struct {
+	Text string `json:"text"`
+}
+
+type apiPostReply struct {
+	Channel string `json:"channel"`
+	Text    string `json:"text"`
+}
+
+type apiServer struct {
+	chatServer *ChatServer
+}
+
+//
+// The API, for the program to put on an HTTP server of its choosing (the
+// daemon puts it on api_listen). It expects to get the whole path,
+// /api/... and all.
+//
+func (chatServer *ChatServer) APIHandler() http.Handler {
+	server := new(apiServer)
+	server.chatServer = chatServer
+	return server
+}
+
+func (server *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, apiPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+	userID, userName, ok := server.authenticate(w, r)
+	if !ok {
+		return
+	}
+	path := strings.Split(strings.TrimSuffix(r.URL.Path[len(apiPrefix):], "/"), "/")
+	switch {
+	case (len(path) == 1) && (path[0] == "channels"):
+		if r.Method != http.MethodGet {
+			http.Error(w, "GET only", http.StatusMethodNotAllowed)
+			return
+		}
+		server.serveChatChannels(w)
+	case (len(path) == 1) && (path[0] == "who"):
+		if r.Method != http.MethodGet {
+			http.Error(w, "GET only", http.StatusMethodNotAllowed)
+			return
+		}
+		server.serveWho(w)
+	case (len(path) == 3) && (path[0] == "channels") && (path[2] == "history"):
+		if r.Method != http.MethodGet {
+			http.Error(w, "GET only", http.StatusMethodNotAllowed)
+			return
+		}
+		server.serveHistory(w, r, path[1])
+	case (len(path) == 3) && (path[0] == "channels") && (path[2] == "messages"):
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		server.servePost(w, r, path[1], userID, userName)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+//
+// Whose token the request has. If it doesn't have one that's anybody's,
+// we've already answered it.
+//
+func (server *apiServer) authenticate(w http.ResponseWriter, r *http.Request) (int64, string, bool) {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Needs an API token: Authorization: Bearer <token> (make one with /apitoken new)", http.StatusUnauthorized)
+		return 0, "", false
+	}
+	token := trim(authorization[len("Bearer "):])
+	userID, userName, err := server.chatServer.store.lookUpAPIToken(apiTokenHash(token))
+	if err != nil {
+		server.chatServer.logger.With("goroutine", "api", "error", err).Error("Looking up API token failed.")
+		http.Error(w, "A database error has occurred.", http.StatusInternalServerError)
+		return 0, "", false
+	}
+	if userID == 0 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "That API token isn't anybody's.", http.StatusUnauthorized)
+		return 0, "", false
+	}
+	return userID, userName, true
+}
+
+//
+// Sends a request to the channel master and waits for its reply. The
+// callback is buffered so the channel master never blocks answering, even
+// if we've given up.
+//
+func (server *apiServer) ask(request messageFromAPIToChannelMaster, deadline *time.Timer) (apiReplyFromChannelMaster, error) {
+	request.apiCallback = make(chan apiReplyFromChannelMaster, 1)
+	select {
+	case server.chatServer.chanMasterFromAPI <- request:
+	case <-deadline.C:
+		return apiReplyFromChannelMaster{}, errors.New("channel master did not take the request in time")
+	}
+	select {
+	case reply := <-request.apiCallback:
+		return reply, nil
+	case <-deadline.C:
+		return apiReplyFromChannelMaster{}, errors.New("channel master did not answer in time")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+//
+// Every chat channel in the database, with the member counts from the chat
+// channels that are running.
+//
+func (server *apiServer) serveChatChannels(w http.ResponseWriter) {
+	deadline := time.NewTimer(apiTimeout)
+	defer deadline.Stop()
+	var request messageFromAPIToChannelMaster
+	request.operation = fromAPIToChannelMasterOpChatChannels
+	reply, err := server.ask(request, deadline)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	members := make(map[string]int)
+	incomplete := false
+	shardsAnswered := 0
+	for (shardsAnswered < reply.asked) && !incomplete {
+		select {
+		case shard := <-reply.shardCallback:
+			shardsAnswered++
+			answered := 0
+			for (answered < shard.membersAsked) && !incomplete {
+				select {
+				case chatChannel := <-shard.membersCallback:
+					members[chatChannel.chatChannelName] = len(chatChannel.members)
+					answered++
+				case <-deadline.C:
+					incomplete = true
+				}
+			}
+		case <-deadline.C:
+			incomplete = true
+		}
+	}
+	chatChanList, err := server.chatServer.store.listChatChannels()
+	if err != nil {
+		server.chatServer.logger.With("goroutine", "api", "error", err).Error("Listing chat channels failed.")
+		http.Error(w, "A database error has occurred.", http.StatusInternalServerError)
+		return
+	}
+	var answer apiChatChannelList
+	answer.Channels = make([]apiChatChannel, 0, len(chatChanList))
+	for _, chatChannelName := range chatChanList {
+		answer.Channels = append(answer.Channels, apiChatChannel{Name: chatChannelName, Members: members[chatChannelName]})
+	}
+	answer.Incomplete = incomplete
+	writeJSON(w, http.StatusOK, answer)
+}
+
+//
+// Everyone logged in, from their doppelgangers. Someone logged in twice is
+// in the list twice.
+//
+func (server *apiServer) serveWho(w http.ResponseWriter) {
+	deadline := time.NewTimer(apiTimeout)
+	defer deadline.Stop()
+	var request messageFromAPIToChannelMaster
+	request.operation = fromAPIToChannelMasterOpWho
+	reply, err := server.ask(request, deadline)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	sessions := make([]adminSessionEntry, 0, reply.asked)
+	incomplete := false
+	for (len(sessions) < reply.asked) && !incomplete {
+		select {
+		case session := <-reply.sessionsCallback:
+			sessions = append(sessions, session)
+		case <-deadline.C:
+			incomplete = true
+		}
+	}
+	sort.Slice(sessions, func(ii, jj int) bool {
+		return sessions[ii].userName < sessions[jj].userName
+	})
+	now := time.Now()
+	var answer apiWho
+	answer.Users = make([]apiUser, 0, len(sessions))
+	for _, session := range sessions {
+		if (session.userID == 0) || (session.mode != loginCommandMode) {
+			continue
+		}
+		var user apiUser
+		user.User = session.userName
+		if session.chatChannelID != 0 {
+			user.Channel = session.chatChannelName
+		}
+		user.Away = session.away
+		user.IdleSeconds = int64(now.Sub(session.lastInput) / time.Second)
+		answer.Users = append(answer.Users, user)
+	}
+	//
+	// Doppelgangers too busy to be asked are missing too.
+	//
+	answer.Incomplete = incomplete || (reply.asked < reply.doppelgangers)
+	writeJSON(w, http.StatusOK, answer)
+}
+
+//
+// For history and messages: the chat channel's ID, if it exists and this
+// node runs it. Otherwise we've already answered.
+//
+func (server *apiServer) lookUpChatChannel(w http.ResponseWriter, chatChannelName string) (int64, bool) {
+	chatChannelID, err := server.chatServer.store.lookUpChatChannel(chatChannelName)
+	if err != nil {
+		server.chatServer.logger.With("goroutine", "api", "error", err).Error("Looking up chat channel failed.")
+		http.Error(w, "A database error has occurred.", http.StatusInternalServerError)
+		return 0, false
+	}
+	if chatChannelID == 0 {
+		http.Error(w, "There's no chat channel #"+chatChannelName+".", http.StatusNotFound)
+		return 0, false
+	}
+	if server.chatServer.cluster != nil {
+		owner := server.chatServer.cluster.membership.ownerOfChatChannel(chatChannelID)
+		if owner != server.chatServer.cluster.self {
+			http.Error(w, "#"+chatChannelName+" is on cluster node "+owner+"; ask that node's API.", http.StatusMisdirectedRequest)
+			return 0, false
+		}
+	}
+	return chatChannelID, true
+}
+
+//
+// Asks the chat channel (or its shard, if it's not running) and waits for
+// the answer.
+//
+func (server *apiServer) askChatChannel(w http.ResponseWriter, request messageFromAPIToChannelMaster) (apiChatChannelReply, bool) {
+	deadline := time.NewTimer(apiTimeout)
+	defer deadline.Stop()
+	reply, err := server.ask(request, deadline)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return apiChatChannelReply{}, false
+	}
+	select {
+	case chatChannel := <-reply.chatChannelCallback:
+		return chatChannel, true
+	case <-deadline.C:
+		http.Error(w, "chat channel did not answer in time", http.StatusServiceUnavailable)
+		return apiChatChannelReply{}, false
+	}
+}
+
+func (server *apiServer) serveHistory(w http.ResponseWriter, r *http.Request, chatChannelName string) {
+	limit := 0
+	if r.URL.Query().Get("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if (err != nil) || (limit < 1) {
+			http.Error(w, "limit has to be a number, 1 or more", http.StatusBadRequest)
+			return
+		}
+	}
+	chatChannelID, ok := server.lookUpChatChannel(w, chatChannelName)
+	if !ok {
+		return
+	}
+	var request messageFromAPIToChannelMaster
+	request.operation = fromAPIToChannelMasterOpHistory
+	request.chatChannelID = chatChannelID
+	request.limit = limit
+	reply, ok := server.askChatChannel(w, request)
+	if !ok {
+		return
+	}
+	var answer apiHistory
+	answer.Channel = chatChannelName
+	answer.Messages = make([]apiMessage, 0, len(reply.history))
+	for _, entry := range reply.history {
+		answer.Messages = append(answer.Messages, apiMessage{Time: entry.when.UTC().Format(time.RFC3339Nano), User: entry.userName, Text: entry.text, Said: entry.said})
+	}
+	writeJSON(w, http.StatusOK, answer)
+}
+
+//
+// Says text on the chat channel the way /say does, as the token's user.
+//
+func (server *apiServer) servePost(w http.ResponseWriter, r *http.Request, chatChannelName string, userID int64, userName string) {
+	var post apiPostRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxPost)).Decode(&post)
+	if err != nil {
+		http.Error(w, "Expected {\"text\": ...}", http.StatusBadRequest)
+		return
+	}
+	post.Text = trim(post.Text)
+	if post.Text == "" {
+		http.Error(w, "Expected {\"text\": ...}, with something to say", http.StatusBadRequest)
+		return
+	}
+	if strings.IndexFunc(post.Text, isControlCharacter) >= 0 {
+		http.Error(w, "text has to be one line, without control characters", http.StatusBadRequest)
+		return
+	}
+	chatChannelID, ok := server.lookUpChatChannel(w, chatChannelName)
+	if !ok {
+		return
+	}
+	var request messageFromAPIToChannelMaster
+	request.operation = fromAPIToChannelMasterOpPost
+	request.chatChannelID = chatChannelID
+	request.chatChannelName = chatChannelName
+	request.userID = userID
+	request.userName = userName
+	request.parameter = userName + " says, " + `"` + post.Text + `"`
+	request.said = post.Text
+	reply, ok := server.askChatChannel(w, request)
+	if !ok {
+		return
+	}
+	if !reply.running {
+		http.Error(w, "The server is shutting down.", http.StatusServiceUnavailable)
+		return
+	}
+	if reply.failed {
+		http.Error(w, "The chat channel couldn't start. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if reply.vetoed {
+		http.Error(w, "Your message was not sent.", http.StatusForbidden)
+		return
+	}
+	writeJSON(w, http.StatusOK, apiPostReply{Channel: chatChannelName, Text: request.parameter})
+}
+
+func isControlCharacter(character rune) bool {
+	return (character < ' ') || (character == 0x7f)
+}
+
+//
+// Tokens are stored (see storage.go) only as their hash, so someone who gets
+// a copy of the database can't use them.
+//
+func apiTokenHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func newAPIToken() (string, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(randomBytes), nil
+}
+
+//
+// How a token is known in /apitoken: the start of its hash, which is
+// enough to tell a user's tokens apart and no help in guessing them.
+//
+func apiTokenName(tokenHash string) string {
+	if len(tokenHash) > 12 {
+		return tokenHash[:12]
+	}
+	return tokenHash
+}
+
+//
+// /apitoken, /apitoken new, /apitoken revoke <number>. Same return values
+// as doCommand. A new token is shown once, when it's made; after that
+// there's only its hash.
+//
+func apiTokenCommand(doppelgangerState *userInfo, operand string) (bool, error) {
+	store := doppelgangerState.chatServer.store
+	subcommand := operand
+	argument := ""
+	ii := strings.Index(operand, " ")
+	if ii > 0 {
+		subcommand = operand[:ii]
+		argument = trim(operand[ii:])
+	}
+	switch subcommand {
+	case "", "list":
+		tokenHashes, err := store.listAPITokens(doppelgangerState.userID)
+		if err != nil {
+			doppelgangerState.logger.With("error", err).Error("Listing API tokens failed.")
+			return true, tellUser(doppelgangerState, "ERR", "\r\nA database error has occurred.\r\n")
+		}
+		if len(tokenHashes) == 0 {
+			return true, tellUser(doppelgangerState, "OK", "\r\nYou have no API tokens. Use /apitoken new to make one.\r\n")
+		}
+		text := "\r\n"
+		lines := make([]string, 0)
+		for jj, tokenHash := range tokenHashes {
+			text += strconv.Itoa(jj+1) + ". " + apiTokenName(tokenHash) + "\r\n"
+			lines = append(lines, "APITOKEN "+strconv.Itoa(jj+1)+" "+apiTokenName(tokenHash))
+		}
+		return true, writeToUser(doppelgangerState, text, strings.Join(lines, "\r\n"))
+	case "new":
+		token, err := newAPIToken()
+		if err != nil {
+			doppelgangerState.logger.With("error", err).Error("Making API token failed.")
+			return true, tellUser(doppelgangerState, "ERR", "\r\nCould not make an API token.\r\n")
+		}
+		tokenHash := apiTokenHash(token)
+		err = store.addAPIToken(doppelgangerState.userID, tokenHash)
+		if err != nil {
+			doppelgangerState.logger.With("error", err).Error("Adding API token failed.")
+			return true, tellUser(doppelgangerState, "ERR", "\r\nA database error has occurred.\r\n")
+		}
+		doppelgangerState.logger.With("api_token", apiTokenName(tokenHash)).Info("API token made.")
+		return true, writeToUser(doppelgangerState, "\r\nAPI token "+apiTokenName(tokenHash)+": "+token+"\r\nCopy it now -- it won't be shown again.\r\n", "OK API token "+apiTokenName(tokenHash)+" "+token)
+	case "revoke":
+		tokenHashes, err := store.listAPITokens(doppelgangerState.userID)
+		if err != nil {
+			doppelgangerState.logger.With("error", err).Error("Listing API tokens failed.")
+			return true, tellUser(doppelgangerState, "ERR", "\r\nA database error has occurred.\r\n")
+		}
+		number, err := strconv.Atoi(argument)
+		if (err != nil) || (number < 1) || (number > len(tokenHashes)) {
+			return true, tellUser(doppelgangerState, "ERR", "\r\nUse /apitoken revoke <number>, with a number from /apitoken.\r\n")
+		}
+		removed, err := store.removeAPIToken(doppelgangerState.userID, tokenHashes[number-1])
+		if err != nil {
+			doppelgangerState.logger.With("error", err).Error("Revoking API token failed.")
+			return true, tellUser(doppelgangerState, "ERR", "\r\nA database error has occurred.\r\n")
+		}
+		if !removed {
+			//
+			// Revoked from another session since we listed them.
+			//
+			return true, tellUser(doppelgangerState, "ERR", "\r\nThat API token is already gone.\r\n")
+		}
+		doppelgangerState.logger.With("api_token", apiTokenName(tokenHashes[number-1])).Info("API token revoked.")
+		return true, tellUser(doppelgangerState, "OK", "\r\nAPI token "+apiTokenName(tokenHashes[number-1])+" revoked.\r\n")
+	}
+	return true, tellUser(doppelgangerState, "ERR", "\r\nUse /apitoken to list your API tokens, /apitoken new to make one, or /apitoken revoke <number> to revoke one.\r\n")
+}
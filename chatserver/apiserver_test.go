@@ -0,0 +1,236 @@
+package chatserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//
+// A bot on the HTTP API, with a token a Telnet user made for it, and Telnet
+// users on the chat channels it asks about and posts to.
+//
+
+//
+// Makes an API request with token (none if it's empty) and returns the
+// status and the body.
+//
+func apiRequest(t *testing.T, method string, url string, token string, body string) (int, string) {
+	t.Helper()
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	contents, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.StatusCode, string(contents)
+}
+
+func apiGet(t *testing.T, url string, token string, answer interface{}) {
+	t.Helper()
+	status, body := apiRequest(t, http.MethodGet, url, token, "")
+	if status != http.StatusOK {
+		t.Fatalf("GET %s: %d %s", url, status, body)
+	}
+	err := json.Unmarshal([]byte(body), answer)
+	if err != nil {
+		t.Fatalf("GET %s: %v in %s", url, err, body)
+	}
+}
+
+//
+// Waits for the chat channel's history to have count messages -- when a
+// chat channel shuts down, its history gets to its shard a moment after
+// the last member is gone.
+//
+func expectHistory(t *testing.T, url string, token string, count int) apiHistory {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		var history apiHistory
+		apiGet(t, url, token, &history)
+		if len(history.Messages) == count {
+			return history
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d messages in the history, got %+v", count, history)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	server := startTestServer(t, nil)
+	api := httptest.NewServer(server.chatServer.APIHandler())
+	t.Cleanup(api.Close)
+	alice := server.logIn("alice", "secret")
+	alice.send("/create lounge")
+	alice.expect(`created\.`)
+	alice.send("/create kitchen")
+	alice.expect(`created\.`)
+	alice.send("/apitoken")
+	alice.expect(`You have no API tokens\.`)
+	alice.send("/apitoken new")
+	token := regexp.MustCompile(`API token [0-9a-f]{12}: ([0-9a-f]{64})`).FindStringSubmatch(alice.expect(`API token [0-9a-f]{12}: [0-9a-f]{64}`))[1]
+	alice.send("/apitoken")
+	alice.expect(`1\. [0-9a-f]{12}\r\n`)
+	//
+	// No token, or one that isn't anybody's, gets nowhere.
+	//
+	status, _ := apiRequest(t, http.MethodGet, api.URL+"/api/channels", "", "")
+	if status != http.StatusUnauthorized {
+		t.Fatalf("GET /api/channels without a token: %d", status)
+	}
+	status, _ = apiRequest(t, http.MethodGet, api.URL+"/api/channels", strings.Repeat("0", 64), "")
+	if status != http.StatusUnauthorized {
+		t.Fatalf("GET /api/channels with someone else's token: %d", status)
+	}
+	bob := server.logIn("bob", "secret")
+	bob.send("/join lounge")
+	bob.expect(`You have joined #lounge`)
+	var chatChannels apiChatChannelList
+	apiGet(t, api.URL+"/api/channels", token, &chatChannels)
+	if (len(chatChannels.Channels) != 2) || (chatChannels.Channels[0] != apiChatChannel{Name: "kitchen", Members: 0}) || (chatChannels.Channels[1] != apiChatChannel{Name: "lounge", Members: 1}) || chatChannels.Incomplete {
+		t.Fatalf("GET /api/channels: %+v", chatChannels)
+	}
+	var who apiWho
+	apiGet(t, api.URL+"/api/who", token, &who)
+	if (len(who.Users) != 2) || (who.Users[0].User != "alice") || (who.Users[0].Channel != "") || (who.Users[1].User != "bob") || (who.Users[1].Channel != "lounge") {
+		t.Fatalf("GET /api/who: %+v", who)
+	}
+	//
+	// Posting, as alice, where someone will hear it and where nobody will
+	// (it's still said, and remembered).
+	//
+	status, body := apiRequest(t, http.MethodPost, api.URL+"/api/channels/lounge/messages", token, `{"text": "hello from a bot"}`)
+	if status != http.StatusOK {
+		t.Fatalf("POST to #lounge: %d %s", status, body)
+	}
+	bob.expect(`alice says, "hello from a bot"`)
+	status, body = apiRequest(t, http.MethodPost, api.URL+"/api/channels/kitchen/messages", token, `{"text": "anyone?"}`)
+	if status != http.StatusOK {
+		t.Fatalf("POST to #kitchen with nobody on it: %d %s", status, body)
+	}
+	readConversationLog(t, server, "kitchen", `alice says, "anyone?"`)
+	history := expectHistory(t, api.URL+"/api/channels/kitchen/history", token, 1)
+	if (history.Messages[0].User != "alice") || (history.Messages[0].Said != "anyone?") {
+		t.Fatalf("GET history of #kitchen after posting to it: %+v", history)
+	}
+	status, _ = apiRequest(t, http.MethodPost, api.URL+"/api/channels/attic/messages", token, `{"text": "anyone?"}`)
+	if status != http.StatusNotFound {
+		t.Fatalf("POST to a chat channel that doesn't exist: %d", status)
+	}
+	status, _ = apiRequest(t, http.MethodPost, api.URL+"/api/channels/lounge/messages", token, `{"text": "two\nlines"}`)
+	if status != http.StatusBadRequest {
+		t.Fatalf("POST with a line break: %d", status)
+	}
+	//
+	// History, while the chat channel is running and after everyone's
+	// left, and once it's running again.
+	//
+	bob.send("hi")
+	bob.expect(`bob says, "hi"`)
+	history = expectHistory(t, api.URL+"/api/channels/lounge/history?limit=1", token, 1)
+	if (history.Messages[0].User != "bob") || (history.Messages[0].Text != `bob says, "hi"`) || (history.Messages[0].Said != "hi") || (history.Messages[0].Time == "") {
+		t.Fatalf("GET history: %+v", history)
+	}
+	status, _ = apiRequest(t, http.MethodGet, api.URL+"/api/channels/lounge/history?limit=none", token, "")
+	if status != http.StatusBadRequest {
+		t.Fatalf("GET history with a bad limit: %d", status)
+	}
+	bob.send("/exit")
+	bob.expect(`You left #lounge`)
+	history = expectHistory(t, api.URL+"/api/channels/lounge/history", token, 2)
+	if (history.Messages[0].User != "alice") || (history.Messages[0].Said != "hello from a bot") {
+		t.Fatalf("GET history after everyone left: %+v", history)
+	}
+	bob.send("/join lounge")
+	bob.expect(`You have joined #lounge`)
+	bob.send("back")
+	bob.expect(`bob says, "back"`)
+	expectHistory(t, api.URL+"/api/channels/lounge/history", token, 3)
+	//
+	// A revoked token is no good any more.
+	//
+	alice.send("/apitoken revoke 1")
+	alice.expect(`API token [0-9a-f]{12} revoked\.`)
+	status, _ = apiRequest(t, http.MethodGet, api.URL+"/api/who", token, "")
+	if status != http.StatusUnauthorized {
+		t.Fatalf("GET /api/who with a revoked token: %d", status)
+	}
+}
+
+//
+// A script posting twice in a row to a chat channel nobody's on, and then a
+// few scripts posting at once: each post waits for the chat channel to be
+// done with the one before, so the history (asked for right away, without
+// waiting) and the conversation log have all of them.
+//
+func TestAPIPostsToIdleChatChannel(t *testing.T) {
+	server := startTestServer(t, nil)
+	api := httptest.NewServer(server.chatServer.APIHandler())
+	t.Cleanup(api.Close)
+	alice := server.logIn("alice", "secret")
+	alice.send("/create deploys")
+	alice.expect(`created\.`)
+	alice.send("/apitoken new")
+	token := regexp.MustCompile(`API token [0-9a-f]{12}: ([0-9a-f]{64})`).FindStringSubmatch(alice.expect(`API token [0-9a-f]{12}: [0-9a-f]{64}`))[1]
+	for _, text := range []string{"deploy started", "deploy finished"} {
+		status, body := apiRequest(t, http.MethodPost, api.URL+"/api/channels/deploys/messages", token, `{"text": "`+text+`"}`)
+		if status != http.StatusOK {
+			t.Fatalf("POST %q to #deploys: %d %s", text, status, body)
+		}
+	}
+	var history apiHistory
+	apiGet(t, api.URL+"/api/channels/deploys/history", token, &history)
+	if (len(history.Messages) != 2) || (history.Messages[0].Said != "deploy started") || (history.Messages[1].Said != "deploy finished") {
+		t.Fatalf("GET history of #deploys after posting twice: %+v", history)
+	}
+	var posting sync.WaitGroup
+	for ii := 1; ii <= 5; ii++ {
+		posting.Add(1)
+		go func(text string) {
+			defer posting.Done()
+			status, body := apiRequest(t, http.MethodPost, api.URL+"/api/channels/deploys/messages", token, `{"text": "`+text+`"}`)
+			if status != http.StatusOK {
+				t.Errorf("POST %q to #deploys: %d %s", text, status, body)
+			}
+		}("host " + strconv.Itoa(ii) + " done")
+	}
+	posting.Wait()
+	apiGet(t, api.URL+"/api/channels/deploys/history", token, &history)
+	if len(history.Messages) != 7 {
+		t.Fatalf("GET history of #deploys after posting from five scripts at once: %+v", history)
+	}
+	contents := readConversationLog(t, server, "deploys", `alice says, "deploy finished"`)
+	for _, text := range []string{"deploy started", "deploy finished", "host 1 done", "host 2 done", "host 3 done", "host 4 done", "host 5 done"} {
+		if !strings.Contains(contents, `alice says, "`+text+`"`) {
+			t.Fatalf("%q isn't in the conversation log of #deploys: %q", text, contents)
+		}
+	}
+	alice.send("/join deploys")
+	alice.expect(`You have joined #deploys`)
+	alice.send("done?")
+	alice.expect(`alice says, "done\?"`)
+	history = expectHistory(t, api.URL+"/api/channels/deploys/history", token, 8)
+	if history.Messages[0].Said != "deploy started" {
+		t.Fatalf("GET history of #deploys once someone joined: %+v", history)
+	}
+}
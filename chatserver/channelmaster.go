@@ -0,0 +1,520 @@
+package chatserver
+
+//
+// Channel master functions
+//
+
+//
+// What a member hears when the slow member policy is "disconnect" and their
+// text queue fills up.
+//
+const slowMemberDisconnectMessage = "You have been disconnected because your connection could not keep up with the chat channel."
+
+//
+// Broadcasts go on a go channel of their own (one per doppelganger), which
+// the doppelganger never closes, and are sent without blocking. If a
+// doppelganger is too busy to have picked up the last broadcast, it's better
+// to drop this one than to hold up the channel master, which everyone
+// depends on. Returns whether the broadcast went out, so callers can tell
+// whoever asked. Only what can do without being delivered is a broadcast:
+// hanging up (see sendHangUp) and settings (see sendLatestSettings) have go
+// channels of their own.
+//
+func broadcastToDoppelganger(logger *Logger, doppelgangerID int64, doppelgangerBroadcastCallback chan messageFromChannelMasterToDoppelganger, theMessage messageFromChannelMasterToDoppelganger) bool {
+	if doppelgangerBroadcastCallback == nil {
+		//
+		// Should never happen.
+		//
+		logger.With("doppelganger_id", doppelgangerID).Error("doppelgangerBroadcastCallback == nil")
+		return false
+	}
+	select {
+	case doppelgangerBroadcastCallback <- theMessage:
+		return true
+	default:
+		logger.With("doppelganger_id", doppelgangerID).Warn("broadcast go channel full, dropping broadcast")
+		return false
+	}
+}
+
+//
+// Telling a doppelganger to hang up (shutdown or disconnect) can't be
+// dropped, so it has a go channel of its own, with room for one. If there's
+// one there already, the doppelganger is going to hang up as soon as it
+// looks, and a second one would change nothing (apart from which message the
+// user sees last), so we leave the first in place. We're the only one who
+// sends on it, so this never blocks. Returns false if a hang-up was already
+// waiting.
+//
+func sendHangUp(doppelgangerHangUpCallback chan messageFromChannelMasterToDoppelganger, theMessage messageFromChannelMasterToDoppelganger) bool {
+	select {
+	case doppelgangerHangUpCallback <- theMessage:
+		return true
+	default:
+		return false
+	}
+}
+
+//
+// Settings go on a go channel of their own (one per doppelganger), with room
+// for one. Only the latest settings matter, so if the doppelganger hasn't
+// picked up the last ones yet, we take them back out and put the new ones
+// in their place -- settings are never dropped, a busy doppelganger just
+// skips straight to the newest. We're the only one who sends on it, so once
+// it's empty there's room and this never blocks. Returns whether there were
+// settings the doppelganger hadn't picked up.
+//
+func sendLatestSettings(doppelgangerSettingsCallback chan liveSettings, settings liveSettings) bool {
+	replaced := false
+	select {
+	case <-doppelgangerSettingsCallback:
+		replaced = true
+	default:
+	}
+	doppelgangerSettingsCallback <- settings
+	return replaced
+}
+
+//
+// Passes the same message on to every shard (see channelmastershard.go).
+//
+func sendToAllShards(chatServer *ChatServer, watch *stallWatch, theMessage messageFromChannelMasterToShard) {
+	for _, shard := range chatServer.channelMasterShards {
+		watch.sendFromChannelMasterToShard(shard.fromChannelMaster, theMessage, shard.index)
+	}
+}
+
+//
+// DO IT
+// Goroutine for channel master
+//
+func channelMasterGoroutine(chatServer *ChatServer, settings liveSettings, incomingFromDoppelganger <-chan messageFromDoppelgangerToChannelMaster, incomingFromChatChannel <-chan messageFromChatChannelToChannelMaster, incomingMetrics <-chan messageFromMetricsToChannelMaster, incomingFromAdmin <-chan messageFromAdminToChannelMaster, incomingFromAPI <-chan messageFromAPIToChannelMaster, incomingFromMain <-chan messageFromMainToChannelMaster) {
+	logger := chatServer.logger.With("goroutine", "channel_master")
+	watch := chatServer.stallWatchdog.watch(logger)
+	defer chatServer.stallWatchdog.unwatch(watch)
+	//
+	// The running chat channels are kept by the shards, not by us (see
+	// channelmastershard.go). Joins, who and exits go straight to them.
+	//
+	// settings (a parameter) is the current live settings. We own them:
+	// Reload sends us new ones, and we pass them along to every
+	// doppelganger and shard, and the shards to every chat channel.
+	//
+	// Every doppelganger on the system registers here when it starts and
+	// unregisters when it exits, so that we can reach all of them (e.g. to
+	// tell them the server is shutting down). Maps doppelganger IDs to the
+	// doppelganger's broadcast go channel, and to its hang-up go channel,
+	// and (for the ones that want settings -- not the cluster's stand-ins
+	// for users on other nodes) to its settings go channel.
+	//
+	doppelgangerRegistry := make(map[int64]chan messageFromChannelMasterToDoppelganger)
+	doppelgangerHangUps := make(map[int64]chan messageFromChannelMasterToDoppelganger)
+	doppelgangerSettings := make(map[int64]chan liveSettings)
+	//
+	// Which registered doppelgangers have a logged in user (doppelganger ID
+	// to user ID), and running totals, all for the metrics.
+	//
+	loggedInUsers := make(map[int64]int64)
+	var logins int64
+	var loginFailures int64
+	var writeErrors int64
+	var slowMemberDisconnects int64
+	//
+	// Shutdown state. Once shuttingDown is set, the shards don't let anyone
+	// join a chat channel any more. mainShutdownCallback is non-nil while
+	// main is waiting for us to tell it everything has drained;
+	// waitForDoppelgangers says whether "drained" includes every
+	// doppelganger being gone or just every chat channel. Each shard tells
+	// us on shardsDrained once it has no chat channels left;
+	// shardsStillDraining counts the ones that haven't yet.
+	//
+	shuttingDown := false
+	shutdownNotice := ""
+	var mainShutdownCallback chan bool
+	waitForDoppelgangers := false
+	var shardsDrained chan int
+	shardsStillDraining := 0
+	for {
+		select {
+		case <-chatServer.stop:
+			//
+			// Shutdown is done with us.
+			//
+			return
+		case theMessage, ok := <-incomingFromDoppelganger:
+			if !ok {
+				//
+				// Whoa, channel closed! Should never happen! Bail!
+				//
+				logger.Error("Channel master's channel for receiving messages from doppelganger's unexpectedly closed.")
+				return
+			}
+			switch theMessage.operation {
+			case fromDoppelgangerToChannelMasterOpRegister:
+				doppelgangerRegistry[theMessage.doppelgangerID] = theMessage.doppelgangerBroadcastCallback
+				doppelgangerHangUps[theMessage.doppelgangerID] = theMessage.doppelgangerHangUpCallback
+				if theMessage.doppelgangerSettingsCallback != nil {
+					//
+					// The doppelganger waits for its settings before it
+					// says anything to the user.
+					//
+					doppelgangerSettings[theMessage.doppelgangerID] = theMessage.doppelgangerSettingsCallback
+					sendLatestSettings(theMessage.doppelgangerSettingsCallback, settings)
+				}
+				if shuttingDown {
+					//
+					// Someone connected just as we started shutting down.
+					// Tell them right away.
+					//
+					var notice messageFromChannelMasterToDoppelganger
+					notice.operation = fromChannelMasterToDoppelgangerOpShutdown
+					notice.msgToUser = shutdownNotice
+					notice.channelID = 0
+					sendHangUp(theMessage.doppelgangerHangUpCallback, notice)
+				}
+			case fromDoppelgangerToChannelMasterOpUnregister:
+				delete(doppelgangerRegistry, theMessage.doppelgangerID)
+				delete(doppelgangerHangUps, theMessage.doppelgangerID)
+				delete(doppelgangerSettings, theMessage.doppelgangerID)
+				delete(loggedInUsers, theMessage.doppelgangerID)
+				writeErrors += theMessage.writeErrors
+			case fromDoppelgangerToChannelMasterOpLoggedIn:
+				loggedInUsers[theMessage.doppelgangerID] = theMessage.userID
+				logins++
+				var event chatEvent
+				event.Type = "login"
+				event.User = theMessage.userName
+				event.UserID = theMessage.userID
+				chatServer.events.emit(event)
+			case fromDoppelgangerToChannelMasterOpLoginFailed:
+				loginFailures++
+			case fromDoppelgangerToChannelMasterOpChatChannelCreated:
+				var event chatEvent
+				event.Type = "channel_created"
+				event.Channel = theMessage.parameter
+				event.User = theMessage.userName
+				event.UserID = theMessage.userID
+				chatServer.events.emit(event)
+			default:
+				//
+				// Should never happen. (Join, who and exit go to the
+				// shards.)
+				//
+				logger.With("operation", theMessage.operation).Error("Unrecognized operation code received by channelmaster from doppelganger")
+			}
+		case theMessage, ok := <-incomingFromChatChannel:
+			if !ok {
+				//
+				// Should never happen.
+				//
+				logger.Error("incomingFromChatChannel go channel unexpectedly closed")
+				return // Try and keep server up
+			}
+			switch theMessage.operation {
+			case fromChatChannelToChannelMasterOpSlowMember:
+				//
+				// A member's text queue filled up and the slow member
+				// policy says to hang up on them. They may have left
+				// already, or be hanging up for some other reason (the
+				// chat channel stops sending them anything either way,
+				// and takes them off when their exit comes in); we only
+				// count the ones we're hanging up on.
+				//
+				doppelgangerHangUpCallback, exists := doppelgangerHangUps[theMessage.doppelgangerID]
+				if exists {
+					var disconnectMessage messageFromChannelMasterToDoppelganger
+					disconnectMessage.operation = fromChannelMasterToDoppelgangerOpDisconnect
+					disconnectMessage.msgToUser = slowMemberDisconnectMessage
+					disconnectMessage.channelID = theMessage.chatChannelID
+					memberLogger := logger.With("doppelganger_id", theMessage.doppelgangerID, "user_id", theMessage.userID, "channel_id", theMessage.chatChannelID)
+					if sendHangUp(doppelgangerHangUpCallback, disconnectMessage) {
+						slowMemberDisconnects++
+						memberLogger.Info("Disconnecting a member who can't keep up with their chat channel.")
+					} else {
+						memberLogger.Info("Member who can't keep up with their chat channel is already being disconnected.")
+					}
+				}
+			default:
+				//
+				// Should never happen. (Join denied and shutdown complete
+				// go to the shards.)
+				//
+				logger.With("operation", theMessage.operation).Error("Unrecognized operation code received by channelmaster from chat channel")
+			}
+		case shardIndex := <-shardsDrained:
+			//
+			// shardsDrained is nil, so never ready, unless we're shutting
+			// down.
+			//
+			shardsStillDraining--
+			logger.With("shard", shardIndex, "shards_still_draining", shardsStillDraining).Debug("Shard has no chat channels left.")
+		case theRequest, ok := <-incomingMetrics:
+			if !ok {
+				//
+				// Should never happen.
+				//
+				logger.Error("incomingMetrics go channel unexpectedly closed")
+				return
+			}
+			//
+			// Our own numbers, plus the lengths of our own incoming go
+			// channels -- if those are near capacity, we're the
+			// bottleneck.
+			//
+			var reply channelMasterMetrics
+			reply.sessions = len(doppelgangerRegistry)
+			reply.loggedInUsers = len(loggedInUsers)
+			reply.logins = logins
+			reply.loginFailures = loginFailures
+			reply.writeErrors = writeErrors
+			reply.slowMemberDisconnects = slowMemberDisconnects
+			reply.doppelgangerQueueLength = len(incomingFromDoppelganger)
+			reply.doppelgangerQueueCapacity = cap(incomingFromDoppelganger)
+			reply.chatChannelQueueLength = len(incomingFromChatChannel)
+			reply.chatChannelQueueCapacity = cap(incomingFromChatChannel)
+			//
+			// Every shard answers the metrics endpoint directly, and
+			// passes the question on to its chat channels. Buffer is big
+			// enough for all of them so none of them ever block, even if
+			// the metrics endpoint has given up waiting.
+			//
+			reply.shardsAsked = len(chatServer.channelMasterShards)
+			reply.shardCallback = make(chan shardMetrics, len(chatServer.channelMasterShards))
+			var metricsMessage messageFromChannelMasterToShard
+			metricsMessage.operation = fromChannelMasterToShardOpMetrics
+			metricsMessage.metricsCallback = reply.shardCallback
+			sendToAllShards(chatServer, watch, metricsMessage)
+			//
+			// Buffered by the metrics endpoint, so this never blocks.
+			//
+			theRequest.metricsCallback <- reply
+		case theRequest, ok := <-incomingFromAdmin:
+			if !ok {
+				//
+				// Should never happen.
+				//
+				logger.Error("incomingFromAdmin go channel unexpectedly closed")
+				return
+			}
+			var reply adminReplyFromChannelMaster
+			reply.doppelgangers = len(doppelgangerRegistry)
+			reply.shuttingDown = shuttingDown
+			switch theRequest.operation {
+			case fromAdminToChannelMasterOpChatChannels, fromAdminToChannelMasterOpMembers:
+				//
+				// The shards have the chat channels. Every shard answers the
+				// admin console directly, like with the metrics.
+				//
+				reply.asked = len(chatServer.channelMasterShards)
+				reply.shardCallback = make(chan adminShardReply, len(chatServer.channelMasterShards))
+				var shardMessage messageFromChannelMasterToShard
+				shardMessage.operation = fromChannelMasterToShardOpChatChannels
+				if theRequest.operation == fromAdminToChannelMasterOpMembers {
+					shardMessage.operation = fromChannelMasterToShardOpMembers
+				}
+				shardMessage.adminCallback = reply.shardCallback
+				sendToAllShards(chatServer, watch, shardMessage)
+			case fromAdminToChannelMasterOpSessions:
+				//
+				// Likewise every doppelganger. Broadcasts can be dropped,
+				// so we only count the ones that went out; the ones that
+				// didn't are too busy to answer anyway, and the admin
+				// console says how many that was.
+				//
+				reply.sessionsCallback = make(chan adminSessionEntry, len(doppelgangerRegistry))
+				for doppelgangerID, doppelgangerBroadcastCallback := range doppelgangerRegistry {
+					var describeMessage messageFromChannelMasterToDoppelganger
+					describeMessage.operation = fromChannelMasterToDoppelgangerOpDescribe
+					describeMessage.channelID = 0
+					describeMessage.adminCallback = reply.sessionsCallback
+					if broadcastToDoppelganger(logger, doppelgangerID, doppelgangerBroadcastCallback, describeMessage) {
+						reply.asked++
+					}
+				}
+			case fromAdminToChannelMasterOpDisconnect:
+				//
+				// If the doppelganger already has a hang-up waiting (the
+				// server is shutting down, say, or someone kicked them
+				// first), it's about to hang up anyway; the admin console
+				// tells the admin that this kick's message won't be seen.
+				//
+				doppelgangerHangUpCallback, exists := doppelgangerHangUps[theRequest.doppelgangerID]
+				if exists {
+					var disconnectMessage messageFromChannelMasterToDoppelganger
+					disconnectMessage.operation = fromChannelMasterToDoppelgangerOpDisconnect
+					disconnectMessage.msgToUser = theRequest.parameter
+					disconnectMessage.channelID = 0
+					reply.delivered = sendHangUp(doppelgangerHangUpCallback, disconnectMessage)
+					logger.With("doppelganger_id", theRequest.doppelgangerID, "already_hanging_up", !reply.delivered).Info("Disconnecting at the admin console's request.")
+				}
+				reply.found = exists
+			default:
+				//
+				// Should never happen.
+				//
+				logger.With("operation", theRequest.operation).Error("Unrecognized operation code received by channelmaster from admin console")
+			}
+			//
+			// Buffered by the admin console, so this never blocks.
+			//
+			theRequest.adminCallback <- reply
+		case theRequest, ok := <-incomingFromAPI:
+			if !ok {
+				//
+				// Should never happen.
+				//
+				logger.Error("incomingFromAPI go channel unexpectedly closed")
+				return
+			}
+			var reply apiReplyFromChannelMaster
+			reply.shuttingDown = shuttingDown
+			reply.doppelgangers = len(doppelgangerRegistry)
+			switch theRequest.operation {
+			case fromAPIToChannelMasterOpChatChannels:
+				//
+				// Same as the admin console's members.
+				//
+				reply.asked = len(chatServer.channelMasterShards)
+				reply.shardCallback = make(chan adminShardReply, len(chatServer.channelMasterShards))
+				var shardMessage messageFromChannelMasterToShard
+				shardMessage.operation = fromChannelMasterToShardOpMembers
+				shardMessage.adminCallback = reply.shardCallback
+				sendToAllShards(chatServer, watch, shardMessage)
+			case fromAPIToChannelMasterOpWho:
+				//
+				// Same as the admin console's sessions: only the
+				// doppelgangers know who's logged in as whom, and where
+				// they are.
+				//
+				reply.sessionsCallback = make(chan adminSessionEntry, len(doppelgangerRegistry))
+				for doppelgangerID, doppelgangerBroadcastCallback := range doppelgangerRegistry {
+					var describeMessage messageFromChannelMasterToDoppelganger
+					describeMessage.operation = fromChannelMasterToDoppelgangerOpDescribe
+					describeMessage.channelID = 0
+					describeMessage.adminCallback = reply.sessionsCallback
+					if broadcastToDoppelganger(logger, doppelgangerID, doppelgangerBroadcastCallback, describeMessage) {
+						reply.asked++
+					}
+				}
+			case fromAPIToChannelMasterOpHistory, fromAPIToChannelMasterOpPost:
+				//
+				// Just the one shard has the chat channel.
+				//
+				reply.asked = 1
+				reply.chatChannelCallback = make(chan apiChatChannelReply, 1)
+				var shardMessage messageFromChannelMasterToShard
+				shardMessage.operation = fromChannelMasterToShardOpHistory
+				if theRequest.operation == fromAPIToChannelMasterOpPost {
+					shardMessage.operation = fromChannelMasterToShardOpPost
+				}
+				shardMessage.apiRequest = theRequest
+				shardMessage.apiCallback = reply.chatChannelCallback
+				shard := shardForChatChannel(chatServer, theRequest.chatChannelID)
+				watch.sendFromChannelMasterToShard(shard.fromChannelMaster, shardMessage, shard.index)
+			default:
+				//
+				// Should never happen.
+				//
+				logger.With("operation", theRequest.operation).Error("Unrecognized operation code received by channelmaster from API")
+			}
+			//
+			// Buffered by the API, so this never blocks.
+			//
+			theRequest.apiCallback <- reply
+		case theMessage, ok := <-incomingFromMain:
+			if !ok {
+				//
+				// Should never happen.
+				//
+				logger.Error("incomingFromMain go channel unexpectedly closed")
+				return
+			}
+			switch theMessage.operation {
+			case fromMainToChannelMasterOpShutdown:
+				//
+				// Tell everyone goodbye. Each doppelganger hangs up on its
+				// user and goes through its normal exit procedure, which
+				// takes it off its chat channel, which shuts the chat
+				// channel down once it's empty. We just wait for all that
+				// to come back to us, through the shards.
+				//
+				shuttingDown = true
+				shutdownNotice = theMessage.parameter
+				mainShutdownCallback = theMessage.mainCallback
+				waitForDoppelgangers = true
+				shardsDrained = make(chan int, len(chatServer.channelMasterShards))
+				shardsStillDraining = len(chatServer.channelMasterShards)
+				var shardMessage messageFromChannelMasterToShard
+				shardMessage.operation = fromChannelMasterToShardOpShutdown
+				shardMessage.drainedCallback = shardsDrained
+				sendToAllShards(chatServer, watch, shardMessage)
+				for _, doppelgangerHangUpCallback := range doppelgangerHangUps {
+					var notice messageFromChannelMasterToDoppelganger
+					notice.operation = fromChannelMasterToDoppelgangerOpShutdown
+					notice.msgToUser = shutdownNotice
+					notice.channelID = 0
+					sendHangUp(doppelgangerHangUpCallback, notice)
+				}
+				logger.With("doppelgangers", len(doppelgangerRegistry)).Info("Shutting down, notified doppelgangers.")
+			case fromMainToChannelMasterOpShutdownChatChannels:
+				//
+				// Users didn't all leave in time. Shut the chat channels
+				// down anyway so their conversation logs get closed. Any
+				// shard that already said it was drained will just say so
+				// again, on the new go channel.
+				//
+				shuttingDown = true
+				mainShutdownCallback = theMessage.mainCallback
+				waitForDoppelgangers = false
+				shardsDrained = make(chan int, len(chatServer.channelMasterShards))
+				shardsStillDraining = len(chatServer.channelMasterShards)
+				var shardMessage messageFromChannelMasterToShard
+				shardMessage.operation = fromChannelMasterToShardOpShutdownChatChannels
+				shardMessage.drainedCallback = shardsDrained
+				sendToAllShards(chatServer, watch, shardMessage)
+				logger.With("doppelgangers", len(doppelgangerRegistry)).Warn("Forced shutdown of chat channels with doppelgangers still running.")
+			case fromMainToChannelMasterOpReloadSettings:
+				//
+				// Keep the new settings for doppelgangers that register
+				// from now on, and pass them to everyone already running.
+				// The shards keep them for chat channels they launch.
+				// Every doppelganger gets them, whenever it next gets
+				// around to looking; the ones still sitting on the last
+				// reload's settings skip those.
+				//
+				settings = theMessage.settings
+				superseded := 0
+				for _, doppelgangerSettingsCallback := range doppelgangerSettings {
+					if sendLatestSettings(doppelgangerSettingsCallback, settings) {
+						superseded++
+					}
+				}
+				var shardMessage messageFromChannelMasterToShard
+				shardMessage.operation = fromChannelMasterToShardOpSettings
+				shardMessage.settings = settings
+				sendToAllShards(chatServer, watch, shardMessage)
+				logger.With("doppelgangers", len(doppelgangerSettings), "superseded", superseded, "shards", len(chatServer.channelMasterShards)).Info("Settings reloaded and queued for every doppelganger and shard.")
+				theMessage.mainCallback <- true
+			default:
+				//
+				// Should never happen.
+				//
+				logger.With("operation", theMessage.operation).Error("Unrecognized operation code received by channelmaster from main")
+			}
+		}
+		//
+		// If main is waiting on us to finish shutting down, check if we're
+		// there yet. We reply only once.
+		//
+		if mainShutdownCallback != nil {
+			drained := (shardsStillDraining == 0)
+			if waitForDoppelgangers && (len(doppelgangerRegistry) != 0) {
+				drained = false
+			}
+			if drained {
+				mainShutdownCallback <- true
+				mainShutdownCallback = nil
+			}
+		}
+	}
+}
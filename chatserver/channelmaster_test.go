@@ -0,0 +1,60 @@
+package chatserver
+
+import (
+	"testing"
+	"time"
+)
+
+//
+// A doppelganger that hasn't picked up its settings gets the newest ones
+// in their place, not the old ones and not both.
+//
+func TestSendLatestSettings(t *testing.T) {
+	doppelgangerSettingsCallback := make(chan liveSettings, 1)
+	var settings liveSettings
+	settings.clientWriteTimeout = time.Second
+	if sendLatestSettings(doppelgangerSettingsCallback, settings) {
+		t.Errorf("first settings replaced something")
+	}
+	settings.clientWriteTimeout = 2 * time.Second
+	if !sendLatestSettings(doppelgangerSettingsCallback, settings) {
+		t.Errorf("second settings didn't replace the first")
+	}
+	latest := <-doppelgangerSettingsCallback
+	if latest.clientWriteTimeout != 2*time.Second {
+		t.Errorf("got settings with clientWriteTimeout %v", latest.clientWriteTimeout)
+	}
+	select {
+	case <-doppelgangerSettingsCallback:
+		t.Errorf("more than one set of settings queued")
+	default:
+	}
+}
+
+//
+// A hang-up is never lost: the first one stays until the doppelganger picks
+// it up, and the ones after it are turned away (and say so) rather than
+// queued behind it.
+//
+func TestSendHangUp(t *testing.T) {
+	doppelgangerHangUpCallback := make(chan messageFromChannelMasterToDoppelganger, 1)
+	var kick messageFromChannelMasterToDoppelganger
+	kick.operation = fromChannelMasterToDoppelgangerOpDisconnect
+	kick.msgToUser = "kicked"
+	if !sendHangUp(doppelgangerHangUpCallback, kick) {
+		t.Errorf("first hang-up wasn't delivered")
+	}
+	var shutdown messageFromChannelMasterToDoppelganger
+	shutdown.operation = fromChannelMasterToDoppelgangerOpShutdown
+	shutdown.msgToUser = "shutting down"
+	if sendHangUp(doppelgangerHangUpCallback, shutdown) {
+		t.Errorf("second hang-up was delivered with the first still waiting")
+	}
+	waiting := <-doppelgangerHangUpCallback
+	if waiting.msgToUser != "kicked" {
+		t.Errorf("got hang-up %q", waiting.msgToUser)
+	}
+	if !sendHangUp(doppelgangerHangUpCallback, shutdown) {
+		t.Errorf("hang-up wasn't delivered once the first was picked up")
+	}
+}
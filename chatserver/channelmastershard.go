@@ -0,0 +1,771 @@
+package chatserver
+
+//
+// The channel master's shards. Joining, who and exiting used to all go
+// through the one channel master goroutine, so with thousands of users
+// everybody's join waited in line behind everybody else's. Now the running
+// chat channels are split up between a fixed number of shard goroutines by
+// chat channel ID (see shardForChatChannel), and each shard does for its
+// chat channels what the channel master used to do for all of them: it
+// launches a chat channel's goroutine when the first member joins, counts
+// members, and shuts the chat channel down when the last one leaves. A chat
+// channel always belongs to the same shard, so no two shards ever know
+// about the same chat channel and nothing is shared between them.
+//
+// The doppelganger looks up the chat channel ID in the database itself
+// before asking to join, so no shard (and not the channel master) ever waits
+// on the disk.
+//
+// The channel master itself still keeps the list of every doppelganger and
+// does everything that's about doppelgangers rather than chat channels
+// (broadcasts, shutdown notices, hanging up on slow members). It passes on
+// to the shards whatever main, the metrics endpoint and the admin console
+// want done with chat channels.
+//
+
+//
+// Structure for a shard to keep track of info for each chat channel -- at
+// the moment this consists of just the go channel used to communicate with
+// the chat channel and the member count, which when decremented to zero will
+// result in a shutdown message being sent to the chat channel and the go
+// channel used to communicate with it being released. moved is set once
+// we've told the chat channel another node in the cluster owns it now (see
+// moveChatChannelsWeDontOwn).
+//
+
+type perChatChanInfo struct {
+	memberCount         int
+	chatChannelCallback chan messageFromChannelMasterToChatChannel
+	moved               bool
+}
+
+//
+// A chat channel goroutine we've told to shut down that hasn't told us it's
+// done yet. Joins and API requests for the chat channel that come in
+// meanwhile wait here: launching it again before it's done would leave two
+// goroutines writing the same conversation log, and the new one wouldn't
+// have what the old one said last (its history only gets to us when it's
+// done). They're taken care of, in the order they came in, when it is.
+//
+type closingChatChanInfo struct {
+	joins       []messageFromDoppelgangerToChannelMaster
+	apiRequests []messageFromChannelMasterToShard
+}
+
+//
+// Everything a shard owns. Only the shard's own goroutine touches it.
+//
+type channelMasterShardInfo struct {
+	chatServer *ChatServer
+	index      int
+	logger     *Logger
+	watch      *stallWatch
+	settings   liveSettings
+	//
+	// We have to use a pointer here to get arround the "cannot assign to
+	// struct field in map" error that would normally occur when we try to
+	// set the go channel for sending messages to the chat channel's
+	// goroutine.
+	//
+	runningChatchannelMap map[int64]*perChatChanInfo
+	//
+	// Chat channel goroutines we've told to shut down but that haven't told
+	// us they're done (closed their conversation logs) yet, by chat channel
+	// ID.
+	//
+	closingChatChannels map[int64]*closingChatChanInfo
+	//
+	// What chat channels that aren't running remembered when they shut
+	// down (see chatHistoryEntry), by chat channel ID. A chat channel that's
+	// launched again gets its history back and takes it over.
+	//
+	recentHistory map[int64][]chatHistoryEntry
+	//
+	// Running totals, for the metrics.
+	//
+	joinDenials                    int64
+	messagesFromClosedChatChannels int64
+	droppedFromClosedChatChannels  int64
+	//
+	// Shutdown state. Once shuttingDown is set, nobody can join a chat
+	// channel on this shard any more. drainedCallback is non-nil while the
+	// channel master is waiting for us to have no chat channels left.
+	//
+	shuttingDown    bool
+	drainedCallback chan int
+}
+
+//
+// Makes the shards and starts their goroutines. Called once from New,
+// before the channel master or any doppelganger starts.
+//
+func startChannelMasterShards(chatServer *ChatServer, settings liveSettings) {
+	chatServer.channelMasterShards = make([]*channelMasterShard, chatServer.config.ChannelMasterShards)
+	for ii := range chatServer.channelMasterShards {
+		shard := new(channelMasterShard)
+		shard.index = ii
+		//
+		// The same buffer sizes the channel master's go channels used to
+		// have, for each shard. The buffer from the channel master is one
+		// because there can't be more than one channel master.
+		//
+		shard.fromDoppelganger = make(chan messageFromDoppelgangerToChannelMaster, chatServer.config.ChannelMasterDoppelgangerQueue)
+		shard.fromChatChannel = make(chan messageFromChatChannelToChannelMaster, chatServer.config.ChannelMasterChatChannelQueue)
+		shard.fromChannelMaster = make(chan messageFromChannelMasterToShard, 1)
+		shard.membershipChanged = make(chan bool, 1)
+		chatServer.channelMasterShards[ii] = shard
+		go channelMasterShardGoroutine(chatServer, shard, settings)
+	}
+}
+
+//
+// Which shard a chat channel belongs to. Chat channel IDs come from the
+// database, so they're positive; the conversion is just so a bad one can't
+// give us a negative index.
+//
+func shardForChatChannel(chatServer *ChatServer, chatChannelID int64) *channelMasterShard {
+	return chatServer.channelMasterShards[uint64(chatChannelID)%uint64(len(chatServer.channelMasterShards))]
+}
+
+func joinChatChannel(shardState *channelMasterShardInfo, userID int64, userName string, doppelgangerID int64, chatChannelID int64, chatChannelName string, doppelgangerCallback chan messageFromChatChannelToDoppelganger, doppelgangerTextQueue chan messageFromChatChannelToDoppelganger) {
+	runningChatchannelMap := shardState.runningChatchannelMap
+	if doppelgangerCallback == nil {
+		//
+		// Should never happen.
+		//
+		shardState.logger.With("doppelganger_id", doppelgangerID, "user_id", userID, "channel_id", chatChannelID).Error("doppelgangerCallback == nil")
+	}
+	if doppelgangerTextQueue == nil {
+		//
+		// Should never happen.
+		//
+		shardState.logger.With("doppelganger_id", doppelgangerID, "user_id", userID, "channel_id", chatChannelID).Error("doppelgangerTextQueue == nil")
+	}
+	_, exists := runningChatchannelMap[chatChannelID]
+	if !exists {
+		//
+		// Chatchannel's goroutine does not exist, so we have to launch it.
+		// We'll add an entry to the list now so we don't launch it twice.
+		// But we'll set it's go channel to nil to indicate we can't
+		// communicate on it yet.
+		//
+		if chatChannelID == 0 {
+			//
+			// Should never happen.
+			//
+			shardState.logger.With("doppelganger_id", doppelgangerID, "user_id", userID).Error("joinChatChannel: chatChannelID == 0")
+			return // Try and keep server up
+		}
+		//
+		// We send the first message as a parameter to the function we call
+		// to launch the chat channel's go routine. We could also send it as
+		// a separate message on the channel, in which case it would execute
+		// later (hopefully on the first loop through of the chat channel
+		// goroutine's select loop) rather than immediately. We're going to
+		// go ahead and do it immediately, since we can.
+		//
+		// First message: user requests permission to join the channel.
+		//
+		var firstMessage messageFromChannelMasterToChatChannel
+		firstMessage.operation = fromChannelMasterToChatChanOpJoin
+		firstMessage.userID = userID
+		firstMessage.userName = userName
+		firstMessage.doppelgangerID = doppelgangerID
+		firstMessage.doppelgangerCallback = doppelgangerCallback
+		firstMessage.doppelgangerTextQueue = doppelgangerTextQueue
+		firstMessage.history = shardState.recentHistory[chatChannelID]
+		delete(shardState.recentHistory, chatChannelID)
+		//
+		// Buffer size of one because there can't be more than one shard
+		// for a chat channel.
+		//
+		incomingFromChannelMaster := make(chan messageFromChannelMasterToChatChannel, 1)
+		//
+		// Add to our list of running channels.
+		//
+		var newChatChan perChatChanInfo
+		newChatChan.memberCount = 1
+		newChatChan.chatChannelCallback = incomingFromChannelMaster
+		runningChatchannelMap[chatChannelID] = &newChatChan // Use a pointer to get arround "cannot assign to struct field in map" error
+		//
+		// Launch chatChannel.
+		//
+		go chatChannelGoRoutine(shardState.chatServer, chatChannelID, chatChannelName, shardState.settings, firstMessage, incomingFromChannelMaster)
+		return
+	}
+	//
+	// chatchannel does exist -- connect up with running chatchanel. If we
+	// haven't gotten called back with the go channel for this chatchannel,
+	// we are screwed. But at least we'll know from the nil check. If we
+	// can't send the join request, this join request will just get dropped
+	// on the floor!! We have to ask the user to attempt it again.
+	//
+	if runningChatchannelMap[chatChannelID] == nil {
+		//
+		// This should be impossible...
+		//
+		shardState.logger.With("channel_id", chatChannelID).Error("runningChatchannelMap[chatChannelID] == nil")
+	} else {
+		runningChatchannelMap[chatChannelID].memberCount++
+		var theMessage messageFromChannelMasterToChatChannel
+		theMessage.operation = fromChannelMasterToChatChanOpJoin
+		theMessage.userID = userID
+		theMessage.userName = userName
+		theMessage.doppelgangerID = doppelgangerID
+		theMessage.doppelgangerCallback = doppelgangerCallback
+		theMessage.doppelgangerTextQueue = doppelgangerTextQueue
+		if runningChatchannelMap[chatChannelID] == nil {
+			//
+			// Should never happen.
+			//
+			shardState.logger.With("channel_id", chatChannelID).Error("runningChatchannelMap[chatChannelID] == nil")
+			return // Try to keep server up.
+		}
+		shardState.watch.sendFromChannelMasterToChatChannel(runningChatchannelMap[chatChannelID].chatChannelCallback, theMessage, chatChannelID)
+	}
+}
+
+//
+// A post (from the API) to a chat channel nobody's on. We launch the chat
+// channel just for the post, with what it remembered, and tell it to shut
+// down right after, the same as when the last member leaves: it says the
+// post to nobody, writes it to the conversation log, answers the API, and
+// hands us back its history with the post in it when it's done. Whatever
+// comes in for it meanwhile (the next post, someone joining, the API asking
+// for the history) waits for that (see closingChatChanInfo).
+//
+func postToIdleChatChannel(shardState *channelMasterShardInfo, apiRequest messageFromAPIToChannelMaster, apiCallback chan apiChatChannelReply) {
+	chatChannelID := apiRequest.chatChannelID
+	var firstMessage messageFromChannelMasterToChatChannel
+	firstMessage.operation = fromChannelMasterToChatChanOpPost
+	firstMessage.userID = apiRequest.userID
+	firstMessage.userName = apiRequest.userName
+	firstMessage.doppelgangerID = 0
+	firstMessage.doppelgangerCallback = nil
+	firstMessage.parameter = apiRequest.parameter
+	firstMessage.said = apiRequest.said
+	firstMessage.apiCallback = apiCallback
+	firstMessage.history = shardState.recentHistory[chatChannelID]
+	delete(shardState.recentHistory, chatChannelID)
+	//
+	// Room for the shutdown message, so sending it never blocks.
+	//
+	incomingFromChannelMaster := make(chan messageFromChannelMasterToChatChannel, 1)
+	go chatChannelGoRoutine(shardState.chatServer, chatChannelID, apiRequest.chatChannelName, shardState.settings, firstMessage, incomingFromChannelMaster)
+	var shutdownMessage messageFromChannelMasterToChatChannel
+	shutdownMessage.operation = fromChannelMasterToChatChanOpShutdown
+	shutdownMessage.userID = apiRequest.userID
+	shutdownMessage.userName = apiRequest.userName
+	shutdownMessage.doppelgangerID = 0
+	shutdownMessage.doppelgangerCallback = nil
+	shardState.watch.sendFromChannelMasterToChatChannel(incomingFromChannelMaster, shutdownMessage, chatChannelID)
+	shardState.closingChatChannels[chatChannelID] = new(closingChatChanInfo)
+}
+
+func whoIsOnChatChannel(shardState *channelMasterShardInfo, userID int64, userName string, doppelgangerID int64, chatChannelID int64, doppelgangerCallback chan messageFromChatChannelToDoppelganger) {
+	runningChatchannelMap := shardState.runningChatchannelMap
+	//
+	// Made this a separate function to make the extra error checking
+	// easier.
+	//
+	if doppelgangerCallback == nil {
+		//
+		// Should never happen.
+		//
+		shardState.logger.With("doppelganger_id", doppelgangerID, "user_id", userID, "channel_id", chatChannelID).Error("doppelgangerCallback == nil")
+		return // Try to keep server up.
+	}
+	_, exists := runningChatchannelMap[chatChannelID]
+	if !exists {
+		//
+		// Should never happen.
+		//
+		shardState.logger.With("channel_id", chatChannelID).Error("runningChatchannelMap[chatChannelID] does not exist")
+		return // Try to keep server up.
+	}
+	if runningChatchannelMap[chatChannelID] == nil {
+		//
+		// Should never happen.
+		//
+		shardState.logger.With("channel_id", chatChannelID).Error("runningChatchannelMap[chatChannelID] == nil")
+		return // Try to keep server up.
+	} else {
+		var theMessage messageFromChannelMasterToChatChannel
+		theMessage.operation = fromChannelMasterToChatChanOpWho
+		theMessage.userID = userID
+		theMessage.userName = userName
+		theMessage.doppelgangerID = doppelgangerID
+		theMessage.doppelgangerCallback = doppelgangerCallback
+		if runningChatchannelMap[chatChannelID] == nil {
+			//
+			// Should never happen.
+			//
+			shardState.logger.With("channel_id", chatChannelID).Error("runningChatchannelMap[chatChannelID] == nil")
+			return // Try to keep server up.
+		}
+		shardState.watch.sendFromChannelMasterToChatChannel(runningChatchannelMap[chatChannelID].chatChannelCallback, theMessage, chatChannelID)
+	}
+}
+
+//
+// A doppelganger (or a cluster member goroutine, for a user on another
+// node) asking to join a chat channel. The doppelganger already looked up
+// the chat channel and knows it exists.
+//
+func handleJoinRequest(shardState *channelMasterShardInfo, theMessage messageFromDoppelgangerToChannelMaster) {
+	if shardState.shuttingDown {
+		var reply messageFromChannelMasterToDoppelganger
+		reply.operation = fromChannelMasterToDoppelgangerOpJoinDenied
+		reply.msgToUser = "The server is shutting down."
+		reply.channelID = 0
+		if theMessage.doppelgangerCallbackFromChannelMaster == nil {
+			//
+			// Should never happen.
+			//
+			shardState.logger.With("doppelganger_id", theMessage.doppelgangerID, "user_id", theMessage.userID).Error("theMessage.doppelgangerCallbackFromChannelMaster == nil")
+			return // Try and keep server up
+		}
+		shardState.watch.sendFromChannelMasterToDoppelganger(theMessage.doppelgangerCallbackFromChannelMaster, reply, theMessage.doppelgangerID)
+		return
+	}
+	if !ownsChatChannel(shardState.chatServer, theMessage.chatChannelID) {
+		//
+		// Another node owns it now, but whoever sent the join (a node that
+		// hasn't heard yet, or one of our own doppelgangers that asked just
+		// before we did) still thinks it's here. Letting them on would leave
+		// them behind when everyone else has moved.
+		//
+		var reply messageFromChannelMasterToDoppelganger
+		reply.operation = fromChannelMasterToDoppelgangerOpJoinDenied
+		reply.msgToUser = "#" + theMessage.parameter + " is moving to another server. Please try again."
+		reply.channelID = 0
+		shardState.watch.sendFromChannelMasterToDoppelganger(theMessage.doppelgangerCallbackFromChannelMaster, reply, theMessage.doppelgangerID)
+		return
+	}
+	closing, isClosing := shardState.closingChatChannels[theMessage.chatChannelID]
+	if isClosing {
+		closing.joins = append(closing.joins, theMessage)
+		return
+	}
+	//
+	// Join the chat channel!
+	//
+	joinChatChannel(shardState, theMessage.userID, theMessage.userName, theMessage.doppelgangerID, theMessage.chatChannelID, theMessage.parameter, theMessage.doppelgangerCallbackFromChatChannel, theMessage.doppelgangerTextQueue)
+}
+
+//
+// The API (through the channel master) posting to a chat channel or asking
+// for its history.
+//
+func handleAPIRequest(shardState *channelMasterShardInfo, theMessage messageFromChannelMasterToShard) {
+	chatChannelID := theMessage.apiRequest.chatChannelID
+	closing, isClosing := shardState.closingChatChannels[chatChannelID]
+	if isClosing {
+		closing.apiRequests = append(closing.apiRequests, theMessage)
+		return
+	}
+	chatChanInfo, exists := shardState.runningChatchannelMap[chatChannelID]
+	if !exists && (theMessage.operation == fromChannelMasterToShardOpPost) && !shardState.shuttingDown {
+		//
+		// Nobody's on it, but it still gets said: logged and remembered by
+		// the chat channel, same as always.
+		//
+		postToIdleChatChannel(shardState, theMessage.apiRequest, theMessage.apiCallback)
+		return
+	}
+	if !exists {
+		//
+		// Nobody's on it. Answer for it: what it remembered, or (if we're
+		// shutting down, so can't launch it any more) that the post went
+		// nowhere. Buffered by the channel master, so this never blocks.
+		//
+		var reply apiChatChannelReply
+		reply.chatChannelID = chatChannelID
+		reply.running = false
+		if theMessage.operation == fromChannelMasterToShardOpHistory {
+			reply.history = latestHistory(shardState.recentHistory[chatChannelID], theMessage.apiRequest.limit)
+		}
+		theMessage.apiCallback <- reply
+		return
+	}
+	var apiMessage messageFromChannelMasterToChatChannel
+	apiMessage.operation = fromChannelMasterToChatChanOpHistory
+	if theMessage.operation == fromChannelMasterToShardOpPost {
+		apiMessage.operation = fromChannelMasterToChatChanOpPost
+	}
+	apiMessage.userID = theMessage.apiRequest.userID
+	apiMessage.userName = theMessage.apiRequest.userName
+	apiMessage.doppelgangerID = 0
+	apiMessage.doppelgangerCallback = nil
+	apiMessage.parameter = theMessage.apiRequest.parameter
+	apiMessage.said = theMessage.apiRequest.said
+	apiMessage.limit = theMessage.apiRequest.limit
+	apiMessage.apiCallback = theMessage.apiCallback
+	shardState.watch.sendFromChannelMasterToChatChannel(chatChanInfo.chatChannelCallback, apiMessage, chatChannelID)
+}
+
+//
+// Another node in the cluster came up or went down, so some of our chat
+// channels may belong to another node now. Each one that does is told it
+// has moved, and tells its members, who exit and join again -- which takes
+// them to the node that owns it now. We don't shut it down ourselves: the
+// members are still on it until their exits get here, and it shuts down
+// like always when the last one leaves. Meanwhile nobody else can join it
+// (see the join in channelMasterShardGoroutine).
+//
+// A chat channel can come back before everyone has gone (the node went
+// down again). Then it's ours again, and whoever rejoins gets back on it;
+// if it moves away again after that, it's told again.
+//
+func moveChatChannelsWeDontOwn(shardState *channelMasterShardInfo) int {
+	count := 0
+	for chatChannelID, chatChanInfo := range shardState.runningChatchannelMap {
+		if ownsChatChannel(shardState.chatServer, chatChannelID) {
+			chatChanInfo.moved = false
+			continue
+		}
+		if chatChanInfo.moved {
+			continue
+		}
+		var movedMessage messageFromChannelMasterToChatChannel
+		movedMessage.operation = fromChannelMasterToChatChanOpMoved
+		movedMessage.userID = 0
+		movedMessage.userName = ""
+		movedMessage.doppelgangerID = 0
+		movedMessage.doppelgangerCallback = nil
+		shardState.watch.sendFromChannelMasterToChatChannel(chatChanInfo.chatChannelCallback, movedMessage, chatChannelID)
+		chatChanInfo.moved = true
+		count++
+	}
+	return count
+}
+
+//
+// Tells every chat channel goroutine on this shard still running to shut
+// down, regardless of how many members it has, and forgets about it. Only
+// used when the server is shutting down and the users didn't all leave in
+// time.
+//
+func shutdownAllChatChannels(shardState *channelMasterShardInfo) int {
+	count := 0
+	for chatChannelID, chatChanInfo := range shardState.runningChatchannelMap {
+		var shutdownMessage messageFromChannelMasterToChatChannel
+		shutdownMessage.operation = fromChannelMasterToChatChanOpShutdown
+		shutdownMessage.userID = 0
+		shutdownMessage.userName = ""
+		shutdownMessage.doppelgangerID = 0
+		shutdownMessage.doppelgangerCallback = nil
+		shardState.watch.sendFromChannelMasterToChatChannel(chatChanInfo.chatChannelCallback, shutdownMessage, chatChannelID)
+		delete(shardState.runningChatchannelMap, chatChannelID)
+		shardState.closingChatChannels[chatChannelID] = new(closingChatChanInfo)
+		count++
+	}
+	return count
+}
+
+//
+// Goroutine for one channel master shard
+//
+func channelMasterShardGoroutine(chatServer *ChatServer, shard *channelMasterShard, settings liveSettings) {
+	shardState := new(channelMasterShardInfo)
+	shardState.chatServer = chatServer
+	shardState.index = shard.index
+	shardState.logger = chatServer.logger.With("goroutine", "channel_master_shard", "shard", shard.index)
+	shardState.watch = chatServer.stallWatchdog.watch(shardState.logger)
+	defer chatServer.stallWatchdog.unwatch(shardState.watch)
+	//
+	// settings (a parameter) is the current live settings. The channel
+	// master sends us new ones on SIGHUP, and we pass them along to every
+	// chat channel we have running.
+	//
+	shardState.settings = settings
+	//
+	// We start off with an empty list of "running" chat channels (channels
+	// with users in them, presumably talking). Chat channel live in the
+	// database until someone actually wants to chat on them. Chat channel
+	// goroutines are launched when the number of users on the channel goes
+	// from 0 to 1. When it goes from 1 to 0, the chat channel goroutine is
+	// supposed to send a message here telling us it is shutting down, and
+	// we remove that channel from the "running" table.
+	//
+	shardState.runningChatchannelMap = make(map[int64]*perChatChanInfo)
+	shardState.closingChatChannels = make(map[int64]*closingChatChanInfo)
+	shardState.recentHistory = make(map[int64][]chatHistoryEntry)
+	logger := shardState.logger
+	watch := shardState.watch
+	runningChatchannelMap := shardState.runningChatchannelMap
+	for {
+		select {
+		case <-chatServer.stop:
+			//
+			// Shutdown is done with us.
+			//
+			return
+		case theMessage, ok := <-shard.fromDoppelganger:
+			if !ok {
+				//
+				// Should never happen.
+				//
+				logger.Error("Shard's channel for receiving messages from doppelgangers unexpectedly closed.")
+				return
+			}
+			switch theMessage.operation {
+			case fromDoppelgangerToChannelMasterOpJoin:
+				handleJoinRequest(shardState, theMessage)
+			case fromDoppelgangerToChannelMasterOpWho:
+				whoIsOnChatChannel(shardState, theMessage.userID, theMessage.userName, theMessage.doppelgangerID, theMessage.chatChannelID, theMessage.doppelgangerCallbackFromChatChannel)
+			case fromDoppelgangerToChannelMasterOpExit:
+				_, exists := runningChatchannelMap[theMessage.chatChannelID]
+				if !exists && shardState.shuttingDown {
+					//
+					// The chat channel was already shut down because the
+					// server is going down and this user didn't leave in
+					// time. Nothing left to do.
+					//
+					logger.With("doppelganger_id", theMessage.doppelgangerID, "user_id", theMessage.userID, "channel_id", theMessage.chatChannelID).Debug("exit from chat channel that was already shut down for server shutdown")
+				} else if !exists {
+					//
+					// Should never happen.
+					//
+					logger.With("doppelganger_id", theMessage.doppelgangerID, "user_id", theMessage.userID, "channel_id", theMessage.chatChannelID).Error("runningChatchannelMap[theMessage.chatChannelID] does not exist (trying to exit a channel that doesn't exist)")
+				} else {
+					var exitMessage messageFromChannelMasterToChatChannel
+					exitMessage.operation = fromChannelMasterToChatChanOpExit
+					exitMessage.userID = theMessage.userID
+					exitMessage.userName = theMessage.userName
+					exitMessage.doppelgangerID = theMessage.doppelgangerID
+					exitMessage.doppelgangerCallback = theMessage.doppelgangerCallbackFromChatChannel
+					watch.sendFromChannelMasterToChatChannel(runningChatchannelMap[theMessage.chatChannelID].chatChannelCallback, exitMessage, theMessage.chatChannelID)
+					runningChatchannelMap[theMessage.chatChannelID].memberCount--
+					if runningChatchannelMap[theMessage.chatChannelID].memberCount == 0 {
+						var shutdownMessage messageFromChannelMasterToChatChannel
+						shutdownMessage.operation = fromChannelMasterToChatChanOpShutdown
+						shutdownMessage.userID = theMessage.userID
+						shutdownMessage.userName = theMessage.userName
+						shutdownMessage.doppelgangerID = theMessage.doppelgangerID
+						shutdownMessage.doppelgangerCallback = theMessage.doppelgangerCallbackFromChatChannel
+						watch.sendFromChannelMasterToChatChannel(runningChatchannelMap[theMessage.chatChannelID].chatChannelCallback, shutdownMessage, theMessage.chatChannelID)
+						shardState.closingChatChannels[theMessage.chatChannelID] = new(closingChatChanInfo)
+						//
+						// We do NOT close the go channel here -- we've
+						// assigned responsibility for closing the go channel
+						// to the other end (the chat channel goroutine). The
+						// go channel is released for the garbage collector.
+						//
+						delete(runningChatchannelMap, theMessage.chatChannelID)
+					}
+				}
+			default:
+				//
+				// Should never happen.
+				//
+				logger.With("operation", theMessage.operation).Error("Unrecognized operation code received by channel master shard from doppelganger")
+			}
+		case theMessage, ok := <-shard.fromChatChannel:
+			if !ok {
+				//
+				// Should never happen.
+				//
+				logger.Error("Shard's channel for receiving messages from chat channels unexpectedly closed.")
+				return
+			}
+			switch theMessage.operation {
+			case fromChatChannelToChannelMasterOpJoinDenied:
+				shardState.joinDenials++
+				if runningChatchannelMap[theMessage.chatChannelID] == nil {
+					//
+					// Should never happen.
+					//
+					logger.With("channel_id", theMessage.chatChannelID).Error("runningChatchannelMap[theMessage.chatChannelID] == nil (join denied by a chat channel we don't have)")
+					break // Try to keep server up.
+				}
+				runningChatchannelMap[theMessage.chatChannelID].memberCount--
+				if runningChatchannelMap[theMessage.chatChannelID].memberCount == 0 {
+					//
+					// This code can't be an exact copy of the above code
+					// because we're dealing with a message from the chat
+					// channel instead of a message from the doppelganger.
+					// But conceptually this does the same thing.
+					//
+					var shutdownMessage messageFromChannelMasterToChatChannel
+					shutdownMessage.operation = fromChannelMasterToChatChanOpShutdown
+					shutdownMessage.userID = theMessage.userID
+					shutdownMessage.userName = ""
+					shutdownMessage.doppelgangerID = theMessage.doppelgangerID
+					shutdownMessage.doppelgangerCallback = nil // have to use nil as this field does not exist here
+					watch.sendFromChannelMasterToChatChannel(runningChatchannelMap[theMessage.chatChannelID].chatChannelCallback, shutdownMessage, theMessage.chatChannelID)
+					shardState.closingChatChannels[theMessage.chatChannelID] = new(closingChatChanInfo)
+					//
+					// We do NOT close the go channel here -- we've assigned
+					// responsibility for closing the go channel to the
+					// other end (the chat channel goroutine). Go channel
+					// is released for the garbage collector.
+					//
+					delete(runningChatchannelMap, theMessage.chatChannelID)
+				}
+			case fromChatChannelToChannelMasterOpShutdownComplete:
+				shardState.messagesFromClosedChatChannels += theMessage.messageCount
+				shardState.droppedFromClosedChatChannels += theMessage.droppedMessages
+				closing, exists := shardState.closingChatChannels[theMessage.chatChannelID]
+				if !exists {
+					//
+					// Should never happen.
+					//
+					logger.With("channel_id", theMessage.chatChannelID).Error("chat channel reported shutting down that wasn't told to")
+					break // Try to keep server up.
+				}
+				delete(shardState.closingChatChannels, theMessage.chatChannelID)
+				if len(theMessage.history) != 0 {
+					shardState.recentHistory[theMessage.chatChannelID] = theMessage.history
+				}
+				//
+				// Now whatever was waiting for it can go ahead, with its
+				// history. The first join (or post) launches it again; if
+				// that's a post, it's closing again right away, and the
+				// rest wait some more.
+				//
+				for _, join := range closing.joins {
+					handleJoinRequest(shardState, join)
+				}
+				for _, apiRequest := range closing.apiRequests {
+					handleAPIRequest(shardState, apiRequest)
+				}
+			default:
+				//
+				// Should never happen.
+				//
+				logger.With("operation", theMessage.operation).Error("Unrecognized operation code received by channel master shard from chat channel")
+			}
+		case <-shard.membershipChanged:
+			count := moveChatChannelsWeDontOwn(shardState)
+			if count > 0 {
+				logger.With("chat_channels", count).Info("Chat channels belong to another cluster node now, telling their members to move.")
+			}
+		case theMessage, ok := <-shard.fromChannelMaster:
+			if !ok {
+				//
+				// Should never happen.
+				//
+				logger.Error("Shard's channel for receiving messages from the channel master unexpectedly closed.")
+				return
+			}
+			switch theMessage.operation {
+			case fromChannelMasterToShardOpSettings:
+				shardState.settings = theMessage.settings
+				for chatChannelID, chatChanInfo := range runningChatchannelMap {
+					var settingsMessage messageFromChannelMasterToChatChannel
+					settingsMessage.operation = fromChannelMasterToChatChanOpSettings
+					settingsMessage.userID = 0
+					settingsMessage.userName = ""
+					settingsMessage.doppelgangerID = 0
+					settingsMessage.doppelgangerCallback = nil
+					settingsMessage.settings = shardState.settings
+					watch.sendFromChannelMasterToChatChannel(chatChanInfo.chatChannelCallback, settingsMessage, chatChannelID)
+				}
+			case fromChannelMasterToShardOpShutdown:
+				//
+				// The members leave on their own once the channel master
+				// has told their doppelgangers goodbye; we just wait for
+				// our chat channels to empty out.
+				//
+				shardState.shuttingDown = true
+				shardState.drainedCallback = theMessage.drainedCallback
+			case fromChannelMasterToShardOpShutdownChatChannels:
+				shardState.shuttingDown = true
+				shardState.drainedCallback = theMessage.drainedCallback
+				count := shutdownAllChatChannels(shardState)
+				if count > 0 {
+					logger.With("chat_channels", count).Warn("Forced shutdown of chat channels with members still on them.")
+				}
+			case fromChannelMasterToShardOpMetrics:
+				//
+				// Our own numbers and queue lengths, and every chat channel
+				// answers the metrics endpoint directly. Buffer is big
+				// enough for all of them so none of them ever block, even if
+				// the metrics endpoint has given up waiting.
+				//
+				var reply shardMetrics
+				reply.shard = shardState.index
+				reply.runningChatChannels = len(runningChatchannelMap)
+				reply.joinDenials = shardState.joinDenials
+				reply.messagesFromClosedChatChannels = shardState.messagesFromClosedChatChannels
+				reply.droppedFromClosedChatChannels = shardState.droppedFromClosedChatChannels
+				reply.doppelgangerQueueLength = len(shard.fromDoppelganger)
+				reply.doppelgangerQueueCapacity = cap(shard.fromDoppelganger)
+				reply.chatChannelQueueLength = len(shard.fromChatChannel)
+				reply.chatChannelQueueCapacity = cap(shard.fromChatChannel)
+				reply.chatChannelsAsked = len(runningChatchannelMap)
+				reply.chatChannelCallback = make(chan chatChannelMetrics, len(runningChatchannelMap))
+				for chatChannelID, chatChanInfo := range runningChatchannelMap {
+					var metricsMessage messageFromChannelMasterToChatChannel
+					metricsMessage.operation = fromChannelMasterToChatChanOpMetrics
+					metricsMessage.userID = 0
+					metricsMessage.userName = ""
+					metricsMessage.doppelgangerID = 0
+					metricsMessage.doppelgangerCallback = nil
+					metricsMessage.metricsCallback = reply.chatChannelCallback
+					watch.sendFromChannelMasterToChatChannel(chatChanInfo.chatChannelCallback, metricsMessage, chatChannelID)
+				}
+				//
+				// Buffered by the channel master for every shard, so this
+				// never blocks.
+				//
+				theMessage.metricsCallback <- reply
+			case fromChannelMasterToShardOpChatChannels:
+				var reply adminShardReply
+				reply.shard = shardState.index
+				reply.chatChannelsClosing = len(shardState.closingChatChannels)
+				reply.chatChannels = make([]adminChatChannelEntry, 0, len(runningChatchannelMap))
+				for chatChannelID, chatChanInfo := range runningChatchannelMap {
+					entry := adminChatChannelEntry{chatChannelID: chatChannelID}
+					if chatChanInfo != nil {
+						entry.memberCount = chatChanInfo.memberCount
+						entry.queueLength = len(chatChanInfo.chatChannelCallback)
+						entry.queueCapacity = cap(chatChanInfo.chatChannelCallback)
+					}
+					reply.chatChannels = append(reply.chatChannels, entry)
+				}
+				theMessage.adminCallback <- reply
+			case fromChannelMasterToShardOpMembers:
+				//
+				// Every chat channel answers the admin console directly,
+				// like with the metrics.
+				//
+				var reply adminShardReply
+				reply.shard = shardState.index
+				reply.chatChannelsClosing = len(shardState.closingChatChannels)
+				reply.membersAsked = len(runningChatchannelMap)
+				reply.membersCallback = make(chan adminChatChannelMembers, len(runningChatchannelMap))
+				for chatChannelID, chatChanInfo := range runningChatchannelMap {
+					var membersMessage messageFromChannelMasterToChatChannel
+					membersMessage.operation = fromChannelMasterToChatChanOpMembers
+					membersMessage.userID = 0
+					membersMessage.userName = ""
+					membersMessage.doppelgangerID = 0
+					membersMessage.doppelgangerCallback = nil
+					membersMessage.adminCallback = reply.membersCallback
+					watch.sendFromChannelMasterToChatChannel(chatChanInfo.chatChannelCallback, membersMessage, chatChannelID)
+				}
+				theMessage.adminCallback <- reply
+			case fromChannelMasterToShardOpHistory, fromChannelMasterToShardOpPost:
+				handleAPIRequest(shardState, theMessage)
+			default:
+				//
+				// Should never happen.
+				//
+				logger.With("operation", theMessage.operation).Error("Unrecognized operation code received by channel master shard from channel master")
+			}
+		}
+		//
+		// If the channel master is waiting on us to finish shutting down,
+		// check if we're there yet. We reply only once, on a go channel
+		// buffered for every shard.
+		//
+		if shardState.drainedCallback != nil {
+			if (len(runningChatchannelMap) == 0) && (len(shardState.closingChatChannels) == 0) {
+				shardState.drainedCallback <- shardState.index
+				shardState.drainedCallback = nil
+			}
+		}
+	}
+}
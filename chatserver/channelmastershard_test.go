@@ -0,0 +1,178 @@
+package chatserver
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+//
+// Join throughput with thousands of sessions joining and exiting at once.
+// Each simulated session does what a doppelganger does for /join and /exit:
+// it looks the chat channel up in the database, asks its shard to join,
+// waits to be let on, then asks to exit and waits for its own exit notice.
+// The sessions are spread over benchmarkChatChannels chat channels, so with
+// one shard it's the old single channel master (minus the database lookup,
+// which the sessions now do themselves) and with more the joins are spread
+// between shards.
+//
+// go test -run XXX -bench JoinExit
+//
+
+const benchmarkChatChannels = 100
+
+func BenchmarkJoinExit(b *testing.B) {
+	for _, shards := range []int{1, 4, 16} {
+		for _, sessions := range []int{1000, 4000} {
+			b.Run("shards="+strconv.Itoa(shards)+"/sessions="+strconv.Itoa(sessions), func(b *testing.B) {
+				benchmarkJoinExit(b, shards, sessions)
+			})
+		}
+	}
+}
+
+func benchmarkJoinExit(b *testing.B, shards int, sessions int) {
+	chatServer, settings := setUpBenchmarkServer(b, shards)
+	defer drainShards(b, chatServer)
+	//
+	// b.N joins (and exits) in all, shared out between the sessions.
+	//
+	b.ResetTimer()
+	start := time.Now()
+	var wait sync.WaitGroup
+	for ii := 0; ii < sessions; ii++ {
+		joins := b.N / sessions
+		if ii < b.N%sessions {
+			joins++
+		}
+		if joins == 0 {
+			continue
+		}
+		wait.Add(1)
+		go func(session int, joins int) {
+			defer wait.Done()
+			benchmarkSession(b, chatServer, settings, int64(session+1), "bench"+strconv.Itoa(session%benchmarkChatChannels), joins)
+		}(ii, joins)
+	}
+	wait.Wait()
+	elapsed := time.Since(start)
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/elapsed.Seconds(), "joins/s")
+}
+
+//
+// A fresh chat server for each run, with just the parts the shards need: a
+// database with the chat channels in it, the configured number of shards,
+// and a logger that throws everything away.
+//
+func setUpBenchmarkServer(b *testing.B, shards int) (*ChatServer, liveSettings) {
+	dir := b.TempDir()
+	chatServer := new(ChatServer)
+	chatServer.logger = newStructuredLogger(ioutil.Discard, logLevelError, "logfmt")
+	chatServer.config = DefaultConfig()
+	chatServer.config.ChannelMasterShards = shards
+	chatServer.config.LogDir = dir
+	chatServer.config.MaxChatChannelMembers = 1 << 30
+	chatServer.stallWatchdog = newStallWatchdog()
+	chatServer.chanMasterFromChatChannelGoChan = make(chan messageFromChatChannelToChannelMaster, chatServer.config.ChannelMasterChatChannelQueue)
+	var err error
+	chatServer.config.DatabasePath = filepath.Join(dir, "bench.db")
+	chatServer.store, err = openSQLiteStorage(chatServer.config, chatServer.logger)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		chatServer.store.close()
+	})
+	for ii := 0; ii < benchmarkChatChannels; ii++ {
+		_, err = chatServer.store.saveChatChannel("bench" + strconv.Itoa(ii))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	settings, err := buildLiveSettings(chatServer.config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	startChannelMasterShards(chatServer, settings)
+	return chatServer, settings
+}
+
+func benchmarkSession(b *testing.B, chatServer *ChatServer, settings liveSettings, doppelgangerID int64, chatChannelName string, joins int) {
+	//
+	// Same buffer sizes as a real doppelganger. Nobody reads the text
+	// queue, which is what the slow member policy is for.
+	//
+	incomingFromChannelMaster := make(chan messageFromChannelMasterToDoppelganger, 1)
+	incomingFromChatChannel := make(chan messageFromChatChannelToDoppelganger, 1)
+	incomingTextFromChatChannel := make(chan messageFromChatChannelToDoppelganger, chatServer.config.MemberQueue)
+	for ii := 0; ii < joins; ii++ {
+		chatChannelID, err := chatServer.store.lookUpChatChannel(chatChannelName)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		shard := shardForChatChannel(chatServer, chatChannelID)
+		var joinMessage messageFromDoppelgangerToChannelMaster
+		joinMessage.operation = fromDoppelgangerToChannelMasterOpJoin
+		joinMessage.userID = doppelgangerID
+		joinMessage.userName = "user" + strconv.FormatInt(doppelgangerID, 10)
+		joinMessage.doppelgangerID = doppelgangerID
+		joinMessage.chatChannelID = chatChannelID
+		joinMessage.parameter = chatChannelName
+		joinMessage.doppelgangerCallbackFromChannelMaster = incomingFromChannelMaster
+		joinMessage.doppelgangerCallbackFromChatChannel = incomingFromChatChannel
+		joinMessage.doppelgangerTextQueue = incomingTextFromChatChannel
+		shard.fromDoppelganger <- joinMessage
+		joined := false
+		for !joined {
+			select {
+			case theMessage := <-incomingFromChatChannel:
+				joined = (theMessage.operation == fromChatChannelToDoppelgangerOpJoined)
+			case theMessage := <-incomingFromChannelMaster:
+				b.Errorf("join denied: %s", theMessage.msgToUser)
+				return
+			}
+		}
+		var exitMessage messageFromDoppelgangerToChannelMaster
+		exitMessage.operation = fromDoppelgangerToChannelMasterOpExit
+		exitMessage.userID = joinMessage.userID
+		exitMessage.userName = joinMessage.userName
+		exitMessage.doppelgangerID = doppelgangerID
+		exitMessage.chatChannelID = chatChannelID
+		exitMessage.doppelgangerCallbackFromChannelMaster = incomingFromChannelMaster
+		exitMessage.doppelgangerCallbackFromChatChannel = incomingFromChatChannel
+		shard.fromDoppelganger <- exitMessage
+		for {
+			theMessage := <-incomingFromChatChannel
+			if (theMessage.operation == fromChatChannelToDoppelgangerOpTextExit) && (theMessage.leavingDoppelgangerID == doppelgangerID) {
+				break
+			}
+		}
+	}
+}
+
+//
+// Waits for every chat channel to finish shutting down, so none of them
+// reports to the next run's shards. The shards themselves are left idle.
+//
+func drainShards(b *testing.B, chatServer *ChatServer) {
+	drained := make(chan int, len(chatServer.channelMasterShards))
+	var shutdownMessage messageFromChannelMasterToShard
+	shutdownMessage.operation = fromChannelMasterToShardOpShutdown
+	shutdownMessage.drainedCallback = drained
+	for _, shard := range chatServer.channelMasterShards {
+		shard.fromChannelMaster <- shutdownMessage
+	}
+	timeout := time.After(30 * time.Second)
+	for ii := 0; ii < len(chatServer.channelMasterShards); ii++ {
+		select {
+		case <-drained:
+		case <-timeout:
+			b.Fatal("shards did not drain")
+		}
+	}
+}
@@ -0,0 +1,774 @@
+package chatserver
+
+import (
+	"errors"
+	"time"
+)
+
+//
+// Chat Channel state. memberList maps userIDs to the Go channel used to
+// communicate with the chat channel goroutine. BRRRP!! No, it maps
+// doppelganger IDs (but keeps track of user IDs), so that the same user
+// can log in more than once and participate in multiple conversations or
+// even talk to themselves on the same channel.
+//
+// Each member also has a text queue (see queueTextForMember), with the
+// number of messages we've put on it so far and whether we've given up on
+// them for being too slow.
+//
+// startFailed means the conversation log wouldn't open when we were
+// launched. We don't take the server down over it: we turn away everyone
+// who tries to join, and every post from the API, until our shard sees
+// we're empty and shuts us down. The next join launches us again, and tries
+// again.
+//
+
+type userEntry struct {
+	userID               int64
+	userName             string
+	doppelgangerCallback chan messageFromChatChannelToDoppelganger
+	textQueue            chan messageFromChatChannelToDoppelganger
+	textSequence         int64
+	slow                 bool
+}
+
+type chatChannelInfo struct {
+	chatServer               *ChatServer
+	chatChannelID            int64
+	chatChannelName          string
+	settings                 liveSettings
+	memberList               map[int64]userEntry
+	convoLog                 conversationLog
+	incomingFromDoppelganger chan messageFromDoppelgangerToChatChannel
+	messageCount             int64
+	droppedMessages          int64
+	history                  []chatHistoryEntry
+	startFailed              bool
+	logger                   *Logger
+	watch                    *stallWatch
+}
+
+//
+// Chat Channel functions
+//
+
+//
+// Return value indicates "true" if a shutdown messages was received and the
+// whole goroutine needs to shut down.
+//
+func processMessageFromChannelMaster(chatChannelState *chatChannelInfo, theMessage messageFromChannelMasterToChatChannel) bool {
+	switch theMessage.operation {
+	case fromChannelMasterToChatChanOpJoin:
+		if chatChannelState.startFailed || (len(chatChannelState.memberList) >= chatChannelState.settings.maxChatChannelMembers) {
+			//
+			// Channel is full! No more users allowed. (Or we couldn't
+			// start.)
+			//
+			// Message back to channel master (our shard of it).
+			//
+			var deniedMsg messageFromChatChannelToChannelMaster
+			deniedMsg.operation = fromChatChannelToChannelMasterOpJoinDenied
+			deniedMsg.userID = theMessage.userID
+			deniedMsg.doppelgangerID = theMessage.doppelgangerID
+			deniedMsg.chatChannelID = chatChannelState.chatChannelID
+			chatChannelState.watch.sendFromChatChannelToChannelMaster(shardForChatChannel(chatChannelState.chatServer, chatChannelState.chatChannelID).fromChatChannel, deniedMsg)
+			//
+			// Message back to user (doppelganger)
+			//
+			var newMsg messageFromChatChannelToDoppelganger
+			newMsg.operation = fromChatChannelToDoppelgangerOpJoinDenied
+			newMsg.originator = 0 // special value that means nobody -- this message is from the channel itself
+			newMsg.chatChannelID = chatChannelState.chatChannelID
+			newMsg.leavingDoppelgangerID = 0
+			newMsg.parameter = "Channel is full"
+			if chatChannelState.startFailed {
+				newMsg.parameter = "The channel couldn't start. Please try again later."
+			}
+			if theMessage.doppelgangerCallback == nil {
+				//
+				// Should never happen.
+				//
+				chatChannelState.logger.With("doppelganger_id", theMessage.doppelgangerID, "user_id", theMessage.userID).Error("theMessage.doppelgangerCallback == nil")
+				return false // Try to keep server up.
+			}
+			chatChannelState.watch.sendFromChatChannelToDoppelganger(theMessage.doppelgangerCallback, newMsg, theMessage.doppelgangerID)
+		} else {
+			//
+			// Send message letting user know we've let them on the channel.
+			//
+			var newMsg messageFromChatChannelToDoppelganger
+			newMsg.operation = fromChatChannelToDoppelgangerOpJoined
+			newMsg.originator = 0 // special value that means nobody -- this message is from the channel itself
+			if chatChannelState.chatChannelID == 0 {
+				//
+				// Should never happen.
+				//
+				chatChannelState.logger.Error("chatChannelState.chatChannelID == 0")
+				return false // Try to keep server up.
+			}
+			newMsg.chatChannelID = chatChannelState.chatChannelID
+			newMsg.leavingDoppelgangerID = 0
+			newMsg.parameter = chatChannelState.chatChannelName
+			newMsg.chatChannelCallback = chatChannelState.incomingFromDoppelganger
+			if newMsg.chatChannelCallback == nil {
+				//
+				// Should never happen.
+				//
+				chatChannelState.logger.Error("newMsg.chatChannelCallback == nil")
+				return false // Try to keep server up.
+			}
+			if theMessage.doppelgangerCallback == nil {
+				//
+				// Should never happen.
+				//
+				chatChannelState.logger.With("doppelganger_id", theMessage.doppelgangerID, "user_id", theMessage.userID).Error("theMessage.doppelgangerCallback == nil")
+				return false // Try to keep server up.
+			}
+			chatChannelState.watch.sendFromChatChannelToDoppelganger(theMessage.doppelgangerCallback, newMsg, theMessage.doppelgangerID)
+			//
+			// Add user to the chat channel's member list.
+			//
+			var entryForList userEntry
+			entryForList.userID = theMessage.userID
+			entryForList.userName = theMessage.userName
+			entryForList.doppelgangerCallback = theMessage.doppelgangerCallback
+			entryForList.textQueue = theMessage.doppelgangerTextQueue
+			chatChannelState.memberList[theMessage.doppelgangerID] = entryForList
+			//
+			// Tell the user who else is on the channel
+			//
+			tellWhoIsOnChannel(chatChannelState, theMessage.doppelgangerID, theMessage.doppelgangerCallback)
+			//
+			// Tell everyone else a new user has joined the channel
+			//
+			for doppelgangerID, memberInfo := range chatChannelState.memberList {
+				if memberInfo.userID != theMessage.userID {
+					var announceMsg messageFromChatChannelToDoppelganger
+					announceMsg.operation = fromChatChannelToDoppelgangerOpTextMessage
+					announceMsg.originator = 0 // special value that means nobody -- this message is from the channel itself
+					announceMsg.chatChannelID = chatChannelState.chatChannelID
+					if chatChannelState.chatChannelID == 0 {
+						//
+						// Should never happen.
+						//
+						chatChannelState.logger.Error("chatChannelState.chatChannelID == 0")
+						return false // Try to keep server up.
+					}
+					announceMsg.parameter = theMessage.userName + " has joined #" + chatChannelState.chatChannelName
+					announceMsg.machineLine = "JOIN #" + chatChannelState.chatChannelName + " " + theMessage.userName
+					announceMsg.chatChannelCallback = chatChannelState.incomingFromDoppelganger
+					if announceMsg.chatChannelCallback == nil {
+						//
+						// Should never happen.
+						//
+						chatChannelState.logger.Error("announceMsg.chatChannelCallback == nil")
+						return false // Try to keep server up.
+					}
+					queueTextForMember(chatChannelState, doppelgangerID, announceMsg)
+				}
+			}
+			logConversationMessage(chatChannelState.logger, chatChannelState.convoLog, timeNow()+" <"+theMessage.userName+" has JOINED #"+chatChannelState.chatChannelName+">\n")
+			emitChatChannelEvent(chatChannelState, "join", theMessage.userID, theMessage.userName)
+			user := User{ID: theMessage.userID, Name: theMessage.userName}
+			for _, reply := range pluginsOnJoin(chatChannelState.chatServer.plugins, chatChannelOf(chatChannelState), user) {
+				sendTextToEveryoneInChatChannel(chatChannelState, 0, reply, machineLine("NOTICE #"+chatChannelState.chatChannelName, reply))
+				rememberChatText(chatChannelState, "", reply, "")
+			}
+		}
+	case fromChannelMasterToChatChanOpWho:
+		tellWhoIsOnChannel(chatChannelState, theMessage.doppelgangerID, theMessage.doppelgangerCallback)
+	case fromChannelMasterToChatChanOpExit:
+		//
+		// Tell everyone user has left
+		//
+		for doppelgangerID, memberInfo := range chatChannelState.memberList {
+			var announceMsg messageFromChatChannelToDoppelganger
+			announceMsg.operation = fromChatChannelToDoppelgangerOpTextExit
+			announceMsg.originator = 0 // special value that means nobody -- this message is from the channel itself
+			announceMsg.chatChannelID = chatChannelState.chatChannelID
+			announceMsg.leavingDoppelgangerID = theMessage.doppelgangerID
+			if chatChannelState.chatChannelID == 0 {
+				//
+				// Should never happen.
+				//
+				chatChannelState.logger.Error("chatChannelState.chatChannelID == 0")
+				return false // Try to keep server up.
+			}
+			if memberInfo.userID == theMessage.userID {
+				announceMsg.parameter = "You left #" + chatChannelState.chatChannelName
+			} else {
+				announceMsg.parameter = theMessage.userName + " has left #" + chatChannelState.chatChannelName
+			}
+			announceMsg.machineLine = "PART #" + chatChannelState.chatChannelName + " " + theMessage.userName
+			announceMsg.chatChannelCallback = chatChannelState.incomingFromDoppelganger
+			if announceMsg.chatChannelCallback == nil {
+				//
+				// Should never happen.
+				//
+				chatChannelState.logger.Error("announceMsg.chatChannelCallback == nil")
+				return false // Try to keep server up.
+			}
+			if memberInfo.doppelgangerCallback == nil {
+				//
+				// Should never happen.
+				//
+				chatChannelState.logger.With("user_id", memberInfo.userID).Error("memberInfo.doppelgangerCallback == nil")
+			}
+			time.Sleep(10) // 10 nanoseconds -- we just want to give other goroutines a chance to run here
+			if doppelgangerID == theMessage.doppelgangerID {
+				//
+				// The leaving doppelganger is waiting for this one, so it
+				// can't be thrown away.
+				//
+				chatChannelState.watch.sendFromChatChannelToDoppelganger(memberInfo.doppelgangerCallback, announceMsg, doppelgangerID)
+			} else {
+				queueTextForMember(chatChannelState, doppelgangerID, announceMsg)
+			}
+		}
+		logConversationMessage(chatChannelState.logger, chatChannelState.convoLog, timeNow()+" <"+theMessage.userName+" has EXITED #"+chatChannelState.chatChannelName+">\n")
+		delete(chatChannelState.memberList, theMessage.doppelgangerID)
+		emitChatChannelEvent(chatChannelState, "exit", theMessage.userID, theMessage.userName)
+		pluginsOnExit(chatChannelState.chatServer.plugins, chatChannelOf(chatChannelState), User{ID: theMessage.userID, Name: theMessage.userName})
+	case fromChannelMasterToChatChanOpSettings:
+		//
+		// Settings were reloaded. The new member limit applies to the next
+		// join (nobody already on the channel gets kicked off if it went
+		// down). We always reopen the conversation log: the log directory
+		// may have changed, and if it didn't, this lets whoever rotates
+		// the logs move the old file out of the way and then send SIGHUP.
+		//
+		chatChannelState.settings = theMessage.settings
+		closeConversationLog(chatChannelState.logger, chatChannelState.convoLog)
+		err := openConversationLog(chatChannelState)
+		if err != nil {
+			//
+			// Keep the server up -- logConversationMessage will log the
+			// write errors until the next reload fixes things.
+			//
+			chatChannelState.logger.With("error", err).Error("reopening conversation log")
+		}
+	case fromChannelMasterToChatChanOpMetrics:
+		//
+		// The metrics endpoint wants our numbers. The channel master made
+		// the callback big enough for every chat channel, so this never
+		// blocks.
+		//
+		var reply chatChannelMetrics
+		reply.chatChannelID = chatChannelState.chatChannelID
+		reply.chatChannelName = chatChannelState.chatChannelName
+		reply.members = len(chatChannelState.memberList)
+		reply.messageCount = chatChannelState.messageCount
+		reply.droppedMessages = chatChannelState.droppedMessages
+		reply.queueLength = len(chatChannelState.incomingFromDoppelganger)
+		reply.queueCapacity = cap(chatChannelState.incomingFromDoppelganger)
+		theMessage.metricsCallback <- reply
+	case fromChannelMasterToChatChanOpMembers:
+		//
+		// The admin console wants our member list. Same deal as the
+		// metrics: the callback has room for every chat channel.
+		//
+		var reply adminChatChannelMembers
+		reply.chatChannelID = chatChannelState.chatChannelID
+		reply.chatChannelName = chatChannelState.chatChannelName
+		reply.members = make([]adminMemberEntry, 0, len(chatChannelState.memberList))
+		for doppelgangerID, memberInfo := range chatChannelState.memberList {
+			reply.members = append(reply.members, adminMemberEntry{doppelgangerID: doppelgangerID, userID: memberInfo.userID, userName: memberInfo.userName})
+		}
+		theMessage.adminCallback <- reply
+	case fromChannelMasterToChatChanOpHistory:
+		//
+		// The API wants what we remember. The channel master made the
+		// callback just for us, so this never blocks either.
+		//
+		var reply apiChatChannelReply
+		reply.chatChannelID = chatChannelState.chatChannelID
+		reply.running = true
+		reply.history = latestHistory(chatChannelState.history, theMessage.limit)
+		theMessage.apiCallback <- reply
+	case fromChannelMasterToChatChanOpPost:
+		//
+		// Someone saying something through the API. They're not a member,
+		// but otherwise it's the same as chat text from one.
+		//
+		if chatChannelState.startFailed {
+			var reply apiChatChannelReply
+			reply.chatChannelID = chatChannelState.chatChannelID
+			reply.running = true
+			reply.failed = true
+			theMessage.apiCallback <- reply
+			break
+		}
+		chatChannelState.messageCount++
+		var textMessage messageFromDoppelgangerToChatChannel
+		textMessage.operation = fromDoppelgangerToChatChannelOpTextMessage
+		textMessage.userID = theMessage.userID
+		textMessage.doppelgangerID = 0
+		textMessage.parameter = theMessage.parameter
+		textMessage.said = theMessage.said
+		var reply apiChatChannelReply
+		reply.chatChannelID = chatChannelState.chatChannelID
+		reply.running = true
+		reply.vetoed = !distributeMessageToEveryoneInChatChannel(chatChannelState, textMessage, theMessage.userName)
+		theMessage.apiCallback <- reply
+	case fromChannelMasterToChatChanOpMoved:
+		//
+		// Another node in the cluster owns us now. Everyone on the channel
+		// is told to exit and join again, which takes them there; the
+		// shard shuts us down when the last one is gone. Members that are
+		// really cluster member goroutines pass it on to the user's node.
+		//
+		chatChannelState.logger.With("members", len(chatChannelState.memberList)).Info("Chat channel moved to another cluster node, telling the members.")
+		for doppelgangerID, memberInfo := range chatChannelState.memberList {
+			var movedMsg messageFromChatChannelToDoppelganger
+			movedMsg.operation = fromChatChannelToDoppelgangerOpMoved
+			movedMsg.originator = 0 // special value that means nobody -- this message is from the channel itself
+			movedMsg.chatChannelID = chatChannelState.chatChannelID
+			movedMsg.leavingDoppelgangerID = 0
+			movedMsg.parameter = chatChannelState.chatChannelName
+			movedMsg.chatChannelCallback = chatChannelState.incomingFromDoppelganger
+			chatChannelState.watch.sendFromChatChannelToDoppelganger(memberInfo.doppelgangerCallback, movedMsg, doppelgangerID)
+		}
+	case fromChannelMasterToChatChanOpShutdown:
+		//
+		// Return true will signal that the whole goroutine should exit and free
+		// up all our channels for the garbage collector.
+		//
+		return true
+	default:
+		//
+		// Should never happen.
+		//
+		chatChannelState.logger.With("operation", theMessage.operation).Error("unrecognized case for operation from channel master")
+	}
+	return false
+}
+
+func tellWhoIsOnChannel(chatChannelState *chatChannelInfo, doppelgangerID int64, doppelgangerCallback chan messageFromChatChannelToDoppelganger) {
+	memberStr := ""
+	machineWho := "WHO #" + chatChannelState.chatChannelName
+	for _, memberInfo := range chatChannelState.memberList {
+		memberStr += ", " + memberInfo.userName
+		machineWho += " " + memberInfo.userName
+	}
+	var whoMsg messageFromChatChannelToDoppelganger
+	whoMsg.operation = fromChatChannelToDoppelgangerOpTextMessage
+	whoMsg.originator = 0 // special value that means nobody -- this message is from the channel itself
+	if chatChannelState.chatChannelID == 0 {
+		//
+		// Should never happen.
+		//
+		chatChannelState.logger.Error("chatChannelState.chatChannelID == 0")
+		return // Try to keep server up.
+	}
+	whoMsg.chatChannelID = chatChannelState.chatChannelID
+	whoMsg.leavingDoppelgangerID = 0
+	whoMsg.parameter = "On this channel: " + memberStr[2:]
+	whoMsg.machineLine = machineWho
+	whoMsg.chatChannelCallback = chatChannelState.incomingFromDoppelganger
+	if whoMsg.chatChannelCallback == nil {
+		//
+		// Should never happen.
+		//
+		chatChannelState.logger.Error("whoMsg.chatChannelCallback == nil")
+		return // Try to keep server up.
+	}
+	if doppelgangerCallback == nil {
+		//
+		// Should never happen.
+		//
+		chatChannelState.logger.Error("doppelgangerCallback == nil")
+		return // Try to keep server up.
+	}
+	chatChannelState.watch.sendFromChatChannelToDoppelganger(doppelgangerCallback, whoMsg, doppelgangerID)
+}
+
+//
+// START logging the conversation! If the file doesn't exist, create it. If
+// it does exist, append to the file. The log directory comes from the
+// settings.
+//
+func openConversationLog(chatChannelState *chatChannelInfo) error {
+	var err error
+	chatChannelState.convoLog, err = chatChannelState.chatServer.store.openConversationLog(chatChannelState.settings.logDir, chatChannelState.chatChannelName)
+	return err
+}
+
+// We do this close as a separate function, rather than just "defer close", so we can catch and log errors.
+func closeConversationLog(logger *Logger, convoLog conversationLog) {
+	if convoLog == nil {
+		//
+		// Reopening it after a reload failed, and we already logged that.
+		//
+		return
+	}
+	err := convoLog.close()
+	if err != nil {
+		//
+		// We don't use Fatal because we want to keep the server up and server
+		// users as much as possible. But we log the error so we know about it
+		// and can fix it.
+		//
+		logger.With("error", err).Error("Closing conversation log failed.")
+	}
+}
+
+//
+// Last thing a chat channel goroutine does before it's gone: let the channel
+// master (our shard of it) know. By the time this runs (it's deferred before
+// the conversation log close, so it runs after), the conversation log is
+// closed, which is what the channel master is waiting to hear when the
+// server is shutting down.
+//
+func notifyChannelMasterOfShutdown(chatServer *ChatServer, logger *Logger, watch *stallWatch, chatChannelID int64, messageCount int64, droppedMessages int64, history []chatHistoryEntry) {
+	var doneMsg messageFromChatChannelToChannelMaster
+	doneMsg.operation = fromChatChannelToChannelMasterOpShutdownComplete
+	doneMsg.userID = 0
+	doneMsg.doppelgangerID = 0
+	doneMsg.chatChannelID = chatChannelID
+	doneMsg.messageCount = messageCount
+	doneMsg.droppedMessages = droppedMessages
+	doneMsg.history = history
+	watch.sendFromChatChannelToChannelMaster(shardForChatChannel(chatServer, chatChannelID).fromChatChannel, doneMsg)
+}
+
+//
+// Chat text from a member. The plugins (see plugin.go) get it first, and
+// can change it, keep it from going out, and say things of their own after
+// it. If it's kept from going out, the member who said it is told, since
+// their doppelganger is waiting for it to come back. Returns whether it went
+// out.
+//
+func distributeMessageToEveryoneInChatChannel(chatChannelState *chatChannelInfo, theMessage messageFromDoppelgangerToChatChannel, userName string) bool {
+	var message Message
+	message.ChatChannel = chatChannelOf(chatChannelState)
+	message.User.ID = theMessage.userID
+	message.User.Name = userName
+	message.Text = theMessage.parameter
+	message.Said = theMessage.said
+	pluginsOnMessage(chatChannelState.chatServer.plugins, &message)
+	if message.Veto {
+		chatChannelState.logger.With("doppelganger_id", theMessage.doppelgangerID, "user_id", theMessage.userID).Debug("Message vetoed by a plugin.")
+		var vetoMsg messageFromChatChannelToDoppelganger
+		vetoMsg.operation = fromChatChannelToDoppelgangerOpTextMessage
+		vetoMsg.originator = theMessage.userID
+		vetoMsg.chatChannelID = chatChannelState.chatChannelID
+		vetoMsg.leavingDoppelgangerID = 0
+		vetoMsg.parameter = "(Your message was not sent.)"
+		vetoMsg.machineLine = "ERR Your message was not sent."
+		queueTextForMember(chatChannelState, theMessage.doppelgangerID, vetoMsg)
+	} else {
+		sendTextToEveryoneInChatChannel(chatChannelState, theMessage.userID, message.Text, machineChatLine(&message))
+		rememberChatText(chatChannelState, message.User.Name, message.Text, message.Said)
+		var event chatEvent
+		event.Type = "message"
+		event.Channel = chatChannelState.chatChannelName
+		event.ChannelID = chatChannelState.chatChannelID
+		event.User = message.User.Name
+		event.UserID = message.User.ID
+		event.Text = message.Text
+		event.Said = message.Said
+		chatChannelState.chatServer.events.emit(event)
+	}
+	for _, reply := range message.Replies {
+		sendTextToEveryoneInChatChannel(chatChannelState, 0, reply, machineLine("NOTICE #"+chatChannelState.chatChannelName, reply))
+		rememberChatText(chatChannelState, "", reply, "")
+	}
+	return !message.Veto
+}
+
+//
+// Sends a line of chat text to every member and puts it in the conversation
+// log. originator is the user who said it, or 0 for the chat channel itself.
+// machineLine is the same thing for members in machine mode (see
+// machinemode.go).
+//
+func sendTextToEveryoneInChatChannel(chatChannelState *chatChannelInfo, originator int64, text string, machineLine string) {
+	for doppelgangerID := range chatChannelState.memberList {
+		var newMsg messageFromChatChannelToDoppelganger
+		newMsg.operation = fromChatChannelToDoppelgangerOpTextMessage
+		newMsg.originator = originator
+		newMsg.chatChannelID = chatChannelState.chatChannelID
+		newMsg.leavingDoppelgangerID = 0
+		newMsg.parameter = text
+		newMsg.machineLine = machineLine
+		queueTextForMember(chatChannelState, doppelgangerID, newMsg)
+	}
+	logConversationMessage(chatChannelState.logger, chatChannelState.convoLog, timeNow()+" "+text+"\n")
+}
+
+//
+// Keeps the latest chat_history lines of chat text, for the API. Joins and
+// exits aren't kept, just what was said.
+//
+func rememberChatText(chatChannelState *chatChannelInfo, userName string, text string, said string) {
+	historySize := chatChannelState.chatServer.config.ChatHistory
+	if historySize == 0 {
+		return
+	}
+	var entry chatHistoryEntry
+	entry.when = time.Now()
+	entry.userName = userName
+	entry.text = text
+	entry.said = said
+	if len(chatChannelState.history) >= historySize {
+		//
+		// Full: the oldest goes. The API only ever gets copies (see
+		// latestHistory), so moving everything along is safe.
+		//
+		chatChannelState.history = chatChannelState.history[len(chatChannelState.history)-historySize:]
+		copy(chatChannelState.history, chatChannelState.history[1:])
+		chatChannelState.history[historySize-1] = entry
+		return
+	}
+	chatChannelState.history = append(chatChannelState.history, entry)
+}
+
+//
+// The latest limit entries of history, or all of them if limit is 0.
+//
+func latestHistory(history []chatHistoryEntry, limit int) []chatHistoryEntry {
+	if (limit > 0) && (len(history) > limit) {
+		history = history[len(history)-limit:]
+	}
+	return append(make([]chatHistoryEntry, 0, len(history)), history...)
+}
+
+//
+// Joins and exits, for the event sink (see eventsink.go).
+//
+func emitChatChannelEvent(chatChannelState *chatChannelInfo, eventType string, userID int64, userName string) {
+	var event chatEvent
+	event.Type = eventType
+	event.Channel = chatChannelState.chatChannelName
+	event.ChannelID = chatChannelState.chatChannelID
+	event.User = userName
+	event.UserID = userID
+	chatChannelState.chatServer.events.emit(event)
+}
+
+func chatChannelOf(chatChannelState *chatChannelInfo) ChatChannel {
+	return ChatChannel{ID: chatChannelState.chatChannelID, Name: chatChannelState.chatChannelName}
+}
+
+//
+// Puts a message on a member's text queue. We never wait here: one member
+// whose client isn't reading must not hold up the chat channel for everyone
+// else. If their queue is full, the slow member policy decides what gives.
+// Either we throw away the oldest message waiting for them (their
+// doppelganger sees the gap in the sequence numbers and tells them how many
+// they missed), or we stop sending them anything and ask the channel master
+// to hang up on them.
+//
+func queueTextForMember(chatChannelState *chatChannelInfo, doppelgangerID int64, theMessage messageFromChatChannelToDoppelganger) {
+	memberInfo, exists := chatChannelState.memberList[doppelgangerID]
+	if !exists || memberInfo.slow {
+		return
+	}
+	if memberInfo.textQueue == nil {
+		//
+		// Should never happen.
+		//
+		chatChannelState.logger.With("doppelganger_id", doppelgangerID, "user_id", memberInfo.userID).Error("memberInfo.textQueue == nil")
+		return // Try to keep server up.
+	}
+	memberInfo.textSequence++
+	theMessage.sequence = memberInfo.textSequence
+	chatChannelState.memberList[doppelgangerID] = memberInfo
+	select {
+	case memberInfo.textQueue <- theMessage:
+		return
+	default:
+	}
+	if chatChannelState.settings.slowMemberDisconnect {
+		chatChannelState.droppedMessages++
+		memberInfo.slow = true
+		chatChannelState.memberList[doppelgangerID] = memberInfo
+		chatChannelState.logger.With("doppelganger_id", doppelgangerID, "user_id", memberInfo.userID, "user_name", memberInfo.userName).Info("Member can't keep up, asking the channel master to disconnect them.")
+		var slowMsg messageFromChatChannelToChannelMaster
+		slowMsg.operation = fromChatChannelToChannelMasterOpSlowMember
+		slowMsg.userID = memberInfo.userID
+		slowMsg.doppelgangerID = doppelgangerID
+		slowMsg.chatChannelID = chatChannelState.chatChannelID
+		if chatChannelState.chatServer.chanMasterFromChatChannelGoChan == nil {
+			//
+			// Should never happen.
+			//
+			chatChannelState.logger.Error("chanMasterFromChatChannelGoChan == nil")
+			return // Try to keep server up.
+		}
+		chatChannelState.watch.sendFromChatChannelToChannelMaster(chatChannelState.chatServer.chanMasterFromChatChannelGoChan, slowMsg)
+		return
+	}
+	//
+	// Drop the oldest. Nobody but us puts anything on a member's text
+	// queue while they're on our channel, so once we've taken one off
+	// there's room -- but we still don't wait, in case the doppelganger got
+	// there first.
+	//
+	select {
+	case <-memberInfo.textQueue:
+		chatChannelState.droppedMessages++
+	default:
+	}
+	select {
+	case memberInfo.textQueue <- theMessage:
+	default:
+		chatChannelState.droppedMessages++
+	}
+}
+
+func logConversationMessage(logger *Logger, convoLog conversationLog, message string) {
+	var err error
+	if convoLog == nil {
+		//
+		// Reopening it after a reload failed.
+		//
+		err = errors.New("conversation log is not open")
+	} else {
+		err = convoLog.appendMessage(message)
+	}
+	if err != nil {
+		//
+		// We log the error so we know about it, but otherwise do everything we
+		// can to keep the server up and running and giving users the service
+		// they expect.
+		//
+		logger.With("error", err).Error("Writing conversation log failed.")
+	}
+}
+
+//
+// DO IT
+// Goroutine for chat channels
+//
+
+func chatChannelGoRoutine(chatServer *ChatServer, chatChannelID int64, chatChannelName string, settings liveSettings, firstMessage messageFromChannelMasterToChatChannel, incomingFromChannelMaster chan messageFromChannelMasterToChatChannel) {
+	//
+	// Now we set up our own state and process the first message, which is
+	// passed in because receiving it on a channel would just mean another
+	// unnecessary trip through the channelmaster's select-loop.
+	//
+	var chatChannelState chatChannelInfo
+	chatChannelState.chatServer = chatServer
+	chatChannelState.chatChannelID = chatChannelID
+	chatChannelState.chatChannelName = chatChannelName
+	chatChannelState.settings = settings
+	chatChannelState.logger = chatServer.logger.With("goroutine", "chat_channel", "channel_id", chatChannelID, "channel", chatChannelName)
+	chatChannelState.watch = chatServer.stallWatchdog.watch(chatChannelState.logger)
+	defer chatServer.stallWatchdog.unwatch(chatChannelState.watch)
+	//
+	// memberList originally mapped userID's to user info, but, that
+	// prevented the same user ID from being in the list more than once. I
+	// tried putting the same user ID in the memberList twice by changing it
+	// from a map to a list, but when a user exited a chat channel, we had
+	// no way of telling the two entries apart. To solve this, we assign
+	// doppelganger IDs to the doppelgangers, and even if we have two
+	// doppelgangers with the same user ID, we can tell them apart. The
+	// memberList was switched back to a map, but this time going from
+	// doppelganger IDs to user info.
+	//
+	chatChannelState.memberList = make(map[int64]userEntry)
+	//
+	// Whatever we remembered the last time we were running, from our shard.
+	//
+	chatChannelState.history = firstMessage.history
+	//
+	// Buffer size per number of users in channel -- you can lower this in the
+	// config if you lower the channel limit.
+	//
+	chatChannelState.incomingFromDoppelganger = make(chan messageFromDoppelgangerToChatChannel, chatServer.config.ChatChannelQueue)
+	//
+	// START logging the conversation!
+	//
+	err := openConversationLog(&chatChannelState)
+	if err != nil {
+		chatChannelState.logger.With("error", err).Error("Opening conversation log failed, turning everyone away.")
+		chatChannelState.startFailed = true
+	}
+	//
+	// Deferred first so it runs last, after the log is closed. A closure so
+	// it reports the final message counts.
+	//
+	defer func() {
+		notifyChannelMasterOfShutdown(chatServer, chatChannelState.logger, chatChannelState.watch, chatChannelID, chatChannelState.messageCount, chatChannelState.droppedMessages, chatChannelState.history)
+	}()
+	//
+	// We do this close as a separate function, rather than just "defer
+	// close", so we can catch and log errors. It's a closure so it closes
+	// whatever log file is open at the end -- reloading settings reopens
+	// the log.
+	//
+	defer func() {
+		closeConversationLog(chatChannelState.logger, chatChannelState.convoLog)
+	}()
+	shutdown := processMessageFromChannelMaster(&chatChannelState, firstMessage)
+	if shutdown {
+		//
+		// It would actually be pretty bizarre if the first message was a
+		// shutdown message -- it should be impossible to end up in here...
+		//
+		close(incomingFromChannelMaster)
+		close(chatChannelState.incomingFromDoppelganger)
+		return
+	}
+	//
+	// Now we go into our own select-loop to process messages from the
+	// channel master or from users.
+	//
+	for {
+		select {
+		case theMessage, ok := <-incomingFromChannelMaster:
+			if !ok {
+				//
+				// Whoa! The channel is closed. What to do? We don't know.
+				// Log and bail.
+				//
+				chatChannelState.logger.Error("incomingFromChannelMaster has unexpectedly closed!")
+				close(incomingFromChannelMaster)
+				close(chatChannelState.incomingFromDoppelganger)
+				return
+			}
+			//
+			// We have to pass off to a function here because we have to
+			// be able to call the same function on the first message.
+			//
+			shutdown = processMessageFromChannelMaster(&chatChannelState, theMessage)
+			if shutdown {
+				close(incomingFromChannelMaster)
+				if len(chatChannelState.memberList) != 0 {
+					//
+					// This happens when the server is shutting down and
+					// not everyone left in time. The members' doppelgangers
+					// still have our go channel, so we must not close it --
+					// a send on a closed go channel would crash the server
+					// in the middle of shutting down.
+					//
+					chatChannelState.logger.With("members", len(chatChannelState.memberList)).Warn("Chat channel exited without empty member list!")
+					return
+				}
+				close(chatChannelState.incomingFromDoppelganger)
+				return
+			}
+		case theMessage, ok := <-chatChannelState.incomingFromDoppelganger:
+			if !ok {
+				//
+				// Whoa! The channel is closed. What to do? We don't know. Log and bail.
+				//
+				chatChannelState.logger.Error("incomingFromDoppelganger has unexpectedly closed!")
+				close(incomingFromChannelMaster)
+				close(chatChannelState.incomingFromDoppelganger)
+				return
+			}
+			switch theMessage.operation {
+			case fromDoppelgangerToChatChannelOpTextMessage:
+				chatChannelState.messageCount++
+				distributeMessageToEveryoneInChatChannel(&chatChannelState, theMessage, chatChannelState.memberList[theMessage.doppelgangerID].userName)
+			default:
+				//
+				// Should never happen.
+				//
+				chatChannelState.logger.With("operation", theMessage.operation).Error("Unexpected message operation code from doppelganger")
+			}
+		}
+	}
+}
@@ -0,0 +1,540 @@
+package chatserver
+
+import (
+	"context"
+	"errors"
+	"go-telnet-mod"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// The chat server as something a Go program can hold on to. The daemon
+// (daemon/wtelnet.go) is one such program: it loads a Config, makes a
+// ChatServer with New, opens the listeners the config asks for, hands them
+// to Serve, and calls Reload on SIGHUP and Shutdown on SIGTERM. A program
+// embedding the chat server does the same with listeners and a Config of
+// its own.
+//
+// A ChatServer is what used to be the package-level globals: the things
+// there's only one of per server -- one storage (see storage.go), one
+// channel master (and its shards, which are made once in New and never
+// change), one stall watchdog, one cluster (nil if we're not in one; see
+// cluster.go) and one event sink (likewise; see eventsink.go). They're set
+// up in New before any goroutine starts and never changed after that, so
+// every goroutine reads them without going through an owner. Each
+// goroutine gets the ChatServer as a parameter; the doppelgangers get it
+// from the chatHandler the telnet server calls. The config is read-only too
+// (settings that can be reloaded live in liveSettings instead).
+//
+// Two ChatServers in one process don't share anything but the logger, if
+// they're given the same one.
+//
+// stop is closed by Shutdown once everything else is done. The goroutines
+// that run for as long as the server does -- the stall watchdog, the
+// channel master and its shards, and the cluster's peer and link goroutines
+// -- return when it is, so nothing of a ChatServer is left running after
+// Shutdown.
+//
+
+type ChatServer struct {
+	config                           Config
+	logger                           *Logger
+	store                            storage
+	chanMasterFromDoppelgangerGoChan chan messageFromDoppelgangerToChannelMaster
+	chanMasterFromChatChannelGoChan  chan messageFromChatChannelToChannelMaster
+	chanMasterMetrics                chan messageFromMetricsToChannelMaster
+	chanMasterFromMain               chan messageFromMainToChannelMaster
+	chanMasterFromAPI                chan messageFromAPIToChannelMaster
+	channelMasterShards              []*channelMasterShard
+	stallWatchdog                    *stallWatchdog
+	stop                             chan struct{}
+	cluster                          *clusterInfo
+	events                           *eventSink
+	plugins                          []Plugin
+	doppelgangers                    sync.WaitGroup
+	telnetServer                     *telnet.Server
+	adminServer                      *telnet.Server
+	ircServer                        *telnet.Server
+	sshServer                        *telnet.Server
+	//
+	// Only Reload, Shutdown and the Serve methods use these, from whatever
+	// goroutine the program calls them on, hence the mutex. currentConfig is
+	// the last config Reload was given, to tell it which changed settings
+	// need a restart. sshConfig is made the first time ServeSSH is called.
+	//
+	mutex            sync.Mutex
+	ownLogger        bool
+	currentConfig    Config
+	clusterListeners []net.Listener
+	shutDown         bool
+	sshConfig        *ssh.ServerConfig
+}
+
+//
+// Things the program embedding the chat server can hand it. All of them are
+// optional.
+//
+// Logger is where the server logs to. If it's nil, the server makes its own,
+// writing to stderr with the level and format in the config (and changes
+// them on Reload). A Logger that's passed in is the caller's to Configure.
+//
+// Plugins (see plugin.go) are called, in order, after the built-in ones the
+// config names.
+//
+type Hooks struct {
+	Logger  *Logger
+	Plugins []Plugin
+}
+
+//
+// What Serve, ServeTLS, ServeAdmin, ServeIRC and ServeSSH return once
+// Shutdown has closed them, as opposed to a listener failing.
+//
+var ErrServerClosed = telnet.ErrServerClosed
+
+//
+// Makes a chat server with config: opens the database (creating it if it
+// doesn't exist, and bringing its schema up to date if it does) and starts
+// the channel master and everything behind it, and the cluster if config
+// asks for one. It doesn't listen anywhere -- that's Serve and friends. If
+// the config or the database is no good, nothing is started and the error
+// says why.
+//
+func New(config Config, hooks Hooks) (*ChatServer, error) {
+	err := validateConfig(&config, false)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := buildLiveSettings(config)
+	if err != nil {
+		return nil, errors.New("problem reading MOTD file: " + err.Error())
+	}
+	plugins, err := registerPlugins(config, hooks)
+	if err != nil {
+		return nil, err
+	}
+	chatServer := new(ChatServer)
+	chatServer.config = config
+	chatServer.plugins = plugins
+	chatServer.currentConfig = config
+	chatServer.logger = hooks.Logger
+	if chatServer.logger == nil {
+		chatServer.logger = NewLogger(os.Stderr)
+		chatServer.logger.Configure(os.Stderr, config)
+		chatServer.ownLogger = true
+	}
+	//
+	// Step 1, connect to our database. Create it if it doesn't exist, and
+	// bring its schema up to date if it does.
+	//
+	chatServer.store, err = openSQLiteStorage(config, chatServer.logger)
+	if err != nil {
+		return nil, errors.New("problem starting database: " + err.Error())
+	}
+	//
+	// The stall watchdog has to exist before any goroutine that sends to
+	// another one starts, because each of them gets a stallWatch from it.
+	//
+	chatServer.stallWatchdog = newStallWatchdog()
+	chatServer.stop = make(chan struct{})
+	if config.StallThresholdSeconds > 0 {
+		go stallWatchdogGoroutine(chatServer.stallWatchdog, time.Duration(config.StallThresholdSeconds)*time.Second, config.StallStackDumpDir, chatServer.logger, chatServer.stop)
+	}
+
+	//
+	// The event sink, if there is one, likewise, since the channel master
+	// and the chat channels send to it.
+	//
+	chatServer.events = startEventSink(config, chatServer.logger)
+	//
+	// Step 2, create channelMaster goroutine, the master goroutine for
+	// coordinating joining channels. But first we create the go channels
+	// other goroutines will use to talk with the channelMaster. The one
+	// from the doppelgangers goes in the ChatServer so the telnet handler
+	// that answers incomming connections, and its doppelganger, will be
+	// able to grab it and talk to the channelMaster.
+	//
+	// Buffer here needs to be big enough for all the users simultaneously
+	// on the system -- if you know typical usage is lower, you can lower
+	// the buffer size in the config.
+	//
+	chatServer.chanMasterFromDoppelgangerGoChan = make(chan messageFromDoppelgangerToChannelMaster, config.ChannelMasterDoppelgangerQueue)
+	//
+	// Buffer here needs to be big enough for all the channels that will be
+	// simultaneously in use -- if you know typical usage is lower, you can
+	// lower the buffer size in the config.
+	//
+	chatServer.chanMasterFromChatChannelGoChan = make(chan messageFromChatChannelToChannelMaster, config.ChannelMasterChatChannelQueue)
+	//
+	// NO buffer here because there is no cycle between the metrics endpoint
+	// and the channel master goroutine -- the channel master answers on a
+	// buffered callback, and the metrics endpoint gives up if the channel
+	// master doesn't take the request in time.
+	//
+	chatServer.chanMasterMetrics = make(chan messageFromMetricsToChannelMaster)
+	//
+	// NO buffer here either -- Reload and Shutdown only talk to the channel
+	// master when reloading settings or shutting down, and nothing ever
+	// sends to them from the channel master except on a callback they're
+	// waiting on.
+	//
+	chatServer.chanMasterFromMain = make(chan messageFromMainToChannelMaster)
+	//
+	// NO buffer for the admin console, for the same reason as the metrics
+	// endpoint.
+	//
+	chanMasterFromAdmin := make(chan messageFromAdminToChannelMaster)
+	//
+	// Or the API.
+	//
+	chatServer.chanMasterFromAPI = make(chan messageFromAPIToChannelMaster)
+	//
+	// The channel master's shards, which keep the running chat channels,
+	// have to be up before the channel master, which passes things on to
+	// them, and before any doppelganger, which asks them to join.
+	//
+	startChannelMasterShards(chatServer, settings)
+	//
+	// Launch channelMaster.
+	//
+	go channelMasterGoroutine(chatServer, settings, chatServer.chanMasterFromDoppelgangerGoChan, chatServer.chanMasterFromChatChannelGoChan, chatServer.chanMasterMetrics, chanMasterFromAdmin, chatServer.chanMasterFromAPI, chatServer.chanMasterFromMain)
+	//
+	// If we're in a cluster, start talking to the other nodes. Same as the
+	// shards, this has to happen before any doppelganger asks where a chat
+	// channel lives.
+	//
+	startCluster(chatServer)
+	if chatServer.cluster != nil {
+		chatServer.logger.With("cluster_node", chatServer.cluster.self, "cluster_listen", config.ClusterListen, "peers", len(chatServer.cluster.peers)).Info("Clustering on.")
+	}
+	//
+	// Step 3, the telnet server for the users. All the listeners given to
+	// Serve share it, so the connection limits are for the whole server,
+	// not per port.
+	//
+	chatServer.telnetServer = &telnet.Server{
+		Handler: chatHandler{chatServer: chatServer},
+		Logger:  chatServer.logger.With("goroutine", "telnet"),
+		//
+		// -1 (off) stays negative, which is how telnet.Server wants "off".
+		//
+		KeepAlivePeriod:           time.Duration(config.TCPKeepaliveSeconds) * time.Second,
+		MaxConnections:            config.MaxConnections,
+		MaxConnectionsPerIP:       config.MaxConnectionsPerIP,
+		PerIPRate:                 float64(config.NewConnectionsPerIPPerMinute) / 60,
+		PerIPBurst:                config.NewConnectionsPerIPPerMinute,
+		AcceptRate:                float64(config.AcceptPerSecond),
+		AcceptBurst:               config.AcceptPerSecond,
+		MaxAcceptBackoff:          time.Duration(config.AcceptRetrySeconds) * time.Second,
+		ServerFullMessage:         config.ServerFullMessage + "\r\n",
+		TooManyConnectionsMessage: config.TooManyConnectionsMessage + "\r\n",
+		//
+		// So we know who can be sent colors (see colortheme.go).
+		//
+		AskTerminalType: true,
+	}
+	//
+	// The admin console gets a telnet server of its own so the connection
+	// limits for users don't apply to it.
+	//
+	chatServer.adminServer = &telnet.Server{
+		Handler: newAdminShell(chatServer, chanMasterFromAdmin),
+		Logger:  chatServer.logger.With("goroutine", "admin"),
+	}
+	//
+	// And the IRC gateway one, though it only uses it for its connection
+	// handling (see ircgateway.go). It gets the same limits as Telnet, but
+	// counted separately.
+	//
+	chatServer.ircServer = &telnet.Server{
+		Handler:                   ircHandler{chatServer: chatServer},
+		Logger:                    chatServer.logger.With("goroutine", "irc"),
+		KeepAlivePeriod:           time.Duration(config.TCPKeepaliveSeconds) * time.Second,
+		MaxConnections:            config.MaxConnections,
+		MaxConnectionsPerIP:       config.MaxConnectionsPerIP,
+		PerIPRate:                 float64(config.NewConnectionsPerIPPerMinute) / 60,
+		PerIPBurst:                config.NewConnectionsPerIPPerMinute,
+		AcceptRate:                float64(config.AcceptPerSecond),
+		AcceptBurst:               config.AcceptPerSecond,
+		MaxAcceptBackoff:          time.Duration(config.AcceptRetrySeconds) * time.Second,
+		ServerFullMessage:         "ERROR :" + config.ServerFullMessage + "\r\n",
+		TooManyConnectionsMessage: "ERROR :" + config.TooManyConnectionsMessage + "\r\n",
+	}
+	//
+	// Likewise the SSH listener (see sshlistener.go). Turning a connection
+	// away happens before SSH has started, so there's no message.
+	//
+	chatServer.sshServer = &telnet.Server{
+		Handler:             sshHandler{chatServer: chatServer},
+		Logger:              chatServer.logger.With("goroutine", "ssh"),
+		KeepAlivePeriod:     time.Duration(config.TCPKeepaliveSeconds) * time.Second,
+		MaxConnections:      config.MaxConnections,
+		MaxConnectionsPerIP: config.MaxConnectionsPerIP,
+		PerIPRate:           float64(config.NewConnectionsPerIPPerMinute) / 60,
+		PerIPBurst:          config.NewConnectionsPerIPPerMinute,
+		AcceptRate:          float64(config.AcceptPerSecond),
+		AcceptBurst:         config.AcceptPerSecond,
+		MaxAcceptBackoff:    time.Duration(config.AcceptRetrySeconds) * time.Second,
+	}
+	return chatServer, nil
+}
+
+//
+// Serves users plain Telnet on listener until Shutdown, when it returns
+// ErrServerClosed, or until the listener fails for good. Running out of
+// file descriptors and the like doesn't count -- the telnet server waits
+// those out itself (for up to accept_retry_seconds at a time). Call it
+// once for each listener, each on a goroutine of its own.
+//
+func (chatServer *ChatServer) Serve(listener net.Listener) error {
+	return chatServer.telnetServer.Serve(listener)
+}
+
+//
+// Same as Serve, but TELNETS, with the certificate and key from certFile
+// and keyFile.
+//
+func (chatServer *ChatServer) ServeTLS(listener net.Listener, certFile string, keyFile string) error {
+	return chatServer.telnetServer.ServeTLS(listener, certFile, keyFile)
+}
+
+//
+// Serves the admin console (see admin.go) on listener. There's no
+// authentication, so listener should be something only the administrator
+// can connect to, like the daemon's Unix socket.
+//
+func (chatServer *ChatServer) ServeAdmin(listener net.Listener) error {
+	return chatServer.adminServer.Serve(listener)
+}
+
+//
+// Serves IRC clients (see ircgateway.go) on listener, the same way Serve
+// serves Telnet.
+//
+func (chatServer *ChatServer) ServeIRC(listener net.Listener) error {
+	return chatServer.ircServer.Serve(listener)
+}
+
+//
+// Serves SSH (see sshlistener.go) on listener, the same way Serve serves
+// Telnet. The first time, it reads the host key from ssh_host_key_file,
+// making one if the file isn't there; if it can't, it returns why without
+// serving anything.
+//
+func (chatServer *ChatServer) ServeSSH(listener net.Listener) error {
+	err := chatServer.loadSSHConfig()
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	return chatServer.sshServer.Serve(listener)
+}
+
+//
+// Takes connections from the other cluster nodes on listener, which should
+// be on the config's cluster_listen address, since that's where they'll
+// dial. It's left open while shutting down, so users on other nodes can
+// still leave our chat channels properly; Shutdown closes it at the end.
+//
+func (chatServer *ChatServer) ServeCluster(listener net.Listener) error {
+	if chatServer.cluster == nil {
+		return errors.New("not in a cluster (cluster_node is empty)")
+	}
+	chatServer.mutex.Lock()
+	if chatServer.shutDown {
+		chatServer.mutex.Unlock()
+		return ErrServerClosed
+	}
+	chatServer.clusterListeners = append(chatServer.clusterListeners, listener)
+	chatServer.mutex.Unlock()
+	serveCluster(chatServer, listener)
+	return nil
+}
+
+//
+// The metrics endpoint (see metrics.go), for the program to put on an HTTP
+// server of its choosing, usually at /metrics.
+//
+func (chatServer *ChatServer) MetricsHandler() http.Handler {
+	return &metricsHandler{chatServer: chatServer}
+}
+
+//
+// Hands the reloadable parts of config to the channel master, which passes
+// them on to the doppelgangers and chat channels that use them. If anything
+// is wrong with config, nothing changes and the error says why. Settings
+// that only take effect on restart are logged, so whoever is reloading
+// isn't left wondering why nothing happened.
+//
+// The config New was given is never changed; it holds the settings that
+// can only change on restart.
+//
+func (chatServer *ChatServer) Reload(config Config) error {
+	err := validateConfig(&config, false)
+	if err != nil {
+		return err
+	}
+	settings, err := buildLiveSettings(config)
+	if err != nil {
+		return errors.New("problem reading MOTD file: " + err.Error())
+	}
+	chatServer.mutex.Lock()
+	defer chatServer.mutex.Unlock()
+	if chatServer.shutDown {
+		return ErrServerClosed
+	}
+	if chatServer.ownLogger {
+		chatServer.logger.Configure(os.Stderr, config)
+	}
+	changed := settingsNeedingRestart(chatServer.currentConfig, config)
+	if len(changed) > 0 {
+		chatServer.logger.With("settings", strings.Join(changed, ",")).Warn("Reload: these settings only take effect on restart.")
+	}
+	chatServer.currentConfig = config
+	var reloadMessage messageFromMainToChannelMaster
+	reloadMessage.operation = fromMainToChannelMasterOpReloadSettings
+	reloadMessage.parameter = ""
+	reloadMessage.settings = settings
+	reloadMessage.mainCallback = make(chan bool, 1)
+	chatServer.chanMasterFromMain <- reloadMessage
+	<-reloadMessage.mainCallback
+	chatServer.logger.Info("Reload: new settings handed to the channel master.")
+	return nil
+}
+
+//
+// Shutdown sequence: stop taking new connections, have the channel master
+// tell everyone goodbye and wait for them to leave, and if they haven't all
+// left by the time ctx is done, have the channel master shut down the chat
+// channels anyway so every conversation log gets closed. Then wait for the
+// doppelgangers to get all the way out, close the cluster listeners and the
+// database, stop every goroutine that was running for the server (see
+// stop), and return. Forcing things closed after ctx is done can take up to
+// shutdown_drain_seconds more at each step; after that we give up and
+// return anyway. If the channel master is stuck, so it doesn't even take
+// the shutdown before ctx is done, nobody is told goodbye.
+//
+// Returns ctx's error if the users didn't all leave in time, and
+// ErrServerClosed if the server was already shut down.
+//
+func (chatServer *ChatServer) Shutdown(ctx context.Context) error {
+	chatServer.mutex.Lock()
+	if chatServer.shutDown {
+		chatServer.mutex.Unlock()
+		return ErrServerClosed
+	}
+	chatServer.shutDown = true
+	chatServer.mutex.Unlock()
+	err := chatServer.telnetServer.Close()
+	if err != nil {
+		chatServer.logger.With("error", err).Warn("Closing the telnet server failed.")
+	}
+	chatServer.adminServer.Close()
+	chatServer.ircServer.Close()
+	chatServer.sshServer.Close()
+	drainTimeout := time.Duration(chatServer.config.ShutdownDrainSeconds) * time.Second
+	//
+	// Buffer of 1 so the channel master never blocks replying to us, even
+	// if we've already given up waiting.
+	//
+	var shutdownMessage messageFromMainToChannelMaster
+	shutdownMessage.operation = fromMainToChannelMasterOpShutdown
+	shutdownMessage.parameter = chatServer.config.ShutdownMessage
+	shutdownMessage.mainCallback = make(chan bool, 1)
+	var result error
+	select {
+	case chatServer.chanMasterFromMain <- shutdownMessage:
+		select {
+		case <-shutdownMessage.mainCallback:
+			chatServer.logger.Info("Shutdown: all users disconnected and all chat channels closed.")
+		case <-ctx.Done():
+			result = ctx.Err()
+			chatServer.logger.Warn("Shutdown: users did not all disconnect in time, closing chat channels anyway.")
+			chatServer.forceChatChannelsClosed(drainTimeout)
+		}
+	case <-ctx.Done():
+		//
+		// The channel master didn't even take it: it's stuck (the stall
+		// watchdog will have said where). There's nobody to tell the users
+		// goodbye or close the chat channels, so we go straight on.
+		//
+		result = ctx.Err()
+		chatServer.logger.Error("Shutdown: the channel master did not take the shutdown in time, exiting anyway.")
+	}
+	chatServer.waitForDoppelgangers(drainTimeout)
+	chatServer.events.close(drainTimeout)
+	chatServer.mutex.Lock()
+	for _, listener := range chatServer.clusterListeners {
+		listener.Close()
+	}
+	chatServer.mutex.Unlock()
+	close(chatServer.stop)
+	chatServer.store.close()
+	return result
+}
+
+//
+// The users didn't all leave in time: have the channel master shut down the
+// chat channels anyway, so every conversation log gets closed. ctx is done
+// by now, so we give the channel master drainTimeout, to take the message
+// and to answer.
+//
+func (chatServer *ChatServer) forceChatChannelsClosed(drainTimeout time.Duration) {
+	giveUp := time.After(drainTimeout)
+	var forceMessage messageFromMainToChannelMaster
+	forceMessage.operation = fromMainToChannelMasterOpShutdownChatChannels
+	forceMessage.parameter = ""
+	forceMessage.mainCallback = make(chan bool, 1)
+	select {
+	case chatServer.chanMasterFromMain <- forceMessage:
+	case <-giveUp:
+		chatServer.logger.With("shutdown_drain_seconds", chatServer.config.ShutdownDrainSeconds).Error("Shutdown: the channel master did not take the message to close the chat channels in time, exiting anyway.")
+		return
+	}
+	select {
+	case <-forceMessage.mainCallback:
+		chatServer.logger.Info("Shutdown: all chat channels closed.")
+	case <-giveUp:
+		chatServer.logger.With("shutdown_drain_seconds", chatServer.config.ShutdownDrainSeconds).Warn("Shutdown: chat channels did not all close in time, exiting anyway.")
+	}
+}
+
+//
+// Once the users are disconnected, their doppelgangers still have to get
+// all the way out. When the chat server is the whole process it hardly
+// matters, but Shutdown returning should mean the server is gone -- the
+// tests start the next one right away, and the database is about to be
+// closed. We don't wait longer than drainTimeout, though.
+//
+func (chatServer *ChatServer) waitForDoppelgangers(drainTimeout time.Duration) {
+	allGone := make(chan bool)
+	go func() {
+		chatServer.doppelgangers.Wait()
+		close(allGone)
+	}()
+	select {
+	case <-allGone:
+	case <-time.After(drainTimeout):
+		chatServer.logger.With("shutdown_drain_seconds", chatServer.config.ShutdownDrainSeconds).Warn("Shutdown: doppelgangers did not all exit in time, exiting anyway.")
+	}
+}
+
+//
+// Brings the database's schema up to date and closes it again, without
+// starting a server (the daemon's -migrate-only). New does this too, so
+// it's only needed to migrate ahead of time.
+//
+func MigrateDatabase(config Config, logger *Logger) error {
+	store, err := openSQLiteStorage(config, logger)
+	if err != nil {
+		return err
+	}
+	store.close()
+	return nil
+}
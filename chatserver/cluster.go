@@ -0,0 +1,512 @@
+package chatserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"hash/fnv"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+//
+// Clustering. Several wtelnet processes (nodes) can share the users and the
+// chat channels: a user connected to any node can join any chat channel and
+// talk with everyone on it, whichever node they're connected to.
+//
+// Every chat channel goroutine still lives in exactly one place -- on the
+// node that owns the chat channel. Which node that is comes from the chat
+// channel ID and the nodes that are up (see ownerOfChatChannel), so every
+// node works it out the same way without asking anyone. Joining a chat
+// channel we own works exactly like it always has. Joining one owned by
+// another node goes to our clusterPeer goroutine for that node instead of to
+// a shard (see clusterpeer.go), which sends the join over to the owner. On
+// the owner, a cluster member goroutine stands in for the remote user (see
+// clustermember.go): it registers with the channel master and joins the
+// chat channel like a doppelganger would, and passes everything the chat
+// channel says to it back over the wire. So the shards and chat channels
+// never know the difference, and the doppelganger only knows that it sends
+// its joins, whos and exits wherever it sent its join.
+//
+// When a node comes up, some chat channels belong to it now that were
+// running somewhere else -- on whichever node they belonged to while it was
+// down, or, if it was only just started, on the new node itself for users
+// who joined before it heard from everybody. So whenever a node comes up or
+// goes down, every shard looks at the chat channels it has running (see
+// moveChatChannelsWeDontOwn), and any that belong to another node now tell
+// their members they've moved. The members exit and join again, and the
+// join goes where the chat channel lives now; once they've all gone, the
+// old chat channel shuts down like any other with nobody on it. Until then
+// it doesn't take anyone new: a join that still arrives for it (from a node
+// that hasn't heard about the new node yet) is refused, and the user can
+// try again. So for a moment a chat channel can be in two places, but nobody
+// stays behind in the old one.
+//
+// The nodes talk over a simple internal TCP protocol: one JSON object per
+// line (clusterFrame). Every node dials every other node it's configured
+// with, and uses that connection for its own users on the other node's chat
+// channels; the other node answers on the same connection. So between two
+// nodes there are two connections, one each way. The dialing side pings
+// every so often, and a connection that hasn't heard anything for the peer
+// timeout is given up on, which is how we find out a node is gone. A node
+// is "up" to us while our connection to it is up -- that's all there is to
+// cluster membership.
+//
+// All the nodes have to use the same database (for now that means the same
+// SQLite file, so the same machine), because accounts and chat channels --
+// and their IDs, which go over the wire -- have to be the same everywhere.
+// The internal protocol has no authentication, so keep cluster_listen on a
+// local or private address.
+//
+
+//
+// Everything about the cluster that's set up once in New and never changes
+// after (like the shards). The membership is the exception, and has its own
+// mutex.
+//
+type clusterInfo struct {
+	self       string
+	peers      map[string]*clusterPeer
+	membership *clusterMembership
+}
+
+//
+// Which nodes are up. This is the other place (besides the stall watchdog)
+// where goroutines share state other than by sending messages: every
+// doppelganger reads it on every /join to find out where the chat channel
+// lives, and having them all ask one goroutine would put every join in the
+// world back in one line, which is what the shards got rid of. Only the
+// clusterPeer goroutines change it, each for its own node.
+//
+type clusterMembership struct {
+	mutex sync.Mutex
+	nodes []string
+	up    map[string]bool
+	since map[string]time.Time
+}
+
+type clusterNodeStatus struct {
+	node  string
+	addr  string
+	self  bool
+	up    bool
+	since time.Time
+}
+
+//
+// The wire format. Op says what it is; the rest is filled in as needed.
+// Session is the doppelganger ID on the node the user is connected to.
+//
+// From the node the user is on to the node that owns the chat channel:
+// hello (with node), ping, join (user and chat channel), who, say (text,
+// and said if the user said it with /say) and exit.
+//
+// Back: hello, pong, joined (chat channel), denied (the chat channel said
+// no, with text), refused (the owner's shard said no, e.g. because it's
+// shutting down, with text), reply (text just for this user, such as who's
+// on the channel), text (chat text, other people joining and leaving, with
+// sequence and originator, for the user's text queue), and left (the user
+// is off the chat channel, with text), and moved (the chat channel belongs
+// to another node now, so the user should exit and join again). Reply, text
+// and left also have machine, the text as a user in machine mode gets it
+// (see machinemode.go).
+//
+type clusterFrame struct {
+	Op         string `json:"op"`
+	Node       string `json:"node,omitempty"`
+	Session    int64  `json:"session,omitempty"`
+	UserID     int64  `json:"user_id,omitempty"`
+	UserName   string `json:"user_name,omitempty"`
+	ChannelID  int64  `json:"channel_id,omitempty"`
+	Channel    string `json:"channel,omitempty"`
+	Originator int64  `json:"originator,omitempty"`
+	Sequence   int64  `json:"sequence,omitempty"`
+	Text       string `json:"text,omitempty"`
+	Said       string `json:"said,omitempty"`
+	Machine    string `json:"machine,omitempty"`
+	//
+	// Not sent. If it isn't nil, the writer sends on it once the frame has
+	// been written (or couldn't be).
+	//
+	flushed chan bool
+}
+
+//
+// How many frames can wait to go out on (or be handled from) one
+// connection. Everything for one node goes through one connection, so this
+// is per node, not per user.
+//
+const clusterConnectionQueue = 4096
+
+//
+// A connection to another node, either way. The reader goroutine puts every
+// frame that comes in on incoming, and closes incoming when the connection
+// is gone (or hasn't heard anything for the peer timeout). The writer
+// goroutine writes everything put on outgoing; if writing fails it closes
+// the connection and throws away whatever comes after, so nobody sending to
+// it ever gets stuck. Whoever owns the connection closes outgoing when
+// they're done with it, which is what stops the writer.
+//
+type clusterConnection struct {
+	conn     net.Conn
+	incoming chan clusterFrame
+	outgoing chan clusterFrame
+}
+
+func startClusterConnection(conn net.Conn, timeout time.Duration, logger *Logger) *clusterConnection {
+	connection := new(clusterConnection)
+	connection.conn = conn
+	connection.incoming = make(chan clusterFrame, clusterConnectionQueue)
+	connection.outgoing = make(chan clusterFrame, clusterConnectionQueue)
+	go readClusterFrames(connection, timeout, logger)
+	go writeClusterFrames(connection, timeout, logger)
+	return connection
+}
+
+func readClusterFrames(connection *clusterConnection, timeout time.Duration, logger *Logger) {
+	defer close(connection.incoming)
+	defer connection.conn.Close()
+	decoder := json.NewDecoder(bufio.NewReader(connection.conn))
+	for {
+		connection.conn.SetReadDeadline(time.Now().Add(timeout))
+		var frame clusterFrame
+		err := decoder.Decode(&frame)
+		if err != nil {
+			logger.With("error", err).Debug("Cluster connection closed.")
+			return
+		}
+		connection.incoming <- frame
+	}
+}
+
+func writeClusterFrames(connection *clusterConnection, timeout time.Duration, logger *Logger) {
+	writer := bufio.NewWriter(connection.conn)
+	encoder := json.NewEncoder(writer)
+	failed := false
+	for frame := range connection.outgoing {
+		if !failed {
+			connection.conn.SetWriteDeadline(time.Now().Add(timeout))
+			err := encoder.Encode(frame)
+			if (err == nil) && ((len(connection.outgoing) == 0) || (frame.flushed != nil)) {
+				//
+				// Nothing else waiting (or someone's waiting for this one),
+				// so send what we have.
+				//
+				err = writer.Flush()
+			}
+			if err != nil {
+				logger.With("error", err).Debug("Writing to cluster connection failed.")
+				failed = true
+				connection.conn.Close()
+			}
+		}
+		if frame.flushed != nil {
+			frame.flushed <- true
+		}
+	}
+}
+
+//
+// Sets up the cluster, if there is one: the membership, and a clusterPeer
+// goroutine for every other node. Called once from New, before any
+// doppelganger starts. The listener for the other nodes is opened by the
+// program (main, in the daemon) with its other listeners and served by
+// serveCluster (through ServeCluster).
+//
+func startCluster(chatServer *ChatServer) {
+	if chatServer.config.ClusterNode == "" {
+		return
+	}
+	cluster := new(clusterInfo)
+	cluster.self = chatServer.config.ClusterNode
+	cluster.peers = make(map[string]*clusterPeer)
+	cluster.membership = new(clusterMembership)
+	cluster.membership.nodes = []string{cluster.self}
+	cluster.membership.up = map[string]bool{cluster.self: true}
+	cluster.membership.since = map[string]time.Time{cluster.self: time.Now()}
+	for _, peerConfig := range chatServer.config.ClusterPeers {
+		peer := new(clusterPeer)
+		peer.node = peerConfig.Node
+		peer.addr = peerConfig.Addr
+		//
+		// These are what a shard's and a chat channel's incoming go
+		// channels are to local users, for every user on this node that
+		// is on the other node's chat channels, so they're as big as the
+		// biggest of those.
+		//
+		peer.fromDoppelganger = make(chan messageFromDoppelgangerToChannelMaster, chatServer.config.ChannelMasterDoppelgangerQueue)
+		peer.fromDoppelgangerToChatChannel = make(chan messageFromDoppelgangerToChatChannel, chatServer.config.ChannelMasterDoppelgangerQueue)
+		cluster.peers[peer.node] = peer
+		cluster.membership.nodes = append(cluster.membership.nodes, peer.node)
+		cluster.membership.since[peer.node] = time.Now()
+	}
+	sort.Strings(cluster.membership.nodes)
+	chatServer.cluster = cluster
+	for _, peer := range cluster.peers {
+		go clusterPeerGoroutine(chatServer, peer)
+	}
+}
+
+//
+// Where a doppelganger sends its join (and later its who and exit) for a
+// chat channel: the chat channel's shard if we own it (or there's no
+// cluster), or the clusterPeer goroutine for the node that does.
+//
+func chatChannelRoute(chatServer *ChatServer, chatChannelID int64) chan messageFromDoppelgangerToChannelMaster {
+	if chatServer.cluster == nil {
+		return shardForChatChannel(chatServer, chatChannelID).fromDoppelganger
+	}
+	owner := chatServer.cluster.membership.ownerOfChatChannel(chatChannelID)
+	if owner == chatServer.cluster.self {
+		return shardForChatChannel(chatServer, chatChannelID).fromDoppelganger
+	}
+	return chatServer.cluster.peers[owner].fromDoppelganger
+}
+
+//
+// Whether the chat channel lives here, as far as we can tell. Always true
+// without a cluster.
+//
+func ownsChatChannel(chatServer *ChatServer, chatChannelID int64) bool {
+	if chatServer.cluster == nil {
+		return true
+	}
+	return chatServer.cluster.membership.ownerOfChatChannel(chatChannelID) == chatServer.cluster.self
+}
+
+//
+// Pokes every shard to look for chat channels that have to move (see
+// moveChatChannelsWeDontOwn). Called by a clusterPeer goroutine whenever its
+// node comes up or goes down. Never blocks: a shard that already has a poke
+// waiting will see this change too.
+//
+func announceMembershipChange(chatServer *ChatServer) {
+	for _, shard := range chatServer.channelMasterShards {
+		select {
+		case shard.membershipChanged <- true:
+		default:
+		}
+	}
+}
+
+//
+// Rendezvous hashing: every node that's up gets a score for the chat
+// channel, and the highest score wins. When a node goes down, only its chat
+// channels move (each to whichever node scores next highest for it), and
+// when it comes back they move back, and nobody else's move at all.
+//
+func (membership *clusterMembership) ownerOfChatChannel(chatChannelID int64) string {
+	membership.mutex.Lock()
+	defer membership.mutex.Unlock()
+	owner := ""
+	var best uint64
+	for _, node := range membership.nodes {
+		if !membership.up[node] {
+			continue
+		}
+		hash := fnv.New64a()
+		hash.Write([]byte(node + "/" + int64ToStr(chatChannelID)))
+		score := mixClusterHash(hash.Sum64())
+		if (owner == "") || (score > best) {
+			owner = node
+			best = score
+		}
+	}
+	return owner
+}
+
+//
+// FNV on its own hardly changes the top bits when only the last character
+// of the input does, and chat channel IDs mostly differ in the last
+// character, so one node would win nearly every chat channel. This is the
+// finalizer from MurmurHash3, which spreads every bit of the input over the
+// whole result.
+//
+func mixClusterHash(hash uint64) uint64 {
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
+
+//
+// Returns whether anything changed.
+//
+func (membership *clusterMembership) setUp(node string, up bool) bool {
+	membership.mutex.Lock()
+	defer membership.mutex.Unlock()
+	if membership.up[node] == up {
+		return false
+	}
+	membership.up[node] = up
+	membership.since[node] = time.Now()
+	return true
+}
+
+//
+// For the metrics endpoint and the admin console.
+//
+func clusterStatus(chatServer *ChatServer) []clusterNodeStatus {
+	if chatServer.cluster == nil {
+		return nil
+	}
+	membership := chatServer.cluster.membership
+	membership.mutex.Lock()
+	defer membership.mutex.Unlock()
+	status := make([]clusterNodeStatus, 0, len(membership.nodes))
+	for _, node := range membership.nodes {
+		var entry clusterNodeStatus
+		entry.node = node
+		entry.self = (node == chatServer.cluster.self)
+		if !entry.self {
+			entry.addr = chatServer.cluster.peers[node].addr
+		} else {
+			entry.addr = chatServer.config.ClusterListen
+		}
+		entry.up = membership.up[node]
+		entry.since = membership.since[node]
+		status = append(status, entry)
+	}
+	return status
+}
+
+//
+// DO IT
+// Accepts connections from the other nodes, each in a goroutine of its own.
+// Runs until the listener is closed.
+//
+func serveCluster(chatServer *ChatServer, listener net.Listener) {
+	logger := chatServer.logger.With("goroutine", "cluster_listener")
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			netErr, ok := err.(net.Error)
+			if ok && netErr.Temporary() {
+				logger.With("error", err).Warn("Accepting cluster connection failed, retrying.")
+				time.Sleep(time.Second)
+				continue
+			}
+			logger.With("error", err).Info("Cluster listener stopped.")
+			return
+		}
+		go clusterLinkGoroutine(chatServer, conn)
+	}
+}
+
+//
+// Goroutine for a connection another node dialed to us. It starts a cluster
+// member goroutine for every user the other node sends to join one of our
+// chat channels, and passes that user's frames on to it. Pings it answers
+// itself. When the connection goes, every cluster member on it is told (by
+// closing its go channel), and once they've all left their chat channels we
+// close the connection's outgoing go channel and are done. When the server
+// has shut down (ChatServer.stop), we hang up, so the other node sees we're
+// gone.
+//
+func clusterLinkGoroutine(chatServer *ChatServer, conn net.Conn) {
+	logger := chatServer.logger.With("goroutine", "cluster_link", "remote_addr", conn.RemoteAddr().String())
+	watch := chatServer.stallWatchdog.watch(logger)
+	defer chatServer.stallWatchdog.unwatch(watch)
+	connection := startClusterConnection(conn, time.Duration(chatServer.config.ClusterPeerTimeoutSeconds)*time.Second, logger)
+	defer close(connection.outgoing)
+	//
+	// The first thing has to be hello, from a node we know.
+	//
+	hello, ok := <-connection.incoming
+	if !ok {
+		return
+	}
+	_, known := chatServer.cluster.peers[hello.Node]
+	if (hello.Op != "hello") || !known {
+		logger.With("op", hello.Op, "node", hello.Node).Warn("Cluster connection from an unknown node, hanging up.")
+		conn.Close()
+		for range connection.incoming {
+		}
+		return
+	}
+	logger = logger.With("node", hello.Node)
+	chatServer.stallWatchdog.relabel(watch, logger)
+	logger.Info("Cluster node connected.")
+	var reply clusterFrame
+	reply.Op = "hello"
+	reply.Node = chatServer.cluster.self
+	watch.sendToClusterConnection(connection.outgoing, reply)
+	//
+	// Session (the doppelganger ID on the other node) to the go channel of
+	// the cluster member goroutine standing in for it. Members tell us on
+	// membersDone when they're gone.
+	//
+	members := make(map[int64]chan clusterFrame)
+	membersDone := make(chan int64, clusterConnectionQueue)
+	incoming := connection.incoming
+	stop := chatServer.stop
+	for (incoming != nil) || (len(members) > 0) {
+		select {
+		case <-stop:
+			//
+			// Closing the connection closes incoming, which takes care of
+			// the rest. Once is enough.
+			//
+			conn.Close()
+			stop = nil
+		case frame, ok := <-incoming:
+			if !ok {
+				logger.Info("Cluster node disconnected.")
+				for _, memberGoChan := range members {
+					close(memberGoChan)
+				}
+				incoming = nil
+				continue
+			}
+			switch frame.Op {
+			case "ping":
+				var pong clusterFrame
+				pong.Op = "pong"
+				watch.sendToClusterConnection(connection.outgoing, pong)
+			case "join":
+				_, exists := members[frame.Session]
+				if exists {
+					//
+					// Should never happen.
+					//
+					logger.With("session", frame.Session).Error("join for a session that's already on a chat channel")
+					break
+				}
+				//
+				// Big enough for anything one user can send while their
+				// member goroutine is busy.
+				//
+				memberGoChan := make(chan clusterFrame, chatServer.config.ChatChannelQueue)
+				members[frame.Session] = memberGoChan
+				go clusterMemberGoroutine(chatServer, hello.Node, frame, memberGoChan, connection.outgoing, membersDone)
+			case "who", "say", "exit":
+				memberGoChan, exists := members[frame.Session]
+				if !exists {
+					logger.With("session", frame.Session, "op", frame.Op).Debug("frame for a session that isn't on a chat channel")
+					break
+				}
+				watch.sendFromClusterLinkToMember(memberGoChan, frame, frame.Session)
+			default:
+				//
+				// Should never happen.
+				//
+				logger.With("op", frame.Op).Error("Unrecognized op from cluster node.")
+			}
+		case session := <-membersDone:
+			memberGoChan, exists := members[session]
+			if exists {
+				delete(members, session)
+				if incoming != nil {
+					//
+					// We only close it if the connection is still up --
+					// otherwise we already did.
+					//
+					close(memberGoChan)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package chatserver
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+//
+// Clusters of test servers in one process. Every node's cluster listener is
+// opened up front, on whatever port is free, so every node knows every
+// other one's address before any of them starts; a node that hasn't been
+// started yet is one that's down (its listener takes connections but never
+// answers, so nobody hears hello from it). They all share one database, the
+// way the nodes of a real cluster have to.
+//
+
+type testCluster struct {
+	t         *testing.T
+	database  string
+	nodes     []string
+	listeners map[string]*testClusterListener
+	servers   map[string]*testServer
+}
+
+//
+// A cluster listener that remembers the connections it accepted, so a test
+// can take its node down the way a crash would: every connection from the
+// other nodes gone at once.
+//
+type testClusterListener struct {
+	net.Listener
+	mutex sync.Mutex
+	conns []net.Conn
+}
+
+func (listener *testClusterListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err == nil {
+		listener.mutex.Lock()
+		listener.conns = append(listener.conns, conn)
+		listener.mutex.Unlock()
+	}
+	return conn, err
+}
+
+func (listener *testClusterListener) crash() {
+	listener.Listener.Close()
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	for _, conn := range listener.conns {
+		conn.Close()
+	}
+}
+
+func newTestCluster(t *testing.T, nodes ...string) *testCluster {
+	cluster := new(testCluster)
+	cluster.t = t
+	cluster.database = filepath.Join(t.TempDir(), "cluster.db")
+	cluster.nodes = nodes
+	cluster.listeners = make(map[string]*testClusterListener)
+	cluster.servers = make(map[string]*testServer)
+	for _, node := range nodes {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cluster.listeners[node] = &testClusterListener{Listener: listener}
+		t.Cleanup(cluster.listeners[node].crash)
+	}
+	return cluster
+}
+
+//
+// Starts a node (in the order the test wants, so one at a time -- the first
+// one to start also sets up the database).
+//
+func (cluster *testCluster) start(node string) *testServer {
+	cluster.t.Helper()
+	server := startTestServer(cluster.t, func(config *Config) {
+		config.DatabasePath = cluster.database
+		config.ClusterNode = node
+		config.ClusterListen = cluster.listeners[node].Addr().String()
+		for _, peer := range cluster.nodes {
+			if peer != node {
+				config.ClusterPeers = append(config.ClusterPeers, ClusterPeerConfig{Node: peer, Addr: cluster.listeners[peer].Addr().String()})
+			}
+		}
+		config.ClusterPeerTimeoutSeconds = 2
+	})
+	go server.chatServer.ServeCluster(cluster.listeners[node])
+	cluster.servers[node] = server
+	return server
+}
+
+//
+// Takes a node down without shutting it down properly: the other nodes
+// lose their connections to it, and can't connect again. The node's
+// goroutines are still there (we're all one process), and it's shut down
+// properly when the test is over.
+//
+func (cluster *testCluster) crash(node string) {
+	cluster.listeners[node].crash()
+}
+
+//
+// Waits until node sees every one of peers as up (or down).
+//
+func (cluster *testCluster) waitUntil(node string, up bool, peers ...string) {
+	cluster.t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		status := make(map[string]bool)
+		for _, entry := range clusterStatus(cluster.servers[node].chatServer) {
+			status[entry.node] = entry.up
+		}
+		ready := true
+		for _, peer := range peers {
+			if status[peer] != up {
+				ready = false
+			}
+		}
+		if ready {
+			return
+		}
+		if time.Now().After(deadline) {
+			cluster.t.Fatalf("timed out waiting for %s to see %v as up=%v: %v", node, peers, up, status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+//
+// Creates a chat channel that belongs to owner once every node is up, and
+// to fallback while owner is down. Needs a node to be running, for the
+// database.
+//
+func (cluster *testCluster) createChatChannel(owner string, fallback string) string {
+	cluster.t.Helper()
+	var store storage
+	for _, server := range cluster.servers {
+		store = server.chatServer.store
+	}
+	for ii := 0; ii < 1000; ii++ {
+		name := "room" + strconv.Itoa(ii)
+		_, err := store.saveChatChannel(name)
+		if err != nil {
+			cluster.t.Fatal(err)
+		}
+		chatChannelID, err := store.lookUpChatChannel(name)
+		if err != nil {
+			cluster.t.Fatal(err)
+		}
+		membership := new(clusterMembership)
+		membership.nodes = cluster.nodes
+		membership.up = make(map[string]bool)
+		for _, node := range cluster.nodes {
+			membership.up[node] = true
+		}
+		if membership.ownerOfChatChannel(chatChannelID) != owner {
+			continue
+		}
+		membership.up[owner] = false
+		if membership.ownerOfChatChannel(chatChannelID) == fallback {
+			return name
+		}
+	}
+	cluster.t.Fatalf("no chat channel belongs to %s, with %s as the fallback", owner, fallback)
+	return ""
+}
+
+//
+// Users on different nodes on one chat channel: joins, chat and leaving go
+// across, and the chat channel is only running on the node that owns it.
+//
+func TestClusterFanOut(t *testing.T) {
+	cluster := newTestCluster(t, "a", "b", "c")
+	a := cluster.start("a")
+	b := cluster.start("b")
+	c := cluster.start("c")
+	cluster.waitUntil("a", true, "b", "c")
+	cluster.waitUntil("b", true, "a", "c")
+	cluster.waitUntil("c", true, "a", "b")
+	lounge := cluster.createChatChannel("b", "a")
+	alice := a.logIn("alice", "secret")
+	alice.send("/join " + lounge)
+	alice.expect("You have joined #" + lounge)
+	bob := b.logIn("bob", "secret")
+	bob.send("/join " + lounge)
+	bob.expect("You have joined #" + lounge)
+	alice.expect("bob has joined #" + lounge)
+	carol := c.logIn("carol", "secret")
+	carol.send("/join " + lounge)
+	carol.expect("You have joined #" + lounge)
+	alice.expect("carol has joined #" + lounge)
+	bob.expect("carol has joined #" + lounge)
+	alice.send("hi")
+	bob.expect(`alice says, "hi"`)
+	carol.expect(`alice says, "hi"`)
+	carol.send("hello")
+	alice.expect(`carol says, "hello"`)
+	bob.expect(`carol says, "hello"`)
+	if (a.metric("wtelnet_chat_channels_active") != 0) || (b.metric("wtelnet_chat_channels_active") != 1) || (c.metric("wtelnet_chat_channels_active") != 0) {
+		t.Errorf("#%s should only be running on b: a %d, b %d, c %d", lounge, a.metric("wtelnet_chat_channels_active"), b.metric("wtelnet_chat_channels_active"), c.metric("wtelnet_chat_channels_active"))
+	}
+	carol.send("/exit")
+	carol.expect("You left #" + lounge)
+	alice.expect("carol has left #" + lounge)
+	bob.expect("carol has left #" + lounge)
+}
+
+//
+// The node that owns a chat channel goes down: users on it from other nodes
+// are told, and joining again puts the chat channel on a node that's up.
+//
+func TestClusterNodeDown(t *testing.T) {
+	cluster := newTestCluster(t, "a", "b")
+	a := cluster.start("a")
+	cluster.start("b")
+	cluster.waitUntil("a", true, "b")
+	lounge := cluster.createChatChannel("b", "a")
+	alice := a.logIn("alice", "secret")
+	alice.send("/join " + lounge)
+	alice.expect("You have joined #" + lounge)
+	cluster.crash("b")
+	alice.expect("Lost the connection to the server with #" + lounge + " on it\\. You are no longer on the channel\\.")
+	cluster.waitUntil("a", false, "b")
+	alice.send("/join " + lounge)
+	alice.expect("You have joined #" + lounge)
+	if a.metric("wtelnet_chat_channels_active") != 1 {
+		t.Errorf("#%s should be running on a now", lounge)
+	}
+}
+
+//
+// A node comes up that owns a chat channel running elsewhere: everyone on
+// it -- on the old owner and on other nodes -- moves to the new owner, and
+// the old one shuts down, so nobody is left talking on a copy.
+//
+func TestClusterNodeComesUp(t *testing.T) {
+	cluster := newTestCluster(t, "a", "b", "c")
+	a := cluster.start("a")
+	c := cluster.start("c")
+	cluster.waitUntil("a", true, "c")
+	cluster.waitUntil("c", true, "a")
+	lounge := cluster.createChatChannel("b", "a")
+	alice := a.logIn("alice", "secret")
+	alice.send("/join " + lounge)
+	alice.expect("You have joined #" + lounge)
+	carol := c.logIn("carol", "secret")
+	carol.send("/join " + lounge)
+	carol.expect("You have joined #" + lounge)
+	alice.expect("carol has joined #" + lounge)
+	b := cluster.start("b")
+	alice.expect("#" + lounge + " has moved to another server\\. Rejoining\\.")
+	alice.expect("You have joined #" + lounge)
+	carol.expect("#" + lounge + " has moved to another server\\. Rejoining\\.")
+	//
+	// c may not have heard from b yet when carol rejoins, in which case a
+	// turns her away and she has to try again.
+	//
+	if carol.expect("You have joined #"+lounge+"|is moving to another server\\. Please try again\\.") != "You have joined #"+lounge {
+		cluster.waitUntil("c", true, "b")
+		carol.send("/join " + lounge)
+		carol.expect("You have joined #" + lounge)
+	}
+	cluster.waitUntil("b", true, "a", "c")
+	bob := b.logIn("bob", "secret")
+	bob.send("/join " + lounge)
+	bob.expect("You have joined #" + lounge)
+	bob.send("hi")
+	alice.expect(`bob says, "hi"`)
+	carol.expect(`bob says, "hi"`)
+	deadline := time.Now().Add(testTimeout)
+	for a.metric("wtelnet_chat_channels_active") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("#%s is still running on a", lounge)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if b.metric("wtelnet_chat_channels_active") != 1 {
+		t.Errorf("#%s should be running on b now", lounge)
+	}
+}
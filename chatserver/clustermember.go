@@ -0,0 +1,310 @@
+package chatserver
+
+import (
+	"math/rand"
+	"time"
+)
+
+//
+// The node that owns a chat channel: one cluster member goroutine for every
+// user on another node who is on (or joining) one of our chat channels. It
+// stands in for the user's doppelganger: it has a doppelganger ID of its
+// own, registers with the channel master, and joins, asks who's on and
+// exits through the shard like a doppelganger does, so the shard and the
+// chat channel can't tell the difference. What the chat channel sends it,
+// it sends on to the other node as frames, and what the other node sends
+// for the user comes in on incoming from the cluster link goroutine.
+//
+// It only lives for one chat channel: once the user is off it (or never got
+// on), it unregisters and is done. If the connection to the other node
+// goes, or the channel master tells it to hang up (the server is shutting
+// down, an admin kicked the user, or they can't keep up with the chat
+// channel and the slow member policy is "disconnect"), it leaves the chat
+// channel. For a user on another node, being hung up on here just means
+// being put off the chat channel -- their connection is on the other node,
+// and that's up to that node.
+//
+
+type clusterMemberInfo struct {
+	chatServer                *ChatServer
+	node                      string
+	session                   int64
+	userID                    int64
+	userName                  string
+	doppelgangerID            int64
+	chatChannelID             int64
+	chatChannelName           string
+	chatChannelCallback       chan messageFromDoppelgangerToChatChannel
+	incomingFromChannelMaster chan messageFromChannelMasterToDoppelganger
+	incomingFromChatChannel   chan messageFromChatChannelToDoppelganger
+	incomingText              chan messageFromChatChannelToDoppelganger
+	incomingBroadcast         chan messageFromChannelMasterToDoppelganger
+	incomingHangUp            chan messageFromChannelMasterToDoppelganger
+	outgoing                  chan clusterFrame
+	logger                    *Logger
+	watch                     *stallWatch
+	joined                    bool
+	leaving                   bool
+	leaveReason               string
+	lastInput                 time.Time
+}
+
+func (member *clusterMemberInfo) channelMasterRequest(operation int) messageFromDoppelgangerToChannelMaster {
+	var theMessage messageFromDoppelgangerToChannelMaster
+	theMessage.operation = operation
+	theMessage.userID = member.userID
+	theMessage.userName = member.userName
+	theMessage.doppelgangerID = member.doppelgangerID
+	theMessage.chatChannelID = member.chatChannelID
+	theMessage.parameter = member.chatChannelName
+	theMessage.doppelgangerCallbackFromChannelMaster = member.incomingFromChannelMaster
+	theMessage.doppelgangerCallbackFromChatChannel = member.incomingFromChatChannel
+	theMessage.doppelgangerTextQueue = member.incomingText
+	theMessage.doppelgangerBroadcastCallback = member.incomingBroadcast
+	theMessage.doppelgangerHangUpCallback = member.incomingHangUp
+	//
+	// No settings go channel: nothing in the settings is about us -- the
+	// user's own node has their connection.
+	//
+	theMessage.doppelgangerSettingsCallback = nil
+	return theMessage
+}
+
+func (member *clusterMemberInfo) sendFrame(op string, text string, machineLine string) {
+	var frame clusterFrame
+	frame.Op = op
+	frame.Session = member.session
+	frame.ChannelID = member.chatChannelID
+	frame.Channel = member.chatChannelName
+	frame.Text = text
+	frame.Machine = machineLine
+	member.watch.sendToClusterConnection(member.outgoing, frame)
+}
+
+//
+// Same as sendFrame, for the last frame we send, but waits (at most the peer
+// timeout) until it's been written. Once we unregister, the channel master
+// may be about to tell main everyone is gone, and main exits -- if our
+// frame were still in the connection's queue then, the user would hear the
+// connection was lost instead of why they're off the chat channel.
+//
+func (member *clusterMemberInfo) sendLastFrame(op string, text string, machineLine string) {
+	var frame clusterFrame
+	frame.Op = op
+	frame.Session = member.session
+	frame.ChannelID = member.chatChannelID
+	frame.Channel = member.chatChannelName
+	frame.Text = text
+	frame.Machine = machineLine
+	frame.flushed = make(chan bool, 1)
+	member.watch.sendToClusterConnection(member.outgoing, frame)
+	select {
+	case <-frame.flushed:
+	case <-time.After(time.Duration(member.chatServer.config.ClusterPeerTimeoutSeconds) * time.Second):
+	}
+}
+
+//
+// Gets off the chat channel -- or, if we haven't heard back about the join
+// yet, as soon as we have.
+//
+func (member *clusterMemberInfo) startLeaving() {
+	if member.leaving {
+		return
+	}
+	member.leaving = true
+	if member.joined {
+		member.watch.sendFromDoppelgangerToChannelMaster(shardForChatChannel(member.chatServer, member.chatChannelID).fromDoppelganger, member.channelMasterRequest(fromDoppelgangerToChannelMasterOpExit))
+	}
+}
+
+//
+// DO IT
+// Goroutine standing in for one user on another node. join is the frame
+// that started it. When it's done it sends its session on done, and then
+// reads (and ignores) incoming until the cluster link goroutine closes it,
+// so the link never waits on a member that's gone.
+//
+func clusterMemberGoroutine(chatServer *ChatServer, node string, join clusterFrame, incoming chan clusterFrame, outgoing chan clusterFrame, done chan int64) {
+	member := new(clusterMemberInfo)
+	member.chatServer = chatServer
+	member.node = node
+	member.session = join.Session
+	member.userID = join.UserID
+	member.userName = join.UserName
+	member.doppelgangerID = rand.New(rand.NewSource(time.Now().UnixNano() + join.Session)).Int63()
+	member.chatChannelID = join.ChannelID
+	member.chatChannelName = join.Channel
+	member.incomingFromChannelMaster = make(chan messageFromChannelMasterToDoppelganger, 1)
+	member.incomingFromChatChannel = make(chan messageFromChatChannelToDoppelganger, 1)
+	member.incomingText = make(chan messageFromChatChannelToDoppelganger, chatServer.config.MemberQueue)
+	member.incomingBroadcast = make(chan messageFromChannelMasterToDoppelganger, 2)
+	member.incomingHangUp = make(chan messageFromChannelMasterToDoppelganger, 1)
+	member.outgoing = outgoing
+	member.lastInput = time.Now()
+	member.logger = chatServer.logger.With("goroutine", "cluster_member", "node", node, "session", join.Session, "doppelganger_id", member.doppelgangerID, "user_id", join.UserID, "user_name", join.UserName, "channel_id", join.ChannelID)
+	member.watch = chatServer.stallWatchdog.watch(member.logger)
+	defer chatServer.stallWatchdog.unwatch(member.watch)
+	member.watch.sendFromDoppelgangerToChannelMaster(chatServer.chanMasterFromDoppelgangerGoChan, member.channelMasterRequest(fromDoppelgangerToChannelMasterOpRegister))
+	member.watch.sendFromDoppelgangerToChannelMaster(shardForChatChannel(member.chatServer, member.chatChannelID).fromDoppelganger, member.channelMasterRequest(fromDoppelgangerToChannelMasterOpJoin))
+	member.logger.Debug("Joining for a user on another node.")
+	runClusterMember(member, incoming)
+	member.watch.sendFromDoppelgangerToChannelMaster(chatServer.chanMasterFromDoppelgangerGoChan, member.channelMasterRequest(fromDoppelgangerToChannelMasterOpUnregister))
+	done <- member.session
+	for range incoming {
+	}
+}
+
+//
+// The member's main loop. Returns once the user is off the chat channel, or
+// never got on it.
+//
+func runClusterMember(member *clusterMemberInfo, incoming chan clusterFrame) {
+	for {
+		select {
+		case frame, ok := <-incoming:
+			if !ok {
+				//
+				// The connection to the user's node is gone.
+				//
+				incoming = nil
+				member.startLeaving()
+				break
+			}
+			member.lastInput = time.Now()
+			switch frame.Op {
+			case "who":
+				if member.joined && !member.leaving {
+					member.watch.sendFromDoppelgangerToChannelMaster(shardForChatChannel(member.chatServer, member.chatChannelID).fromDoppelganger, member.channelMasterRequest(fromDoppelgangerToChannelMasterOpWho))
+				}
+			case "say":
+				if member.joined && !member.leaving {
+					var newMsg messageFromDoppelgangerToChatChannel
+					newMsg.operation = fromDoppelgangerToChatChannelOpTextMessage
+					newMsg.userID = member.userID
+					newMsg.doppelgangerID = member.doppelgangerID
+					newMsg.parameter = frame.Text
+					newMsg.said = frame.Said
+					member.watch.sendFromDoppelgangerToChatChannel(member.chatChannelCallback, newMsg, member.chatChannelID)
+				}
+			case "exit":
+				member.startLeaving()
+			default:
+				//
+				// Should never happen.
+				//
+				member.logger.With("op", frame.Op).Error("Unrecognized op for cluster member.")
+			}
+		case response := <-member.incomingFromChannelMaster:
+			switch response.operation {
+			case fromChannelMasterToDoppelgangerOpJoinDenied:
+				//
+				// The shard won't let anyone join (we're shutting down).
+				//
+				member.sendLastFrame("refused", response.msgToUser, "")
+				return
+			case fromChannelMasterToDoppelgangerOpGenericText:
+				member.sendFrame("reply", response.msgToUser, "")
+			default:
+				//
+				// Should never happen.
+				//
+				member.logger.With("operation", response.operation).Error("unexpected opcode from channel master")
+			}
+		case theMessage := <-member.incomingFromChatChannel:
+			switch theMessage.operation {
+			case fromChatChannelToDoppelgangerOpJoinDenied:
+				member.sendLastFrame("denied", theMessage.parameter, "")
+				return
+			case fromChatChannelToDoppelgangerOpJoined:
+				member.joined = true
+				member.chatChannelCallback = theMessage.chatChannelCallback
+				member.sendFrame("joined", "", "")
+				if member.leaving {
+					//
+					// Asked to leave before we were even on.
+					//
+					member.leaving = false
+					member.startLeaving()
+				}
+			case fromChatChannelToDoppelgangerOpTextMessage:
+				member.sendFrame("reply", theMessage.parameter, theMessage.machineLine)
+			case fromChatChannelToDoppelgangerOpMoved:
+				//
+				// The user's doppelganger exits and joins again, which
+				// takes it wherever the chat channel lives now. If it's
+				// already leaving, there's nothing to tell it.
+				//
+				if !member.leaving {
+					member.sendFrame("moved", "", "")
+				}
+			case fromChatChannelToDoppelgangerOpTextExit:
+				if theMessage.leavingDoppelgangerID != member.doppelgangerID {
+					//
+					// Should never happen -- other people leaving come on
+					// the text queue.
+					//
+					member.logger.With("leaving_doppelganger_id", theMessage.leavingDoppelgangerID).Error("someone else's exit on the member's own go channel")
+					break
+				}
+				text := theMessage.parameter
+				if member.leaveReason != "" {
+					text = member.leaveReason + "\r\n" + text
+				}
+				member.sendLastFrame("left", text, theMessage.machineLine)
+				return
+			default:
+				//
+				// Should never happen.
+				//
+				member.logger.With("operation", theMessage.operation).Error("unexpected opcode received from chat channel")
+			}
+		case theMessage := <-member.incomingText:
+			var frame clusterFrame
+			frame.Op = "text"
+			frame.Session = member.session
+			frame.ChannelID = theMessage.chatChannelID
+			frame.Originator = theMessage.originator
+			frame.Sequence = theMessage.sequence
+			frame.Text = theMessage.parameter
+			frame.Machine = theMessage.machineLine
+			member.watch.sendToClusterConnection(member.outgoing, frame)
+		case broadcast := <-member.incomingBroadcast:
+			switch broadcast.operation {
+			case fromChannelMasterToDoppelgangerOpDescribe:
+				var reply adminSessionEntry
+				reply.doppelgangerID = member.doppelgangerID
+				reply.userID = member.userID
+				reply.userName = member.userName
+				reply.remoteAddr = "cluster node " + member.node
+				reply.mode = loginCommandMode
+				if member.joined {
+					reply.chatChannelID = member.chatChannelID
+				} else {
+					reply.chatChannelID = -1
+				}
+				reply.chatChannelName = member.chatChannelName
+				reply.lastInput = member.lastInput
+				reply.queueLength = len(member.incomingFromChannelMaster) + len(member.incomingFromChatChannel) + len(member.incomingText) + len(member.incomingBroadcast) + len(member.incomingHangUp)
+				broadcast.adminCallback <- reply
+			default:
+				//
+				// Should never happen.
+				//
+				member.logger.With("operation", broadcast.operation).Error("unexpected opcode in broadcast from channel master")
+			}
+		case hangUpMessage := <-member.incomingHangUp:
+			switch hangUpMessage.operation {
+			case fromChannelMasterToDoppelgangerOpDisconnect, fromChannelMasterToDoppelgangerOpShutdown:
+				member.logger.Info("Leaving the chat channel at the channel master's request.")
+				member.leaveReason = hangUpMessage.msgToUser
+				member.startLeaving()
+			default:
+				//
+				// Should never happen.
+				//
+				member.logger.With("operation", hangUpMessage.operation).Error("unexpected opcode in hang-up from channel master")
+			}
+		}
+	}
+}
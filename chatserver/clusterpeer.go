@@ -0,0 +1,401 @@
+package chatserver
+
+import (
+	"net"
+	"time"
+)
+
+//
+// The node a user is connected to: one clusterPeer goroutine for every
+// other node. To a doppelganger, the peer goroutine for the node that owns
+// its chat channel looks like both the shard (it sends its join, who and
+// exit to fromDoppelganger) and the chat channel (once it's joined, what it
+// says goes to fromDoppelgangerToChatChannel). The peer goroutine turns all
+// that into frames for the other node, and turns what comes back into the
+// same messages a shard or chat channel would have sent, on the same go
+// channels.
+//
+// It also keeps the connection to the other node up: it dials, says hello,
+// pings, and marks the node up when it answers (so the chat channels that
+// belong to it move there -- see announceMembershipChange). When the
+// connection goes it marks the node down (so its chat channels move to other
+// nodes), tells everyone who was on one of its chat channels that they're
+// off it, and dials again. It hangs up and returns when the server has shut
+// down (ChatServer.stop).
+//
+
+//
+// The go channels a clusterPeer goroutine listens on. Doppelgangers find
+// them with chatChannelRoute.
+//
+type clusterPeer struct {
+	node                          string
+	addr                          string
+	fromDoppelganger              chan messageFromDoppelgangerToChannelMaster
+	fromDoppelgangerToChatChannel chan messageFromDoppelgangerToChatChannel
+}
+
+//
+// A doppelganger that has joined (or asked to join) a chat channel on the
+// other node, with the go channels to answer it on.
+//
+type clusterSession struct {
+	userID                    int64
+	userName                  string
+	chatChannelID             int64
+	chatChannelName           string
+	callbackFromChannelMaster chan messageFromChannelMasterToDoppelganger
+	callbackFromChatChannel   chan messageFromChatChannelToDoppelganger
+	textQueue                 chan messageFromChatChannelToDoppelganger
+	joined                    bool
+}
+
+//
+// How long we wait before dialing again after a dial fails or the
+// connection goes.
+//
+const clusterRedialInterval = 1 * time.Second
+
+func dialClusterPeer(addr string, timeout time.Duration, result chan net.Conn) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		result <- nil
+		return
+	}
+	result <- conn
+}
+
+//
+// DO IT
+// Goroutine for one other node. Runs for as long as the server does.
+//
+func clusterPeerGoroutine(chatServer *ChatServer, peer *clusterPeer) {
+	logger := chatServer.logger.With("goroutine", "cluster_peer", "node", peer.node, "addr", peer.addr)
+	watch := chatServer.stallWatchdog.watch(logger)
+	defer chatServer.stallWatchdog.unwatch(watch)
+	timeout := time.Duration(chatServer.config.ClusterPeerTimeoutSeconds) * time.Second
+	//
+	// Doppelganger ID to session, for everyone on (or joining) one of the
+	// other node's chat channels.
+	//
+	sessions := make(map[int64]*clusterSession)
+	//
+	// connection and incoming are nil while we don't have a connection;
+	// dialed gets the result of a dial, redial fires when it's time to try
+	// again. up is whether the other node has said hello back.
+	//
+	var connection *clusterConnection
+	var incoming chan clusterFrame
+	var redial <-chan time.Time
+	up := false
+	dialed := make(chan net.Conn, 1)
+	dialing := true
+	go dialClusterPeer(peer.addr, timeout, dialed)
+	pingTicker := time.NewTicker(timeout / 4)
+	defer pingTicker.Stop()
+	for {
+		select {
+		case <-chatServer.stop:
+			//
+			// Shutdown is done with us. Hang up, and if we're in the
+			// middle of dialing, hang up on that too once it's through.
+			//
+			if connection != nil {
+				close(connection.outgoing)
+				connection.conn.Close()
+			}
+			if dialing {
+				go func() {
+					conn := <-dialed
+					if conn != nil {
+						conn.Close()
+					}
+				}()
+			}
+			return
+		case conn := <-dialed:
+			dialing = false
+			if conn == nil {
+				logger.Debug("Dialing cluster node failed, will try again.")
+				redial = time.After(clusterRedialInterval)
+				break
+			}
+			connection = startClusterConnection(conn, timeout, logger)
+			incoming = connection.incoming
+			var hello clusterFrame
+			hello.Op = "hello"
+			hello.Node = chatServer.cluster.self
+			watch.sendToClusterConnection(connection.outgoing, hello)
+		case <-redial:
+			redial = nil
+			dialing = true
+			go dialClusterPeer(peer.addr, timeout, dialed)
+		case <-pingTicker.C:
+			if connection != nil {
+				var ping clusterFrame
+				ping.Op = "ping"
+				watch.sendToClusterConnection(connection.outgoing, ping)
+			}
+		case frame, ok := <-incoming:
+			if !ok {
+				close(connection.outgoing)
+				connection = nil
+				incoming = nil
+				if up {
+					up = false
+					if chatServer.cluster.membership.setUp(peer.node, false) {
+						announceMembershipChange(chatServer)
+					}
+					logger.With("sessions", len(sessions)).Warn("Cluster node down.")
+				}
+				dropClusterSessions(watch, peer, sessions)
+				redial = time.After(clusterRedialInterval)
+				break
+			}
+			switch frame.Op {
+			case "hello":
+				if frame.Node != peer.node {
+					logger.With("said_node", frame.Node).Error("Cluster node answered hello with the wrong name, hanging up.")
+					connection.conn.Close()
+					break
+				}
+				up = true
+				if chatServer.cluster.membership.setUp(peer.node, true) {
+					announceMembershipChange(chatServer)
+				}
+				logger.Info("Cluster node up.")
+			case "pong":
+				//
+				// Nothing to do -- hearing anything at all is what keeps
+				// the connection's read deadline from running out.
+				//
+			default:
+				handleFrameFromOwner(watch, logger, peer, sessions, frame)
+			}
+		case theMessage := <-peer.fromDoppelganger:
+			//
+			// No "ok" check here -- nobody ever closes this go channel.
+			//
+			handleRequestForOwner(watch, logger, peer, sessions, connection, theMessage)
+		case theMessage := <-peer.fromDoppelgangerToChatChannel:
+			session, exists := sessions[theMessage.doppelgangerID]
+			if !exists || !session.joined || (connection == nil) {
+				//
+				// Said right as the connection went. The doppelganger is
+				// about to hear it's off the chat channel.
+				//
+				break
+			}
+			switch theMessage.operation {
+			case fromDoppelgangerToChatChannelOpTextMessage:
+				var say clusterFrame
+				say.Op = "say"
+				say.Session = theMessage.doppelgangerID
+				say.UserID = theMessage.userID
+				say.Text = theMessage.parameter
+				say.Said = theMessage.said
+				watch.sendToClusterConnection(connection.outgoing, say)
+			default:
+				//
+				// Should never happen.
+				//
+				logger.With("operation", theMessage.operation).Error("Unexpected message operation code from doppelganger")
+			}
+		}
+	}
+}
+
+//
+// Join, who and exit from our doppelgangers, on their way to the other
+// node. If we don't have a connection, we answer for the other node: the
+// join is denied and the exit is done.
+//
+func handleRequestForOwner(watch *stallWatch, logger *Logger, peer *clusterPeer, sessions map[int64]*clusterSession, connection *clusterConnection, theMessage messageFromDoppelgangerToChannelMaster) {
+	switch theMessage.operation {
+	case fromDoppelgangerToChannelMasterOpJoin:
+		if connection == nil {
+			var reply messageFromChannelMasterToDoppelganger
+			reply.operation = fromChannelMasterToDoppelgangerOpJoinDenied
+			reply.msgToUser = "The server with #" + theMessage.parameter + " on it can't be reached right now. Please try again."
+			reply.channelID = 0
+			watch.sendFromClusterPeerToDoppelganger(theMessage.doppelgangerCallbackFromChannelMaster, reply, theMessage.doppelgangerID)
+			return
+		}
+		session := new(clusterSession)
+		session.userID = theMessage.userID
+		session.userName = theMessage.userName
+		session.chatChannelID = theMessage.chatChannelID
+		session.chatChannelName = theMessage.parameter
+		session.callbackFromChannelMaster = theMessage.doppelgangerCallbackFromChannelMaster
+		session.callbackFromChatChannel = theMessage.doppelgangerCallbackFromChatChannel
+		session.textQueue = theMessage.doppelgangerTextQueue
+		sessions[theMessage.doppelgangerID] = session
+		var join clusterFrame
+		join.Op = "join"
+		join.Session = theMessage.doppelgangerID
+		join.UserID = theMessage.userID
+		join.UserName = theMessage.userName
+		join.ChannelID = theMessage.chatChannelID
+		join.Channel = theMessage.parameter
+		watch.sendToClusterConnection(connection.outgoing, join)
+	case fromDoppelgangerToChannelMasterOpWho, fromDoppelgangerToChannelMasterOpExit:
+		_, exists := sessions[theMessage.doppelgangerID]
+		if !exists || (connection == nil) {
+			//
+			// We already told the doppelganger it's off the chat channel
+			// (the connection went), and it asked before it heard.
+			//
+			logger.With("doppelganger_id", theMessage.doppelgangerID, "operation", theMessage.operation).Debug("request for a session we've already dropped")
+			return
+		}
+		var frame clusterFrame
+		if theMessage.operation == fromDoppelgangerToChannelMasterOpWho {
+			frame.Op = "who"
+		} else {
+			frame.Op = "exit"
+		}
+		frame.Session = theMessage.doppelgangerID
+		watch.sendToClusterConnection(connection.outgoing, frame)
+	default:
+		//
+		// Should never happen.
+		//
+		logger.With("operation", theMessage.operation).Error("Unrecognized operation code received by cluster peer from doppelganger")
+	}
+}
+
+//
+// Frames from the other node's cluster member goroutines, answering our
+// doppelgangers. Each becomes what the shard or the chat channel would have
+// sent.
+//
+func handleFrameFromOwner(watch *stallWatch, logger *Logger, peer *clusterPeer, sessions map[int64]*clusterSession, frame clusterFrame) {
+	session, exists := sessions[frame.Session]
+	if !exists {
+		logger.With("session", frame.Session, "op", frame.Op).Debug("frame for a session we don't have")
+		return
+	}
+	switch frame.Op {
+	case "joined":
+		session.joined = true
+		var newMsg messageFromChatChannelToDoppelganger
+		newMsg.operation = fromChatChannelToDoppelgangerOpJoined
+		newMsg.originator = 0
+		newMsg.chatChannelID = session.chatChannelID
+		newMsg.parameter = frame.Channel
+		newMsg.chatChannelCallback = peer.fromDoppelgangerToChatChannel
+		watch.sendFromClusterPeerToChatChannelCallback(session.callbackFromChatChannel, newMsg, frame.Session)
+	case "denied":
+		var newMsg messageFromChatChannelToDoppelganger
+		newMsg.operation = fromChatChannelToDoppelgangerOpJoinDenied
+		newMsg.originator = 0
+		newMsg.chatChannelID = session.chatChannelID
+		newMsg.parameter = frame.Text
+		watch.sendFromClusterPeerToChatChannelCallback(session.callbackFromChatChannel, newMsg, frame.Session)
+		delete(sessions, frame.Session)
+	case "refused":
+		var reply messageFromChannelMasterToDoppelganger
+		reply.operation = fromChannelMasterToDoppelgangerOpJoinDenied
+		reply.msgToUser = frame.Text
+		reply.channelID = 0
+		watch.sendFromClusterPeerToDoppelganger(session.callbackFromChannelMaster, reply, frame.Session)
+		delete(sessions, frame.Session)
+	case "reply":
+		var newMsg messageFromChatChannelToDoppelganger
+		newMsg.operation = fromChatChannelToDoppelgangerOpTextMessage
+		newMsg.originator = 0
+		newMsg.chatChannelID = session.chatChannelID
+		newMsg.parameter = frame.Text
+		newMsg.machineLine = frame.Machine
+		watch.sendFromClusterPeerToChatChannelCallback(session.callbackFromChatChannel, newMsg, frame.Session)
+	case "text":
+		//
+		// Other people's chat, joins and leaves. The doppelganger shows
+		// someone else leaving the same way it shows chat, so they all
+		// come back as text messages.
+		//
+		var newMsg messageFromChatChannelToDoppelganger
+		newMsg.operation = fromChatChannelToDoppelgangerOpTextMessage
+		newMsg.originator = frame.Originator
+		newMsg.chatChannelID = session.chatChannelID
+		newMsg.sequence = frame.Sequence
+		newMsg.parameter = frame.Text
+		newMsg.machineLine = frame.Machine
+		queueTextForSession(session, newMsg)
+	case "moved":
+		var newMsg messageFromChatChannelToDoppelganger
+		newMsg.operation = fromChatChannelToDoppelgangerOpMoved
+		newMsg.originator = 0
+		newMsg.chatChannelID = session.chatChannelID
+		newMsg.parameter = session.chatChannelName
+		watch.sendFromClusterPeerToChatChannelCallback(session.callbackFromChatChannel, newMsg, frame.Session)
+	case "left":
+		var newMsg messageFromChatChannelToDoppelganger
+		newMsg.operation = fromChatChannelToDoppelgangerOpTextExit
+		newMsg.originator = 0
+		newMsg.chatChannelID = session.chatChannelID
+		newMsg.leavingDoppelgangerID = frame.Session
+		newMsg.parameter = frame.Text
+		newMsg.machineLine = frame.Machine
+		newMsg.chatChannelCallback = peer.fromDoppelgangerToChatChannel
+		watch.sendFromClusterPeerToChatChannelCallback(session.callbackFromChatChannel, newMsg, frame.Session)
+		delete(sessions, frame.Session)
+	default:
+		//
+		// Should never happen.
+		//
+		logger.With("op", frame.Op).Error("Unrecognized op from cluster node.")
+	}
+}
+
+//
+// Same as queueTextForMember, but the slow member policy was already
+// applied by the chat channel on the other node, to our cluster member
+// goroutine there. All we do if the doppelganger's text queue is full is
+// throw away the oldest; the sequence numbers came with the messages, so
+// the doppelganger still sees the gap and says how many were skipped.
+//
+func queueTextForSession(session *clusterSession, theMessage messageFromChatChannelToDoppelganger) {
+	select {
+	case session.textQueue <- theMessage:
+		return
+	default:
+	}
+	select {
+	case <-session.textQueue:
+	default:
+	}
+	select {
+	case session.textQueue <- theMessage:
+	default:
+	}
+}
+
+//
+// The connection to the other node is gone, and with it every chat channel
+// our users were on there. Everyone who had joined is told they're off the
+// chat channel, the same way as if they had typed /exit; everyone still
+// waiting to join is told they can't.
+//
+func dropClusterSessions(watch *stallWatch, peer *clusterPeer, sessions map[int64]*clusterSession) {
+	for doppelgangerID, session := range sessions {
+		if session.joined {
+			var newMsg messageFromChatChannelToDoppelganger
+			newMsg.operation = fromChatChannelToDoppelgangerOpTextExit
+			newMsg.originator = 0
+			newMsg.chatChannelID = session.chatChannelID
+			newMsg.leavingDoppelgangerID = doppelgangerID
+			newMsg.parameter = "Lost the connection to the server with #" + session.chatChannelName + " on it. You are no longer on the channel."
+			newMsg.machineLine = "PART #" + session.chatChannelName + " " + session.userName
+			newMsg.chatChannelCallback = peer.fromDoppelgangerToChatChannel
+			watch.sendFromClusterPeerToChatChannelCallback(session.callbackFromChatChannel, newMsg, doppelgangerID)
+		} else {
+			var reply messageFromChannelMasterToDoppelganger
+			reply.operation = fromChannelMasterToDoppelgangerOpJoinDenied
+			reply.msgToUser = "Lost the connection to the server with #" + session.chatChannelName + " on it. Please try again."
+			reply.channelID = 0
+			watch.sendFromClusterPeerToDoppelganger(session.callbackFromChannelMaster, reply, doppelgangerID)
+		}
+		delete(sessions, doppelgangerID)
+	}
+}
@@ -0,0 +1,263 @@
+package chatserver
+
+import (
+	"hash/fnv"
+	"strings"
+	"time"
+)
+
+//
+// Per-user preferences, and the colors that go with them. /set shows them,
+// and "/set <name> <value>" changes one; they're kept in the storage, and
+// loaded when the user logs in, so they follow the user from session to
+// session. Nobody gets colors or timestamps unless they ask:
+//
+//	/set color on       chat in color: a color for each kind of message
+//	                    (chat, emotes, notices, people joining and leaving),
+//	                    and one for each user's name, the same one every
+//	                    time
+//	/set timestamps on  the time at the start of every message
+//	/set theme light    colors for a light background instead of a dark one
+//
+// Colors are ANSI escape sequences, so they're only for terminals that
+// understand them. Over SSH, the client tells us what kind of terminal it is
+// when it asks for a pty; over Telnet, the telnet server asks with the
+// TERMINAL-TYPE option (RFC 1091 -- see servetelnet.go). A "dumb" terminal
+// doesn't get colors, and neither does one that won't say what it is, or
+// hasn't yet. Machine mode never gets either: tagged lines stay the same for
+// bots whatever the user set.
+//
+
+//
+// Every preference there is, and what it can be set to. The first value is
+// the one a user has until they set it.
+//
+var userPrefChoices = []struct {
+	name   string
+	values []string
+}{
+	{"color", []string{"off", "on"}},
+	{"timestamps", []string{"off", "on"}},
+	{"theme", []string{"dark", "light"}},
+}
+
+//
+// What a connection can tell us about the user's terminal besides its width
+// (see terminalSizer): what kind of terminal it is. SSH sessions know, and
+// Telnet ones once the client has told us (see servetelnet.go).
+//
+type terminalTyper interface {
+	TerminalType() string
+}
+
+const ansiReset = "\x1b[0m"
+
+//
+// A color for the timestamp, one for each kind of message (by its machine
+// mode tag -- see machinemode.go; none for plain chat), and the colors
+// user names get picked from.
+//
+type colorTheme struct {
+	timestamp string
+	kinds     map[string]string
+	names     []string
+}
+
+var colorThemes = map[string]colorTheme{
+	"dark": {
+		timestamp: "\x1b[90m",
+		kinds: map[string]string{
+			"EMOTE":   "\x1b[36m",
+			"NOTICE":  "\x1b[33m",
+			"JOIN":    "\x1b[32m",
+			"PART":    "\x1b[32m",
+			"SKIPPED": "\x1b[31m",
+			"ERR":     "\x1b[31m",
+		},
+		names: []string{"\x1b[91m", "\x1b[92m", "\x1b[93m", "\x1b[94m", "\x1b[95m", "\x1b[96m"},
+	},
+	"light": {
+		timestamp: "\x1b[90m",
+		kinds: map[string]string{
+			"EMOTE":   "\x1b[35m",
+			"NOTICE":  "\x1b[34m",
+			"JOIN":    "\x1b[32m",
+			"PART":    "\x1b[32m",
+			"SKIPPED": "\x1b[31m",
+			"ERR":     "\x1b[31m",
+		},
+		names: []string{"\x1b[31m", "\x1b[32m", "\x1b[34m", "\x1b[35m", "\x1b[36m"},
+	},
+}
+
+//
+// Whatever the user hasn't set is the default. Something in the storage we
+// don't know (a preference or value from a newer server, say) is left out.
+//
+func loadUserPrefs(doppelgangerState *userInfo) {
+	doppelgangerState.prefs = make(map[string]string)
+	for _, choice := range userPrefChoices {
+		doppelgangerState.prefs[choice.name] = choice.values[0]
+	}
+	stored, err := doppelgangerState.chatServer.store.loadUserPrefs(doppelgangerState.userID)
+	if err != nil {
+		//
+		// Not worth keeping them from logging in over.
+		//
+		doppelgangerState.logger.With("error", err).Error("Loading preferences failed.")
+		return
+	}
+	for name, value := range stored {
+		if isUserPrefChoice(name, value) {
+			doppelgangerState.prefs[name] = value
+		}
+	}
+}
+
+func isUserPrefChoice(name string, value string) bool {
+	for _, choice := range userPrefChoices {
+		if choice.name != name {
+			continue
+		}
+		for _, allowed := range choice.values {
+			if allowed == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//
+// Can the user's terminal show ANSI colors? (See the top of the file.)
+//
+func terminalHasColors(doppelgangerState *userInfo) bool {
+	if doppelgangerState.machineMode {
+		return false
+	}
+	typer, ok := doppelgangerState.connCloser.(terminalTyper)
+	if !ok {
+		return false
+	}
+	//
+	// Telnet clients tend to give the name in capitals ("XTERM", "DUMB").
+	// "UNKNOWN" is what some say when they don't know either.
+	//
+	terminalType := strings.ToLower(typer.TerminalType())
+	return (terminalType != "") && (terminalType != "dumb") && (terminalType != "unknown")
+}
+
+//
+// Same return values as doCommand.
+//
+func setCommand(doppelgangerState *userInfo, operand string) (bool, error) {
+	if operand == "" {
+		text := "\r\n"
+		lines := make([]string, 0)
+		for _, choice := range userPrefChoices {
+			text += choice.name + " " + doppelgangerState.prefs[choice.name] + "\r\n"
+			lines = append(lines, "SET "+choice.name+" "+doppelgangerState.prefs[choice.name])
+		}
+		if (doppelgangerState.prefs["color"] == "on") && !terminalHasColors(doppelgangerState) {
+			text += "Your terminal can't show colors, so you don't see them here.\r\n"
+		}
+		return true, writeToUser(doppelgangerState, text, strings.Join(lines, "\r\n"))
+	}
+	name := operand
+	value := ""
+	ii := strings.Index(operand, " ")
+	if ii > 0 {
+		name = strings.ToLower(operand[:ii])
+		value = strings.ToLower(trim(operand[ii:]))
+	}
+	if !isUserPrefChoice(name, value) {
+		usage := make([]string, 0)
+		for _, choice := range userPrefChoices {
+			usage = append(usage, choice.name+" "+strings.Join(choice.values, "|"))
+		}
+		return true, tellUser(doppelgangerState, "ERR", "\r\nUse /set <name> <value>: "+strings.Join(usage, ", ")+".\r\n")
+	}
+	err := doppelgangerState.chatServer.store.saveUserPref(doppelgangerState.userID, name, value)
+	if err != nil {
+		doppelgangerState.logger.With("error", err).Error("Saving preference failed.")
+		return true, tellUser(doppelgangerState, "ERR", "\r\nA database error has occurred.\r\n")
+	}
+	doppelgangerState.prefs[name] = value
+	text := "\r\n" + name + " is now " + value + "."
+	if (name == "color") && (value == "on") && !terminalHasColors(doppelgangerState) {
+		text += " Your terminal can't show colors, though, so you won't see them here."
+	}
+	return true, tellUser(doppelgangerState, "OK", text+"\r\n")
+}
+
+//
+// A chat channel's message the way the user wants it: with the time in
+// front, wrapped to their terminal, in color. We wrap before adding the
+// colors, so the escape sequences don't count towards the width; wrapping
+// only ever turns spaces into line breaks, so the timestamp and the name
+// are still at the front afterwards.
+//
+func formatChatText(doppelgangerState *userInfo, theMessage messageFromChatChannelToDoppelganger) string {
+	timestamp := ""
+	text := theMessage.parameter
+	if doppelgangerState.prefs["timestamps"] == "on" {
+		timestamp = time.Now().Format("[15:04]")
+		text = timestamp + " " + text
+	}
+	text = wrapToTerminal(doppelgangerState, text)
+	if (doppelgangerState.prefs["color"] != "on") || !terminalHasColors(doppelgangerState) {
+		return text
+	}
+	theme, ok := colorThemes[doppelgangerState.prefs["theme"]]
+	if !ok {
+		theme = colorThemes["dark"]
+	}
+	kind, userName := chatTextKind(theMessage)
+	colored := ""
+	if timestamp != "" {
+		colored = theme.timestamp + timestamp + ansiReset
+		text = text[len(timestamp):]
+		separator := " "
+		if strings.HasPrefix(text, "\r\n") {
+			separator = "\r\n"
+		}
+		colored += separator
+		text = text[len(separator):]
+	}
+	if (userName != "") && strings.HasPrefix(text, userName) {
+		colored += nameColor(theme, userName) + userName + ansiReset
+		text = text[len(userName):]
+	}
+	kindColor := theme.kinds[kind]
+	if (kindColor == "") || (text == "") {
+		return colored + text
+	}
+	return colored + kindColor + text + ansiReset
+}
+
+//
+// What kind of message it is, and who it's about if it's about someone,
+// from the tagged line a user in machine mode would get instead.
+//
+func chatTextKind(theMessage messageFromChatChannelToDoppelganger) (string, string) {
+	if theMessage.machineLine == "" {
+		return "NOTICE", ""
+	}
+	fields := strings.SplitN(theMessage.machineLine, " ", 4)
+	switch fields[0] {
+	case "MSG", "EMOTE", "JOIN", "PART":
+		if len(fields) >= 3 {
+			return fields[0], fields[2]
+		}
+	}
+	return fields[0], ""
+}
+
+//
+// The same name gets the same color every time, for everyone.
+//
+func nameColor(theme colorTheme, userName string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(userName))
+	return theme.names[hash.Sum32()%uint32(len(theme.names))]
+}
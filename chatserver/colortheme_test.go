@@ -0,0 +1,106 @@
+package chatserver
+
+import (
+	"regexp"
+	"testing"
+)
+
+//
+// A user who likes colors and timestamps, a chat channel with someone else
+// on it, and the preferences still there the next time they log in.
+//
+
+func TestColorTheme(t *testing.T) {
+	server := startTestServer(t, nil)
+	alice := server.logIn("alice", "secret")
+	alice.send("/set")
+	alice.expect("color off\r\ntimestamps off\r\ntheme dark\r\n")
+	alice.send("/set color purple")
+	alice.expect(`Use /set <name> <value>: color off\|on, timestamps off\|on, theme dark\|light\.`)
+	alice.send("/set color on")
+	alice.expect(`color is now on\.`)
+	alice.send("/set timestamps on")
+	alice.expect(`timestamps is now on\.`)
+	alice.send("/create lounge")
+	alice.expect(`created\.`)
+	alice.send("/join lounge")
+	alice.expect(`You have joined #lounge`)
+	bob := server.logIn("bob", "secret")
+	bob.send("/join lounge")
+	bob.expect(`You have joined #lounge`)
+	theme := colorThemes["dark"]
+	timestamp := regexp.QuoteMeta(theme.timestamp) + `\[\d\d:\d\d\]` + regexp.QuoteMeta(ansiReset) + " "
+	bobColor := regexp.QuoteMeta(nameColor(theme, "bob") + "bob" + ansiReset)
+	alice.expect(timestamp + bobColor + regexp.QuoteMeta(theme.kinds["JOIN"]+" has joined #lounge"))
+	bob.send("hi")
+	bob.expect(`> hibob says, "hi"\r\n`)
+	alice.expect(timestamp + bobColor + ` says, "hi"\r\n`)
+	bob.send("/emote waves")
+	alice.expect(timestamp + bobColor + regexp.QuoteMeta(theme.kinds["EMOTE"]+" waves"+ansiReset))
+	//
+	// Same colors for everyone, and another theme's if you want.
+	//
+	alice.send("/set theme light")
+	alice.expect(`theme is now light\.`)
+	bob.send("/set color on")
+	bob.expect(`color is now on\.`)
+	alice.send("hello")
+	bob.expect(`> ` + regexp.QuoteMeta(nameColor(theme, "alice")+"alice"+ansiReset) + ` says, "hello"`)
+	alice.expect(timestamp + regexp.QuoteMeta(nameColor(colorThemes["light"], "alice")+"alice"+ansiReset) + ` says, "hello"`)
+	//
+	// Machine mode gets neither.
+	//
+	alice.send("/machine")
+	alice.expect("Machine mode on\\.\r\n")
+	bob.send("again")
+	alice.expect("^MSG #lounge bob again\r\n")
+	alice.send("/set")
+	alice.expect("^SET color on\r\nSET timestamps on\r\nSET theme light\r\n")
+	//
+	// And they're kept.
+	//
+	carol := server.logIn("alice", "secret")
+	carol.send("/set")
+	carol.expect("color on\r\ntimestamps on\r\ntheme light\r\n")
+	//
+	// Unless their terminal can't show them, or won't say whether it can.
+	//
+	for _, terminalType := range []string{"DUMB", ""} {
+		dave := server.logInOn(server.dialTerminal("dave", terminalType), "alice", "secret")
+		dave.send("/set")
+		dave.expect("color on\r\ntimestamps on\r\ntheme light\r\n" + `Your terminal can't show colors, so you don't see them here\.`)
+	}
+}
+
+type testTerminal struct {
+	terminalType string
+}
+
+func (terminal testTerminal) Close() error {
+	return nil
+}
+
+func (terminal testTerminal) TerminalType() string {
+	return terminal.terminalType
+}
+
+func TestTerminalHasColors(t *testing.T) {
+	for _, test := range []struct {
+		doppelgangerState userInfo
+		hasColors         bool
+	}{
+		{userInfo{telnet: true}, false},
+		{userInfo{telnet: true, connCloser: testTerminal{"XTERM"}}, true},
+		{userInfo{telnet: true, connCloser: testTerminal{"DUMB"}}, false},
+		{userInfo{telnet: true, connCloser: testTerminal{"UNKNOWN"}}, false},
+		{userInfo{connCloser: testTerminal{"xterm-256color"}, machineMode: true}, false},
+		{userInfo{connCloser: testTerminal{"xterm-256color"}}, true},
+		{userInfo{connCloser: testTerminal{"dumb"}}, false},
+		{userInfo{connCloser: testTerminal{""}}, false},
+		{userInfo{}, false},
+	} {
+		if terminalHasColors(&test.doppelgangerState) != test.hasColors {
+			t.Errorf("terminalHasColors(%+v) is %v", test.doppelgangerState, !test.hasColors)
+		}
+	}
+}
@@ -0,0 +1,1039 @@
+package chatserver
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// Configuration for the whole daemon. Everything that used to be hardcoded
+// in main (listen port, database file name, go channel buffer sizes, log file
+// locations, welcome text) lives here now. Values come
+// from three places, in increasing order of priority: the defaults below, the
+// JSON config file (if one is given with -config), and command-line flags.
+//
+// The daemon's main loads the config with LoadConfig; a program embedding
+// the chat server can fill in a Config itself, starting from DefaultConfig.
+// Either way it's validated in New, before any goroutines are launched, and
+// ChatServer.config is never modified after that, so it's safe for every
+// goroutine to read it without going through an owner goroutine.
+//
+// Some settings can be changed without a restart (ChatServer.Reload, which
+// the daemon calls when it gets SIGHUP). Those are copied into a
+// liveSettings (see datastructures.go), which the channel master owns and
+// passes along to the goroutines that use them. Goroutines must take those
+// settings from their liveSettings, not from ChatServer.config, or they'll
+// never see a reload.
+//
+
+type TLSListenerConfig struct {
+	Addr     string `json:"addr"`
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+type ClusterPeerConfig struct {
+	Node string `json:"node"`
+	Addr string `json:"addr"`
+}
+
+type Config struct {
+	//
+	// Network.
+	//
+	Listen    []string            `json:"listen"`
+	ListenTLS []TLSListenerConfig `json:"listen_tls"`
+	//
+	// Address for the HTTP metrics endpoint (/metrics, in Prometheus text
+	// format), e.g. "127.0.0.1:9555". Empty means no metrics endpoint. It
+	// has no authentication, so keep it on a local or private address.
+	//
+	MetricsListen string `json:"metrics_listen"`
+	//
+	// Address for the web gateway (see webgateway.go), e.g. ":8080": a chat
+	// client for browsers, and the JSON events it runs on. Empty means no
+	// web gateway. It's plain HTTP, so put it behind an HTTPS proxy if it
+	// can be reached from outside.
+	//
+	WebListen string `json:"web_listen"`
+	//
+	// Address for the HTTP API (see apiserver.go), e.g. "127.0.0.1:8081",
+	// for bots and other programs, with a per-user API token for each.
+	// Empty means no API. Plain HTTP, tokens and all, so the same goes as
+	// for the web gateway.
+	//
+	APIListen string `json:"api_listen"`
+	//
+	// Address for the IRC gateway (see ircgateway.go), e.g. ":6667", so IRC
+	// clients can chat on the same chat channels. Empty means no IRC
+	// gateway. It's plain text, passwords and all, same as Telnet.
+	//
+	IRCListen string `json:"irc_listen"`
+	//
+	// Address for the SSH listener (see sshlistener.go), e.g. ":2222": the
+	// same chat as Telnet, encrypted, for any ssh client. Empty means no
+	// SSH. Its host key is kept in SSHHostKeyFile, which is made the first
+	// time if it isn't there.
+	//
+	SSHListen      string `json:"ssh_listen"`
+	SSHHostKeyFile string `json:"ssh_host_key_file"`
+	//
+	// Path of the Unix domain socket for the admin console. Empty means no
+	// admin console. Anyone who can connect to the socket can kick users,
+	// so it's made readable and writable by the daemon's user only.
+	//
+	AdminSocket string `json:"admin_socket"`
+	//
+	// Files.
+	//
+	DatabasePath  string `json:"database_path"`
+	LogDir        string `json:"log_dir"`
+	DaemonLogFile string `json:"daemon_log_file"`
+	MOTDFile      string `json:"motd_file"`
+	//
+	// The database's SQLite journal mode ("wal" lets users log in while
+	// someone else is creating an account; use "delete" if the database is
+	// on a network file system, where WAL doesn't work) and how many
+	// milliseconds to wait for another connection's lock before giving up.
+	//
+	DatabaseJournalMode   string `json:"database_journal_mode"`
+	DatabaseBusyTimeoutMs int    `json:"database_busy_timeout_ms"`
+	//
+	// Only bring the database schema up to date, then exit (-migrate-only;
+	// there's no point putting it in the config file).
+	//
+	MigrateOnly bool `json:"-"`
+	//
+	// How much goes in the daemon log: LogLevel is "error", "warn", "info",
+	// "debug" or "trace" (the last two include every connection the telnet
+	// server accepts), and LogFormat is "logfmt" or "json".
+	//
+	LogLevel  string `json:"log_level"`
+	LogFormat string `json:"log_format"`
+	//
+	// Who can connect and who can sign up. Registration is "open" (anyone
+	// can create an account at the login prompt) or "closed" (only existing
+	// users can log in). BannedIPs are IP addresses or CIDR networks
+	// (e.g. "203.0.113.7", "198.51.100.0/24") that get turned away.
+	//
+	Registration string   `json:"registration"`
+	BannedIPs    []string `json:"banned_ips"`
+	//
+	// What users see when the server is shutting down.
+	//
+	ShutdownMessage string `json:"shutdown_message"`
+	//
+	// Idle users. After IdleWarningSeconds without typing anything a user
+	// is warned, and after IdleTimeoutSeconds they're disconnected (0 turns
+	// either off). Users who set themselves /away aren't disconnected if
+	// AwayExemptFromIdle is set.
+	//
+	IdleWarningSeconds int  `json:"idle_warning_seconds"`
+	IdleTimeoutSeconds int  `json:"idle_timeout_seconds"`
+	AwayExemptFromIdle bool `json:"away_exempt_from_idle"`
+	//
+	// Dead connections. Every KeepaliveSeconds we send the client a Telnet
+	// NOP, so a connection that's gone away shows up as a write error (0
+	// turns that off). TCPKeepaliveSeconds is the TCP keepalive period on
+	// accepted connections; 0 leaves the system default and -1 turns TCP
+	// keepalive off.
+	//
+	KeepaliveSeconds    int `json:"keepalive_seconds"`
+	TCPKeepaliveSeconds int `json:"tcp_keepalive_seconds"`
+	//
+	// Slow clients. Chat text waits for each member of a chat channel in a
+	// queue of its own, MemberQueue messages long, so one member who isn't
+	// reading can't hold up everyone else on the channel. When a member's
+	// queue is full, SlowMemberPolicy says what happens: "drop_oldest"
+	// throws away the oldest message waiting (the user sees how many they
+	// missed) and "disconnect" hangs up on them. A write to a client that
+	// takes longer than ClientWriteTimeoutSeconds hangs up on them too (0
+	// means wait forever).
+	//
+	MemberQueue               int    `json:"member_queue"`
+	SlowMemberPolicy          string `json:"slow_member_policy"`
+	ClientWriteTimeoutSeconds int    `json:"client_write_timeout_seconds"`
+	//
+	// Connection limits, across all listeners. MaxConnections is the most
+	// users connected at once and MaxConnectionsPerIP the most from one IP
+	// address. NewConnectionsPerIPPerMinute limits how fast one IP address
+	// can connect. Clients over any of these are told why (with
+	// ServerFullMessage or TooManyConnectionsMessage) and hung up on.
+	// AcceptPerSecond limits how fast we take new connections at all;
+	// connections over that rate wait their turn. 0 means no limit for all
+	// of these.
+	//
+	MaxConnections               int    `json:"max_connections"`
+	MaxConnectionsPerIP          int    `json:"max_connections_per_ip"`
+	NewConnectionsPerIPPerMinute int    `json:"new_connections_per_ip_per_minute"`
+	AcceptPerSecond              int    `json:"accept_per_second"`
+	ServerFullMessage            string `json:"server_full_message"`
+	TooManyConnectionsMessage    string `json:"too_many_connections_message"`
+	//
+	// Limits. The go channel buffer sizes are here because, as explained in
+	// New, they need to be big enough for all the users (or chat channels)
+	// simultaneously on the system. The channel master's shards each get
+	// go channels of the same sizes as the channel master's.
+	//
+	MaxChatChannelMembers          int `json:"max_chat_channel_members"`
+	ChannelMasterShards            int `json:"channel_master_shards"`
+	ChannelMasterDoppelgangerQueue int `json:"channel_master_doppelganger_queue"`
+	ChannelMasterChatChannelQueue  int `json:"channel_master_chat_channel_queue"`
+	ChatChannelQueue               int `json:"chat_channel_queue"`
+	//
+	// How many of the latest messages each chat channel remembers, for the
+	// API's history. 0 remembers none.
+	//
+	ChatHistory int `json:"chat_history"`
+	//
+	// Timeouts and intervals.
+	//
+	AcceptRetrySeconds   int `json:"accept_retry_seconds"`
+	ShutdownDrainSeconds int `json:"shutdown_drain_seconds"`
+	//
+	// The stall watchdog logs any goroutine that's been blocked sending to
+	// another one (or writing to a client) for StallThresholdSeconds (0
+	// turns the watchdog off). If StallStackDumpDir is set, it also writes
+	// every goroutine's stack to a file there.
+	//
+	StallThresholdSeconds int    `json:"stall_threshold_seconds"`
+	StallStackDumpDir     string `json:"stall_stack_dump_dir"`
+	//
+	// Clustering (see cluster.go). ClusterNode is this server's name in the
+	// cluster; empty means no cluster. The other nodes connect to
+	// ClusterListen, and ClusterPeers are all the other nodes, by name and
+	// the address of their ClusterListen. A node we haven't heard from for
+	// ClusterPeerTimeoutSeconds is taken to be down. Every node has to use
+	// the same database.
+	//
+	ClusterNode               string              `json:"cluster_node"`
+	ClusterListen             string              `json:"cluster_listen"`
+	ClusterPeers              []ClusterPeerConfig `json:"cluster_peers"`
+	ClusterPeerTimeoutSeconds int                 `json:"cluster_peer_timeout_seconds"`
+	//
+	// Built-in plugins to run (see plugin.go), by name, e.g. "timebot".
+	// They're called before any a program embedding the server passes in
+	// Hooks.Plugins.
+	//
+	Plugins []string `json:"plugins"`
+	//
+	// Where to send chat events (see eventsink.go): an http:// or https://
+	// URL to POST each one to, or unix:<path> for a Unix socket to write
+	// them to, a line of JSON each. Empty means nowhere. EventQueue is how
+	// many events can wait to go out -- once it's full, new ones are thrown
+	// away -- and EventRetries how many more times we try to send one
+	// before giving up on it.
+	//
+	EventSink    string `json:"event_sink"`
+	EventQueue   int    `json:"event_queue"`
+	EventRetries int    `json:"event_retries"`
+}
+
+const defaultWelcomeMessage = "Welcome to the Wayne Brain Telnet daemon. Type ^D to exit."
+
+//
+// These are the values that used to be hardcoded, so a server started with
+// no config file and no flags behaves exactly like it always did.
+//
+func DefaultConfig() Config {
+	var config Config
+	config.Listen = []string{":5555"}
+	config.ListenTLS = make([]TLSListenerConfig, 0)
+	config.MetricsListen = ""
+	config.WebListen = ""
+	config.APIListen = ""
+	config.IRCListen = ""
+	config.SSHListen = ""
+	config.SSHHostKeyFile = "ssh_host_ed25519_key"
+	config.AdminSocket = ""
+	config.DatabasePath = "waynetelnet.db"
+	config.LogDir = "."
+	config.DaemonLogFile = ""
+	config.MOTDFile = ""
+	config.DatabaseJournalMode = "wal"
+	config.DatabaseBusyTimeoutMs = 5000
+	config.MigrateOnly = false
+	config.LogLevel = "info"
+	config.LogFormat = "logfmt"
+	config.Registration = "open"
+	config.BannedIPs = make([]string, 0)
+	config.ShutdownMessage = "The server is shutting down. Goodbye!"
+	config.IdleWarningSeconds = 0
+	config.IdleTimeoutSeconds = 0
+	config.AwayExemptFromIdle = true
+	config.KeepaliveSeconds = 60
+	config.TCPKeepaliveSeconds = 60
+	config.MemberQueue = 64
+	config.SlowMemberPolicy = "drop_oldest"
+	config.ClientWriteTimeoutSeconds = 60
+	config.MaxConnections = 0
+	config.MaxConnectionsPerIP = 0
+	config.NewConnectionsPerIPPerMinute = 0
+	config.AcceptPerSecond = 0
+	config.ServerFullMessage = "Sorry, the server is full right now. Please try again later."
+	config.TooManyConnectionsMessage = "Sorry, there are too many connections from your address right now. Please try again later."
+	config.MaxChatChannelMembers = 6
+	config.ChannelMasterShards = 8
+	config.ChannelMasterDoppelgangerQueue = 16384
+	config.ChannelMasterChatChannelQueue = 512
+	config.ChatChannelQueue = 128
+	config.ChatHistory = 50
+	config.AcceptRetrySeconds = 10
+	config.ShutdownDrainSeconds = 10
+	config.StallThresholdSeconds = 10
+	config.StallStackDumpDir = ""
+	config.ClusterNode = ""
+	config.ClusterListen = ""
+	config.ClusterPeers = make([]ClusterPeerConfig, 0)
+	config.ClusterPeerTimeoutSeconds = 5
+	config.Plugins = make([]string, 0)
+	config.EventSink = ""
+	config.EventQueue = 1000
+	config.EventRetries = 5
+	return config
+}
+
+//
+// Reads the JSON config file on top of whatever is already in config.
+// Fields not mentioned in the file keep their previous (default) values.
+//
+func loadConfigFile(config *Config, configFilePath string) error {
+	contents, err := ioutil.ReadFile(configFilePath)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(contents)))
+	decoder.DisallowUnknownFields() // catch typos in field names
+	err = decoder.Decode(config)
+	if err != nil {
+		return errors.New("config file " + configFilePath + ": " + err.Error())
+	}
+	return nil
+}
+
+//
+// flag.Value for flags that can be given more than once, e.g.
+// "-listen :5555 -listen :6666". A comma-separated list is also accepted.
+//
+type stringListFlag []string
+
+func (list *stringListFlag) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringListFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		item = trim(item)
+		if item != "" {
+			*list = append(*list, item)
+		}
+	}
+	return nil
+}
+
+//
+// Same as stringListFlag, but each value is "addr;certfile;keyfile" since a
+// TLS listener needs all three.
+//
+type tlsListenerListFlag []TLSListenerConfig
+
+func (list *tlsListenerListFlag) String() string {
+	parts := make([]string, 0)
+	for _, listener := range *list {
+		parts = append(parts, listener.Addr+";"+listener.CertFile+";"+listener.KeyFile)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (list *tlsListenerListFlag) Set(value string) error {
+	parts := strings.Split(value, ";")
+	if len(parts) != 3 {
+		return errors.New("TLS listener must be given as addr;certfile;keyfile, got " + strconv.Quote(value))
+	}
+	var listener TLSListenerConfig
+	listener.Addr = trim(parts[0])
+	listener.CertFile = trim(parts[1])
+	listener.KeyFile = trim(parts[2])
+	*list = append(*list, listener)
+	return nil
+}
+
+//
+// Same again for cluster peers, each given as "node=addr".
+//
+type clusterPeerListFlag []ClusterPeerConfig
+
+func (list *clusterPeerListFlag) String() string {
+	parts := make([]string, 0)
+	for _, peer := range *list {
+		parts = append(parts, peer.Node+"="+peer.Addr)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (list *clusterPeerListFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return errors.New("cluster peer must be given as node=addr, got " + strconv.Quote(item))
+		}
+		var peer ClusterPeerConfig
+		peer.Node = trim(parts[0])
+		peer.Addr = trim(parts[1])
+		*list = append(*list, peer)
+	}
+	return nil
+}
+
+//
+// Parses the command line, loads the config file if one was named, and lets
+// any flags that were explicitly given override the file. The result is
+// validated before it is returned.
+//
+func LoadConfig(arguments []string) (Config, error) {
+	config := DefaultConfig()
+	flagSet := flag.NewFlagSet("wtelnet", flag.ContinueOnError)
+	configFilePath := flagSet.String("config", "", "path to JSON config file")
+	var listen stringListFlag
+	flagSet.Var(&listen, "listen", "address to listen on for plain Telnet (repeatable)")
+	var listenTLS tlsListenerListFlag
+	flagSet.Var(&listenTLS, "listen-tls", "TELNETS listener as addr;certfile;keyfile (repeatable)")
+	metricsListen := flagSet.String("metrics", config.MetricsListen, "address for the HTTP metrics endpoint, e.g. 127.0.0.1:9555; off if empty")
+	webListen := flagSet.String("web", config.WebListen, "address for the web gateway (a chat client for browsers), e.g. :8080; off if empty")
+	apiListen := flagSet.String("api", config.APIListen, "address for the HTTP API for bots, e.g. 127.0.0.1:8081; off if empty")
+	ircListen := flagSet.String("irc", config.IRCListen, "address for the IRC gateway, e.g. :6667; off if empty")
+	sshListen := flagSet.String("ssh", config.SSHListen, "address for the SSH listener, e.g. :2222; off if empty")
+	sshHostKeyFile := flagSet.String("ssh-host-key", config.SSHHostKeyFile, "path of the SSH host key (made if it isn't there)")
+	adminSocket := flagSet.String("admin-socket", config.AdminSocket, "path of the Unix socket for the admin console; off if empty")
+	databasePath := flagSet.String("db", config.DatabasePath, "path to SQLite database file")
+	databaseJournalMode := flagSet.String("db-journal-mode", config.DatabaseJournalMode, "SQLite journal mode: wal, delete, truncate or persist")
+	databaseBusyTimeoutMs := flagSet.Int("db-busy-timeout", config.DatabaseBusyTimeoutMs, "milliseconds to wait for a database lock before giving up")
+	migrateOnly := flagSet.Bool("migrate-only", config.MigrateOnly, "bring the database schema up to date and exit")
+	logDir := flagSet.String("log-dir", config.LogDir, "directory for chat channel conversation logs")
+	daemonLogFile := flagSet.String("daemon-log", config.DaemonLogFile, "file (in log-dir) for daemon error log; stderr if empty")
+	logLevel := flagSet.String("log-level", config.LogLevel, "daemon log verbosity: error, warn, info, debug or trace")
+	logFormat := flagSet.String("log-format", config.LogFormat, "daemon log line format: logfmt or json")
+	motdFile := flagSet.String("motd", config.MOTDFile, "file with the welcome message shown on connect")
+	registration := flagSet.String("registration", config.Registration, "\"open\" to let anyone create an account, \"closed\" to allow only existing users")
+	var bannedIPs stringListFlag
+	flagSet.Var(&bannedIPs, "ban", "IP address or CIDR network to refuse connections from (repeatable)")
+	maxChatChannelMembers := flagSet.Int("max-channel-members", config.MaxChatChannelMembers, "maximum number of users on one chat channel")
+	channelMasterShards := flagSet.Int("shards", config.ChannelMasterShards, "number of channel master shards the running chat channels are split between")
+	channelMasterDoppelgangerQueue := flagSet.Int("master-doppelganger-queue", config.ChannelMasterDoppelgangerQueue, "buffer size of go channel from doppelgangers to channel master")
+	channelMasterChatChannelQueue := flagSet.Int("master-chat-channel-queue", config.ChannelMasterChatChannelQueue, "buffer size of go channel from chat channels to channel master")
+	chatChannelQueue := flagSet.Int("chat-channel-queue", config.ChatChannelQueue, "buffer size of go channel from doppelgangers to each chat channel")
+	chatHistory := flagSet.Int("chat-history", config.ChatHistory, "latest messages each chat channel remembers for the API")
+	acceptRetrySeconds := flagSet.Int("accept-retry", config.AcceptRetrySeconds, "most seconds to wait before accepting again after running out of file descriptors")
+	shutdownDrainSeconds := flagSet.Int("shutdown-drain", config.ShutdownDrainSeconds, "seconds to wait for users to disconnect when shutting down")
+	idleWarningSeconds := flagSet.Int("idle-warning", config.IdleWarningSeconds, "seconds without typing before a user is warned about being idle; 0 for never")
+	idleTimeoutSeconds := flagSet.Int("idle-timeout", config.IdleTimeoutSeconds, "seconds without typing before a user is disconnected; 0 for never")
+	awayExemptFromIdle := flagSet.Bool("away-exempt", config.AwayExemptFromIdle, "users who are /away are not disconnected for being idle")
+	keepaliveSeconds := flagSet.Int("keepalive", config.KeepaliveSeconds, "seconds between Telnet NOPs sent to each client; 0 for never")
+	maxConnections := flagSet.Int("max-connections", config.MaxConnections, "most users connected at once; 0 for no limit")
+	maxConnectionsPerIP := flagSet.Int("max-connections-per-ip", config.MaxConnectionsPerIP, "most connections at once from one IP address; 0 for no limit")
+	newConnectionsPerIPPerMinute := flagSet.Int("per-ip-rate", config.NewConnectionsPerIPPerMinute, "most new connections per minute from one IP address; 0 for no limit")
+	acceptPerSecond := flagSet.Int("accept-rate", config.AcceptPerSecond, "most new connections accepted per second; 0 for no limit")
+	stallThresholdSeconds := flagSet.Int("stall-threshold", config.StallThresholdSeconds, "seconds a goroutine can be blocked sending before the stall watchdog logs it; 0 for no watchdog")
+	stallStackDumpDir := flagSet.String("stall-dumps", config.StallStackDumpDir, "directory to dump goroutine stacks to when a stall is detected; no dumps if empty")
+	tcpKeepaliveSeconds := flagSet.Int("tcp-keepalive", config.TCPKeepaliveSeconds, "TCP keepalive period in seconds on accepted connections; -1 for off")
+	memberQueue := flagSet.Int("member-queue", config.MemberQueue, "chat messages that can wait for each chat channel member before the slow member policy kicks in")
+	slowMemberPolicy := flagSet.String("slow-member-policy", config.SlowMemberPolicy, "what to do when a member's queue is full: \"drop_oldest\" or \"disconnect\"")
+	clientWriteTimeoutSeconds := flagSet.Int("write-timeout", config.ClientWriteTimeoutSeconds, "seconds a write to a client can take before we hang up on them; 0 for no limit")
+	clusterNode := flagSet.String("cluster-node", config.ClusterNode, "this server's name in the cluster; no cluster if empty")
+	clusterListen := flagSet.String("cluster-listen", config.ClusterListen, "address the other cluster nodes connect to, e.g. 127.0.0.1:7555")
+	var clusterPeers clusterPeerListFlag
+	flagSet.Var(&clusterPeers, "cluster-peer", "another cluster node as name=addr (repeatable)")
+	clusterPeerTimeoutSeconds := flagSet.Int("cluster-peer-timeout", config.ClusterPeerTimeoutSeconds, "seconds without hearing from a cluster node before it's taken to be down")
+	var plugins stringListFlag
+	flagSet.Var(&plugins, "plugin", "built-in plugin to run, e.g. timebot (repeatable)")
+	eventSink := flagSet.String("event-sink", config.EventSink, "where to send chat events: an http:// URL or unix:<socket path>; nowhere if empty")
+	eventQueue := flagSet.Int("event-queue", config.EventQueue, "most chat events waiting to be sent before new ones are thrown away")
+	eventRetries := flagSet.Int("event-retries", config.EventRetries, "times to retry sending a chat event before giving up on it")
+	err := flagSet.Parse(arguments)
+	if err != nil {
+		return config, err
+	}
+	if *configFilePath != "" {
+		err = loadConfigFile(&config, *configFilePath)
+		if err != nil {
+			return config, err
+		}
+	}
+	//
+	// Only flags that were actually typed on the command line override the
+	// config file -- otherwise a flag's default would clobber the file.
+	//
+	flagSet.Visit(func(theFlag *flag.Flag) {
+		switch theFlag.Name {
+		case "listen":
+			config.Listen = listen
+		case "listen-tls":
+			config.ListenTLS = listenTLS
+		case "metrics":
+			config.MetricsListen = *metricsListen
+		case "web":
+			config.WebListen = *webListen
+		case "api":
+			config.APIListen = *apiListen
+		case "irc":
+			config.IRCListen = *ircListen
+		case "ssh":
+			config.SSHListen = *sshListen
+		case "ssh-host-key":
+			config.SSHHostKeyFile = *sshHostKeyFile
+		case "admin-socket":
+			config.AdminSocket = *adminSocket
+		case "db":
+			config.DatabasePath = *databasePath
+		case "db-journal-mode":
+			config.DatabaseJournalMode = *databaseJournalMode
+		case "db-busy-timeout":
+			config.DatabaseBusyTimeoutMs = *databaseBusyTimeoutMs
+		case "migrate-only":
+			config.MigrateOnly = *migrateOnly
+		case "log-dir":
+			config.LogDir = *logDir
+		case "daemon-log":
+			config.DaemonLogFile = *daemonLogFile
+		case "log-level":
+			config.LogLevel = *logLevel
+		case "log-format":
+			config.LogFormat = *logFormat
+		case "motd":
+			config.MOTDFile = *motdFile
+		case "registration":
+			config.Registration = *registration
+		case "ban":
+			config.BannedIPs = bannedIPs
+		case "max-channel-members":
+			config.MaxChatChannelMembers = *maxChatChannelMembers
+		case "shards":
+			config.ChannelMasterShards = *channelMasterShards
+		case "master-doppelganger-queue":
+			config.ChannelMasterDoppelgangerQueue = *channelMasterDoppelgangerQueue
+		case "master-chat-channel-queue":
+			config.ChannelMasterChatChannelQueue = *channelMasterChatChannelQueue
+		case "chat-channel-queue":
+			config.ChatChannelQueue = *chatChannelQueue
+		case "chat-history":
+			config.ChatHistory = *chatHistory
+		case "accept-retry":
+			config.AcceptRetrySeconds = *acceptRetrySeconds
+		case "shutdown-drain":
+			config.ShutdownDrainSeconds = *shutdownDrainSeconds
+		case "stall-threshold":
+			config.StallThresholdSeconds = *stallThresholdSeconds
+		case "stall-dumps":
+			config.StallStackDumpDir = *stallStackDumpDir
+		case "idle-warning":
+			config.IdleWarningSeconds = *idleWarningSeconds
+		case "idle-timeout":
+			config.IdleTimeoutSeconds = *idleTimeoutSeconds
+		case "away-exempt":
+			config.AwayExemptFromIdle = *awayExemptFromIdle
+		case "keepalive":
+			config.KeepaliveSeconds = *keepaliveSeconds
+		case "tcp-keepalive":
+			config.TCPKeepaliveSeconds = *tcpKeepaliveSeconds
+		case "member-queue":
+			config.MemberQueue = *memberQueue
+		case "slow-member-policy":
+			config.SlowMemberPolicy = *slowMemberPolicy
+		case "write-timeout":
+			config.ClientWriteTimeoutSeconds = *clientWriteTimeoutSeconds
+		case "max-connections":
+			config.MaxConnections = *maxConnections
+		case "max-connections-per-ip":
+			config.MaxConnectionsPerIP = *maxConnectionsPerIP
+		case "per-ip-rate":
+			config.NewConnectionsPerIPPerMinute = *newConnectionsPerIPPerMinute
+		case "accept-rate":
+			config.AcceptPerSecond = *acceptPerSecond
+		case "cluster-node":
+			config.ClusterNode = *clusterNode
+		case "cluster-listen":
+			config.ClusterListen = *clusterListen
+		case "cluster-peer":
+			config.ClusterPeers = clusterPeers
+		case "cluster-peer-timeout":
+			config.ClusterPeerTimeoutSeconds = *clusterPeerTimeoutSeconds
+		case "plugin":
+			config.Plugins = plugins
+		case "event-sink":
+			config.EventSink = *eventSink
+		case "event-queue":
+			config.EventQueue = *eventQueue
+		case "event-retries":
+			config.EventRetries = *eventRetries
+		}
+	})
+	err = validateConfig(&config, true)
+	return config, err
+}
+
+//
+// Checks everything we can check before starting up, so the server refuses
+// to start with a clear message instead of failing later in some goroutine.
+// All problems are reported at once rather than one per run.
+//
+// needListener is for the daemon, which has nothing to do if there's
+// nowhere to listen. New doesn't care: a program embedding the chat server
+// can hand Serve listeners of its own.
+//
+func validateConfig(config *Config, needListener bool) error {
+	problems := make([]string, 0)
+	if needListener && ((len(config.Listen) + len(config.ListenTLS)) == 0) {
+		problems = append(problems, "no listen addresses configured (need at least one of listen or listen_tls)")
+	}
+	for _, addr := range config.Listen {
+		problem := checkListenAddr(addr)
+		if problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	for _, listener := range config.ListenTLS {
+		problem := checkListenAddr(listener.Addr)
+		if problem != "" {
+			problems = append(problems, problem)
+		}
+		if listener.CertFile == "" || listener.KeyFile == "" {
+			problems = append(problems, "TLS listener "+listener.Addr+" needs both cert_file and key_file")
+			continue
+		}
+		for _, tlsFile := range []string{listener.CertFile, listener.KeyFile} {
+			_, err := os.Stat(tlsFile)
+			if err != nil {
+				problems = append(problems, "TLS listener "+listener.Addr+": "+err.Error())
+			}
+		}
+	}
+	if config.MetricsListen != "" {
+		problem := checkListenAddr(config.MetricsListen)
+		if problem != "" {
+			problems = append(problems, "metrics_listen: "+problem)
+		}
+	}
+	if config.WebListen != "" {
+		problem := checkListenAddr(config.WebListen)
+		if problem != "" {
+			problems = append(problems, "web_listen: "+problem)
+		}
+	}
+	if config.APIListen != "" {
+		problem := checkListenAddr(config.APIListen)
+		if problem != "" {
+			problems = append(problems, "api_listen: "+problem)
+		}
+	}
+	if config.IRCListen != "" {
+		problem := checkListenAddr(config.IRCListen)
+		if problem != "" {
+			problems = append(problems, "irc_listen: "+problem)
+		}
+	}
+	if config.SSHListen != "" {
+		problem := checkListenAddr(config.SSHListen)
+		if problem != "" {
+			problems = append(problems, "ssh_listen: "+problem)
+		}
+		if config.SSHHostKeyFile == "" {
+			problems = append(problems, "ssh_host_key_file: needed for ssh_listen")
+		} else {
+			_, err := os.Stat(filepath.Dir(config.SSHHostKeyFile))
+			if err != nil {
+				problems = append(problems, "ssh_host_key_file: "+err.Error())
+			}
+		}
+	}
+	if config.AdminSocket != "" {
+		_, err := os.Stat(filepath.Dir(config.AdminSocket))
+		if err != nil {
+			problems = append(problems, "admin_socket: "+err.Error())
+		}
+	}
+	if config.DatabasePath == "" {
+		problems = append(problems, "database_path must not be empty")
+	}
+	if strings.Contains(config.DatabasePath, "?") {
+		//
+		// The SQLite driver would take the rest for its own options.
+		//
+		problems = append(problems, "database_path must not contain \"?\"")
+	}
+	switch strings.ToLower(config.DatabaseJournalMode) {
+	case "wal", "delete", "truncate", "persist":
+	default:
+		problems = append(problems, "database_journal_mode must be \"wal\", \"delete\", \"truncate\" or \"persist\", got "+strconv.Quote(config.DatabaseJournalMode))
+	}
+	problems = checkNotNegative(problems, "database_busy_timeout_ms", config.DatabaseBusyTimeoutMs)
+	if config.LogDir == "" {
+		config.LogDir = "."
+	}
+	info, err := os.Stat(config.LogDir)
+	if err != nil {
+		problems = append(problems, "log_dir: "+err.Error())
+	} else {
+		if !info.IsDir() {
+			problems = append(problems, "log_dir "+config.LogDir+" is not a directory")
+		}
+	}
+	if config.MOTDFile != "" {
+		_, err = os.Stat(config.MOTDFile)
+		if err != nil {
+			problems = append(problems, "motd_file: "+err.Error())
+		}
+	}
+	_, err = parseLogLevel(config.LogLevel)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	err = checkLogFormat(config.LogFormat)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	if config.Registration != "open" && config.Registration != "closed" {
+		problems = append(problems, "registration must be \"open\" or \"closed\", got "+strconv.Quote(config.Registration))
+	}
+	_, err = parseBannedIPs(config.BannedIPs)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	problems = checkPositive(problems, "max_chat_channel_members", config.MaxChatChannelMembers)
+	problems = checkPositive(problems, "channel_master_shards", config.ChannelMasterShards)
+	problems = checkPositive(problems, "channel_master_doppelganger_queue", config.ChannelMasterDoppelgangerQueue)
+	problems = checkPositive(problems, "channel_master_chat_channel_queue", config.ChannelMasterChatChannelQueue)
+	problems = checkPositive(problems, "chat_channel_queue", config.ChatChannelQueue)
+	problems = checkNotNegative(problems, "chat_history", config.ChatHistory)
+	problems = checkPositive(problems, "member_queue", config.MemberQueue)
+	if config.SlowMemberPolicy != "drop_oldest" && config.SlowMemberPolicy != "disconnect" {
+		problems = append(problems, "slow_member_policy must be \"drop_oldest\" or \"disconnect\", got "+strconv.Quote(config.SlowMemberPolicy))
+	}
+	problems = checkNotNegative(problems, "client_write_timeout_seconds", config.ClientWriteTimeoutSeconds)
+	problems = checkPositive(problems, "accept_retry_seconds", config.AcceptRetrySeconds)
+	problems = checkPositive(problems, "shutdown_drain_seconds", config.ShutdownDrainSeconds)
+	problems = checkNotNegative(problems, "stall_threshold_seconds", config.StallThresholdSeconds)
+	if config.StallStackDumpDir != "" {
+		info, err := os.Stat(config.StallStackDumpDir)
+		if err != nil {
+			problems = append(problems, "stall_stack_dump_dir: "+err.Error())
+		} else if !info.IsDir() {
+			problems = append(problems, "stall_stack_dump_dir "+config.StallStackDumpDir+" is not a directory")
+		}
+	}
+	problems = checkNotNegative(problems, "idle_warning_seconds", config.IdleWarningSeconds)
+	problems = checkNotNegative(problems, "idle_timeout_seconds", config.IdleTimeoutSeconds)
+	problems = checkNotNegative(problems, "keepalive_seconds", config.KeepaliveSeconds)
+	problems = checkNotNegative(problems, "max_connections", config.MaxConnections)
+	problems = checkNotNegative(problems, "max_connections_per_ip", config.MaxConnectionsPerIP)
+	problems = checkNotNegative(problems, "new_connections_per_ip_per_minute", config.NewConnectionsPerIPPerMinute)
+	problems = checkNotNegative(problems, "accept_per_second", config.AcceptPerSecond)
+	if config.TCPKeepaliveSeconds < -1 {
+		problems = append(problems, "tcp_keepalive_seconds must be -1 (off) or more, got "+intToStr(config.TCPKeepaliveSeconds))
+	}
+	if (config.IdleWarningSeconds > 0) && (config.IdleTimeoutSeconds > 0) && (config.IdleWarningSeconds >= config.IdleTimeoutSeconds) {
+		problems = append(problems, "idle_warning_seconds must be less than idle_timeout_seconds, or the warning comes after the user is already gone")
+	}
+	problems = checkCluster(problems, config)
+	for _, name := range config.Plugins {
+		_, exists := builtinPlugins[name]
+		if !exists {
+			problems = append(problems, "plugins: there's no built-in plugin called "+strconv.Quote(name)+" (there's "+builtinPluginNames()+")")
+		}
+	}
+	if config.EventSink != "" {
+		problem := checkEventSink(config.EventSink)
+		if problem != "" {
+			problems = append(problems, "event_sink: "+problem)
+		}
+	}
+	problems = checkPositive(problems, "event_queue", config.EventQueue)
+	problems = checkNotNegative(problems, "event_retries", config.EventRetries)
+	if len(problems) != 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func checkCluster(problems []string, config *Config) []string {
+	if config.ClusterNode == "" {
+		if (config.ClusterListen != "") || (len(config.ClusterPeers) != 0) {
+			problems = append(problems, "cluster_listen and cluster_peers need cluster_node (this server's name in the cluster)")
+		}
+		return problems
+	}
+	if config.ClusterListen == "" {
+		problems = append(problems, "cluster_node needs cluster_listen, for the other nodes to connect to")
+	} else {
+		problem := checkListenAddr(config.ClusterListen)
+		if problem != "" {
+			problems = append(problems, "cluster_listen: "+problem)
+		}
+	}
+	seen := map[string]bool{config.ClusterNode: true}
+	for _, peer := range config.ClusterPeers {
+		if peer.Node == "" || peer.Addr == "" {
+			problems = append(problems, "cluster_peers: every peer needs both node and addr")
+			continue
+		}
+		if seen[peer.Node] {
+			problems = append(problems, "cluster_peers: node name "+strconv.Quote(peer.Node)+" is used more than once (or is this server's own)")
+		}
+		seen[peer.Node] = true
+		_, _, err := net.SplitHostPort(peer.Addr)
+		if err != nil {
+			problems = append(problems, "cluster_peers: "+peer.Node+": "+err.Error())
+		}
+	}
+	return checkPositive(problems, "cluster_peer_timeout_seconds", config.ClusterPeerTimeoutSeconds)
+}
+
+func checkListenAddr(addr string) string {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "listen address " + strconv.Quote(addr) + ": " + err.Error()
+	}
+	if port == "" {
+		return "listen address " + strconv.Quote(addr) + " has no port"
+	}
+	return ""
+}
+
+func checkPositive(problems []string, name string, value int) []string {
+	if value <= 0 {
+		return append(problems, name+" must be greater than 0, got "+intToStr(value))
+	}
+	return problems
+}
+
+//
+// For settings where 0 means "off".
+//
+func checkNotNegative(problems []string, name string, value int) []string {
+	if value < 0 {
+		return append(problems, name+" must not be negative, got "+intToStr(value))
+	}
+	return problems
+}
+
+//
+// The welcome message (MOTD) is read at startup and again on every reload
+// (see buildLiveSettings), so editing the file and sending SIGHUP changes
+// it. Telnet wants CR+LF line endings, so we convert whatever the file has.
+//
+func loadMOTD(motdFilePath string) (string, error) {
+	if motdFilePath == "" {
+		return defaultWelcomeMessage, nil
+	}
+	contents, err := ioutil.ReadFile(motdFilePath)
+	if err != nil {
+		return "", err
+	}
+	motd := strings.Replace(string(contents), "\r\n", "\n", -1)
+	motd = strings.TrimRight(motd, "\n")
+	return strings.Replace(motd, "\n", "\r\n", -1), nil
+}
+
+//
+// Banned IPs can be single addresses or CIDR networks; we turn single
+// addresses into one-address networks so there's only one kind of thing to
+// check against.
+//
+func parseBannedIPs(bannedIPs []string) ([]*net.IPNet, error) {
+	bannedNetworks := make([]*net.IPNet, 0)
+	for _, banned := range bannedIPs {
+		if strings.Contains(banned, "/") {
+			_, network, err := net.ParseCIDR(banned)
+			if err != nil {
+				return nil, errors.New("banned_ips: " + err.Error())
+			}
+			bannedNetworks = append(bannedNetworks, network)
+			continue
+		}
+		ip := net.ParseIP(banned)
+		if ip == nil {
+			return nil, errors.New("banned_ips: " + strconv.Quote(banned) + " is not an IP address or CIDR network")
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		bannedNetworks = append(bannedNetworks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return bannedNetworks, nil
+}
+
+//
+// Checks a remote address ("host:port", as net.Conn gives it to us) against
+// the banned networks. An address we can't parse isn't banned -- we'd rather
+// let someone odd in than lock everyone out over a formatting surprise.
+//
+func addressIsBanned(bannedNetworks []*net.IPNet, remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range bannedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Builds the reloadable part of the configuration. Used at startup and again
+// on every SIGHUP. The config has already been validated, but the MOTD file
+// can still fail to read.
+//
+func buildLiveSettings(config Config) (liveSettings, error) {
+	var settings liveSettings
+	var err error
+	settings.motd, err = loadMOTD(config.MOTDFile)
+	if err != nil {
+		return settings, err
+	}
+	settings.maxChatChannelMembers = config.MaxChatChannelMembers
+	settings.registrationOpen = (config.Registration == "open")
+	settings.bannedNetworks, err = parseBannedIPs(config.BannedIPs)
+	if err != nil {
+		return settings, err
+	}
+	settings.logDir = config.LogDir
+	settings.idleWarning = time.Duration(config.IdleWarningSeconds) * time.Second
+	settings.idleTimeout = time.Duration(config.IdleTimeoutSeconds) * time.Second
+	settings.awayExemptFromIdle = config.AwayExemptFromIdle
+	settings.keepaliveInterval = time.Duration(config.KeepaliveSeconds) * time.Second
+	settings.slowMemberDisconnect = (config.SlowMemberPolicy == "disconnect")
+	settings.clientWriteTimeout = time.Duration(config.ClientWriteTimeoutSeconds) * time.Second
+	return settings, nil
+}
+
+//
+// Settings that only take effect on restart. On SIGHUP we tell whoever is
+// reloading if they changed any of these, so they aren't left wondering why
+// nothing happened.
+//
+func settingsNeedingRestart(oldConfig Config, newConfig Config) []string {
+	changed := make([]string, 0)
+	if strings.Join(oldConfig.Listen, ",") != strings.Join(newConfig.Listen, ",") {
+		changed = append(changed, "listen")
+	}
+	listenTLSFlag := tlsListenerListFlag(oldConfig.ListenTLS)
+	newListenTLSFlag := tlsListenerListFlag(newConfig.ListenTLS)
+	if listenTLSFlag.String() != newListenTLSFlag.String() {
+		changed = append(changed, "listen_tls")
+	}
+	if oldConfig.MetricsListen != newConfig.MetricsListen {
+		changed = append(changed, "metrics_listen")
+	}
+	if oldConfig.WebListen != newConfig.WebListen {
+		changed = append(changed, "web_listen")
+	}
+	if oldConfig.APIListen != newConfig.APIListen {
+		changed = append(changed, "api_listen")
+	}
+	if oldConfig.IRCListen != newConfig.IRCListen {
+		changed = append(changed, "irc_listen")
+	}
+	if oldConfig.SSHListen != newConfig.SSHListen {
+		changed = append(changed, "ssh_listen")
+	}
+	if oldConfig.SSHHostKeyFile != newConfig.SSHHostKeyFile {
+		changed = append(changed, "ssh_host_key_file")
+	}
+	if oldConfig.AdminSocket != newConfig.AdminSocket {
+		changed = append(changed, "admin_socket")
+	}
+	if oldConfig.DatabasePath != newConfig.DatabasePath {
+		changed = append(changed, "database_path")
+	}
+	if oldConfig.DatabaseJournalMode != newConfig.DatabaseJournalMode || oldConfig.DatabaseBusyTimeoutMs != newConfig.DatabaseBusyTimeoutMs {
+		changed = append(changed, "database_journal_mode/database_busy_timeout_ms")
+	}
+	if oldConfig.ChannelMasterShards != newConfig.ChannelMasterShards {
+		changed = append(changed, "channel_master_shards")
+	}
+	if oldConfig.ChannelMasterDoppelgangerQueue != newConfig.ChannelMasterDoppelgangerQueue {
+		changed = append(changed, "channel_master_doppelganger_queue")
+	}
+	if oldConfig.ChannelMasterChatChannelQueue != newConfig.ChannelMasterChatChannelQueue {
+		changed = append(changed, "channel_master_chat_channel_queue")
+	}
+	if oldConfig.ChatChannelQueue != newConfig.ChatChannelQueue {
+		changed = append(changed, "chat_channel_queue")
+	}
+	if oldConfig.ChatHistory != newConfig.ChatHistory {
+		changed = append(changed, "chat_history")
+	}
+	if oldConfig.MemberQueue != newConfig.MemberQueue {
+		changed = append(changed, "member_queue")
+	}
+	if oldConfig.AcceptRetrySeconds != newConfig.AcceptRetrySeconds {
+		changed = append(changed, "accept_retry_seconds")
+	}
+	if oldConfig.ShutdownDrainSeconds != newConfig.ShutdownDrainSeconds {
+		changed = append(changed, "shutdown_drain_seconds")
+	}
+	if oldConfig.StallThresholdSeconds != newConfig.StallThresholdSeconds {
+		changed = append(changed, "stall_threshold_seconds")
+	}
+	if oldConfig.StallStackDumpDir != newConfig.StallStackDumpDir {
+		changed = append(changed, "stall_stack_dump_dir")
+	}
+	if oldConfig.ShutdownMessage != newConfig.ShutdownMessage {
+		changed = append(changed, "shutdown_message")
+	}
+	if oldConfig.TCPKeepaliveSeconds != newConfig.TCPKeepaliveSeconds {
+		changed = append(changed, "tcp_keepalive_seconds")
+	}
+	if oldConfig.MaxConnections != newConfig.MaxConnections {
+		changed = append(changed, "max_connections")
+	}
+	if oldConfig.MaxConnectionsPerIP != newConfig.MaxConnectionsPerIP {
+		changed = append(changed, "max_connections_per_ip")
+	}
+	if oldConfig.NewConnectionsPerIPPerMinute != newConfig.NewConnectionsPerIPPerMinute {
+		changed = append(changed, "new_connections_per_ip_per_minute")
+	}
+	if oldConfig.AcceptPerSecond != newConfig.AcceptPerSecond {
+		changed = append(changed, "accept_per_second")
+	}
+	if (oldConfig.ClusterNode != newConfig.ClusterNode) || (oldConfig.ClusterListen != newConfig.ClusterListen) || (oldConfig.ClusterPeerTimeoutSeconds != newConfig.ClusterPeerTimeoutSeconds) {
+		changed = append(changed, "cluster_node/cluster_listen/cluster_peer_timeout_seconds")
+	}
+	clusterPeersFlag := clusterPeerListFlag(oldConfig.ClusterPeers)
+	newClusterPeersFlag := clusterPeerListFlag(newConfig.ClusterPeers)
+	if clusterPeersFlag.String() != newClusterPeersFlag.String() {
+		changed = append(changed, "cluster_peers")
+	}
+	if strings.Join(oldConfig.Plugins, ",") != strings.Join(newConfig.Plugins, ",") {
+		changed = append(changed, "plugins")
+	}
+	if (oldConfig.EventSink != newConfig.EventSink) || (oldConfig.EventQueue != newConfig.EventQueue) || (oldConfig.EventRetries != newConfig.EventRetries) {
+		changed = append(changed, "event_sink/event_queue/event_retries")
+	}
+	if (oldConfig.ServerFullMessage != newConfig.ServerFullMessage) || (oldConfig.TooManyConnectionsMessage != newConfig.TooManyConnectionsMessage) {
+		changed = append(changed, "server_full_message/too_many_connections_message")
+	}
+	return changed
+}
+
+//
+// Chat channel conversation logs go in the configured log directory.
+//
+func conversationLogPath(logDir string, chatChannelName string) string {
+	return filepath.Join(logDir, deslash(chatChannelName)+".channel.log")
+}
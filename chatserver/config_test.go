@@ -0,0 +1,132 @@
+package chatserver
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//
+// LoadConfig the way the daemon calls it, with a config file written for
+// the test and command-line flags on top.
+//
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "wtelnet.json")
+	err := ioutil.WriteFile(path, []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+//
+// Expects LoadConfig to refuse arguments, saying every one of problems.
+//
+func expectConfigProblems(t *testing.T, arguments []string, problems ...string) {
+	t.Helper()
+	_, err := LoadConfig(arguments)
+	if err == nil {
+		t.Fatalf("LoadConfig(%q) took it", arguments)
+	}
+	for _, problem := range problems {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("LoadConfig(%q) didn't say %q:\n%v", arguments, problem, err)
+		}
+	}
+}
+
+//
+// The file overrides the defaults, and flags that are given override the
+// file -- even a flag given with the default value, which is how you undo
+// the file from the command line.
+//
+func TestLoadConfigFileAndFlags(t *testing.T) {
+	logDir := t.TempDir()
+	path := writeConfigFile(t, `{
+		"listen": [":6000"],
+		"log_dir": "`+logDir+`",
+		"max_chat_channel_members": 10,
+		"registration": "closed",
+		"chat_history": 20
+	}`)
+	config, err := LoadConfig([]string{"-config", path, "-listen", ":7000", "-max-channel-members", "12", "-registration", "open"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(config.Listen) != 1) || (config.Listen[0] != ":7000") {
+		t.Errorf("listen: %q", config.Listen)
+	}
+	if config.MaxChatChannelMembers != 12 {
+		t.Errorf("max_chat_channel_members: %d", config.MaxChatChannelMembers)
+	}
+	if config.Registration != "open" {
+		t.Errorf("registration: %q", config.Registration)
+	}
+	if config.ChatHistory != 20 {
+		t.Errorf("chat_history (only in the file): %d", config.ChatHistory)
+	}
+	if config.LogDir != logDir {
+		t.Errorf("log_dir (only in the file): %q", config.LogDir)
+	}
+	if config.MemberQueue != DefaultConfig().MemberQueue {
+		t.Errorf("member_queue (in neither): %d", config.MemberQueue)
+	}
+}
+
+//
+// A misspelled setting in the file is an error, not silently ignored.
+//
+func TestLoadConfigUnknownField(t *testing.T) {
+	path := writeConfigFile(t, `{"max_channel_members": 10}`)
+	expectConfigProblems(t, []string{"-config", path}, "config file "+path, `unknown field "max_channel_members"`)
+}
+
+//
+// Everything wrong is reported at once.
+//
+func TestLoadConfigProblemsTogether(t *testing.T) {
+	expectConfigProblems(t, []string{"-log-dir", t.TempDir(), "-max-channel-members", "0", "-registration", "maybe", "-slow-member-policy", "sometimes", "-log-level", "loud", "-idle-warning", "60", "-idle-timeout", "30"},
+		"max_chat_channel_members must be greater than 0, got 0",
+		`registration must be "open" or "closed", got "maybe"`,
+		`slow_member_policy must be "drop_oldest" or "disconnect", got "sometimes"`,
+		"loud",
+		"idle_warning_seconds must be less than idle_timeout_seconds")
+}
+
+func TestLoadConfigBadListenAddress(t *testing.T) {
+	expectConfigProblems(t, []string{"-log-dir", t.TempDir(), "-listen", "localhost"}, `listen address "localhost": `)
+	expectConfigProblems(t, []string{"-log-dir", t.TempDir(), "-listen", ":5555", "-metrics", "127.0.0.1:"}, `metrics_listen: listen address "127.0.0.1:" has no port`)
+	expectConfigProblems(t, []string{"-log-dir", t.TempDir(), "-listen", ""}, "no listen addresses configured")
+}
+
+func TestLoadConfigBadEventSink(t *testing.T) {
+	expectConfigProblems(t, []string{"-log-dir", t.TempDir(), "-event-sink", "ftp://example.com/events"}, `event_sink: must be an http:// or https:// URL or unix:<socket path>, got "ftp://example.com/events"`)
+	expectConfigProblems(t, []string{"-log-dir", t.TempDir(), "-event-sink", "unix:"}, "event_sink: unix: needs the path of the socket after it")
+	_, err := LoadConfig([]string{"-log-dir", t.TempDir(), "-event-sink", "unix:/run/wtelnet/events.sock"})
+	if err != nil {
+		t.Errorf("event sink on a Unix socket: %v", err)
+	}
+}
+
+//
+// Reload warns about changed settings that only take effect on restart,
+// and only about those.
+//
+func TestSettingsNeedingRestart(t *testing.T) {
+	oldConfig := DefaultConfig()
+	newConfig := DefaultConfig()
+	newConfig.Listen = []string{":6000"}
+	newConfig.DatabasePath = "elsewhere.db"
+	newConfig.MaxChatChannelMembers = 50
+	newConfig.BannedIPs = []string{"192.0.2.0/24"}
+	changed := settingsNeedingRestart(oldConfig, newConfig)
+	if strings.Join(changed, ",") != "listen,database_path" {
+		t.Fatalf("settings needing a restart: %q", changed)
+	}
+	if len(settingsNeedingRestart(oldConfig, DefaultConfig())) != 0 {
+		t.Fatalf("settings needing a restart with nothing changed: %q", settingsNeedingRestart(oldConfig, DefaultConfig()))
+	}
+}
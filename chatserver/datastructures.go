@@ -0,0 +1,632 @@
+package chatserver
+
+import (
+	"net"
+	"time"
+)
+
+//
+// The parts of the configuration that can be changed while the server is
+// running (by sending it SIGHUP). The channel master owns the current
+// settings; everyone else gets a copy in a message -- doppelgangers when
+// they register and chat channels when they're launched -- and a fresh copy
+// whenever the settings are reloaded. Nothing in here is ever modified after
+// it's built, so sharing the bannedNetworks slice between copies is safe.
+//
+
+type liveSettings struct {
+	motd                  string
+	maxChatChannelMembers int
+	registrationOpen      bool
+	bannedNetworks        []*net.IPNet
+	logDir                string
+	idleWarning           time.Duration
+	idleTimeout           time.Duration
+	awayExemptFromIdle    bool
+	keepaliveInterval     time.Duration
+	slowMemberDisconnect  bool
+	clientWriteTimeout    time.Duration
+}
+
+// ----------------------------------------------------------------
+// Begin message format definitions
+// ----------------------------------------------------------------
+
+// ----------------------------------------------------------------
+//
+// channel master -> user (doppelganger)
+//
+// ----------------------------------------------------------------
+
+//
+// Codes for responses from the channel master.
+// Join denied is the same as generic text message but signals the doppelganger to set the chat channel id  back to 0.
+// Shutdown (sent on the doppelganger's hang-up go channel, not its regular
+// one -- see sendHangUp) tells the doppelganger to show the user msgToUser
+// and hang up because the server is going down. Disconnect, on the same go
+// channel, works like Shutdown but for one user: the admin console kicking
+// them, or a slow member being hung up on.
+// Describe is a broadcast (sent on the broadcast go channel, and dropped if
+// that's full) on behalf of the admin console, asking the doppelganger to
+// send a description of itself on adminCallback.
+//
+
+const (
+	fromChannelMasterToDoppelgangerOpGenericText = iota
+	fromChannelMasterToDoppelgangerOpJoinDenied
+	fromChannelMasterToDoppelgangerOpShutdown
+	fromChannelMasterToDoppelgangerOpDisconnect
+	fromChannelMasterToDoppelgangerOpDescribe
+)
+
+//
+// Format of the messages from the channel master to user (doppelganger) goroutines.
+//
+
+type messageFromChannelMasterToDoppelganger struct {
+	channelID     int64
+	operation     int
+	msgToUser     string
+	adminCallback chan adminSessionEntry
+}
+
+// ----------------------------------------------------------------
+//
+// user (doppelganger) -> chat channel
+//
+// ----------------------------------------------------------------
+
+//
+// Operation codes to send from users (doppelgangers) to chat channels.
+//
+
+const (
+	fromDoppelgangerToChatChannelOpTextMessage = iota
+	fromDoppelgangerToChatChannelOpExit
+)
+
+//
+// Format of the messages from users (doppelgangers) to the chat channel
+// goroutines. The chat channel only goes by the user ID; the doppelganger ID
+// is for when the "chat channel" is really a clusterPeer goroutine passing
+// the message on to another node, which needs to know which of its users
+// said it. parameter is the line everyone sees; said is just what the user
+// said, for /say, for the plugins (see plugin.go).
+//
+
+type messageFromDoppelgangerToChatChannel struct {
+	operation      int
+	userID         int64
+	doppelgangerID int64
+	parameter      string
+	said           string
+}
+
+// ----------------------------------------------------------------
+//
+// chat channel -> user (doppelganger)
+//
+// ----------------------------------------------------------------
+
+// Operation codes to send from chat channels to users (doppelgangers).
+
+const (
+	fromChatChannelToDoppelgangerOpJoinDenied = iota
+	fromChatChannelToDoppelgangerOpJoined
+	fromChatChannelToDoppelgangerOpTextMessage
+	fromChatChannelToDoppelgangerOpTextExit
+	fromChatChannelToDoppelgangerOpMoved
+)
+
+//
+// Format of the messages from the chat channel to the users (doppelgangers)
+// -- including the actual chatting.
+//
+// These go on one of two go channels. Answers to the doppelganger itself
+// (joined, join denied, who's on the channel, and its own exit coming back) go
+// on its regular one, which the chat channel waits on like always. So does
+// moved, which means another node in the cluster owns the chat channel now
+// (see moveChatChannelsWeDontOwn), and the member should exit and join it
+// again, which takes it there. Chat text, and other people joining and
+// leaving, go on the doppelganger's text queue, which the chat channel never
+// waits on: if the queue is full, the slow member policy decides what gives.
+// sequence counts the messages put on a member's text queue since it joined,
+// so the doppelganger can tell when some were thrown away. machineLine is the
+// same thing as parameter, as the one tagged line a user in machine mode gets
+// instead (see machinemode.go).
+//
+
+type messageFromChatChannelToDoppelganger struct {
+	operation             int
+	originator            int64
+	chatChannelID         int64
+	leavingDoppelgangerID int64
+	sequence              int64
+	parameter             string
+	machineLine           string
+	chatChannelCallback   chan messageFromDoppelgangerToChatChannel
+}
+
+// ----------------------------------------------------------------
+//
+// channel master -> chat channel
+//
+// ----------------------------------------------------------------
+
+//
+// Codes for messages from channel master to chatchannel goroutines.
+//
+
+const (
+	fromChannelMasterToChatChanOpJoin = iota
+	fromChannelMasterToChatChanOpWho
+	fromChannelMasterToChatChanOpExit
+	fromChannelMasterToChatChanOpShutdown
+	fromChannelMasterToChatChanOpSettings
+	fromChannelMasterToChatChanOpMetrics
+	fromChannelMasterToChatChanOpMembers
+	fromChannelMasterToChatChanOpHistory
+	fromChannelMasterToChatChanOpPost
+	fromChannelMasterToChatChanOpMoved
+)
+
+//
+// Format of messages from channel master to chat channel goroutines. History
+// and post are for the API (see apiserver.go): history asks for the latest
+// limit messages (all we have if it's 0), and post is a message from userID
+// to say on the chat channel, parameter and said the same as from a
+// doppelganger. Both are answered on apiCallback. The first message, the one
+// a chat channel is launched with, carries in history what the chat channel
+// remembered the last time it was running. Moved tells the chat channel
+// another node owns it now, so it can tell its members to go there.
+//
+
+type messageFromChannelMasterToChatChannel struct {
+	operation             int
+	userID                int64
+	userName              string
+	doppelgangerID        int64
+	doppelgangerCallback  chan messageFromChatChannelToDoppelganger
+	doppelgangerTextQueue chan messageFromChatChannelToDoppelganger
+	settings              liveSettings
+	metricsCallback       chan chatChannelMetrics
+	adminCallback         chan adminChatChannelMembers
+	parameter             string
+	said                  string
+	limit                 int
+	history               []chatHistoryEntry
+	apiCallback           chan apiChatChannelReply
+}
+
+// ----------------------------------------------------------------
+//
+// user (doppelganger) -> channel master
+//
+// ----------------------------------------------------------------
+
+//
+// Operation codes to send to the channel master, i.e. join a channel, exit a
+// channel. Join, who and exit go to the channel master shard that has the chat
+// channel (see channelmastershard.go), with the chat channel ID already looked
+// up by the doppelganger -- or, if another node in the cluster owns the chat
+// channel, to the clusterPeer goroutine for that node (see chatChannelRoute);
+// everything else goes to the channel master itself. Register and unregister
+// are sent once each, when the doppelganger starts and right before it exits,
+// so the channel master knows every doppelganger on the system (it needs that
+// to tell them all when the server is shutting down). Logged in and login
+// failed are only there so the channel master can count them for the metrics
+// (and send logins to the event sink -- see eventsink.go); unregister carries
+// the number of write errors the doppelganger had, for the same reason. Chat
+// channel created is only for the event sink too: /create goes straight to the
+// database, and then the doppelganger tells us, with the name in parameter.
+//
+
+const (
+	fromDoppelgangerToChannelMasterOpJoin = iota
+	fromDoppelgangerToChannelMasterOpWho
+	fromDoppelgangerToChannelMasterOpExit
+	fromDoppelgangerToChannelMasterOpRegister
+	fromDoppelgangerToChannelMasterOpUnregister
+	fromDoppelgangerToChannelMasterOpLoggedIn
+	fromDoppelgangerToChannelMasterOpLoginFailed
+	fromDoppelgangerToChannelMasterOpChatChannelCreated
+)
+
+//
+// Format of the channel master message, used to make requests of the channel
+// master, i.e. join a channel. Replies will use the response format above, and
+// the request includes the channel to reply on. Channel master doesn't remember
+// reply channels from call to call -- except for register, which hands it the
+// go channels it reaches the doppelganger on from then on: broadcasts,
+// hang-ups (see sendHangUp) and settings (see sendLatestSettings).
+//
+
+type messageFromDoppelgangerToChannelMaster struct {
+	operation                             int
+	userID                                int64
+	userName                              string
+	doppelgangerID                        int64
+	chatChannelID                         int64
+	parameter                             string
+	doppelgangerCallbackFromChannelMaster chan messageFromChannelMasterToDoppelganger
+	doppelgangerCallbackFromChatChannel   chan messageFromChatChannelToDoppelganger
+	doppelgangerTextQueue                 chan messageFromChatChannelToDoppelganger
+	doppelgangerBroadcastCallback         chan messageFromChannelMasterToDoppelganger
+	doppelgangerHangUpCallback            chan messageFromChannelMasterToDoppelganger
+	doppelgangerSettingsCallback          chan liveSettings
+	writeErrors                           int64
+}
+
+// ----------------------------------------------------------------
+//
+// chat channel -> channel master
+//
+// ----------------------------------------------------------------
+
+//
+// Operation codes to send to the channel master. Join denied and shutdown
+// complete go to the chat channel's shard, slow member to the channel master
+// itself. Join denied tells the channel master a join failed. The channel
+// master needs to know this otherwise it will have the number of members in
+// the chat channel off by 1.
+// Shutdown complete is sent as the very last thing a chat channel goroutine
+// does, after its conversation log is closed, so that when the server is
+// shutting down the channel master knows when every log has been flushed. It
+// also carries how many messages the chat channel handled (and threw away
+// for slow members), so the channel master's counts for the metrics don't go
+// backwards when a chat channel goes away. Slow member asks the channel
+// master to hang up on a member whose text queue filled up, when the slow
+// member policy is "disconnect".
+//
+// Shutdown complete also hands the shard the chat channel's history, which
+// the shard keeps for the API and gives back to the chat channel if it's
+// launched again.
+//
+
+const (
+	fromChatChannelToChannelMasterOpJoinDenied = iota
+	fromChatChannelToChannelMasterOpShutdownComplete
+	fromChatChannelToChannelMasterOpSlowMember
+)
+
+type messageFromChatChannelToChannelMaster struct {
+	operation       int
+	userID          int64
+	doppelgangerID  int64
+	chatChannelID   int64
+	messageCount    int64
+	droppedMessages int64
+	history         []chatHistoryEntry
+}
+
+// ----------------------------------------------------------------
+//
+// main -> channel master
+//
+// ----------------------------------------------------------------
+
+//
+// "Main" is whoever runs the chat server -- these come from ChatServer's
+// Shutdown and Reload (see chatserver.go), which main calls in the daemon.
+//
+// Operation codes main sends to the channel master when the server is
+// shutting down. Shutdown starts the process: the channel master tells every
+// doppelganger to say goodbye to its user and hang up, and stops letting
+// anyone join chat channels. It replies on mainCallback once every
+// doppelganger and every chat channel is gone. If that takes longer than the
+// drain timeout, main sends shutdown chat channels, which makes the channel
+// master shut down every chat channel that's still running (so their
+// conversation logs get closed) and reply once they have.
+//
+// Reload settings hands the channel master new live settings (after a
+// SIGHUP), which it keeps and passes on to every doppelganger and chat
+// channel, and replies on mainCallback once it has.
+//
+
+const (
+	fromMainToChannelMasterOpShutdown = iota
+	fromMainToChannelMasterOpShutdownChatChannels
+	fromMainToChannelMasterOpReloadSettings
+)
+
+type messageFromMainToChannelMaster struct {
+	operation    int
+	parameter    string
+	settings     liveSettings
+	mainCallback chan bool
+}
+
+// ----------------------------------------------------------------
+//
+// channel master -> channel master shards
+//
+// ----------------------------------------------------------------
+
+//
+// The channel master passes on to every shard whatever main, the metrics
+// endpoint and the admin console want to do with chat channels. Settings
+// are the new live settings after a reload. Shutdown tells the shard to stop
+// letting anyone join, and shutdown chat channels to shut down every chat
+// channel it has right away; either way the shard sends its index on
+// drainedCallback once it has no chat channels left (right away if it has
+// none). Metrics, chat channels and members are the shard's answers for the
+// metrics endpoint and the admin console, which it sends on metricsCallback
+// or adminCallback -- those are big enough for every shard, so no shard ever
+// blocks answering.
+//
+// History and post are the API's, for one chat channel. The shard passes
+// them on to the chat channel if it's running, and otherwise answers on
+// apiCallback itself: with the history it kept when the chat channel shut
+// down, or for a post, that nobody's there to hear it.
+//
+
+const (
+	fromChannelMasterToShardOpSettings = iota
+	fromChannelMasterToShardOpShutdown
+	fromChannelMasterToShardOpShutdownChatChannels
+	fromChannelMasterToShardOpMetrics
+	fromChannelMasterToShardOpChatChannels
+	fromChannelMasterToShardOpMembers
+	fromChannelMasterToShardOpHistory
+	fromChannelMasterToShardOpPost
+)
+
+//
+// The go channels a shard listens on. Doppelgangers and chat channels find
+// the shard for a chat channel with shardForChatChannel. membershipChanged
+// gets a poke from the clusterPeer goroutines whenever another node comes up
+// or goes down (see announceMembershipChange). Nobody ever waits on it: one
+// poke is as good as several, since the shard looks at the membership as it
+// is by the time it gets to it.
+//
+type channelMasterShard struct {
+	index             int
+	fromDoppelganger  chan messageFromDoppelgangerToChannelMaster
+	fromChatChannel   chan messageFromChatChannelToChannelMaster
+	fromChannelMaster chan messageFromChannelMasterToShard
+	membershipChanged chan bool
+}
+
+type messageFromChannelMasterToShard struct {
+	operation       int
+	settings        liveSettings
+	drainedCallback chan int
+	metricsCallback chan shardMetrics
+	adminCallback   chan adminShardReply
+	apiRequest      messageFromAPIToChannelMaster
+	apiCallback     chan apiChatChannelReply
+}
+
+// ----------------------------------------------------------------
+//
+// metrics -> channel master -> chat channels
+//
+// ----------------------------------------------------------------
+
+//
+// The metrics endpoint asks the channel master for its numbers. The channel
+// master answers on metricsCallback, and passes the question on to every
+// shard, which answer the metrics endpoint directly on shardCallback
+// (shardsAsked says how many). Each shard in turn passes the question on to
+// every chat channel it has running. The chat channels answer the metrics
+// endpoint directly, on the shard's chatChannelCallback, which the shard
+// makes big enough that none of them ever block. chatChannelsAsked says how
+// many answers to expect.
+//
+
+type messageFromMetricsToChannelMaster struct {
+	metricsCallback chan channelMasterMetrics
+}
+
+type channelMasterMetrics struct {
+	sessions                  int
+	loggedInUsers             int
+	logins                    int64
+	loginFailures             int64
+	writeErrors               int64
+	slowMemberDisconnects     int64
+	doppelgangerQueueLength   int
+	doppelgangerQueueCapacity int
+	chatChannelQueueLength    int
+	chatChannelQueueCapacity  int
+	shardsAsked               int
+	shardCallback             chan shardMetrics
+}
+
+type shardMetrics struct {
+	shard                          int
+	runningChatChannels            int
+	joinDenials                    int64
+	messagesFromClosedChatChannels int64
+	droppedFromClosedChatChannels  int64
+	doppelgangerQueueLength        int
+	doppelgangerQueueCapacity      int
+	chatChannelQueueLength         int
+	chatChannelQueueCapacity       int
+	chatChannelsAsked              int
+	chatChannelCallback            chan chatChannelMetrics
+}
+
+type chatChannelMetrics struct {
+	chatChannelID   int64
+	chatChannelName string
+	members         int
+	messageCount    int64
+	droppedMessages int64
+	queueLength     int
+	queueCapacity   int
+}
+
+// ----------------------------------------------------------------
+//
+// admin console -> channel master -> chat channels and doppelgangers
+//
+// ----------------------------------------------------------------
+
+//
+// The admin console asks the channel master about its own state (how many
+// doppelgangers are registered), and the channel master passes questions
+// about chat channels on to the shards and questions about sessions on to
+// the doppelgangers, which answer the admin console directly on
+// shardCallback or sessionsCallback, the same way the metrics work. For
+// members, each shard passes the question on to its chat channels, which
+// answer on the shard's membersCallback. All the callbacks are made big
+// enough that nobody ever blocks answering, and asked (or membersAsked) says
+// how many answers to expect (for sessions, doppelgangers minus asked were
+// too busy to be asked). Disconnect is for one doppelganger; found says
+// whether it was registered, and delivered whether it's hanging up because
+// of us rather than something before us.
+//
+
+const (
+	fromAdminToChannelMasterOpChatChannels = iota
+	fromAdminToChannelMasterOpMembers
+	fromAdminToChannelMasterOpSessions
+	fromAdminToChannelMasterOpDisconnect
+)
+
+type messageFromAdminToChannelMaster struct {
+	operation      int
+	doppelgangerID int64
+	parameter      string
+	adminCallback  chan adminReplyFromChannelMaster
+}
+
+type adminReplyFromChannelMaster struct {
+	doppelgangers    int
+	shuttingDown     bool
+	found            bool
+	delivered        bool
+	asked            int
+	shardCallback    chan adminShardReply
+	sessionsCallback chan adminSessionEntry
+}
+
+type adminShardReply struct {
+	shard               int
+	chatChannels        []adminChatChannelEntry
+	chatChannelsClosing int
+	membersAsked        int
+	membersCallback     chan adminChatChannelMembers
+}
+
+type adminChatChannelEntry struct {
+	chatChannelID int64
+	memberCount   int
+	queueLength   int
+	queueCapacity int
+}
+
+type adminChatChannelMembers struct {
+	chatChannelID   int64
+	chatChannelName string
+	members         []adminMemberEntry
+}
+
+type adminMemberEntry struct {
+	doppelgangerID int64
+	userID         int64
+	userName       string
+}
+
+type adminSessionEntry struct {
+	doppelgangerID  int64
+	userID          int64
+	userName        string
+	remoteAddr      string
+	mode            int
+	chatChannelID   int64
+	chatChannelName string
+	lastInput       time.Time
+	away            bool
+	queueLength     int
+}
+
+// ----------------------------------------------------------------
+//
+// API -> channel master -> chat channels and doppelgangers
+//
+// ----------------------------------------------------------------
+
+//
+// The API (see apiserver.go) asks the channel master the same way the admin
+// console does. Chat channels and who get the same answers as the admin
+// console's members and sessions: the channel master passes chat channels
+// on to every shard (and they to their chat channels), and who on to every
+// doppelganger, and they answer the API directly on shardCallback or
+// sessionsCallback. History and post are for one chat channel, which the API
+// has already looked up, so they go to just the one shard, which answers (or
+// has its chat channel answer) on chatChannelCallback. As always, every
+// callback has room for every answer, and asked says how many to expect
+// (for who, doppelgangers minus asked were too busy to be asked).
+//
+
+const (
+	fromAPIToChannelMasterOpChatChannels = iota
+	fromAPIToChannelMasterOpWho
+	fromAPIToChannelMasterOpHistory
+	fromAPIToChannelMasterOpPost
+)
+
+type messageFromAPIToChannelMaster struct {
+	operation       int
+	chatChannelID   int64
+	chatChannelName string
+	userID          int64
+	userName        string
+	parameter       string
+	said            string
+	limit           int
+	apiCallback     chan apiReplyFromChannelMaster
+}
+
+type apiReplyFromChannelMaster struct {
+	shuttingDown        bool
+	doppelgangers       int
+	asked               int
+	shardCallback       chan adminShardReply
+	sessionsCallback    chan adminSessionEntry
+	chatChannelCallback chan apiChatChannelReply
+}
+
+//
+// running says whether the chat channel was running (for a post, whether
+// it was said at all -- a post to a chat channel nobody's on launches the
+// chat channel for it, except when the server is shutting down); vetoed,
+// whether a plugin kept the post from going out; failed, whether the chat
+// channel couldn't start (its conversation log wouldn't open), so the post
+// wasn't said.
+//
+
+type apiChatChannelReply struct {
+	chatChannelID int64
+	running       bool
+	vetoed        bool
+	failed        bool
+	history       []chatHistoryEntry
+}
+
+//
+// One message a chat channel remembers. userName is who said it, or empty
+// for the chat channel itself (a plugin's reply, say).
+//
+
+type chatHistoryEntry struct {
+	when     time.Time
+	userName string
+	text     string
+	said     string
+}
+
+// ----------------------------------------------------------------
+// End of message format definitions
+// ----------------------------------------------------------------
+
+//
+// We attach our Telnet handler goroutine to respond to incoming user
+// connections to this data structure. All it holds is the chat server the
+// connections are for, which ServeTELNET hands to the doppelganger.
+//
+type chatHandler struct {
+	chatServer *ChatServer
+}
@@ -1,11 +1,13 @@
-package main
+package chatserver
 
 import (
+	"errors"
 	"github.com/reiver/go-oi"
 	"go-telnet-mod"
 	"golang.org/x/crypto/bcrypt"
-	"log"
+	"io"
 	"math/rand"
+	"net"
 	"strings"
 	"time"
 )
@@ -22,21 +24,47 @@ const (
 	loginCommandMode
 )
 
+//
+// What's on the other end of a doppelganger. It decides whether we talk
+// Telnet to it, and whether it starts out in machine mode (see
+// machinemode.go).
+//
+const (
+	telnetSession   = iota // a Telnet client (servetelnet.go)
+	machineSession         // in machine mode for good: the web and IRC gateways, and SSH without a terminal
+	terminalSession        // a terminal, but not over Telnet: SSH with a terminal (sshlistener.go)
+)
+
 //
 // Struct for doppelganger goroutine to keep track of its own state (keeping
 // track of logged in user).
 //
 
 type userInfo struct {
+	chatServer                           *ChatServer
 	writer                               telnet.Writer
+	errorCounter                         *errorCountingWriter
+	logger                               *Logger
+	watch                                *stallWatch
+	connCloser                           io.Closer
+	remoteAddr                           string
+	settings                             liveSettings
 	userID                               int64
 	userName                             string
 	doppelgangerID                       int64
 	chatChannelID                        int64
 	chatChannelName                      string
 	chatChannelCallback                  chan messageFromDoppelgangerToChatChannel
+	chatChannelRoute                     chan messageFromDoppelgangerToChannelMaster
+	rejoinChatChannel                    string
 	incomingFromChannelMaster            chan messageFromChannelMasterToDoppelganger
 	incomingFromChatChannel              chan messageFromChatChannelToDoppelganger
+	incomingTextFromChatChannel          chan messageFromChatChannelToDoppelganger
+	incomingBroadcastFromChannelMaster   chan messageFromChannelMasterToDoppelganger
+	incomingHangUpFromChannelMaster      chan messageFromChannelMasterToDoppelganger
+	incomingSettingsFromChannelMaster    chan liveSettings
+	textChatChannelID                    int64
+	lastTextSequence                     int64
 	mode                                 int
 	promptNeeded                         bool
 	promptLen                            int
@@ -49,118 +77,44 @@ type userInfo struct {
 	cursorColumn                         int
 	prevUsrByte                          byte
 	echoOn                               bool
+	machineMode                          bool
+	machineModeOnly                      bool
+	telnet                               bool
+	terminal                             terminalSizer
 	telnetGoroutineHasGoneAway           bool
+	hungUp                               bool
 	cantExitBeforeExitMessageFromChannel bool
 	cantExitCount                        int
+	lastInput                            time.Time
+	lastKeepalive                        time.Time
+	idleWarned                           bool
+	away                                 bool
+	awayMessage                          string
+	prefs                                map[string]string
 }
 
-func userExists(username string) (bool, error) {
-	cmd := "SELECT userid FROM user WHERE username = ?;"
-	stmtSelExisting, err := global.db.Prepare(cmd)
-	if err != nil {
-		return false, err
-	}
-	rowsExisting, err := stmtSelExisting.Query(username)
-	if err != nil {
-		return false, err
-	}
-	defer rowsExisting.Close()
-	var userID int64
-	userID = 0
-	for rowsExisting.Next() {
-		err = rowsExisting.Scan(&userID)
-		if err != nil {
-			return false, err
-		}
-	}
-	return (userID != 0), nil
-}
-
-func createUser(username string, password string) error {
-	var pwhashBin []byte
-	var pwhashStr string
-	var err error
-	pwhashBin, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return err
-	}
-	pwhashStr = string(pwhashBin)
-	tx, err := global.db.Begin()
-	if err != nil {
-		return err
-	}
-	cmd := "SELECT userid FROM user WHERE username = ?;"
-	stmtSelExisting, err := tx.Prepare(cmd)
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	rowsExisting, err := stmtSelExisting.Query(username)
+//
+// The storage only keeps the bcrypt hash of the password.
+//
+func createUser(store storage, username string, password string) error {
+	pwhashBin, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
-	defer rowsExisting.Close()
-	var userID int64
-	userID = 0
-	for rowsExisting.Next() {
-		err = rowsExisting.Scan(&userID)
-		if err != nil {
-			tx.Rollback()
-			return err
-		}
-	}
-	if userID == 0 {
-		cmd = "INSERT INTO user (username, password) VALUES (?, ?);"
-		stmtIns, err := tx.Prepare(cmd)
-		if err != nil {
-			tx.Rollback()
-			return err
-		}
-		_, err = stmtIns.Exec(username, pwhashStr)
-		if err != nil {
-			tx.Rollback()
-			return err
-		}
-	} else {
-		cmd = "UPDATE user SET username = ?, password = ? WHERE userid = ?;"
-		stmtUpd, err := tx.Prepare(cmd)
-		_, err = stmtUpd.Exec(username, pwhashStr, userID)
-		if err != nil {
-			tx.Rollback()
-			return err
-		}
-	}
-	err = tx.Commit()
-	return err // can be nil
+	return store.saveUser(username, string(pwhashBin))
 }
 
-func login(username string, password string) (int64, string, error) {
-	cmd := "SELECT userid, username, password FROM user WHERE username = ?;"
-	stmtSelExisting, err := global.db.Prepare(cmd)
-	if err != nil {
-		return 0, "", err
-	}
-	rowsExisting, err := stmtSelExisting.Query(username)
+func login(store storage, username string, password string) (int64, string, error) {
+	//
+	// We overwrite "username" with the value from the storage -- if the
+	// database SELECT is case-independent, the representation of the
+	// username stored in the database is presumed to be the authoritative
+	// version of the username.
+	//
+	userID, username, hashedPassword, err := store.lookUpUser(username)
 	if err != nil {
 		return 0, "", err
 	}
-	defer rowsExisting.Close()
-	var userID int64
-	userID = 0
-	var hashedPassword string
-	for rowsExisting.Next() {
-		//
-		// We overwrite "username" with the value from the database -- if
-		// database SELECT is case-independent, the representation of the
-		// username stored in the database is presumed to be the
-		// authoritative version of the username.
-		//
-		err = rowsExisting.Scan(&userID, &username, &hashedPassword)
-		if err != nil {
-			return 0, "", err
-		}
-	}
 	if userID == 0 {
 		//
 		// We should have already checked that the user exists, so we really
@@ -175,95 +129,14 @@ func login(username string, password string) (int64, string, error) {
 	return userID, username, nil
 }
 
-//
-// Boolean return value indicates if the channel already existed. We don't
-// consider this an error, because it's "app layer" rather than "database
-// layer", but we could handle it with an error code.
-//
-func createChatchannel(chatChannelName string) (bool, error) {
-	tx, err := global.db.Begin()
-	if err != nil {
-		return false, err
-	}
-	cmd := "SELECT channelid FROM channel WHERE channelName = ?;"
-	stmtSelExisting, err := tx.Prepare(cmd)
-	if err != nil {
-		tx.Rollback()
-		return false, err
-	}
-	rowsExisting, err := stmtSelExisting.Query(chatChannelName)
-	if err != nil {
-		tx.Rollback()
-		return false, err
-	}
-	defer rowsExisting.Close()
-	var channelID int64
-	channelID = 0
-	for rowsExisting.Next() {
-		err = rowsExisting.Scan(&channelID)
-		if err != nil {
-			tx.Rollback()
-			return false, err
-		}
-	}
-	var alreadyExists bool
-	if channelID == 0 {
-		alreadyExists = false
-		cmd = "INSERT INTO channel (channelname) VALUES (?);"
-		stmtIns, err := tx.Prepare(cmd)
-		if err != nil {
-			tx.Rollback()
-			return false, err
-		}
-		_, err = stmtIns.Exec(chatChannelName)
-		if err != nil {
-			tx.Rollback()
-			return false, err
-		}
-	} else {
-		alreadyExists = true
+func backspaceOut(doppelgangerState *userInfo, amountToBackspace int) error {
+	if doppelgangerState.machineMode {
 		//
-		// If you create the same channel twice, it just updates the name. If
-		// your database is set to do case-independent SELECTs, this could
-		// change the case on the name Maybe not the behavior you expect. We
-		// should probably do a real "rename" command!
+		// Nothing to backspace over -- there's no prompt and nothing was
+		// echoed.
 		//
-		cmd = "UPDATE channel SET channelname = ? WHERE channelid = ?;"
-		stmtUpd, err := tx.Prepare(cmd)
-		_, err = stmtUpd.Exec(chatChannelName, channelID)
-		if err != nil {
-			tx.Rollback()
-			return true, err
-		}
-	}
-	err = tx.Commit()
-	return alreadyExists, err // can be nil
-}
-
-func getChatchannelList() ([]string, error) {
-	cmd := "SELECT channelname FROM channel WHERE 1 ORDER BY channelname;"
-	stmtSelExisting, err := global.db.Prepare(cmd)
-	if err != nil {
-		return nil, err
-	}
-	rowsExisting, err := stmtSelExisting.Query()
-	if err != nil {
-		return nil, err
-	}
-	defer rowsExisting.Close()
-	chatChanList := make([]string, 0)
-	var chatChannelName string
-	for rowsExisting.Next() {
-		err = rowsExisting.Scan(&chatChannelName)
-		if err != nil {
-			return nil, err
-		}
-		chatChanList = append(chatChanList, chatChannelName)
+		return nil
 	}
-	return chatChanList, nil
-}
-
-func backspaceOut(doppelgangerState *userInfo, amountToBackspace int) error {
 	//
 	// We optimized this so we're not constantly allocating membory
 	// for backspaces.
@@ -299,10 +172,12 @@ func doCommand(doppelgangerState *userInfo, command string) (bool, error) {
 	// is ultimate said with "emote".
 	//
 	emoteParameter := ""
+	said := ""
 	switch command {
 	case "/say":
 		command = "/emote"
 		emoteParameter = doppelgangerState.userName + " says, " + `"` + operand + `"`
+		said = operand
 	case "/think":
 		command = "/emote"
 		emoteParameter = doppelgangerState.userName + " thinks . o O ( " + operand + " )"
@@ -326,10 +201,10 @@ func doCommand(doppelgangerState *userInfo, command string) (bool, error) {
 			}
 		}
 		if operand == "" {
-			_, err := oi.LongWrite(doppelgangerState.writer, []byte("\r\nPlease specify a channel name to create.\r\n"))
+			err := tellUser(doppelgangerState, "ERR", "\r\nPlease specify a channel name to create.\r\n")
 			return true, err // can be nil
 		}
-		alreadyExisted, err := createChatchannel(operand)
+		alreadyExisted, err := doppelgangerState.chatServer.store.saveChatChannel(operand)
 		if err != nil {
 			//
 			// We can't return an error because that would indicate to the
@@ -338,21 +213,22 @@ func doCommand(doppelgangerState *userInfo, command string) (bool, error) {
 			// layer, the user is still here. So we log the error, send the
 			// user a generic message, and try to keep going.
 			//
-			log.Println(err)
-			_, err := oi.LongWrite(doppelgangerState.writer, []byte("\r\nA database error has occurred.\r\n"))
+			doppelgangerState.logger.With("channel", operand, "error", err).Error("Creating chat channel failed.")
+			err := tellUser(doppelgangerState, "ERR", "\r\nA database error has occurred.\r\n")
 			if err != nil {
 				return false, err
 			}
 		} else {
 			if alreadyExisted {
-				_, err = oi.LongWrite(doppelgangerState.writer, []byte("\r\nChannel already exists.\r\n"))
+				err = tellUser(doppelgangerState, "ERR", "\r\nChannel already exists.\r\n")
 			} else {
-				_, err = oi.LongWrite(doppelgangerState.writer, []byte("\r\nChannel \"#"+operand+"\" created.\r\n"))
+				notifyChannelMasterOfCreate(doppelgangerState, operand)
+				err = tellUser(doppelgangerState, "OK", "\r\nChannel \"#"+operand+"\" created.\r\n")
 			}
 			return true, err // err can be nil
 		}
 	case "/list":
-		chatChannelList, err := getChatchannelList()
+		chatChannelList, err := doppelgangerState.chatServer.store.listChatChannels()
 		if err != nil {
 			//
 			// We can't return an error because that would indicate to the
@@ -361,12 +237,19 @@ func doCommand(doppelgangerState *userInfo, command string) (bool, error) {
 			// user is still here. So we log the error, send the user a generic
 			// message, and try to keep going.
 			//
-			log.Println(err)
-			_, err = oi.LongWrite(doppelgangerState.writer, []byte("\r\nA database error has occurred.\r\n"))
+			doppelgangerState.logger.With("error", err).Error("Listing chat channels failed.")
+			err = tellUser(doppelgangerState, "ERR", "\r\nA database error has occurred.\r\n")
 			if err != nil {
 				return false, err
 			}
 		}
+		if doppelgangerState.machineMode {
+			line := "LIST"
+			for _, chatChanName := range chatChannelList {
+				line += " #" + chatChanName
+			}
+			return true, writeToUser(doppelgangerState, "", line)
+		}
 		//
 		// User's carriage return was not echoed.
 		//
@@ -389,7 +272,7 @@ func doCommand(doppelgangerState *userInfo, command string) (bool, error) {
 			// the login. Nonetheless if they do somehow get here, we do the
 			// sensible thing.
 			//
-			_, err := oi.LongWrite(doppelgangerState.writer, []byte("\r\nYou have to log in before you can join a channel.\r\n"))
+			err := tellUser(doppelgangerState, "ERR", "\r\nYou have to log in before you can join a channel.\r\n")
 			return true, err // err can be nil
 		} else {
 			//
@@ -403,7 +286,25 @@ func doCommand(doppelgangerState *userInfo, command string) (bool, error) {
 			// join a new one.
 			//
 			if doppelgangerState.chatChannelID > 0 {
-				_, err := oi.LongWrite(doppelgangerState.writer, []byte("\r\nYou have to exit your current channel before you can join a new channel.\r\n"))
+				err := tellUser(doppelgangerState, "ERR", "\r\nYou have to exit your current channel before you can join a new channel.\r\n")
+				return true, err // err can be nil
+			}
+			if operand == "" {
+				err := tellUser(doppelgangerState, "ERR", "\r\nPlease specify a channel name.\r\n")
+				return true, err // err can be nil
+			}
+			//
+			// We look the chat channel up ourselves, so the channel master
+			// never has to wait on the database.
+			//
+			chatChannelID, err := doppelgangerState.chatServer.store.lookUpChatChannel(operand)
+			if err != nil {
+				doppelgangerState.logger.With("channel", operand, "error", err).Error("Looking up chat channel failed.")
+				err = tellUser(doppelgangerState, "ERR", "\r\nA database error has occurred.\r\n")
+				return true, err // err can be nil
+			}
+			if chatChannelID == 0 {
+				err = tellUser(doppelgangerState, "ERR", "\r\nChannel #"+operand+" does not exist.\r\n")
 				return true, err // err can be nil
 			}
 			var theMessage messageFromDoppelgangerToChannelMaster
@@ -411,16 +312,11 @@ func doCommand(doppelgangerState *userInfo, command string) (bool, error) {
 			theMessage.userName = doppelgangerState.userName
 			theMessage.doppelgangerID = doppelgangerState.doppelgangerID
 			theMessage.operation = fromDoppelgangerToChannelMasterOpJoin
+			theMessage.chatChannelID = chatChannelID
 			theMessage.parameter = operand
 			theMessage.doppelgangerCallbackFromChannelMaster = doppelgangerState.incomingFromChannelMaster
 			theMessage.doppelgangerCallbackFromChatChannel = doppelgangerState.incomingFromChatChannel
-			if global.chanMasterFromDoppelgangerGoChan == nil {
-				//
-				// Should never happen.
-				//
-				logError("doppelganger ID " + int64ToStr(doppelgangerState.doppelgangerID) + " user ID " + int64ToStr(doppelgangerState.userID) + " error: global.chanMasterFromDoppelgangerGoChan == nil")
-				return false, nil // Try and keep server up (kind of laughable if the go channel to the channel master is gone, though)
-			}
+			theMessage.doppelgangerTextQueue = doppelgangerState.incomingTextFromChatChannel
 			//
 			// Here try to prevent the "send on closed channel" error that can
 			// occur later on. By changing the chat channel ID here to something
@@ -433,7 +329,12 @@ func doCommand(doppelgangerState *userInfo, command string) (bool, error) {
 			// "send on closed channel"
 			//
 			doppelgangerState.chatChannelID = -1
-			global.chanMasterFromDoppelgangerGoChan <- theMessage
+			//
+			// Who and exit go wherever the join went, even if the chat
+			// channel would belong to another node by then.
+			//
+			doppelgangerState.chatChannelRoute = chatChannelRoute(doppelgangerState.chatServer, chatChannelID)
+			doppelgangerState.watch.sendFromDoppelgangerToChannelMaster(doppelgangerState.chatChannelRoute, theMessage)
 			return false, nil
 		}
 	case "/who":
@@ -444,33 +345,27 @@ func doCommand(doppelgangerState *userInfo, command string) (bool, error) {
 			// the login. Nonetheless if they do somehow get here, we do the
 			// sensible thing.
 			//
-			_, err := oi.LongWrite(doppelgangerState.writer, []byte("\r\nYou are not logged in.\r\n"))
+			err := tellUser(doppelgangerState, "ERR", "\r\nYou are not logged in.\r\n")
 			return true, err // err can be nil
 		} else {
 			if doppelgangerState.chatChannelID == 0 {
-				_, err := oi.LongWrite(doppelgangerState.writer, []byte("\r\nYou are not on a channel.\r\n"))
+				err := tellUser(doppelgangerState, "ERR", "\r\nYou are not on a channel.\r\n")
 				return true, err // err can be nil
 			} else {
-				_, err := oi.LongWrite(doppelgangerState.writer, []byte("\r\n"))
+				err := writeToUser(doppelgangerState, "\r\n", "")
 				if err != nil {
 					return true, err
 				}
 				var theMessage messageFromDoppelgangerToChannelMaster
 				theMessage.userID = doppelgangerState.userID
 				theMessage.userName = doppelgangerState.userName
+				theMessage.doppelgangerID = doppelgangerState.doppelgangerID
 				theMessage.chatChannelID = doppelgangerState.chatChannelID
 				theMessage.operation = fromDoppelgangerToChannelMasterOpWho
 				theMessage.parameter = operand
 				theMessage.doppelgangerCallbackFromChannelMaster = doppelgangerState.incomingFromChannelMaster
 				theMessage.doppelgangerCallbackFromChatChannel = doppelgangerState.incomingFromChatChannel
-				if global.chanMasterFromDoppelgangerGoChan == nil {
-					//
-					// Should never happen.
-					//
-					logError("doppelganger ID " + int64ToStr(doppelgangerState.doppelgangerID) + " user ID " + int64ToStr(doppelgangerState.userID) + " error: global.chanMasterFromDoppelgangerGoChan == nil")
-					return false, nil // Try and keep server up (kind of laughable if the go channel to the channel master is gone, though)
-				}
-				global.chanMasterFromDoppelgangerGoChan <- theMessage
+				doppelgangerState.watch.sendFromDoppelgangerToChannelMaster(doppelgangerState.chatChannelRoute, theMessage)
 				return true, nil
 			}
 		}
@@ -482,14 +377,14 @@ func doCommand(doppelgangerState *userInfo, command string) (bool, error) {
 			// the login. Nonetheless if they do somehow get here, we do the
 			// sensible thing.
 			//
-			_, err := oi.LongWrite(doppelgangerState.writer, []byte("\r\nYou are not logged in.\r\n"))
+			err := tellUser(doppelgangerState, "ERR", "\r\nYou are not logged in.\r\n")
 			return true, err // err can be nil
 		} else {
 			if doppelgangerState.chatChannelID == 0 {
-				_, err := oi.LongWrite(doppelgangerState.writer, []byte("\r\nYou are not on a channel. You have to join a channel before you can exit it.\r\n"))
+				err := tellUser(doppelgangerState, "ERR", "\r\nYou are not on a channel. You have to join a channel before you can exit it.\r\n")
 				return true, err // err can be nil
 			} else {
-				_, err := oi.LongWrite(doppelgangerState.writer, []byte("\r\n"))
+				err := writeToUser(doppelgangerState, "\r\n", "")
 				if err != nil {
 					return true, err
 				}
@@ -502,14 +397,7 @@ func doCommand(doppelgangerState *userInfo, command string) (bool, error) {
 				theMessage.parameter = operand // we could say the name of the channel we're leaving, but it'll be ignored so don't bother
 				theMessage.doppelgangerCallbackFromChannelMaster = doppelgangerState.incomingFromChannelMaster
 				theMessage.doppelgangerCallbackFromChatChannel = doppelgangerState.incomingFromChatChannel
-				if global.chanMasterFromDoppelgangerGoChan == nil {
-					//
-					// Should never happen.
-					//
-					logError("doppelganger ID " + int64ToStr(doppelgangerState.doppelgangerID) + " user ID " + int64ToStr(doppelgangerState.userID) + " error: global.chanMasterFromDoppelgangerGoChan == nil")
-					return false, nil // Try and keep server up (kind of laughable if the go channel to the channel master is gone, though)
-				}
-				global.chanMasterFromDoppelgangerGoChan <- theMessage
+				doppelgangerState.watch.sendFromDoppelgangerToChannelMaster(doppelgangerState.chatChannelRoute, theMessage)
 				//
 				// We go ahead and set our chat channel to 0 to pre-empt the
 				// possibility of sending that chat channel goroutine any more
@@ -543,7 +431,7 @@ func doCommand(doppelgangerState *userInfo, command string) (bool, error) {
 			// login. Nonetheless if they do somehow get here, we do the
 			// sensible thing.
 			//
-			_, err := oi.LongWrite(doppelgangerState.writer, []byte("\r\nYou have to log in before you can talk on a channel.\r\n"))
+			err := tellUser(doppelgangerState, "ERR", "\r\nYou have to log in before you can talk on a channel.\r\n")
 			return false, err // err can be nil
 		} else {
 			if doppelgangerState.chatChannelID == 0 {
@@ -551,40 +439,184 @@ func doCommand(doppelgangerState *userInfo, command string) (bool, error) {
 				// Carriage return because we're not going to backspace out,
 				// we're going to go to the next line and give an error message.
 				//
-				_, err := oi.LongWrite(doppelgangerState.writer, []byte("\r\nYou have to join a channel before you can say anything on a channel. Right now you're just talking to yourself.\r\n"))
+				err := tellUser(doppelgangerState, "ERR", "\r\nYou have to join a channel before you can say anything on a channel. Right now you're just talking to yourself.\r\n")
 				return true, err // err can be nil
 			} else {
 				var newMsg messageFromDoppelgangerToChatChannel
 				newMsg.operation = fromDoppelgangerToChatChannelOpTextMessage
 				newMsg.userID = doppelgangerState.userID
+				newMsg.doppelgangerID = doppelgangerState.doppelgangerID
 				newMsg.parameter = emoteParameter
+				newMsg.said = said
 				if doppelgangerState.chatChannelCallback == nil {
 					//
 					// Should never happen.
 					//
-					logError("doppelganger ID " + int64ToStr(doppelgangerState.doppelgangerID) + " user ID " + int64ToStr(doppelgangerState.userID) + " error: doppelgangerState.chatChannelCallback == nil")
+					doppelgangerState.logger.With("channel_id", doppelgangerState.chatChannelID).Error("doppelgangerState.chatChannelCallback == nil")
 					return false, nil // Try and keep server up
 				}
-				doppelgangerState.chatChannelCallback <- newMsg
+				doppelgangerState.watch.sendFromDoppelgangerToChatChannel(doppelgangerState.chatChannelCallback, newMsg, doppelgangerState.chatChannelID)
+			}
+		}
+	case "/away":
+		//
+		// "/away <message>" marks the user away, plain "/away" marks them
+		// back. While away, the user isn't disconnected for being idle (if
+		// the server allows it).
+		//
+		if operand == "" {
+			if !doppelgangerState.away {
+				err := tellUser(doppelgangerState, "ERR", "\r\nYou are not away. Use /away <message> to go away.\r\n")
+				return true, err // err can be nil
 			}
+			doppelgangerState.away = false
+			doppelgangerState.awayMessage = ""
+			return announceAway(doppelgangerState, doppelgangerState.userName+" is back.", "You are no longer away.")
 		}
+		doppelgangerState.away = true
+		doppelgangerState.awayMessage = operand
+		return announceAway(doppelgangerState, doppelgangerState.userName+" is away: "+operand, "You are away: "+operand)
+	case "/sshkey":
+		return sshKeyCommand(doppelgangerState, operand)
+	case "/apitoken":
+		return apiTokenCommand(doppelgangerState, operand)
+	case "/set":
+		return setCommand(doppelgangerState, operand)
 	case "/help":
-		_, err := oi.LongWrite(doppelgangerState.writer, []byte("\r\n\r\n/list                 -- list channels\r\n/create <channelname> -- create a channel\r\n/join <channelname>   -- join a channel\r\n/who                  -- show who is on the current channel\r\n/exit                 -- exit the current channel\r\n\r\nOnce on a channel:\r\n/say   -- say something on the current channel\r\n/emote -- emote on current channel\r\n/think -- think something on current channel\r\n/sing  -- sing something on current channel\r\n\r\n/help  -- this command\r\n\r\nAbbreviations:\r\n' -- say\r\n; -- emote\r\n\r\n^D log off\r\n\r\n"))
+		help := "\r\n\r\n/list                 -- list channels\r\n/create <channelname> -- create a channel\r\n/join <channelname>   -- join a channel\r\n/who                  -- show who is on the current channel\r\n/exit                 -- exit the current channel\r\n/away <message>       -- mark yourself away (/away alone to come back)\r\n/machine [off]        -- one tagged line per event, for bots\r\n/sshkey [add|remove]  -- your public keys for logging in over SSH\r\n/apitoken [new]       -- your tokens for the HTTP API\r\n/set [<name> <value>] -- your preferences: color, timestamps, theme\r\n\r\nOnce on a channel:\r\n/say   -- say something on the current channel\r\n/emote -- emote on current channel\r\n/think -- think something on current channel\r\n/sing  -- sing something on current channel\r\n\r\n/help  -- this command\r\n\r\nAbbreviations:\r\n' -- say\r\n; -- emote\r\n\r\n^D log off\r\n\r\n"
+		err := writeToUser(doppelgangerState, help, machineLines("HELP", help))
 		return true, err // err can be nil
 	default:
 		//
 		// Carriage return needed because user's "return" wasn't echoed.
 		//
-		_, err := oi.LongWrite(doppelgangerState.writer, []byte("\r\n"))
+		err := writeToUser(doppelgangerState, "\r\n", "")
 		if err != nil {
 			return false, err
 		}
-		_, err = oi.LongWrite(doppelgangerState.writer, []byte("\r\nCommand \""+command+"\" not recognized.\r\n"))
+		err = tellUser(doppelgangerState, "ERR", "\r\nCommand \""+command+"\" not recognized.\r\n")
 		return true, err // err can be nil
 	}
 	return false, nil
 }
 
+//
+// Going away and coming back. If we're on a channel, everyone on it gets told
+// (including us, when the message bounces back, which is how we see it). If
+// we're not on a channel we just tell the user. Same return values as
+// doCommand.
+//
+func announceAway(doppelgangerState *userInfo, channelText string, userText string) (bool, error) {
+	if doppelgangerState.chatChannelID == 0 {
+		err := tellUser(doppelgangerState, "OK", "\r\n"+userText+"\r\n")
+		return true, err // err can be nil
+	}
+	//
+	// Backspace out what the user typed, same as /emote.
+	//
+	err := backspaceOut(doppelgangerState, doppelgangerState.cursorColumn)
+	if err != nil {
+		return false, err
+	}
+	var newMsg messageFromDoppelgangerToChatChannel
+	newMsg.operation = fromDoppelgangerToChatChannelOpTextMessage
+	newMsg.userID = doppelgangerState.userID
+	newMsg.doppelgangerID = doppelgangerState.doppelgangerID
+	newMsg.parameter = channelText
+	if doppelgangerState.chatChannelCallback == nil {
+		//
+		// Should never happen.
+		//
+		doppelgangerState.logger.With("channel_id", doppelgangerState.chatChannelID).Error("doppelgangerState.chatChannelCallback == nil")
+		return false, nil // Try and keep server up
+	}
+	doppelgangerState.watch.sendFromDoppelgangerToChatChannel(doppelgangerState.chatChannelCallback, newMsg, doppelgangerState.chatChannelID)
+	return false, nil
+}
+
+//
+// Something from the server itself (not from a chat channel) that has to
+// interrupt whatever the user is doing, like an idle warning. We backspace
+// out the prompt and whatever the user has typed so far, the same as for
+// chat channel messages, and the main loop puts them back with the next
+// prompt.
+//
+func serverNotice(doppelgangerState *userInfo, text string) error {
+	err := backspaceOut(doppelgangerState, doppelgangerState.promptLen+doppelgangerState.cursorColumn)
+	if err != nil {
+		return err
+	}
+	return writeToUser(doppelgangerState, text+"\r\n", machineLine("SERVER", text))
+}
+
+//
+// Runs from the main loop, every sessionCheckInterval. Sends the Telnet
+// keepalive if it's time, and warns or disconnects the user if they've been
+// idle too long. A dead connection shows up here as a write error, which is
+// the whole point of the keepalive -- otherwise we wouldn't find out until
+// somebody on the user's chat channel said something. Returns true if the
+// user needs a new prompt.
+//
+func sessionHousekeeping(doppelgangerState *userInfo, now time.Time) bool {
+	if doppelgangerState.telnetGoroutineHasGoneAway {
+		return false
+	}
+	settings := doppelgangerState.settings
+	if (settings.keepaliveInterval > 0) && (now.Sub(doppelgangerState.lastKeepalive) >= settings.keepaliveInterval) {
+		doppelgangerState.lastKeepalive = now
+		//
+		// IAC NOP. Clients don't show anything for it. Our Telnet writer
+		// doesn't escape IAC, so this goes out as a command. Bots in
+		// machine mode get a line they can ignore instead. SSH terminals
+		// get nothing -- there's nothing a terminal wouldn't show -- so
+		// only TCP keepalives find dead SSH connections.
+		//
+		keepalive := []byte{255, 241}
+		if doppelgangerState.machineMode {
+			keepalive = []byte("PING\r\n")
+		} else if !doppelgangerState.telnet {
+			keepalive = []byte{}
+		}
+		_, err := oi.LongWrite(doppelgangerState.writer, keepalive)
+		if err != nil {
+			//
+			// We are assuming if we got an error, the network connection
+			// is closed, and we need to exit the doppelganger because we
+			// are done, too.
+			//
+			doppelgangerState.telnetGoroutineHasGoneAway = true
+			return false
+		}
+	}
+	if doppelgangerState.away && settings.awayExemptFromIdle {
+		return false
+	}
+	idle := now.Sub(doppelgangerState.lastInput)
+	if (settings.idleTimeout > 0) && (idle >= settings.idleTimeout) {
+		doppelgangerState.logger.With("idle", idle.Round(time.Second).String()).Info("Disconnecting idle user.")
+		//
+		// Best effort, same as the shutdown notice.
+		//
+		serverNotice(doppelgangerState, "\r\nYou have been idle too long. Goodbye!")
+		hangUp(doppelgangerState)
+		return false
+	}
+	if (settings.idleWarning > 0) && (idle >= settings.idleWarning) && !doppelgangerState.idleWarned {
+		doppelgangerState.idleWarned = true
+		warning := "\r\nYou have been idle for " + idle.Round(time.Second).String() + "."
+		if settings.idleTimeout > 0 {
+			warning = warning + " You will be disconnected if you don't type something within " + (settings.idleTimeout - idle).Round(time.Second).String() + "."
+		}
+		err := serverNotice(doppelgangerState, warning)
+		if err != nil {
+			doppelgangerState.telnetGoroutineHasGoneAway = true
+			return false
+		}
+		return true
+	}
+	return false
+}
+
 //
 // We had to break this out into a separate function because this functionality
 // has to be shared between the text message and leave chat channel op codes.
@@ -593,10 +625,14 @@ func doCommand(doppelgangerState *userInfo, command string) (bool, error) {
 //
 func genericTextOutput(doppelgangerState *userInfo, theMessage messageFromChatChannelToDoppelganger) bool {
 	var err error
+	if doppelgangerState.machineMode {
+		err = writeToUser(doppelgangerState, "", machineTextLine(doppelgangerState, theMessage))
+		return err != nil
+	}
 	if theMessage.originator == doppelgangerState.userID {
 		// Our own message -- don't backspace out.
 		err = backspaceOut(doppelgangerState, doppelgangerState.promptLen+doppelgangerState.cursorColumn)
-		_, err = oi.LongWrite(doppelgangerState.writer, []byte(theMessage.parameter+"\r\n"))
+		_, err = oi.LongWrite(doppelgangerState.writer, []byte(formatChatText(doppelgangerState, theMessage)+"\r\n"))
 	} else {
 		//
 		// Backspace out before outputting message
@@ -610,7 +646,7 @@ func genericTextOutput(doppelgangerState *userInfo, theMessage messageFromChatCh
 			//
 			return true
 		}
-		_, err = oi.LongWrite(doppelgangerState.writer, []byte(theMessage.parameter+"\r\n"))
+		_, err = oi.LongWrite(doppelgangerState.writer, []byte(formatChatText(doppelgangerState, theMessage)+"\r\n"))
 	}
 	if err != nil {
 		//
@@ -622,6 +658,65 @@ func genericTextOutput(doppelgangerState *userInfo, theMessage messageFromChatCh
 	return false
 }
 
+//
+// Chat text, broken into lines that fit the user's terminal, if we know how
+// wide it is.
+//
+func wrapToTerminal(doppelgangerState *userInfo, text string) string {
+	if doppelgangerState.terminal == nil {
+		return text
+	}
+	width := doppelgangerState.terminal.TerminalWidth()
+	if width <= 0 {
+		return text
+	}
+	return wrapText(text, width)
+}
+
+//
+// Messages from the chat channel's text queue: other people's chat, and
+// other people joining and leaving. If the sequence number jumped, the chat
+// channel threw some away because we weren't keeping up, and we say how many
+// before the message. Messages still queued from a chat channel we've since
+// left don't count. Return value is the same as genericTextOutput's.
+//
+func textQueueOutput(doppelgangerState *userInfo, theMessage messageFromChatChannelToDoppelganger) bool {
+	if doppelgangerState.telnetGoroutineHasGoneAway {
+		return false
+	}
+	if theMessage.chatChannelID == doppelgangerState.textChatChannelID {
+		skipped := theMessage.sequence - doppelgangerState.lastTextSequence - 1
+		if skipped > 0 {
+			var skippedMsg messageFromChatChannelToDoppelganger
+			skippedMsg.operation = fromChatChannelToDoppelgangerOpTextMessage
+			skippedMsg.originator = 0
+			skippedMsg.chatChannelID = theMessage.chatChannelID
+			if skipped == 1 {
+				skippedMsg.parameter = "[1 message skipped]"
+			} else {
+				skippedMsg.parameter = "[" + int64ToStr(skipped) + " messages skipped]"
+			}
+			skippedMsg.machineLine = "SKIPPED #" + doppelgangerState.chatChannelName + " " + int64ToStr(skipped)
+			if genericTextOutput(doppelgangerState, skippedMsg) {
+				return true
+			}
+		}
+		if theMessage.sequence > doppelgangerState.lastTextSequence {
+			doppelgangerState.lastTextSequence = theMessage.sequence
+		}
+	}
+	switch theMessage.operation {
+	case fromChatChannelToDoppelgangerOpTextMessage, fromChatChannelToDoppelgangerOpTextExit:
+		return genericTextOutput(doppelgangerState, theMessage)
+	default:
+		//
+		// Should never happen.
+		//
+		doppelgangerState.logger.With("operation", theMessage.operation).Error("unexpected opcode on text queue from chat channel")
+	}
+	return false
+}
+
 //
 // Made this into a separate function because we can detect the user has gone
 // away at lots of points (for example in the command loop or in the processing
@@ -650,7 +745,7 @@ func handleChannelExitProcedure(doppelgangerState *userInfo) bool {
 			// begin with and will never send us the message, so it's safe
 			// for us to just go ahead and shut down.
 			//
-			logError("doppelganger ID " + int64ToStr(doppelgangerState.doppelgangerID) + " user ID " + int64ToStr(doppelgangerState.userID) + " error: cantExitBeforeExitMessageFromChannel has looped 1000 times, something is wrong.")
+			doppelgangerState.logger.Error("cantExitBeforeExitMessageFromChannel has looped 1000 times, something is wrong.")
 			return true
 		}
 		return false
@@ -666,7 +761,7 @@ func handleChannelExitProcedure(doppelgangerState *userInfo) bool {
 			// join request and actual join.
 			//
 			if doppelgangerState.chatChannelID == -1 {
-				log.Println("doppelganger ID " + int64ToStr(doppelgangerState.doppelgangerID) + " user ID " + int64ToStr(doppelgangerState.userID) + ", chatChannelID == -1, skipping sending of exit message.")
+				doppelgangerState.logger.Debug("chatChannelID == -1, skipping sending of exit message.")
 			} else {
 				var theMessage messageFromDoppelgangerToChannelMaster
 				theMessage.operation = fromDoppelgangerToChannelMasterOpExit
@@ -677,14 +772,7 @@ func handleChannelExitProcedure(doppelgangerState *userInfo) bool {
 				theMessage.parameter = ""
 				theMessage.doppelgangerCallbackFromChannelMaster = doppelgangerState.incomingFromChannelMaster
 				theMessage.doppelgangerCallbackFromChatChannel = doppelgangerState.incomingFromChatChannel
-				if global.chanMasterFromDoppelgangerGoChan == nil {
-					//
-					// Should never happen.
-					//
-					logError("doppelganger ID " + int64ToStr(doppelgangerState.doppelgangerID) + " user ID " + int64ToStr(doppelgangerState.userID) + " error: global.chanMasterFromDoppelgangerGoChan == nil")
-					return false // Try and keep server up (kind of laughable if the go channel to the channel master is gone, though)
-				}
-				global.chanMasterFromDoppelgangerGoChan <- theMessage
+				doppelgangerState.watch.sendFromDoppelgangerToChannelMaster(doppelgangerState.chatChannelRoute, theMessage)
 			}
 			doppelgangerState.chatChannelID = 0
 			doppelgangerState.chatChannelName = "(no channel)"
@@ -696,9 +784,236 @@ func handleChannelExitProcedure(doppelgangerState *userInfo) bool {
 	}
 }
 
-func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
+//
+// Register and unregister with the channel master, so it knows about every
+// doppelganger on the system and can reach us with broadcasts (such as the
+// server shutting down). Register happens once at startup and unregister
+// once right before the goroutine exits. We also let the channel master know
+// about logins, for the metrics.
+//
+func notifyChannelMaster(doppelgangerState *userInfo, operation int) {
+	var theMessage messageFromDoppelgangerToChannelMaster
+	theMessage.operation = operation
+	theMessage.userID = doppelgangerState.userID
+	theMessage.userName = doppelgangerState.userName
+	theMessage.doppelgangerID = doppelgangerState.doppelgangerID
+	theMessage.chatChannelID = 0
+	theMessage.parameter = ""
+	theMessage.doppelgangerCallbackFromChannelMaster = doppelgangerState.incomingFromChannelMaster
+	theMessage.doppelgangerCallbackFromChatChannel = doppelgangerState.incomingFromChatChannel
+	theMessage.doppelgangerBroadcastCallback = doppelgangerState.incomingBroadcastFromChannelMaster
+	theMessage.doppelgangerHangUpCallback = doppelgangerState.incomingHangUpFromChannelMaster
+	theMessage.doppelgangerSettingsCallback = doppelgangerState.incomingSettingsFromChannelMaster
+	theMessage.writeErrors = doppelgangerState.errorCounter.errors
+	if doppelgangerState.chatServer.chanMasterFromDoppelgangerGoChan == nil {
+		//
+		// Should never happen.
+		//
+		doppelgangerState.logger.Error("chanMasterFromDoppelgangerGoChan == nil")
+		return
+	}
+	doppelgangerState.watch.sendFromDoppelgangerToChannelMaster(doppelgangerState.chatServer.chanMasterFromDoppelgangerGoChan, theMessage)
+}
+
+//
+// Only for the event sink (see eventsink.go).
+//
+func notifyChannelMasterOfCreate(doppelgangerState *userInfo, chatChannelName string) {
+	var theMessage messageFromDoppelgangerToChannelMaster
+	theMessage.operation = fromDoppelgangerToChannelMasterOpChatChannelCreated
+	theMessage.userID = doppelgangerState.userID
+	theMessage.userName = doppelgangerState.userName
+	theMessage.doppelgangerID = doppelgangerState.doppelgangerID
+	theMessage.chatChannelID = 0
+	theMessage.parameter = chatChannelName
+	doppelgangerState.watch.sendFromDoppelgangerToChannelMaster(doppelgangerState.chatServer.chanMasterFromDoppelgangerGoChan, theMessage)
+}
+
+//
+// Wraps the Telnet writer to count write errors, for the metrics, and to let
+// the stall watchdog know if we're stuck writing to a client that isn't
+// reading. Only the doppelganger goroutine that owns it ever uses it.
+//
+// It also puts a deadline on every write (if the connection can take one and
+// the timeout isn't 0), so a client that stops reading can't keep us stuck
+// forever. Once a write has timed out, timedOut is set and every write after
+// that fails right away -- we're about to hang up anyway.
+//
+type errorCountingWriter struct {
+	writer   telnet.Writer
+	errors   int64
+	watch    *stallWatch
+	deadline writeDeadliner
+	timeout  time.Duration
+	timedOut bool
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+//
+// What a connection can tell us about the user's terminal: so far just how
+// wide it is, in columns (0 if it doesn't know). SSH sessions know; Telnet
+// ones don't.
+//
+type terminalSizer interface {
+	TerminalWidth() int
+}
+
+var errClientWriteTimedOut = errors.New("write to client timed out")
+
+func (counter *errorCountingWriter) Write(p []byte) (int, error) {
+	if counter.timedOut {
+		counter.errors++
+		return 0, errClientWriteTimedOut
+	}
+	if counter.watch != nil {
+		counter.watch.blocked(stallEdgeDoppelgangerToClient, 0)
+		defer counter.watch.unblocked()
+	}
+	if counter.deadline != nil {
+		if counter.timeout > 0 {
+			counter.deadline.SetWriteDeadline(time.Now().Add(counter.timeout))
+		} else {
+			counter.deadline.SetWriteDeadline(time.Time{})
+		}
+	}
+	n, err := counter.writer.Write(p)
+	if err != nil {
+		counter.errors++
+		netErr, ok := err.(net.Error)
+		if ok && netErr.Timeout() {
+			counter.timedOut = true
+		}
+	}
+	return n, err
+}
+
+//
+// Every way out of the doppelganger goroutine goes through here. We
+// unregister before closing our go channels -- the channel master only ever
+// sends to the broadcast go channel, which we never close, so it's harmless
+// if a broadcast is still on its way to us after this.
+//
+func doppelgangerExit(doppelgangerState *userInfo) {
+	notifyChannelMaster(doppelgangerState, fromDoppelgangerToChannelMasterOpUnregister)
+	close(doppelgangerState.incomingFromChannelMaster)
+	close(doppelgangerState.incomingFromChatChannel)
+	doppelgangerState.chatServer.stallWatchdog.unwatch(doppelgangerState.watch)
+}
+
+//
+// Hang up on the user. The Telnet goroutine's read fails as a result, it
+// closes our userGoChannel, and from there we go through the same exit
+// procedure as if the user had disconnected.
+//
+func hangUp(doppelgangerState *userInfo) {
+	doppelgangerState.telnetGoroutineHasGoneAway = true
+	if (doppelgangerState.connCloser == nil) || doppelgangerState.hungUp {
+		return
+	}
+	doppelgangerState.hungUp = true
+	err := doppelgangerState.connCloser.Close()
+	if err != nil {
+		doppelgangerState.logger.With("error", err).Warn("Closing connection failed.")
+	}
+}
+
+//
+// The user is who they say they are: userID and userName are set, and
+// plugins have had their say. From here on everything we log says who it
+// is.
+//
+func finishLogin(doppelgangerState *userInfo) error {
+	doppelgangerState.logger = doppelgangerState.logger.With("user_id", doppelgangerState.userID, "user_name", doppelgangerState.userName)
+	doppelgangerState.chatServer.stallWatchdog.relabel(doppelgangerState.watch, doppelgangerState.logger)
+	doppelgangerState.logger.Info("Logged in.")
+	loadUserPrefs(doppelgangerState)
+	notifyChannelMaster(doppelgangerState, fromDoppelgangerToChannelMasterOpLoggedIn)
+	doppelgangerState.mode = loginCommandMode
+	//
+	// Carriage return needed because user's "return" wasn't echoed.
+	//
+	return tellUser(doppelgangerState, "OK", "\r\nYou are logged in. Use /help for help with commands.\r\n")
+}
+
+//
+// Settings arrive from the channel master, once right after we register and
+// again whenever the configuration is reloaded. A reload can ban the address
+// of someone who's already connected, so we check every time. Returns false
+// if we hung up on the user.
+//
+func applySettings(doppelgangerState *userInfo, settings liveSettings) bool {
+	doppelgangerState.settings = settings
+	doppelgangerState.errorCounter.timeout = settings.clientWriteTimeout
+	if !addressIsBanned(settings.bannedNetworks, doppelgangerState.remoteAddr) {
+		return true
+	}
+	doppelgangerState.logger.Info("Disconnecting banned address.")
+	if !doppelgangerState.telnetGoroutineHasGoneAway {
+		//
+		// Best effort, same as the shutdown notice.
+		//
+		tellUser(doppelgangerState, "SERVER", "\r\nConnections from your address are not accepted.\r\n")
+	}
+	hangUp(doppelgangerState)
+	return false
+}
+
+//
+// How often the main loop checks for keepalives and idle users. The actual
+// intervals are in the settings; this just needs to be a lot shorter than
+// any of them, and than the gap between the idle warning and the idle
+// timeout, or a user could go straight from no warning to disconnected.
+// Five seconds is plenty for the usual settings of a minute or more.
+//
+func sessionCheckInterval(settings liveSettings) time.Duration {
+	interval := 5 * time.Second
+	intervals := []time.Duration{settings.keepaliveInterval, settings.idleWarning, settings.idleTimeout}
+	if (settings.idleWarning > 0) && (settings.idleTimeout > 0) {
+		intervals = append(intervals, settings.idleTimeout-settings.idleWarning)
+	}
+	for _, setting := range intervals {
+		if (setting > 0) && (setting/4 < interval) {
+			interval = setting / 4
+		}
+	}
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	return interval
+}
+
+//
+// sessionKind is telnetSession, machineSession or terminalSession (see
+// above). authenticated is the user if they've already proved who they are
+// (to the SSH listener), so they skip logging in; its ID is 0 otherwise.
+//
+func doppelgangerGoroutine(chatServer *ChatServer, writer telnet.Writer, connCloser io.Closer, remoteAddr string, userGoChannel <-chan byte, sessionKind int, authenticated User) {
+	defer chatServer.doppelgangers.Done()
 	var doppelgangerState userInfo
+	doppelgangerState.chatServer = chatServer
+	//
+	// Every write to the user goes through the error counter, so we can
+	// tell the channel master how many failed when we unregister.
+	//
+	doppelgangerState.errorCounter = &errorCountingWriter{writer: writer, errors: 0}
+	deadline, ok := connCloser.(writeDeadliner)
+	if ok {
+		doppelgangerState.errorCounter.deadline = deadline
+	}
+	writer = doppelgangerState.errorCounter
 	doppelgangerState.writer = writer
+	doppelgangerState.connCloser = connCloser
+	doppelgangerState.remoteAddr = remoteAddr
+	doppelgangerState.machineMode = (sessionKind == machineSession)
+	doppelgangerState.machineModeOnly = doppelgangerState.machineMode
+	doppelgangerState.telnet = (sessionKind == telnetSession)
+	terminal, ok := connCloser.(terminalSizer)
+	if ok {
+		doppelgangerState.terminal = terminal
+	}
 	doppelgangerState.telnetGoroutineHasGoneAway = false
 	doppelgangerState.cantExitBeforeExitMessageFromChannel = false
 	doppelgangerState.userID = 0
@@ -715,6 +1030,30 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 	//
 	doppelgangerState.incomingFromChatChannel = make(chan messageFromChatChannelToDoppelganger, 1)
 	//
+	// Chat text from the chat channel comes on its own queue, which the
+	// chat channel never waits on -- when it's full, the slow member policy
+	// kicks in. Like the broadcast go channel, we never close this one.
+	//
+	doppelgangerState.incomingTextFromChatChannel = make(chan messageFromChatChannelToDoppelganger, chatServer.config.MemberQueue)
+	//
+	// Buffer size of 2 because broadcasts are rare and the channel master
+	// never blocks sending them -- if we haven't picked up the last ones, the
+	// next one is dropped. We never close this go channel.
+	//
+	doppelgangerState.incomingBroadcastFromChannelMaster = make(chan messageFromChannelMasterToDoppelganger, 2)
+	//
+	// Being told to hang up can't be dropped either: room for one, and the
+	// channel master doesn't send another while that one's waiting (see
+	// sendHangUp). Never closed.
+	//
+	doppelgangerState.incomingHangUpFromChannelMaster = make(chan messageFromChannelMasterToDoppelganger, 1)
+	//
+	// Settings can't be dropped, so they have a go channel of their own:
+	// room for one, which the channel master replaces if we haven't picked
+	// it up yet (see sendLatestSettings). We never close this one either.
+	//
+	doppelgangerState.incomingSettingsFromChannelMaster = make(chan liveSettings, 1)
+	//
 	// Had to move mode into doppelgangerState so commands (handled by a
 	// function to make the code structure simpler) can set the "suppress
 	// prompt" mode.
@@ -728,6 +1067,15 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 	doppelgangerState.attemptingUserName = ""
 	doppelgangerState.attemptingUserNewPassword = ""
 	//
+	// Idle tracking starts now -- sitting at the login prompt counts as
+	// idle, too.
+	//
+	doppelgangerState.lastInput = time.Now()
+	doppelgangerState.lastKeepalive = doppelgangerState.lastInput
+	doppelgangerState.idleWarned = false
+	doppelgangerState.away = false
+	doppelgangerState.awayMessage = ""
+	//
 	// We use the random number generator to give ourselves an ID. We could
 	// use unsigned 64-bit numbers, but I find it's better to avoid unsigned
 	// ints unless you really need to. There are edge cases where unsigned
@@ -743,10 +1091,32 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
 	doppelgangerState.doppelgangerID = rnd.Int63()
 	//
+	// Everything we log says which doppelganger and which address it's
+	// about. The user ID and name get added when the user logs in.
+	//
+	doppelgangerState.logger = chatServer.logger.With("goroutine", "doppelganger", "doppelganger_id", doppelgangerState.doppelgangerID, "remote_addr", remoteAddr)
+	doppelgangerState.logger.Debug("Connected.")
+	doppelgangerState.watch = chatServer.stallWatchdog.watch(doppelgangerState.logger)
+	doppelgangerState.errorCounter.watch = doppelgangerState.watch
+	notifyChannelMaster(&doppelgangerState, fromDoppelgangerToChannelMasterOpRegister)
+	//
+	// The channel master answers our registration with the current settings
+	// (MOTD, registration policy, banned addresses). We need them before we
+	// say anything to the user. If the user disconnects while we wait, we
+	// find out from userGoChannel in the main loop like always.
+	//
+	initialSettings := <-doppelgangerState.incomingSettingsFromChannelMaster
+	if !applySettings(&doppelgangerState, initialSettings) {
+		doppelgangerExit(&doppelgangerState)
+		return
+	}
+	//
 	// Switch to full duplex!!
 	//
 	var err error
-	_, err = oi.LongWrite(writer, []byte{255, 251, 3, 255, 251, 1, 13, 10}) // turn on full duplex, turn off local echo
+	if doppelgangerState.telnet {
+		_, err = oi.LongWrite(writer, []byte{255, 251, 3, 255, 251, 1, 13, 10}) // turn on full duplex, turn off local echo
+	}
 	if err != nil {
 		//
 		// We are assuming if we got an error, the network connection is
@@ -756,12 +1126,11 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 		// ahead and bail here. Once we're in the loop, though, we'll
 		// need to check and see if we're on a chat channel.
 		//
-		close(doppelgangerState.incomingFromChannelMaster)
-		close(doppelgangerState.incomingFromChatChannel)
-		logError("doppelganger ID " + int64ToStr(doppelgangerState.doppelgangerID) + " user ID " + int64ToStr(doppelgangerState.userID) + " error: turn on full duplex failed.")
+		doppelgangerExit(&doppelgangerState)
+		doppelgangerState.logger.Error("turn on full duplex failed.")
 		return
 	}
-	_, err = oi.LongWrite(writer, []byte("Welcome to the Wayne Brain Telnet daemon. Type ^D to exit.\r\n\r\n"))
+	err = writeToUser(&doppelgangerState, doppelgangerState.settings.motd+"\r\n\r\n", machineLines("MOTD", doppelgangerState.settings.motd))
 	if err != nil {
 		//
 		// We are assuming if we got an error, the network connection is
@@ -771,9 +1140,8 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 		// ahead and bail here. Once we're in the loop, though, we'll
 		// need to check and see if we're on a chat channel.
 		//
-		close(doppelgangerState.incomingFromChannelMaster)
-		close(doppelgangerState.incomingFromChatChannel)
-		logError("doppelganger ID " + int64ToStr(doppelgangerState.doppelgangerID) + " user ID " + int64ToStr(doppelgangerState.userID) + " error: sending welcome message failed.")
+		doppelgangerExit(&doppelgangerState)
+		doppelgangerState.logger.Error("sending welcome message failed.")
 		return
 	}
 	//
@@ -789,9 +1157,52 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 	doppelgangerState.backspaceBuffer = make([]byte, 0)
 	echoSlice := make([]byte, 1) // just to keep from having to allocate a 1-byte slice over and over
 	//
+	// Users the SSH listener has already checked skip straight to being
+	// logged in -- unless a plugin won't have them, and then there's no
+	// other way in, so we hang up.
+	//
+	if authenticated.ID != 0 {
+		doppelgangerState.userID = authenticated.ID
+		doppelgangerState.userName = authenticated.Name
+		refusal := pluginsOnLogin(chatServer.plugins, authenticated)
+		if refusal != nil {
+			doppelgangerState.logger.With("user_id", authenticated.ID, "user_name", authenticated.Name, "reason", refusal).Warn("Login refused by a plugin.")
+			doppelgangerState.userID = 0
+			doppelgangerState.userName = ""
+			notifyChannelMaster(&doppelgangerState, fromDoppelgangerToChannelMasterOpLoginFailed)
+			tellUser(&doppelgangerState, "ERR", refusal.Error()+"\r\n")
+			hangUp(&doppelgangerState)
+			doppelgangerExit(&doppelgangerState)
+			return
+		}
+		err = finishLogin(&doppelgangerState)
+		if err != nil {
+			doppelgangerState.telnetGoroutineHasGoneAway = true
+		}
+	}
+	//
+	// For keepalives and idle checks. The settings can change on reload, so
+	// we compare against whatever the settings are at the time, and change
+	// how often we tick when they do.
+	//
+	sessionTickerInterval := sessionCheckInterval(doppelgangerState.settings)
+	sessionTicker := time.NewTicker(sessionTickerInterval)
+	defer sessionTicker.Stop()
+	//
 	// Main loop -- prompt the user and process bytes that the user types
 	//
 	for {
+		if doppelgangerState.promptNeeded && doppelgangerState.machineMode {
+			//
+			// No prompt in machine mode -- just a line saying what we
+			// want next, while the user is logging in.
+			//
+			err = writeMachinePrompt(&doppelgangerState)
+			if err != nil {
+				doppelgangerState.telnetGoroutineHasGoneAway = true
+			}
+			doppelgangerState.promptNeeded = false
+		}
 		if doppelgangerState.promptNeeded {
 			//
 			// ALRIGHTY! This is the main loop where we accept and process
@@ -858,7 +1269,7 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 				//
 				// Should never happen.
 				//
-				logError("doppelganger ID " + int64ToStr(doppelgangerState.doppelgangerID) + " user ID " + int64ToStr(doppelgangerState.userID) + " error: mode for prompt is missing or invalid. mode: " + intToStr(doppelgangerState.mode))
+				doppelgangerState.logger.With("mode", doppelgangerState.mode).Error("mode for prompt is missing or invalid")
 			}
 			if err != nil {
 				//
@@ -868,6 +1279,13 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 				//
 				doppelgangerState.telnetGoroutineHasGoneAway = true
 			}
+			//
+			// Prompt is out. Whatever happens next (the user typing, a
+			// message from a chat channel, etc) says if we need another
+			// one -- we don't want a fresh prompt every time the session
+			// ticker goes off.
+			//
+			doppelgangerState.promptNeeded = false
 		}
 		//
 		// This is the main select where we receive messages from the Telnet
@@ -895,6 +1313,9 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 				// sure why Go selects work this way but they do.
 				//
 				usrByte = 0 // special value to signal no further processing
+			} else {
+				doppelgangerState.lastInput = time.Now()
+				doppelgangerState.idleWarned = false
 			}
 			if (usrByte == 3) || (usrByte == 4) { // user typed ^C or ^D
 				//
@@ -981,9 +1402,9 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 			//
 			// Echo!
 			//
-			// With special handling for backspaces.
+			// With special handling for backspaces. Never in machine mode.
 			//
-			if doppelgangerState.echoOn {
+			if doppelgangerState.echoOn && !doppelgangerState.machineMode {
 				//
 				// We assign 0 to ourselves as a special value that means
 				// transmit nothing.
@@ -1081,6 +1502,18 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 				//
 				if command == "" { // ignore blank lines
 					doppelgangerState.promptNeeded = false
+				} else if ((doppelgangerState.mode == loginUsernameMode) || (doppelgangerState.mode == loginCommandMode)) && isMachineModeCommand(command) {
+					//
+					// Bots can switch before they log in, so the login
+					// goes the machine mode way, too. Not while we're
+					// asking for a password, though -- that could be a
+					// password.
+					//
+					doppelgangerState.promptNeeded, err = setMachineMode(&doppelgangerState, command)
+					if err != nil {
+						doppelgangerState.telnetGoroutineHasGoneAway = true
+					}
+					doppelgangerState.cursorColumn = 0
 				} else {
 					//
 					// How we interpret the command depends on what
@@ -1089,18 +1522,18 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 					switch doppelgangerState.mode {
 					case loginUsernameMode:
 						doppelgangerState.attemptingUserName = command
-						exists, err := userExists(doppelgangerState.attemptingUserName)
+						existingUserID, _, _, err := chatServer.store.lookUpUser(doppelgangerState.attemptingUserName)
 						if err != nil {
 							//
 							// Eh, we really don't know what to do here.
 							// Log error for human to review (hopefully).
 							//
-							log.Println(err)
+							doppelgangerState.logger.With("user_name", doppelgangerState.attemptingUserName, "error", err).Error("Looking up user failed.")
 							//
 							// What now? We can't exit because the user is
 							// still connected.
 							//
-							_, err = oi.LongWrite(writer, []byte("A database error occurred.\r\n"))
+							err = tellUser(&doppelgangerState, "ERR", "A database error occurred.\r\n")
 							if err != nil {
 								//
 								// We are assuming if we got an error, the network
@@ -1110,12 +1543,12 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 								doppelgangerState.telnetGoroutineHasGoneAway = true
 							}
 						}
-						if !exists {
+						if existingUserID == 0 {
 							//
 							// Prepend carriage return because user's carriage
 							// return is not echoed.
 							//
-							_, err = oi.LongWrite(writer, []byte("\r\nThat username does not exist on this system. "))
+							err = tellUser(&doppelgangerState, "ERR", "\r\nThat username does not exist on this system. ")
 							if err != nil {
 								//
 								// We are assuming if we got an error, the network
@@ -1124,13 +1557,25 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 								//
 								doppelgangerState.telnetGoroutineHasGoneAway = true
 							}
-							doppelgangerState.mode = loginNewUserYNMode
+							if doppelgangerState.settings.registrationOpen {
+								doppelgangerState.mode = loginNewUserYNMode
+							} else {
+								//
+								// Registration is closed, so don't offer
+								// to create the account; just ask for a
+								// username again.
+								//
+								err = tellUser(&doppelgangerState, "ERR", "New accounts are not being accepted right now.\r\n")
+								if err != nil {
+									doppelgangerState.telnetGoroutineHasGoneAway = true
+								}
+							}
 						} else {
 							//
 							// Carriage return because user's carriage return
 							// is not echoed.
 							//
-							_, err = oi.LongWrite(writer, []byte("\r\n"))
+							err = writeToUser(&doppelgangerState, "\r\n", "")
 							if err != nil {
 								//
 								// We are assuming if we got an error, the network
@@ -1147,7 +1592,7 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 						// Prepend carriage return because user's carriage
 						// return is not echoed.
 						//
-						_, err = oi.LongWrite(writer, []byte("\r\n"))
+						err = writeToUser(&doppelgangerState, "\r\n", "")
 						if err != nil {
 							//
 							// We are assuming if we got an error, the network
@@ -1172,7 +1617,7 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 						// Line feed because the user's return for the
 						// password wasn't echoed.
 						//
-						_, err = oi.LongWrite(writer, []byte{13, 10})
+						err = writeToUser(&doppelgangerState, "\r\n", "")
 						if err != nil {
 							//
 							// We are assuming if we got an error, the network
@@ -1182,7 +1627,7 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 							doppelgangerState.telnetGoroutineHasGoneAway = true
 						}
 						if len(command) < 4 {
-							_, err = oi.LongWrite(writer, []byte("Please enter a password at least 4 characters long.\r\n"))
+							err = tellUser(&doppelgangerState, "ERR", "Please enter a password at least 4 characters long.\r\n")
 							if err != nil {
 								//
 								// We are assuming if we got an error, the network
@@ -1201,13 +1646,13 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 						// Line feed because the user's return for the
 						// password wasn't echoed.
 						//
-						_, err = oi.LongWrite(writer, []byte{13, 10})
+						err = writeToUser(&doppelgangerState, "\r\n", "")
 						//
 						// Default to trying again.
 						//
 						doppelgangerState.mode = loginNewPassword1Mode
 						if command != doppelgangerState.attemptingUserNewPassword {
-							_, err = oi.LongWrite(writer, []byte("Confirmation password did not match. Please try again.\r\n"))
+							err = tellUser(&doppelgangerState, "ERR", "Confirmation password did not match. Please try again.\r\n")
 							if err != nil {
 								//
 								// We are assuming if we got an error, the network
@@ -1217,11 +1662,13 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 								doppelgangerState.telnetGoroutineHasGoneAway = true
 							}
 						} else {
-							err = createUser(doppelgangerState.attemptingUserName, doppelgangerState.attemptingUserNewPassword)
+							err = createUser(chatServer.store, doppelgangerState.attemptingUserName, doppelgangerState.attemptingUserNewPassword)
 							if err != nil {
-								_, err = oi.LongWrite(writer, []byte("An error occurred while creating your account: "+err.Error()+"\r\n"))
+								doppelgangerState.logger.With("user_name", doppelgangerState.attemptingUserName, "error", err).Warn("Creating account failed.")
+								err = tellUser(&doppelgangerState, "ERR", "An error occurred while creating your account: "+err.Error()+"\r\n")
 							} else {
-								_, err = oi.LongWrite(writer, []byte("Your new account has been created. Please log in as you will normally.\r\n"))
+								doppelgangerState.logger.With("user_name", doppelgangerState.attemptingUserName).Info("Account created.")
+								err = tellUser(&doppelgangerState, "OK", "Your new account has been created. Please log in as you will normally.\r\n")
 								if err != nil {
 									//
 									// We are assuming if we got an error, the network
@@ -1237,13 +1684,19 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 						doppelgangerState.echoOn = true
 					case loginRegularPasswordMode:
 						password := command
-						doppelgangerState.userID, doppelgangerState.userName, err = login(doppelgangerState.attemptingUserName, password)
+						doppelgangerState.userID, doppelgangerState.userName, err = login(chatServer.store, doppelgangerState.attemptingUserName, password)
+						var refusal error
+						if doppelgangerState.userID != 0 {
+							refusal = pluginsOnLogin(chatServer.plugins, User{ID: doppelgangerState.userID, Name: doppelgangerState.userName})
+						}
 						if doppelgangerState.userID == 0 {
 							//
 							// Leading carriage return needed because user's
 							// "return" wasn't echoed.
 							//
-							_, err = oi.LongWrite(writer, []byte("\r\nIncorrect password.\r\n"))
+							doppelgangerState.logger.With("user_name", doppelgangerState.attemptingUserName).Warn("Login failed: incorrect password.")
+							notifyChannelMaster(&doppelgangerState, fromDoppelgangerToChannelMasterOpLoginFailed)
+							err = tellUser(&doppelgangerState, "ERR", "\r\nIncorrect password.\r\n")
 							if err != nil {
 								//
 								// We are assuming if we got an error, the network
@@ -1253,12 +1706,28 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 								doppelgangerState.telnetGoroutineHasGoneAway = true
 							}
 							doppelgangerState.mode = loginUsernameMode
-						} else {
+						} else if refusal != nil {
 							//
-							// Carriage return needed because user's "return"
-							// wasn't echoed.
+							// Right password, but a plugin (see plugin.go)
+							// won't have them. Back to the start, same as a
+							// wrong password.
 							//
-							_, err = oi.LongWrite(writer, []byte("\r\nYou are logged in. Use /help for help with commands.\r\n"))
+							doppelgangerState.logger.With("user_id", doppelgangerState.userID, "user_name", doppelgangerState.userName, "reason", refusal).Warn("Login refused by a plugin.")
+							doppelgangerState.userID = 0
+							doppelgangerState.userName = ""
+							notifyChannelMaster(&doppelgangerState, fromDoppelgangerToChannelMasterOpLoginFailed)
+							err = tellUser(&doppelgangerState, "ERR", "\r\n"+refusal.Error()+"\r\n")
+							if err != nil {
+								//
+								// We are assuming if we got an error, the network
+								// connection is closed, and we need to exit the
+								// doppelganger because we are done, too.
+								//
+								doppelgangerState.telnetGoroutineHasGoneAway = true
+							}
+							doppelgangerState.mode = loginUsernameMode
+						} else {
+							err = finishLogin(&doppelgangerState)
 							if err != nil {
 								//
 								// We are assuming if we got an error, the network
@@ -1267,7 +1736,6 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 								//
 								doppelgangerState.telnetGoroutineHasGoneAway = true
 							}
-							doppelgangerState.mode = loginCommandMode
 						}
 						doppelgangerState.promptNeeded = true
 						doppelgangerState.echoOn = true
@@ -1323,7 +1791,7 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 						//
 						// Should never happen.
 						//
-						logError("doppelganger ID " + int64ToStr(doppelgangerState.doppelgangerID) + " user ID " + int64ToStr(doppelgangerState.userID) + " error: login mode for command processing is missing or invalid: " + intToStr(doppelgangerState.mode))
+						doppelgangerState.logger.With("mode", doppelgangerState.mode).Error("login mode for command processing is missing or invalid")
 					}
 					//
 					// Reset line buffer for next line.
@@ -1338,9 +1806,8 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 				// channel?? This should never happen. Log and
 				// bail.
 				//
-				logError("doppelganger ID " + int64ToStr(doppelgangerState.doppelgangerID) + " user ID " + int64ToStr(doppelgangerState.userID) + " error: incomingFromChannelMaster go channel has unexpectedly closed.")
-				close(doppelgangerState.incomingFromChannelMaster)
-				close(doppelgangerState.incomingFromChatChannel)
+				doppelgangerState.logger.Error("incomingFromChannelMaster go channel has unexpectedly closed.")
+				doppelgangerExit(&doppelgangerState)
 				return
 			}
 			//
@@ -1355,7 +1822,7 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 				// has typed so far?
 				//
 				if !doppelgangerState.telnetGoroutineHasGoneAway {
-					_, err = oi.LongWrite(writer, []byte("\r\n"+response.msgToUser+"\r\n"))
+					err = tellUser(&doppelgangerState, "ERR", "\r\n"+response.msgToUser+"\r\n")
 					if err != nil {
 						//
 						// We are assuming if we got an error, the network
@@ -1376,7 +1843,7 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 				//
 				doppelgangerState.chatChannelID = 0
 				if !doppelgangerState.telnetGoroutineHasGoneAway {
-					_, err = oi.LongWrite(writer, []byte("\r\n"+response.msgToUser+"\r\n"))
+					err = tellUser(&doppelgangerState, "ERR", "\r\n"+response.msgToUser+"\r\n")
 					if err != nil {
 						//
 						// We are assuming if we got an error, the network
@@ -1399,7 +1866,7 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 				//
 				// Should never happen.
 				//
-				logError("doppelganger ID " + int64ToStr(doppelgangerState.doppelgangerID) + " user ID " + int64ToStr(doppelgangerState.userID) + " error: unexpected opcode from channel master: " + intToStr(response.operation))
+				doppelgangerState.logger.With("operation", response.operation).Error("unexpected opcode from channel master")
 			}
 			doppelgangerState.promptNeeded = true
 		case theMessage, ok := <-doppelgangerState.incomingFromChatChannel:
@@ -1408,15 +1875,20 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 				// Whoa, channel closed! We lost our own response channel??
 				// This should never happen. Log and bail.
 				//
-				logError("doppelganger ID " + int64ToStr(doppelgangerState.doppelgangerID) + " user ID " + int64ToStr(doppelgangerState.userID) + " error: callback channel for chat channels unexpectedly closed.")
-				close(doppelgangerState.incomingFromChannelMaster)
-				close(doppelgangerState.incomingFromChatChannel)
+				doppelgangerState.logger.Error("callback channel for chat channels unexpectedly closed.")
+				doppelgangerExit(&doppelgangerState)
 				return
 			}
 			switch theMessage.operation {
 			case fromChatChannelToDoppelgangerOpJoinDenied:
+				//
+				// Same as the channel master denying the join: we're not on
+				// a channel after all, so clear out the -1, and if we've
+				// lost the Telnet connection, we can exit now.
+				//
+				doppelgangerState.chatChannelID = 0
 				if !doppelgangerState.telnetGoroutineHasGoneAway {
-					_, err = oi.LongWrite(writer, []byte("\r\nRequest to join channel denied: "+theMessage.parameter+"\r\n"))
+					err = tellUser(&doppelgangerState, "ERR", "\r\nRequest to join channel denied: "+theMessage.parameter+"\r\n")
 					if err != nil {
 						//
 						// We are assuming if we got an error, the network connection
@@ -1426,18 +1898,23 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 						doppelgangerState.telnetGoroutineHasGoneAway = true
 					}
 				}
+				if doppelgangerState.telnetGoroutineHasGoneAway {
+					doppelgangerState.cantExitBeforeExitMessageFromChannel = false
+				}
 			case fromChatChannelToDoppelgangerOpJoined:
 				doppelgangerState.chatChannelID = theMessage.chatChannelID
 				doppelgangerState.chatChannelName = theMessage.parameter
 				doppelgangerState.chatChannelCallback = theMessage.chatChannelCallback
+				doppelgangerState.textChatChannelID = theMessage.chatChannelID
+				doppelgangerState.lastTextSequence = 0
 				if doppelgangerState.chatChannelCallback == nil {
 					//
 					// Should never happen.
 					//
-					logError("doppelganger ID " + int64ToStr(doppelgangerState.doppelgangerID) + " user ID " + int64ToStr(doppelgangerState.userID) + " error: doppelgangerState.chatChannelCallback == nil")
+					doppelgangerState.logger.With("channel_id", doppelgangerState.chatChannelID).Error("doppelgangerState.chatChannelCallback == nil")
 				}
 				if !doppelgangerState.telnetGoroutineHasGoneAway {
-					_, err = oi.LongWrite(writer, []byte("\r\nYou have joined #"+doppelgangerState.chatChannelName+"\r\n"))
+					err = writeToUser(&doppelgangerState, "\r\nYou have joined #"+doppelgangerState.chatChannelName+"\r\n", "JOIN #"+doppelgangerState.chatChannelName+" "+doppelgangerState.userName)
 					if err != nil {
 						//
 						// We are assuming if we got an error, the network connection is
@@ -1485,8 +1962,7 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 				//
 				if doppelgangerState.telnetGoroutineHasGoneAway {
 					if doppelgangerState.doppelgangerID == theMessage.leavingDoppelgangerID {
-						close(doppelgangerState.incomingFromChannelMaster)
-						close(doppelgangerState.incomingFromChatChannel)
+						doppelgangerExit(&doppelgangerState)
 						return
 					}
 				}
@@ -1512,20 +1988,123 @@ func doppelgangerGoroutine(writer telnet.Writer, userGoChannel <-chan byte) {
 					//
 					doppelgangerState.chatChannelID = 0
 					doppelgangerState.chatChannelName = "(no channel)"
+					//
+					// If we only left because the chat channel moved, join
+					// it again, the same as if the user had typed /join --
+					// which looks up where it lives now.
+					//
+					if (doppelgangerState.rejoinChatChannel != "") && !doppelgangerState.telnetGoroutineHasGoneAway {
+						_, err = doCommand(&doppelgangerState, "/join "+doppelgangerState.rejoinChatChannel)
+						if err != nil {
+							doppelgangerState.telnetGoroutineHasGoneAway = true
+						}
+					}
+					doppelgangerState.rejoinChatChannel = ""
 				}
+			case fromChatChannelToDoppelgangerOpMoved:
+				//
+				// The chat channel lives on another node in the cluster
+				// now. We exit, and once our exit comes back, join again
+				// (see above). If we've already left (the user typed /exit
+				// just before), there's nothing to do.
+				//
+				if (theMessage.chatChannelID != doppelgangerState.chatChannelID) || doppelgangerState.telnetGoroutineHasGoneAway {
+					break
+				}
+				doppelgangerState.rejoinChatChannel = doppelgangerState.chatChannelName
+				err = serverNotice(&doppelgangerState, "#"+doppelgangerState.chatChannelName+" has moved to another server. Rejoining.")
+				if err != nil {
+					doppelgangerState.telnetGoroutineHasGoneAway = true
+				}
+				handleChannelExitProcedure(&doppelgangerState)
 			default:
 				//
 				// Should never happen.
 				//
-				logError("doppelganger ID " + int64ToStr(doppelgangerState.doppelgangerID) + " user ID " + int64ToStr(doppelgangerState.userID) + " error: unexpected opcode received from chat channel: " + intToStr(theMessage.operation))
+				doppelgangerState.logger.With("operation", theMessage.operation).Error("unexpected opcode received from chat channel")
+			}
+			doppelgangerState.promptNeeded = true
+		case theMessage := <-doppelgangerState.incomingTextFromChatChannel:
+			//
+			// No "ok" check here -- nobody ever closes this go channel.
+			//
+			shutdown := textQueueOutput(&doppelgangerState, theMessage)
+			if shutdown {
+				doppelgangerState.telnetGoroutineHasGoneAway = true
 			}
 			doppelgangerState.promptNeeded = true
+		case now := <-sessionTicker.C:
+			if sessionHousekeeping(&doppelgangerState, now) {
+				doppelgangerState.promptNeeded = true
+			}
+		case settings := <-doppelgangerState.incomingSettingsFromChannelMaster:
+			//
+			// No "ok" check here or for broadcasts and hang-ups -- nobody
+			// ever closes these go channels.
+			//
+			applySettings(&doppelgangerState, settings)
+			if sessionCheckInterval(settings) != sessionTickerInterval {
+				sessionTickerInterval = sessionCheckInterval(settings)
+				sessionTicker.Reset(sessionTickerInterval)
+			}
+		case broadcast := <-doppelgangerState.incomingBroadcastFromChannelMaster:
+			switch broadcast.operation {
+			case fromChannelMasterToDoppelgangerOpDescribe:
+				//
+				// For the admin console. The callback has room for every
+				// doppelganger, so this never blocks.
+				//
+				var reply adminSessionEntry
+				reply.doppelgangerID = doppelgangerState.doppelgangerID
+				reply.userID = doppelgangerState.userID
+				reply.userName = doppelgangerState.userName
+				reply.remoteAddr = doppelgangerState.remoteAddr
+				reply.mode = doppelgangerState.mode
+				reply.chatChannelID = doppelgangerState.chatChannelID
+				reply.chatChannelName = doppelgangerState.chatChannelName
+				reply.lastInput = doppelgangerState.lastInput
+				reply.away = doppelgangerState.away
+				reply.queueLength = len(doppelgangerState.incomingFromChannelMaster) + len(doppelgangerState.incomingFromChatChannel) + len(doppelgangerState.incomingTextFromChatChannel) + len(doppelgangerState.incomingBroadcastFromChannelMaster) + len(doppelgangerState.incomingHangUpFromChannelMaster)
+				broadcast.adminCallback <- reply
+			default:
+				//
+				// Should never happen.
+				//
+				doppelgangerState.logger.With("operation", broadcast.operation).Error("unexpected opcode in broadcast from channel master")
+			}
+		case hangUpMessage := <-doppelgangerState.incomingHangUpFromChannelMaster:
+			switch hangUpMessage.operation {
+			case fromChannelMasterToDoppelgangerOpDisconnect:
+				doppelgangerState.logger.Info("Hanging up at the channel master's request.")
+				fallthrough
+			case fromChannelMasterToDoppelgangerOpShutdown:
+				if !doppelgangerState.telnetGoroutineHasGoneAway {
+					//
+					// Best effort -- if the write fails the user is gone
+					// anyway, which is what we're about to make happen.
+					//
+					tellUser(&doppelgangerState, "SERVER", "\r\n"+hangUpMessage.msgToUser+"\r\n")
+				}
+				hangUp(&doppelgangerState)
+			default:
+				//
+				// Should never happen.
+				//
+				doppelgangerState.logger.With("operation", hangUpMessage.operation).Error("unexpected opcode in hang-up from channel master")
+			}
+		}
+		if doppelgangerState.errorCounter.timedOut && !doppelgangerState.hungUp {
+			//
+			// The client stopped reading. The Telnet goroutine won't
+			// notice on its own, so hang up to get its read to fail, too.
+			//
+			doppelgangerState.logger.With("timeout", doppelgangerState.settings.clientWriteTimeout.String()).Info("Write to client timed out, hanging up.")
+			hangUp(&doppelgangerState)
 		}
 		if doppelgangerState.telnetGoroutineHasGoneAway {
 			shutdown := handleChannelExitProcedure(&doppelgangerState)
 			if shutdown {
-				close(doppelgangerState.incomingFromChannelMaster)
-				close(doppelgangerState.incomingFromChatChannel)
+				doppelgangerExit(&doppelgangerState)
 				return
 			}
 		}
@@ -0,0 +1,312 @@
+package chatserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// The event sink: what happens on the chat, as JSON, for something else to
+// act on -- an archiver, a bridge, a moderation bot. It's set up with the
+// event_sink setting, which is either an http:// or https:// URL, which gets
+// a POST for each event, or unix:<path>, a Unix socket we connect to and
+// write the events to, a line each. Events look like this:
+//
+//	{"type":"message","time":"2026-10-19T12:00:00Z","channel":"lounge","channel_id":3,"user":"bob","user_id":2,"text":"bob says, \"hi\"","said":"hi"}
+//
+// type is one of:
+//
+//	message          someone said something on a chat channel (text and
+//	                 said as in a plugin's Message, after the plugins are
+//	                 done with it; vetoed messages aren't sent)
+//	join, exit       someone joined or left a chat channel
+//	channel_created  someone made a chat channel with /create (there's no
+//	                 channel_id)
+//	login            someone logged in (there's no channel)
+//
+// In a cluster, node says which node sent it. The chat channel goroutines
+// send messages, joins and exits and the channel master sends the rest, and
+// none of them ever waits for the sink: the event goes on a queue (of
+// event_queue events) without waiting, and if the queue is full, it's thrown
+// away and counted. One goroutine takes events off the queue and sends them,
+// in order, each one up to event_retries more times, waiting longer every
+// time, before giving up on it. Something that stops answering just means
+// the queue fills up and events are lost -- never that the chat slows down.
+//
+
+//
+// How long one try at sending an event can take, and how long we wait
+// before the first retry (then double that each time, up to the most).
+//
+const (
+	eventSendTimeout     = 10 * time.Second
+	eventRetryDelay      = 1 * time.Second
+	eventMaxRetryDelay   = 30 * time.Second
+	eventSinkUnixPrefix  = "unix:"
+	eventSinkContentType = "application/json"
+)
+
+type chatEvent struct {
+	Type      string `json:"type"`
+	Time      string `json:"time"`
+	Node      string `json:"node,omitempty"`
+	Channel   string `json:"channel,omitempty"`
+	ChannelID int64  `json:"channel_id,omitempty"`
+	User      string `json:"user,omitempty"`
+	UserID    int64  `json:"user_id,omitempty"`
+	Text      string `json:"text,omitempty"`
+	Said      string `json:"said,omitempty"`
+}
+
+type eventSink struct {
+	url        string
+	socketPath string
+	retries    int
+	node       string
+	logger     *Logger
+	queue      chan chatEvent
+	stop       chan struct{}
+	done       chan struct{}
+	//
+	// Only the sink's goroutine uses these.
+	//
+	client *http.Client
+	conn   net.Conn
+	//
+	// The counts are kept by whoever throws an event away as well as by the
+	// sink's goroutine, and read by the metrics endpoint, hence the mutex.
+	// dropping is so we only log once each time the queue fills up.
+	//
+	mutex     sync.Mutex
+	delivered int64
+	dropped   int64
+	failed    int64
+	dropping  bool
+}
+
+type eventSinkMetrics struct {
+	delivered     int64
+	dropped       int64
+	failed        int64
+	queueLength   int
+	queueCapacity int
+}
+
+//
+// Same as checkListenAddr, for event_sink.
+//
+func checkEventSink(sink string) string {
+	if strings.HasPrefix(sink, eventSinkUnixPrefix) {
+		if sink == eventSinkUnixPrefix {
+			return "unix: needs the path of the socket after it"
+		}
+		return ""
+	}
+	parsed, err := url.Parse(sink)
+	if err != nil {
+		return err.Error()
+	}
+	if ((parsed.Scheme != "http") && (parsed.Scheme != "https")) || (parsed.Host == "") {
+		return "must be an http:// or https:// URL or unix:<socket path>, got " + strconv.Quote(sink)
+	}
+	return ""
+}
+
+//
+// Starts the sink's goroutine, if config says where to send events.
+// Returns nil if it doesn't; emit on a nil sink does nothing.
+//
+func startEventSink(config Config, logger *Logger) *eventSink {
+	if config.EventSink == "" {
+		return nil
+	}
+	sink := new(eventSink)
+	if strings.HasPrefix(config.EventSink, eventSinkUnixPrefix) {
+		sink.socketPath = config.EventSink[len(eventSinkUnixPrefix):]
+	} else {
+		sink.url = config.EventSink
+	}
+	sink.retries = config.EventRetries
+	sink.node = config.ClusterNode
+	sink.logger = logger.With("goroutine", "event_sink", "event_sink", config.EventSink)
+	sink.queue = make(chan chatEvent, config.EventQueue)
+	sink.stop = make(chan struct{})
+	sink.done = make(chan struct{})
+	sink.client = &http.Client{Timeout: eventSendTimeout}
+	sink.conn = nil
+	go eventSinkGoroutine(sink)
+	return sink
+}
+
+//
+// Puts an event on the queue, without waiting. The time (and, in a cluster,
+// the node) are filled in here.
+//
+func (sink *eventSink) emit(event chatEvent) {
+	if sink == nil {
+		return
+	}
+	event.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	event.Node = sink.node
+	select {
+	case sink.queue <- event:
+		sink.mutex.Lock()
+		sink.dropping = false
+		sink.mutex.Unlock()
+	default:
+		sink.mutex.Lock()
+		sink.dropped++
+		logIt := !sink.dropping
+		sink.dropping = true
+		sink.mutex.Unlock()
+		if logIt {
+			sink.logger.With("event_queue", cap(sink.queue)).Warn("Event queue is full, throwing events away.")
+		}
+	}
+}
+
+//
+// For the metrics endpoint.
+//
+func (sink *eventSink) metrics() eventSinkMetrics {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	var result eventSinkMetrics
+	result.delivered = sink.delivered
+	result.dropped = sink.dropped
+	result.failed = sink.failed
+	result.queueLength = len(sink.queue)
+	result.queueCapacity = cap(sink.queue)
+	return result
+}
+
+//
+// For Shutdown, once the users are gone: sends what's left on the queue
+// (trying each only once) and stops, waiting at most timeout for it.
+//
+func (sink *eventSink) close(timeout time.Duration) {
+	if sink == nil {
+		return
+	}
+	close(sink.stop)
+	select {
+	case <-sink.done:
+	case <-time.After(timeout):
+		sink.logger.With("events_left", len(sink.queue)).Warn("Shutdown: events not all sent in time, exiting anyway.")
+	}
+}
+
+func eventSinkGoroutine(sink *eventSink) {
+	defer close(sink.done)
+	for {
+		select {
+		case event := <-sink.queue:
+			sink.deliver(event, false)
+		case <-sink.stop:
+			for {
+				select {
+				case event := <-sink.queue:
+					sink.deliver(event, true)
+				default:
+					if sink.conn != nil {
+						sink.conn.Close()
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+//
+// Sends one event, retrying (unless we're stopping) until it goes or we run
+// out of retries.
+//
+func (sink *eventSink) deliver(event chatEvent, stopping bool) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		//
+		// Should never happen.
+		//
+		sink.logger.With("error", err).Error("Could not encode event.")
+		return
+	}
+	delay := eventRetryDelay
+	for attempt := 0; ; attempt++ {
+		err = sink.send(body)
+		if err == nil {
+			sink.mutex.Lock()
+			sink.delivered++
+			sink.mutex.Unlock()
+			return
+		}
+		if stopping || (attempt >= sink.retries) {
+			sink.mutex.Lock()
+			sink.failed++
+			sink.mutex.Unlock()
+			sink.logger.With("type", event.Type, "attempts", attempt+1, "error", err).Warn("Could not send event, giving up on it.")
+			return
+		}
+		sink.logger.With("type", event.Type, "attempt", attempt+1, "retry_in", delay.String(), "error", err).Debug("Could not send event, will retry.")
+		select {
+		case <-time.After(delay):
+		case <-sink.stop:
+			stopping = true
+		}
+		delay = delay * 2
+		if delay > eventMaxRetryDelay {
+			delay = eventMaxRetryDelay
+		}
+	}
+}
+
+func (sink *eventSink) send(body []byte) error {
+	if sink.socketPath != "" {
+		return sink.sendToSocket(body)
+	}
+	response, err := sink.client.Post(sink.url, eventSinkContentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	//
+	// Reading the rest lets the connection be used again.
+	//
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+	if (response.StatusCode < 200) || (response.StatusCode > 299) {
+		return errors.New("HTTP status " + response.Status)
+	}
+	return nil
+}
+
+//
+// The connection to the socket stays open between events. If writing to it
+// fails, we close it, and the next try connects again.
+//
+func (sink *eventSink) sendToSocket(body []byte) error {
+	if sink.conn == nil {
+		conn, err := net.DialTimeout("unix", sink.socketPath, eventSendTimeout)
+		if err != nil {
+			return err
+		}
+		sink.conn = conn
+	}
+	sink.conn.SetWriteDeadline(time.Now().Add(eventSendTimeout))
+	_, err := sink.conn.Write(append(body, '\n'))
+	if err != nil {
+		sink.conn.Close()
+		sink.conn = nil
+		return err
+	}
+	return nil
+}
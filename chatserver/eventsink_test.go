@@ -0,0 +1,204 @@
+package chatserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+//
+// What the event sink sends, as received by an HTTP endpoint and by a Unix
+// socket, and what happens when the other end isn't keeping up.
+//
+
+type eventCollector struct {
+	mutex   sync.Mutex
+	events  []chatEvent
+	arrived chan bool
+}
+
+func newEventCollector() *eventCollector {
+	collector := new(eventCollector)
+	collector.events = make([]chatEvent, 0)
+	collector.arrived = make(chan bool, 1)
+	return collector
+}
+
+func (collector *eventCollector) add(event chatEvent) {
+	collector.mutex.Lock()
+	collector.events = append(collector.events, event)
+	collector.mutex.Unlock()
+	select {
+	case collector.arrived <- true:
+	default:
+	}
+}
+
+//
+// Waits for an event of type eventType about user, skipping the ones before
+// it, and returns it.
+//
+func (collector *eventCollector) expect(t *testing.T, eventType string, user string) chatEvent {
+	t.Helper()
+	deadline := time.After(testTimeout)
+	for {
+		collector.mutex.Lock()
+		for ii, event := range collector.events {
+			if (event.Type == eventType) && (event.User == user) {
+				collector.events = collector.events[ii+1:]
+				collector.mutex.Unlock()
+				return event
+			}
+		}
+		got := collector.events
+		collector.mutex.Unlock()
+		select {
+		case <-collector.arrived:
+		case <-deadline:
+			t.Fatalf("timed out waiting for a %s event for %s; got %+v", eventType, user, got)
+		}
+	}
+}
+
+func TestEventSinkHTTP(t *testing.T) {
+	collector := newEventCollector()
+	//
+	// The first try fails, so the first event is a retry.
+	//
+	var requests int
+	var requestsMutex sync.Mutex
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsMutex.Lock()
+		requests++
+		first := (requests == 1)
+		requestsMutex.Unlock()
+		if first {
+			http.Error(w, "not yet", http.StatusServiceUnavailable)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Error("Content-Type: ", r.Header.Get("Content-Type"))
+		}
+		var event chatEvent
+		err = json.Unmarshal(body, &event)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		collector.add(event)
+	}))
+	t.Cleanup(endpoint.Close)
+	server := startTestServer(t, func(config *Config) {
+		config.EventSink = endpoint.URL + "/events"
+	})
+	alice := server.logIn("alice", "secret")
+	event := collector.expect(t, "login", "alice")
+	if event.UserID == 0 || event.Time == "" {
+		t.Fatalf("login event: %+v", event)
+	}
+	alice.send("/create lounge")
+	alice.expect(`created\.`)
+	event = collector.expect(t, "channel_created", "alice")
+	if event.Channel != "lounge" {
+		t.Fatalf("channel_created event: %+v", event)
+	}
+	alice.send("/join lounge")
+	alice.expect(`You have joined #lounge`)
+	event = collector.expect(t, "join", "alice")
+	if (event.Channel != "lounge") || (event.ChannelID == 0) {
+		t.Fatalf("join event: %+v", event)
+	}
+	alice.send("hello")
+	alice.expect(`alice says, "hello"`)
+	event = collector.expect(t, "message", "alice")
+	if (event.Channel != "lounge") || (event.Text != `alice says, "hello"`) || (event.Said != "hello") {
+		t.Fatalf("message event: %+v", event)
+	}
+	alice.send("/exit")
+	alice.expect(`You left #lounge`)
+	collector.expect(t, "exit", "alice")
+}
+
+func TestEventSinkUnixSocket(t *testing.T) {
+	collector := newEventCollector()
+	socketPath := filepath.Join(t.TempDir(), "events.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					var event chatEvent
+					err := json.Unmarshal(scanner.Bytes(), &event)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					collector.add(event)
+				}
+			}()
+		}
+	}()
+	server := startTestServer(t, func(config *Config) {
+		config.EventSink = "unix:" + socketPath
+	})
+	server.logIn("alice", "secret")
+	collector.expect(t, "login", "alice")
+	server.logIn("bob", "secret")
+	collector.expect(t, "login", "bob")
+}
+
+//
+// Nothing is listening, and the queue holds one event, so the rest are
+// thrown away -- without emit ever waiting.
+//
+func TestEventSinkQueueFull(t *testing.T) {
+	config := DefaultConfig()
+	config.EventSink = "unix:" + filepath.Join(t.TempDir(), "nobody.sock")
+	config.EventQueue = 1
+	config.EventRetries = 100
+	sink := startEventSink(config, NewLogger(ioutil.Discard))
+	t.Cleanup(func() {
+		sink.close(testTimeout)
+	})
+	for ii := 0; ii < 10; ii++ {
+		var event chatEvent
+		event.Type = "login"
+		event.User = "alice"
+		sink.emit(event)
+	}
+	metrics := sink.metrics()
+	//
+	// The goroutine may have taken the first one off the queue to send it
+	// (and be retrying it), making room for a second.
+	//
+	if (metrics.dropped != 8) && (metrics.dropped != 9) {
+		t.Fatalf("dropped %d events, expected 8 or 9", metrics.dropped)
+	}
+	if metrics.delivered != 0 {
+		t.Fatalf("delivered %d events with nothing listening", metrics.delivered)
+	}
+}
@@ -0,0 +1,419 @@
+package chatserver
+
+import (
+	"bytes"
+	"context"
+	"go-telnet-mod"
+	"io"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//
+// The integration test harness. startTestServer runs a whole chat server
+// in-process -- New and Serve, same as the daemon's main -- on an ephemeral
+// port, with its database and conversation logs in a temporary directory,
+// and shuts it down (the way SIGTERM does) when the test is over.
+// dialTestClient connects to it over a real Telnet connection
+// (go-telnet-mod's, the same as the load tester's), and the test drives it
+// expect-style: send a line, wait for what the server should say back.
+//
+
+const testTimeout = 5 * time.Second
+
+type testServer struct {
+	t          *testing.T
+	addr       string
+	dir        string
+	chatServer *ChatServer
+	config     Config
+	done       chan bool
+	log        *testLog
+}
+
+//
+// The daemon log, kept in memory and shown if the test fails.
+//
+type testLog struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (log *testLog) Write(p []byte) (int, error) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return log.buffer.Write(p)
+}
+
+func (log *testLog) String() string {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return log.buffer.String()
+}
+
+//
+// Starts a server with the default configuration, changed by adjust (if
+// it isn't nil).
+//
+func startTestServer(t *testing.T, adjust func(config *Config)) *testServer {
+	return startTestServerWithPlugins(t, adjust)
+}
+
+//
+// Same, with plugins passed in the way a program embedding the server
+// would (Hooks.Plugins).
+//
+func startTestServerWithPlugins(t *testing.T, adjust func(config *Config), plugins ...Plugin) *testServer {
+	server := new(testServer)
+	server.t = t
+	server.dir = t.TempDir()
+	server.done = make(chan bool)
+	server.log = new(testLog)
+	config := DefaultConfig()
+	config.DatabasePath = filepath.Join(server.dir, "test.db")
+	config.LogDir = server.dir
+	config.LogLevel = "debug"
+	//
+	// Long enough for every doppelganger to get off its chat channel (they
+	// check once a second while they wait), so none of them is still
+	// running when the test's temporary directory is removed. Shutting
+	// down doesn't take that long unless something's stuck.
+	//
+	config.ShutdownDrainSeconds = 10
+	if adjust != nil {
+		adjust(&config)
+	}
+	server.config = config
+	logger := NewLogger(server.log)
+	logger.Configure(server.log, config)
+	var err error
+	server.chatServer, err = New(config, Hooks{Logger: logger, Plugins: plugins})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		server.chatServer.Shutdown(context.Background())
+		t.Fatal(err)
+	}
+	server.addr = listener.Addr().String()
+	go func() {
+		err := server.chatServer.Serve(listener)
+		if err != ErrServerClosed {
+			t.Error("Serve: ", err)
+		}
+		close(server.done)
+	}()
+	t.Cleanup(server.stop)
+	return server
+}
+
+//
+// Shuts the server down and waits for it to finish.
+//
+func (server *testServer) stop() {
+	drainContext, cancel := context.WithTimeout(context.Background(), time.Duration(server.config.ShutdownDrainSeconds)*time.Second)
+	defer cancel()
+	//
+	// Users being slow to leave (they are, with the race detector on) is
+	// in the log; it's only a failure if Shutdown couldn't shut down.
+	//
+	err := server.chatServer.Shutdown(drainContext)
+	if err == ErrServerClosed {
+		//
+		// The test already shut it down.
+		//
+		return
+	}
+	if (err != nil) && (err != context.DeadlineExceeded) {
+		server.t.Error("Shutdown: ", err)
+	}
+	<-server.done
+	if server.t.Failed() {
+		server.t.Log("daemon log:\n" + server.log.String())
+	}
+}
+
+type testClient struct {
+	t    *testing.T
+	name string
+	conn io.ReadWriteCloser
+	//
+	// How much the reader goroutine asks for at a time.
+	//
+	readSize int
+	//
+	// Shared with the reader goroutine. arrived gets a (non-blocking) poke
+	// whenever something comes in. While paused isn't nil, the reader
+	// goroutine waits for it to be closed before reading any more.
+	//
+	mutex   sync.Mutex
+	pending []byte
+	readErr error
+	arrived chan bool
+	paused  chan bool
+}
+
+//
+// Connects to the server. name is only for error messages. The
+// connection is closed when the test is over. The client says it's an
+// xterm when the server asks.
+//
+func (server *testServer) dial(name string) *testClient {
+	return server.dialTerminal(name, "XTERM")
+}
+
+//
+// Same, but the client says it's a terminalType terminal, or won't say if
+// that's "".
+//
+func (server *testServer) dialTerminal(name string, terminalType string) *testClient {
+	conn, err := telnet.DialTo(server.addr)
+	if err != nil {
+		server.t.Fatal(err)
+	}
+	if terminalType != "" {
+		conn.ReportTerminalType(terminalType)
+	}
+	return server.startClient(name, conn, 1)
+}
+
+//
+// Same, but over plain TCP -- we only ever send plain text, so that's all
+// the Telnet we need -- which we can read more than a byte at a time, and
+// whose receive buffer we can shrink when the client stops reading (see
+// stopReading).
+//
+func (server *testServer) dialPlain(name string) *testClient {
+	conn, err := net.Dial("tcp", server.addr)
+	if err != nil {
+		server.t.Fatal(err)
+	}
+	return server.startClient(name, conn, 4096)
+}
+
+func (server *testServer) startClient(name string, conn io.ReadWriteCloser, readSize int) *testClient {
+	client := new(testClient)
+	client.t = server.t
+	client.name = name
+	client.conn = conn
+	client.readSize = readSize
+	client.arrived = make(chan bool, 1)
+	go client.readAll()
+	server.t.Cleanup(func() {
+		conn.Close()
+	})
+	return client
+}
+
+//
+// Reads everything the server sends, as it comes in, until the connection
+// is closed. Over Telnet a byte at a time, like the load tester, because
+// go-telnet-mod's Read doesn't return until it's filled the buffer it was
+// given.
+//
+func (client *testClient) readAll() {
+	buffer := make([]byte, client.readSize)
+	for {
+		numBytes, err := client.conn.Read(buffer)
+		client.mutex.Lock()
+		client.pending = append(client.pending, buffer[:numBytes]...)
+		if err != nil {
+			client.readErr = err
+		}
+		client.mutex.Unlock()
+		select {
+		case client.arrived <- true:
+		default:
+		}
+		if err != nil {
+			return
+		}
+		client.mutex.Lock()
+		paused := client.paused
+		client.mutex.Unlock()
+		if paused != nil {
+			<-paused
+		}
+	}
+}
+
+//
+// A client that can't keep up: stops reading (after the read it's in the
+// middle of) until resumeReading, so what the server sends piles up in the
+// connection and then in the server. Over plain TCP, the connection's
+// receive buffer is made small while it's stopped, so that happens after
+// kilobytes instead of megabytes.
+//
+func (client *testClient) stopReading() {
+	client.t.Helper()
+	client.setReceiveBuffer(4096)
+	client.mutex.Lock()
+	client.paused = make(chan bool)
+	client.mutex.Unlock()
+}
+
+func (client *testClient) resumeReading() {
+	client.t.Helper()
+	client.setReceiveBuffer(4 << 20)
+	client.mutex.Lock()
+	close(client.paused)
+	client.paused = nil
+	client.mutex.Unlock()
+}
+
+func (client *testClient) setReceiveBuffer(size int) {
+	client.t.Helper()
+	tcpConn, ok := client.conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	err := tcpConn.SetReadBuffer(size)
+	if err != nil {
+		client.t.Fatalf("%s: %v", client.name, err)
+	}
+}
+
+func (client *testClient) send(line string) {
+	client.t.Helper()
+	_, err := client.conn.Write([]byte(line + "\r\n"))
+	if err != nil {
+		client.t.Fatalf("%s: sending %q: %v", client.name, line, err)
+	}
+}
+
+//
+// Waits (at most testTimeout) for the server to send something matching
+// pattern (a regular expression), and returns what matched. Everything up
+// to the end of the match is used up, so the next expect only looks at
+// what came after it. Backspacing over the prompt (which the server does
+// when chat text comes in while you're at it) is taken out first.
+//
+func (client *testClient) expect(pattern string) string {
+	client.t.Helper()
+	wanted := regexp.MustCompile(pattern)
+	deadline := time.After(testTimeout)
+	for {
+		client.mutex.Lock()
+		client.pending = bytes.Replace(client.pending, []byte("\x08 \x08"), nil, -1)
+		location := wanted.FindIndex(client.pending)
+		if location != nil {
+			matched := string(client.pending[location[0]:location[1]])
+			client.pending = client.pending[location[1]:]
+			client.mutex.Unlock()
+			return matched
+		}
+		pending := string(client.pending)
+		readErr := client.readErr
+		client.mutex.Unlock()
+		if readErr != nil {
+			client.t.Fatalf("%s: connection closed (%v) waiting for %q; got %q", client.name, readErr, pattern, pending)
+		}
+		select {
+		case <-client.arrived:
+		case <-deadline:
+			client.t.Fatalf("%s: timed out waiting for %q; got %q", client.name, pattern, pending)
+		}
+	}
+}
+
+//
+// Fails if the server has sent anything matching pattern (that hasn't been
+// used up by expect) within wait.
+//
+func (client *testClient) expectNot(pattern string, wait time.Duration) {
+	client.t.Helper()
+	wanted := regexp.MustCompile(pattern)
+	time.Sleep(wait)
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if wanted.Match(client.pending) {
+		client.t.Fatalf("%s: didn't expect %q; got %q", client.name, pattern, client.pending)
+	}
+}
+
+//
+// Waits (at most testTimeout) for the server to hang up.
+//
+func (client *testClient) expectHangUp() {
+	client.t.Helper()
+	deadline := time.After(testTimeout)
+	for {
+		client.mutex.Lock()
+		readErr := client.readErr
+		pending := string(client.pending)
+		client.mutex.Unlock()
+		if readErr != nil {
+			return
+		}
+		select {
+		case <-client.arrived:
+		case <-deadline:
+			client.t.Fatalf("%s: timed out waiting to be hung up on; got %q", client.name, pending)
+		}
+	}
+}
+
+//
+// The value of a metric (one without labels) from the metrics endpoint.
+//
+func (server *testServer) metric(name string) int64 {
+	server.t.Helper()
+	recorder := httptest.NewRecorder()
+	server.chatServer.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		if strings.HasPrefix(line, name+" ") {
+			value, err := strconv.ParseInt(line[len(name)+1:], 10, 64)
+			if err != nil {
+				server.t.Fatalf("metric %s: %v", name, err)
+			}
+			return value
+		}
+	}
+	server.t.Fatalf("no metric %s", name)
+	return 0
+}
+
+//
+// Connects and logs in as userName, creating the account first if there
+// isn't one.
+//
+func (server *testServer) logIn(userName string, password string) *testClient {
+	server.t.Helper()
+	return server.logInOn(server.dial(userName), userName, password)
+}
+
+//
+// Same, over plain TCP (see dialPlain).
+//
+func (server *testServer) logInPlain(userName string, password string) *testClient {
+	server.t.Helper()
+	return server.logInOn(server.dialPlain(userName), userName, password)
+}
+
+func (server *testServer) logInOn(client *testClient, userName string, password string) *testClient {
+	server.t.Helper()
+	client.expect(`Username: `)
+	client.send(userName)
+	if client.expect(`Password: |Create new account\? \(y/n\) `) != "Password: " {
+		client.send("y")
+		client.expect(`Password for new account: `)
+		client.send(password)
+		client.expect(`Repeat password: `)
+		client.send(password)
+		client.expect(`Your new account has been created\.`)
+		client.expect(`Username: `)
+		client.send(userName)
+		client.expect(`Password: `)
+	}
+	client.send(password)
+	client.expect(`You are logged in\.`)
+	return client
+}
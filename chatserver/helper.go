@@ -0,0 +1,65 @@
+package chatserver
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+//
+// Handy trimmer we use everywhere, gets rid of white space at beginnings and
+// ends of strings.
+//
+func trim(strn string) string {
+	return strings.Trim(strn, " \t\n\r")
+}
+
+//
+// Some more handy helper functions.
+//
+
+func intToStr(ii int) string {
+	return strconv.FormatInt(int64(ii), 10)
+}
+
+func int64ToStr(ii int64) string {
+	return strconv.FormatInt(ii, 10)
+}
+
+func timeNow() string {
+	return time.Now().Format("2006-01-02 15:04:05")
+}
+
+func deslash(strn string) string {
+	return strings.Replace(strn, "/", "", -1)
+}
+
+//
+// Breaks text (which can have CR+LF line breaks of its own) into lines no
+// wider than width, between words. A word wider than width gets a line to
+// itself, and the terminal can wrap it.
+//
+func wrapText(text string, width int) string {
+	lines := make([]string, 0)
+	for _, paragraph := range strings.Split(text, "\r\n") {
+		line := ""
+		lineLen := 0
+		for _, word := range strings.Split(paragraph, " ") {
+			wordLen := utf8.RuneCountInString(word)
+			if lineLen == 0 {
+				line = word
+				lineLen = wordLen
+			} else if lineLen+1+wordLen > width {
+				lines = append(lines, line)
+				line = word
+				lineLen = wordLen
+			} else {
+				line = line + " " + word
+				lineLen = lineLen + 1 + wordLen
+			}
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\r\n")
+}
@@ -0,0 +1,472 @@
+package chatserver
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+// The daemon from the outside: real Telnet connections to a server started
+// in-process by the harness (harness_test.go).
+//
+
+func TestLogin(t *testing.T) {
+	server := startTestServer(t, nil)
+	//
+	// A new user is offered an account, and logs in with it.
+	//
+	alice := server.logIn("alice", "secret")
+	alice.send("/help")
+	alice.expect(`/join`)
+	//
+	// A user with an account goes straight to the password, and a wrong
+	// one gets them the username prompt again.
+	//
+	again := server.dial("alice again")
+	again.expect(`Username: `)
+	again.send("alice")
+	again.expect(`Password: `)
+	again.send("wrong")
+	again.expect(`Incorrect password\.`)
+	again.expect(`Username: `)
+	again.send("alice")
+	again.expect(`Password: `)
+	again.send("secret")
+	again.expect(`You are logged in\.`)
+}
+
+func TestAccountCreation(t *testing.T) {
+	server := startTestServer(t, nil)
+	client := server.dial("bob")
+	client.expect(`Username: `)
+	client.send("bob")
+	client.expect(`Create new account\? \(y/n\) `)
+	client.send("y")
+	client.expect(`Password for new account: `)
+	client.send("first")
+	client.expect(`Repeat password: `)
+	client.send("second")
+	client.expect(`Confirmation password did not match\.`)
+	server.logIn("bob", "secret")
+	userID, userName, _, err := server.chatServer.store.lookUpUser("bob")
+	if err != nil || userID == 0 || userName != "bob" {
+		t.Errorf("lookUpUser after creating the account: %d, %q, %v", userID, userName, err)
+	}
+}
+
+func TestRegistrationClosed(t *testing.T) {
+	server := startTestServer(t, func(config *Config) {
+		config.Registration = "closed"
+	})
+	client := server.dial("mallory")
+	client.expect(`Username: `)
+	client.send("mallory")
+	client.expect(`New accounts are not being accepted right now\.`)
+	client.expect(`Username: `)
+	client.expectNot(`Create new account`, 100*time.Millisecond)
+}
+
+func TestJoinAndExit(t *testing.T) {
+	server := startTestServer(t, nil)
+	alice := server.logIn("alice", "secret")
+	alice.send("/join lobby")
+	alice.expect(`Channel #lobby does not exist\.`)
+	alice.send("/create #lobby")
+	alice.expect(`Channel "#lobby" created\.`)
+	alice.send("/list")
+	alice.expect(`#lobby`)
+	alice.send("/join lobby")
+	alice.expect(`You have joined #lobby`)
+	alice.send("/join lobby")
+	alice.expect(`You have to exit your current channel`)
+
+	bob := server.logIn("bob", "secret")
+	bob.send("/join lobby")
+	bob.expect(`You have joined #lobby`)
+	alice.expect(`bob has joined #lobby`)
+	bob.send("/who")
+	who := bob.expect(`On this channel: [a-z, ]+`)
+	if !strings.Contains(who, "alice") || !strings.Contains(who, "bob") {
+		t.Errorf("/who: %q", who)
+	}
+
+	bob.send("/exit")
+	bob.expect(`You left #lobby`)
+	alice.expect(`bob has left #lobby`)
+	bob.send("/exit")
+	bob.expect(`You are not on a channel\.`)
+	//
+	// Off the channel, bob doesn't hear it any more.
+	//
+	alice.send("anyone there?")
+	alice.expect(`alice says, "anyone there\?"`)
+	bob.expectNot(`anyone there`, 200*time.Millisecond)
+	//
+	// And the chat channel logged all of it.
+	//
+	alice.send("/exit")
+	alice.expect(`You left #lobby`)
+	conversation := readConversationLog(t, server, "lobby", "<alice has EXITED #lobby>")
+	for _, wanted := range []string{"<alice has JOINED #lobby>", "<bob has JOINED #lobby>", "<bob has EXITED #lobby>", `alice says, "anyone there?"`, "<alice has EXITED #lobby>"} {
+		if !strings.Contains(conversation, wanted) {
+			t.Errorf("conversation log doesn't have %q:\n%s", wanted, conversation)
+		}
+	}
+}
+
+func TestChannelFull(t *testing.T) {
+	server := startTestServer(t, func(config *Config) {
+		config.MaxChatChannelMembers = 2
+	})
+	alice := server.logIn("alice", "secret")
+	alice.send("/create small")
+	alice.expect(`created\.`)
+	alice.send("/join small")
+	alice.expect(`You have joined #small`)
+	bob := server.logIn("bob", "secret")
+	bob.send("/join small")
+	bob.expect(`You have joined #small`)
+	carol := server.logIn("carol", "secret")
+	carol.send("/join small")
+	carol.expect(`Request to join channel denied: Channel is full`)
+	//
+	// Denied means not on it: carol can join once there's room.
+	//
+	carol.send("/who")
+	carol.expect(`You are not on a channel\.`)
+	bob.send("/exit")
+	bob.expect(`You left #small`)
+	carol.send("/join small")
+	carol.expect(`You have joined #small`)
+	alice.expect(`carol has joined #small`)
+}
+
+//
+// A chat channel whose conversation log won't open (here there's a directory
+// in the way) turns away joins and posts instead of taking the server down,
+// and starts once it can.
+//
+func TestConversationLogWontOpen(t *testing.T) {
+	server := startTestServer(t, nil)
+	api := httptest.NewServer(server.chatServer.APIHandler())
+	t.Cleanup(api.Close)
+	alice := server.logIn("alice", "secret")
+	alice.send("/create lounge")
+	alice.expect(`created\.`)
+	alice.send("/apitoken new")
+	token := regexp.MustCompile(`API token [0-9a-f]{12}: ([0-9a-f]{64})`).FindStringSubmatch(alice.expect(`API token [0-9a-f]{12}: [0-9a-f]{64}`))[1]
+	err := os.Mkdir(conversationLogPath(server.dir, "lounge"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.send("/join lounge")
+	alice.expect(`Request to join channel denied: The channel couldn't start\. Please try again later\.`)
+	status, body := apiRequest(t, http.MethodPost, api.URL+"/api/channels/lounge/messages", token, `{"text": "anyone?"}`)
+	if status != http.StatusInternalServerError {
+		t.Fatalf("POST to a chat channel that can't start: %d %s", status, body)
+	}
+	err = os.Remove(conversationLogPath(server.dir, "lounge"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.send("/join lounge")
+	alice.expect(`You have joined #lounge`)
+	alice.send("made it")
+	alice.expect(`alice says, "made it"`)
+	readConversationLog(t, server, "lounge", `alice says, "made it"`)
+}
+
+func TestMessageFanOut(t *testing.T) {
+	const members = 5
+	server := startTestServer(t, nil)
+	clients := make([]*testClient, members)
+	for ii := range clients {
+		clients[ii] = server.logIn("user"+strconv.Itoa(ii), "secret")
+		if ii == 0 {
+			clients[ii].send("/create busy")
+			clients[ii].expect(`created\.`)
+		}
+		clients[ii].send("/join busy")
+		clients[ii].expect(`You have joined #busy`)
+	}
+	//
+	// Everyone says something, and everyone -- the speaker too -- hears
+	// each of them, in the order the chat channel got them.
+	//
+	for ii, client := range clients {
+		client.send("hello from " + strconv.Itoa(ii))
+		for _, listener := range clients {
+			listener.expect(`user` + strconv.Itoa(ii) + ` says, "hello from ` + strconv.Itoa(ii) + `"`)
+		}
+	}
+	//
+	// Someone on another chat channel hears none of it.
+	//
+	outsider := server.logIn("outsider", "secret")
+	outsider.send("/create quiet")
+	outsider.expect(`created\.`)
+	outsider.send("/join quiet")
+	outsider.expect(`You have joined #quiet`)
+	clients[0].send("just us")
+	for _, listener := range clients {
+		listener.expect(`user0 says, "just us"`)
+	}
+	outsider.expectNot(`just us`, 200*time.Millisecond)
+}
+
+//
+// A member who stops reading, with drop_oldest: once their queue is full
+// the oldest messages go, and when they catch up they're told how many they
+// missed.
+//
+func TestSlowMemberDropOldest(t *testing.T) {
+	server := startTestServer(t, func(config *Config) {
+		config.MemberQueue = 4
+		config.ClientWriteTimeoutSeconds = 0
+	})
+	apiURL, token, bob := joinFirehose(t, server)
+	messagesURL := apiURL + "/api/channels/firehose/messages"
+	bob.stopReading()
+	flood(t, messagesURL, token, func() bool {
+		return server.metric("wtelnet_chat_messages_dropped_total") > 0
+	})
+	bob.resumeReading()
+	status, body := apiRequest(t, http.MethodPost, messagesURL, token, `{"text": "caught up?"}`)
+	if status != http.StatusOK {
+		t.Fatalf("POST: %d %s", status, body)
+	}
+	bob.expect(`\[\d+ messages? skipped\]`)
+	bob.expect(`alice says, "caught up\?"`)
+}
+
+//
+// Likewise with the "disconnect" policy: they're told why and hung up on,
+// counted once, and off the chat channel.
+//
+func TestSlowMemberDisconnect(t *testing.T) {
+	server := startTestServer(t, func(config *Config) {
+		config.MemberQueue = 4
+		config.SlowMemberPolicy = "disconnect"
+		config.ClientWriteTimeoutSeconds = 0
+	})
+	apiURL, token, bob := joinFirehose(t, server)
+	messagesURL := apiURL + "/api/channels/firehose/messages"
+	bob.stopReading()
+	flood(t, messagesURL, token, func() bool {
+		return server.metric("wtelnet_slow_member_disconnects_total") > 0
+	})
+	bob.resumeReading()
+	bob.expect(regexp.QuoteMeta(slowMemberDisconnectMessage))
+	deadline := time.Now().Add(testTimeout)
+	for {
+		var chatChannels apiChatChannelList
+		apiGet(t, apiURL+"/api/channels", token, &chatChannels)
+		if (len(chatChannels.Channels) == 1) && (chatChannels.Channels[0].Members == 0) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("still on the chat channel: %+v", chatChannels)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	disconnects := server.metric("wtelnet_slow_member_disconnects_total")
+	if disconnects != 1 {
+		t.Errorf("wtelnet_slow_member_disconnects_total is %d", disconnects)
+	}
+}
+
+//
+// bob on #firehose, over plain TCP (see dialPlain), and an API token of
+// alice's to say things there with.
+//
+func joinFirehose(t *testing.T, server *testServer) (string, string, *testClient) {
+	api := httptest.NewServer(server.chatServer.APIHandler())
+	t.Cleanup(api.Close)
+	alice := server.logIn("alice", "secret")
+	alice.send("/create firehose")
+	alice.expect(`created\.`)
+	alice.send("/apitoken new")
+	token := regexp.MustCompile(`API token [0-9a-f]{12}: ([0-9a-f]{64})`).FindStringSubmatch(alice.expect(`API token [0-9a-f]{12}: [0-9a-f]{64}`))[1]
+	bob := server.logInPlain("bob", "secret")
+	bob.send("/join firehose")
+	bob.expect(`You have joined #firehose`)
+	return api.URL, token, bob
+}
+
+//
+// Posts long lines until done says to stop. It takes a while: everything
+// has to fill up the connection to the member who isn't reading before it
+// starts filling up their queue.
+//
+func flood(t *testing.T, messagesURL string, token string, done func() bool) {
+	t.Helper()
+	post := `{"text": "` + strings.Repeat("blah", 2000) + `"}`
+	deadline := time.Now().Add(4 * testTimeout)
+	for posts := 0; !done(); posts++ {
+		if time.Now().After(deadline) {
+			t.Fatalf("still not done after %d posts", posts)
+		}
+		status, body := apiRequest(t, http.MethodPost, messagesURL, token, post)
+		if status != http.StatusOK {
+			t.Fatalf("POST: %d %s", status, body)
+		}
+	}
+}
+
+//
+// Reloads one after another, faster than anyone picks them up: the last one
+// is the one that counts, and it's never lost -- here it bans everyone
+// connected.
+//
+func TestReloadBan(t *testing.T) {
+	server := startTestServer(t, nil)
+	alice := server.logIn("alice", "secret")
+	for ii := 0; ii < 5; ii++ {
+		config := server.config
+		config.ShutdownMessage = "Reload " + strconv.Itoa(ii)
+		if ii == 4 {
+			config.BannedIPs = []string{"127.0.0.0/8"}
+		}
+		err := server.chatServer.Reload(config)
+		if err != nil {
+			t.Fatalf("Reload: %v", err)
+		}
+	}
+	alice.expect(`Connections from your address are not accepted\.`)
+}
+
+//
+// Someone who doesn't type anything is warned and then hung up on, unless
+// they're away; everyone gets keepalives in the meantime.
+//
+func TestIdleUsers(t *testing.T) {
+	server := startTestServer(t, func(config *Config) {
+		config.IdleWarningSeconds = 1
+		config.IdleTimeoutSeconds = 2
+		config.AwayExemptFromIdle = true
+		config.KeepaliveSeconds = 1
+	})
+	alice := server.logInPlain("alice", "secret")
+	bob := server.logInPlain("bob", "secret")
+	bob.send("/away lunch")
+	bob.expect(`You are away: lunch`)
+	//
+	// IAC NOP. Neither byte is UTF-8, and regexp sees each as U+FFFD.
+	//
+	alice.expect(`\x{FFFD}\x{FFFD}`)
+	alice.expect(`You have been idle for 1s\. You will be disconnected if you don't type something within 1s\.`)
+	alice.expect(`You have been idle too long\. Goodbye!`)
+	alice.expectHangUp()
+	bob.expect(`\x{FFFD}\x{FFFD}`)
+	bob.expectNot(`You have been idle`, time.Second)
+	bob.send("/away")
+	bob.expect(`You are no longer away\.`)
+}
+
+//
+// Shutdown tells everyone goodbye, and once it returns nothing of the server
+// is left running -- not even the cluster peer goroutine, which was busy
+// dialing a node that isn't there.
+//
+func TestShutdown(t *testing.T) {
+	before := countServerGoroutines()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nowhere := listener.Addr().String()
+	listener.Close()
+	server := startTestServer(t, func(config *Config) {
+		config.ClusterNode = "a"
+		config.ClusterListen = "127.0.0.1:0"
+		config.ClusterPeers = []ClusterPeerConfig{{Node: "b", Addr: nowhere}}
+		config.ClusterPeerTimeoutSeconds = 1
+		config.StallThresholdSeconds = 1
+	})
+	alice := server.logIn("alice", "secret")
+	alice.send("/create lounge")
+	alice.expect(`created\.`)
+	alice.send("/join lounge")
+	alice.expect(`You have joined #lounge`)
+	err = server.chatServer.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal("Shutdown: ", err)
+	}
+	alice.expect(`The server is shutting down\. Goodbye!`)
+	//
+	// The last test's server may still have been on its way out when we
+	// counted, so there can be fewer than before, but never more.
+	//
+	deadline := time.Now().Add(testTimeout)
+	for countServerGoroutines() > before {
+		if time.Now().After(deadline) {
+			buffer := make([]byte, 1<<20)
+			t.Fatalf("goroutines still running after Shutdown:\n%s", buffer[:runtime.Stack(buffer, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//
+// A channel master that's stuck (here, one that never hears from Shutdown)
+// doesn't keep Shutdown from returning once ctx is done.
+//
+func TestShutdownChannelMasterStuck(t *testing.T) {
+	server := startTestServer(t, nil)
+	server.chatServer.chanMasterFromMain = make(chan messageFromMainToChannelMaster)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	returned := make(chan error, 1)
+	go func() {
+		returned <- server.chatServer.Shutdown(ctx)
+	}()
+	select {
+	case err := <-returned:
+		if err != context.DeadlineExceeded {
+			t.Fatal("Shutdown: ", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Shutdown didn't return with the channel master stuck")
+	}
+	waitForLog(t, server.log, `msg="Shutdown: the channel master did not take the shutdown in time, exiting anyway."`)
+}
+
+//
+// How many goroutines there are, of the kinds that run for as long as a
+// server does.
+//
+func countServerGoroutines() int {
+	buffer := make([]byte, 1<<20)
+	stacks := string(buffer[:runtime.Stack(buffer, true)])
+	count := 0
+	for _, name := range []string{"channelMasterGoroutine(", "channelMasterShardGoroutine(", "clusterPeerGoroutine(", "clusterLinkGoroutine(", "stallWatchdogGoroutine("} {
+		count += strings.Count(stacks, "chatserver."+name)
+	}
+	return count
+}
+
+//
+// The chat channel writes its log as it goes, so we give it a moment to get
+// as far as until.
+//
+func readConversationLog(t *testing.T, server *testServer, chatChannelName string, until string) string {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		contents, err := ioutil.ReadFile(conversationLogPath(server.dir, chatChannelName))
+		if (err == nil && strings.Contains(string(contents), until)) || time.Now().After(deadline) {
+			return string(contents)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,732 @@
+package chatserver
+
+import (
+	"bufio"
+	"go-telnet-mod"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// The IRC gateway: IRC clients (and whatever tooling already speaks IRC) on
+// the same chat channels as everyone on Telnet. Like the web gateway (see
+// webgateway.go), every connection is a doppelganger in machine mode (see
+// machinemode.go), so logging in, chat channels, bans, idle timeouts and
+// shutting down all work the way they do for Telnet. The gateway only
+// translates: IRC commands into lines the user "types", and the
+// doppelganger's tagged lines into IRC messages.
+//
+// What IRC clients can do:
+//
+//	PASS, NICK, USER   log in: NICK is the username and PASS the password.
+//	                   If there's no such user, the account is made (if new
+//	                   accounts are being accepted), same as answering y
+//	                   over Telnet. Wrong password is 464 and a hang-up.
+//	JOIN #channel      /join, leaving the current chat channel first --
+//	                   wtelnet users are on one chat channel at a time. The
+//	                   chat channel has to exist (/create it over Telnet).
+//	PART #channel      /exit
+//	PRIVMSG #channel   /say, or /emote for a CTCP ACTION (/me). Only to the
+//	                   chat channel they're on; there are no private
+//	                   messages in wtelnet.
+//	NAMES, LIST        /who and /list
+//	PING, QUIT         what they say
+//
+// Everything else the server says (errors, /help, idle warnings) comes as a
+// NOTICE. The IRC users' own messages aren't sent back to them, since IRC
+// clients show them already.
+//
+
+const ircServerName = "wtelnet"
+
+//
+// Longest line we take from an IRC client. IRC says 512 bytes, but we're
+// not fussy about it.
+//
+const ircMaxLine = 8192
+
+type ircHandler struct {
+	chatServer *ChatServer
+}
+
+//
+// The doppelganger's side of an IRC connection. It's the doppelganger's
+// writer, turning its tagged lines into IRC, and what it hangs up (Close).
+// It keeps what the connection's goroutine needs to know about what the
+// doppelganger said -- what it's asking for while logging in, whether it's
+// logged in, which chat channel it's on -- and pokes changed (never waiting
+// on it) when any of that changes.
+//
+type ircSession struct {
+	conn    net.Conn
+	changed chan bool
+	hungUp  chan struct{}
+	hangUp  sync.Once
+	//
+	// The doppelganger writes, and the connection's goroutine reads the
+	// state and writes replies of its own, hence the mutex.
+	//
+	mutex           sync.Mutex
+	partial         []byte
+	nick            string
+	asking          string
+	askPending      bool
+	loggedIn        bool
+	lastError       string
+	chatChannelName string
+	motd            []string
+}
+
+//
+// The connection's goroutine's side: what the IRC client has told us, and
+// what we've typed for it. Nobody else touches it.
+//
+type ircConnection struct {
+	session       *ircSession
+	userGoChannel chan byte
+	password      string
+	nick          string
+	gotUser       bool
+	answered      map[string]int
+	pendingJoin   string
+}
+
+//
+// One connection, from NICK to QUIT. The telnet server (see New) is only
+// doing the connection handling: we read and write the connection
+// ourselves, since IRC isn't Telnet.
+//
+func (handler ircHandler) ServeTELNET(ctx telnet.Context, writer telnet.Writer, reader telnet.Reader) {
+	conn := ctx.Conn()
+	if conn == nil {
+		//
+		// Should never happen.
+		//
+		ctx.Logger().Errorf("IRC goroutine: no connection")
+		return
+	}
+	session := newIRCSession(conn)
+	lines := make(chan string)
+	go readIRCLines(conn, lines, session.hungUp)
+	var connection ircConnection
+	connection.session = session
+	//
+	// NO buffer here, same as for Telnet.
+	//
+	connection.userGoChannel = make(chan byte)
+	connection.password = ""
+	connection.nick = ""
+	connection.gotUser = false
+	connection.answered = make(map[string]int)
+	connection.pendingJoin = ""
+	//
+	// If the doppelganger goes away on its own, without hanging up (it
+	// couldn't register with the channel master, say), we still need to
+	// know, or we'd wait forever to type at it.
+	//
+	handler.chatServer.doppelgangers.Add(1)
+	go func() {
+		doppelgangerGoroutine(handler.chatServer, session, session, conn.RemoteAddr().String(), connection.userGoChannel, machineSession, User{})
+		session.Close()
+	}()
+	connected := true
+	for connected {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				connected = false
+			} else {
+				connected = connection.handleLine(line) && connection.answer()
+			}
+		case <-session.changed:
+			connected = connection.answer()
+		case <-session.hungUp:
+			connected = false
+		}
+	}
+	close(connection.userGoChannel)
+	session.Close()
+}
+
+func newIRCSession(conn net.Conn) *ircSession {
+	session := new(ircSession)
+	session.conn = conn
+	session.changed = make(chan bool, 1)
+	session.hungUp = make(chan struct{})
+	session.partial = make([]byte, 0)
+	session.nick = ""
+	session.asking = ""
+	session.askPending = false
+	session.loggedIn = false
+	session.lastError = ""
+	session.chatChannelName = ""
+	session.motd = make([]string, 0)
+	return session
+}
+
+//
+// Reads lines from the IRC client until the connection closes or the
+// session is over.
+//
+func readIRCLines(conn net.Conn, lines chan<- string, hungUp <-chan struct{}) {
+	defer close(lines)
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 512), ircMaxLine)
+	for scanner.Scan() {
+		select {
+		case lines <- strings.TrimSuffix(scanner.Text(), "\r"):
+		case <-hungUp:
+			return
+		}
+	}
+}
+
+//
+// One command from the IRC client. Returns false if we're done with them.
+//
+func (connection *ircConnection) handleLine(line string) bool {
+	command, params := parseIRCLine(line)
+	session := connection.session
+	switch command {
+	case "":
+		return true
+	case "CAP":
+		//
+		// We don't have any capabilities, but clients that ask wait for
+		// the answer.
+		//
+		if (len(params) > 0) && (strings.ToUpper(params[0]) == "LS") {
+			return session.send(ircServerName, "CAP", "*", "LS", "")
+		}
+		return true
+	case "PING":
+		token := ircServerName
+		if len(params) > 0 {
+			token = params[0]
+		}
+		return session.send(ircServerName, "PONG", ircServerName, token)
+	case "PONG":
+		return true
+	case "QUIT":
+		session.send("", "ERROR", "Closing link")
+		return false
+	case "PASS":
+		if connection.answered["username"] > 0 {
+			return session.numeric("462", "You may not reregister")
+		}
+		if len(params) > 0 {
+			connection.password = params[0]
+		}
+		return true
+	case "NICK":
+		if len(params) == 0 {
+			return session.numeric("431", "No nickname given")
+		}
+		if connection.answered["username"] > 0 {
+			return session.notice("Nick changes aren't supported.")
+		}
+		connection.nick = params[0]
+		session.setNick(params[0])
+		return true
+	case "USER":
+		if connection.gotUser {
+			return session.numeric("462", "You may not reregister")
+		}
+		connection.gotUser = true
+		return true
+	}
+	if !session.isLoggedIn() {
+		return session.numeric("451", "You have not registered")
+	}
+	switch command {
+	case "JOIN":
+		if len(params) == 0 {
+			return session.numeric("461", "JOIN", "Not enough parameters")
+		}
+		if params[0] == "0" {
+			return connection.leave()
+		}
+		//
+		// Only the first one -- we can only be on one at a time.
+		//
+		chatChannelName := strings.TrimPrefix(strings.Split(params[0], ",")[0], "#")
+		current := session.currentChatChannel()
+		if strings.EqualFold(current, chatChannelName) {
+			return true
+		}
+		if current == "" {
+			return connection.typeLine("/join " + chatChannelName)
+		}
+		//
+		// The /join has to wait until the doppelganger says it's left
+		// (see answer).
+		//
+		connection.pendingJoin = chatChannelName
+		return connection.typeLine("/exit")
+	case "PART":
+		if len(params) == 0 {
+			return session.numeric("461", "PART", "Not enough parameters")
+		}
+		for _, target := range strings.Split(params[0], ",") {
+			if !connection.isOn(target) {
+				return session.numeric("442", target, "You're not on that channel")
+			}
+		}
+		return connection.leave()
+	case "PRIVMSG", "NOTICE":
+		//
+		// NOTICEs go to the chat channel the same as PRIVMSGs, but IRC
+		// says never to answer one with an error.
+		//
+		if len(params) < 2 {
+			if command == "NOTICE" {
+				return true
+			}
+			return session.numeric("412", "No text to send")
+		}
+		if !strings.HasPrefix(params[0], "#") {
+			if command == "NOTICE" {
+				return true
+			}
+			return session.numeric("401", params[0], "No such nick/channel")
+		}
+		if !connection.isOn(params[0]) {
+			if command == "NOTICE" {
+				return true
+			}
+			return session.numeric("404", params[0], "Cannot send to channel")
+		}
+		text := params[1]
+		if strings.HasPrefix(text, "\x01ACTION ") {
+			return connection.typeLine("/emote " + strings.TrimSuffix(text[len("\x01ACTION "):], "\x01"))
+		}
+		if strings.HasPrefix(text, "\x01") {
+			//
+			// Some other CTCP. We don't do those.
+			//
+			return true
+		}
+		return connection.typeLine("/say " + text)
+	case "NAMES":
+		if (len(params) == 0) || connection.isOn(params[0]) {
+			if session.currentChatChannel() != "" {
+				return connection.typeLine("/who")
+			}
+		}
+		target := "*"
+		if len(params) > 0 {
+			target = params[0]
+		}
+		return session.numeric("366", target, "End of /NAMES list")
+	case "LIST":
+		return connection.typeLine("/list")
+	case "MODE":
+		//
+		// Clients ask after connecting and joining. There aren't any
+		// modes.
+		//
+		if (len(params) > 0) && strings.HasPrefix(params[0], "#") {
+			return session.numeric("324", params[0], "+")
+		}
+		return session.numeric("221", "+")
+	}
+	return session.numeric("421", command, "Unknown command")
+}
+
+//
+// Whatever the doppelganger's asking for while the user logs in, we answer
+// from PASS and NICK, once we have them. It asks for the username again
+// after making a new account; any other time it asks for something twice,
+// the last answer was wrong and the client gets the error and a hang-up.
+// Once they're logged in, this is where a JOIN waiting for a PART goes out.
+// Returns false if we're done with them.
+//
+func (connection *ircConnection) answer() bool {
+	session := connection.session
+	if session.isLoggedIn() {
+		if (connection.pendingJoin != "") && (session.currentChatChannel() == "") {
+			chatChannelName := connection.pendingJoin
+			connection.pendingJoin = ""
+			return connection.typeLine("/join " + chatChannelName)
+		}
+		return true
+	}
+	if (connection.nick == "") || !connection.gotUser {
+		return true
+	}
+	asking, lastError, ok := session.takeAsk()
+	if !ok {
+		return true
+	}
+	limit := 1
+	if asking == "username" {
+		limit = limit + connection.answered["new_account"]
+	}
+	if connection.answered[asking] >= limit {
+		if lastError == "" {
+			lastError = "Login failed"
+		}
+		session.numeric("464", lastError)
+		session.send("", "ERROR", "Closing link")
+		return false
+	}
+	connection.answered[asking]++
+	switch asking {
+	case "username":
+		return connection.typeLine(connection.nick)
+	case "new_account":
+		return connection.typeLine("y")
+	case "password", "new_password", "repeat_password":
+		if connection.password == "" {
+			session.numeric("464", "Password required (use PASS)")
+			session.send("", "ERROR", "Closing link")
+			return false
+		}
+		return connection.typeLine(connection.password)
+	}
+	//
+	// Should never happen.
+	//
+	session.send("", "ERROR", "Can't log in: the server asked for "+asking)
+	return false
+}
+
+func (connection *ircConnection) isOn(target string) bool {
+	current := connection.session.currentChatChannel()
+	return (current != "") && strings.EqualFold(current, strings.TrimPrefix(target, "#"))
+}
+
+func (connection *ircConnection) leave() bool {
+	connection.pendingJoin = ""
+	if connection.session.currentChatChannel() == "" {
+		return true
+	}
+	return connection.typeLine("/exit")
+}
+
+//
+// Hands a line to the doppelganger a byte at a time, followed by a return,
+// the same as the web gateway's typeLine. Returns false if the session is
+// over.
+//
+func (connection *ircConnection) typeLine(line string) bool {
+	keystrokes := make([]byte, 0, len(line)+1)
+	for ii := 0; ii < len(line); ii++ {
+		if (line[ii] >= 32) && (line[ii] != 127) {
+			keystrokes = append(keystrokes, line[ii])
+		}
+	}
+	keystrokes = append(keystrokes, 13)
+	for _, keystroke := range keystrokes {
+		select {
+		case connection.userGoChannel <- keystroke:
+		case <-connection.session.hungUp:
+			return false
+		}
+	}
+	return true
+}
+
+//
+// Splits an IRC line into its command (upper case) and parameters, the
+// last of which can have spaces if it starts with a colon. The prefix, if
+// there is one, is ignored -- we know who they are.
+//
+func parseIRCLine(line string) (string, []string) {
+	line = strings.TrimLeft(line, " ")
+	if strings.HasPrefix(line, ":") {
+		space := strings.Index(line, " ")
+		if space < 0 {
+			return "", nil
+		}
+		line = strings.TrimLeft(line[space:], " ")
+	}
+	params := make([]string, 0)
+	trailing := ""
+	hasTrailing := false
+	colon := strings.Index(line, " :")
+	if colon >= 0 {
+		trailing = line[colon+2:]
+		hasTrailing = true
+		line = line[:colon]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	params = append(params, fields[1:]...)
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+	return strings.ToUpper(fields[0]), params
+}
+
+//
+// An IRC message. The last parameter always goes out as the trailing one
+// (with a colon), which is always allowed and saves working out when it's
+// needed.
+//
+func ircMessage(prefix string, command string, params ...string) string {
+	message := command
+	if prefix != "" {
+		message = ":" + prefix + " " + message
+	}
+	for ii, param := range params {
+		param = strings.Replace(strings.Replace(param, "\r", "", -1), "\n", " ", -1)
+		if ii == len(params)-1 {
+			message = message + " :" + param
+		} else {
+			message = message + " " + param
+		}
+	}
+	return message + "\r\n"
+}
+
+func ircUserPrefix(userName string) string {
+	return userName + "!" + userName + "@" + ircServerName
+}
+
+func (session *ircSession) send(prefix string, command string, params ...string) bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.sendLocked(prefix, command, params...) == nil
+}
+
+func (session *ircSession) numeric(numeric string, params ...string) bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.numericLocked(numeric, params...) == nil
+}
+
+func (session *ircSession) notice(text string) bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.noticeLocked(text) == nil
+}
+
+func (session *ircSession) sendLocked(prefix string, command string, params ...string) error {
+	_, err := session.conn.Write([]byte(ircMessage(prefix, command, params...)))
+	return err
+}
+
+func (session *ircSession) numericLocked(numeric string, params ...string) error {
+	return session.sendLocked(ircServerName, numeric, append([]string{session.target()}, params...)...)
+}
+
+func (session *ircSession) noticeLocked(text string) error {
+	return session.sendLocked(ircServerName, "NOTICE", session.target(), text)
+}
+
+//
+// Who numerics and notices go to: their nick, or * if we don't know it yet.
+//
+func (session *ircSession) target() string {
+	if session.nick == "" {
+		return "*"
+	}
+	return session.nick
+}
+
+func (session *ircSession) setNick(nick string) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.nick = nick
+}
+
+func (session *ircSession) isLoggedIn() bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.loggedIn
+}
+
+func (session *ircSession) currentChatChannel() string {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.chatChannelName
+}
+
+//
+// What the doppelganger's asking for, if it's asking and nobody's answered
+// yet, and the last error it gave while the user was logging in.
+//
+func (session *ircSession) takeAsk() (string, string, bool) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if !session.askPending {
+		return "", "", false
+	}
+	session.askPending = false
+	return session.asking, session.lastError, true
+}
+
+func (session *ircSession) poke() {
+	select {
+	case session.changed <- true:
+	default:
+	}
+}
+
+//
+// The doppelganger's writer. It's in machine mode, so everything it writes
+// is whole lines, but not necessarily one per write; we keep whatever comes
+// after the last line break for next time.
+//
+func (session *ircSession) Write(p []byte) (int, error) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.partial = append(session.partial, p...)
+	for {
+		end := strings.Index(string(session.partial), "\r\n")
+		if end < 0 {
+			break
+		}
+		line := string(session.partial[:end])
+		session.partial = session.partial[end+2:]
+		if line == "" {
+			continue
+		}
+		err := session.translateLocked(line)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+//
+// One tagged line from the doppelganger (see machinemode.go), as IRC.
+//
+func (session *ircSession) translateLocked(line string) error {
+	fields := strings.SplitN(line, " ", 2)
+	tag := fields[0]
+	rest := ""
+	if len(fields) > 1 {
+		rest = fields[1]
+	}
+	switch tag {
+	case "ASK":
+		session.asking = rest
+		session.askPending = true
+		session.poke()
+		return nil
+	case "MOTD":
+		//
+		// IRC clients expect the MOTD after the welcome, so it waits
+		// until they've logged in.
+		//
+		if !session.loggedIn {
+			session.motd = append(session.motd, rest)
+			return nil
+		}
+		return session.noticeLocked(rest)
+	case "OK":
+		if !session.loggedIn && (session.asking == "password") {
+			session.loggedIn = true
+			session.poke()
+			return session.welcomeLocked()
+		}
+		return session.noticeLocked(rest)
+	case "ERR":
+		if !session.loggedIn {
+			session.lastError = rest
+		}
+		return session.noticeLocked(rest)
+	case "MSG", "EMOTE":
+		fields = splitMachineLine(rest, 3)
+		if strings.EqualFold(fields[1], session.nick) {
+			return nil
+		}
+		text := fields[2]
+		if tag == "EMOTE" {
+			text = "\x01ACTION " + text + "\x01"
+		}
+		return session.sendLocked(ircUserPrefix(fields[1]), "PRIVMSG", "#"+fields[0], text)
+	case "NOTICE":
+		fields = splitMachineLine(rest, 2)
+		return session.sendLocked(ircServerName, "NOTICE", "#"+fields[0], fields[1])
+	case "JOIN", "PART":
+		fields = splitMachineLine(rest, 2)
+		if strings.EqualFold(fields[1], session.nick) {
+			if tag == "JOIN" {
+				session.chatChannelName = fields[0]
+			} else {
+				session.chatChannelName = ""
+			}
+			session.poke()
+		}
+		return session.sendLocked(ircUserPrefix(fields[1]), tag, "#"+fields[0])
+	case "WHO":
+		fields = strings.Fields(rest)
+		if len(fields) == 0 {
+			return nil
+		}
+		err := session.numericLocked("353", "=", fields[0], strings.Join(fields[1:], " "))
+		if err != nil {
+			return err
+		}
+		return session.numericLocked("366", fields[0], "End of /NAMES list")
+	case "LIST":
+		//
+		// We don't know how many are on each one, so we say 0.
+		//
+		for _, chatChannelName := range strings.Fields(rest) {
+			err := session.numericLocked("322", chatChannelName, "0", "")
+			if err != nil {
+				return err
+			}
+		}
+		return session.numericLocked("323", "End of /LIST")
+	case "SKIPPED":
+		fields = splitMachineLine(rest, 2)
+		return session.sendLocked(ircServerName, "NOTICE", "#"+fields[0], "["+fields[1]+" messages skipped]")
+	case "PING":
+		return session.sendLocked("", "PING", ircServerName)
+	}
+	return session.noticeLocked(rest)
+}
+
+//
+// What IRC clients wait for before they do anything: the welcome, and the
+// MOTD we've been holding on to.
+//
+func (session *ircSession) welcomeLocked() error {
+	err := session.numericLocked("001", "Welcome to "+ircServerName+", "+session.nick)
+	if err != nil {
+		return err
+	}
+	if len(session.motd) == 0 {
+		return session.numericLocked("422", "MOTD File is missing")
+	}
+	err = session.numericLocked("375", "- "+ircServerName+" Message of the day -")
+	if err != nil {
+		return err
+	}
+	for _, line := range session.motd {
+		err = session.numericLocked("372", "- "+line)
+		if err != nil {
+			return err
+		}
+	}
+	return session.numericLocked("376", "End of /MOTD command")
+}
+
+//
+// So client_write_timeout works the same as for Telnet connections.
+//
+func (session *ircSession) SetWriteDeadline(t time.Time) error {
+	return session.conn.SetWriteDeadline(t)
+}
+
+//
+// The doppelganger hanging up, or the connection's goroutine done with it.
+//
+func (session *ircSession) Close() error {
+	var err error
+	session.hangUp.Do(func() {
+		close(session.hungUp)
+		err = session.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,82 @@
+package chatserver
+
+import (
+	"net"
+	"testing"
+)
+
+//
+// A scripted IRC client and a Telnet user on the same chat channel. The IRC
+// client is a testClient too, driven expect-style on the raw IRC lines.
+//
+
+func (server *testServer) dialIRC(name string) *testClient {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		server.t.Fatal(err)
+	}
+	go server.chatServer.ServeIRC(listener)
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		server.t.Fatal(err)
+	}
+	return server.startClient(name, conn, 4096)
+}
+
+func TestIRCGateway(t *testing.T) {
+	server := startTestServer(t, nil)
+	alice := server.logIn("alice", "secret")
+	alice.send("/create lounge")
+	alice.expect(`created\.`)
+	alice.send("/create kitchen")
+	alice.expect(`created\.`)
+	alice.send("/join lounge")
+	alice.expect(`You have joined #lounge`)
+	//
+	// A new account, made on the way in.
+	//
+	bob := server.dialIRC("bob")
+	bob.send("CAP LS 302")
+	bob.expect(`:wtelnet CAP \* LS :\r\n`)
+	bob.send("PASS secret")
+	bob.send("NICK bob")
+	bob.send("USER bob 0 * :Bob")
+	bob.expect(`:wtelnet 001 bob :Welcome to wtelnet, bob\r\n`)
+	bob.expect(`:wtelnet (376|422) bob :[^\r]*\r\n`)
+	bob.send("PING :abc")
+	bob.expect(`^:wtelnet PONG wtelnet :abc\r\n`)
+	bob.send("LIST")
+	bob.expect(`:wtelnet 322 bob (#kitchen|#lounge) 0 :\r\n:wtelnet 322 bob (#kitchen|#lounge) 0 :\r\n:wtelnet 323 bob :End of /LIST\r\n`)
+	bob.send("JOIN #lounge")
+	bob.expect(`^:bob!bob@wtelnet JOIN :#lounge\r\n:wtelnet 353 bob = #lounge :(alice bob|bob alice)\r\n:wtelnet 366 bob #lounge :End of /NAMES list\r\n`)
+	alice.expect(`bob has joined #lounge`)
+	//
+	// Both ways. bob's own message isn't sent back to bob.
+	//
+	alice.send("hello")
+	bob.expect(`^:alice!alice@wtelnet PRIVMSG #lounge :hello\r\n`)
+	alice.send("/emote waves")
+	bob.expect("^:alice!alice@wtelnet PRIVMSG #lounge :\x01ACTION waves\x01\r\n")
+	bob.send("PRIVMSG #lounge :hi from IRC")
+	alice.expect(`bob says, "hi from IRC"`)
+	bob.send("PRIVMSG #lounge :\x01ACTION waves back\x01")
+	alice.expect(`bob waves back`)
+	bob.send("PRIVMSG #kitchen :anyone?")
+	bob.expect(`^:wtelnet 404 bob #kitchen :Cannot send to channel\r\n`)
+	//
+	// Switching chat channels leaves the old one first.
+	//
+	bob.send("JOIN #kitchen")
+	bob.expect(`^:bob!bob@wtelnet PART :#lounge\r\n:bob!bob@wtelnet JOIN :#kitchen\r\n:wtelnet 353 bob = #kitchen :bob\r\n`)
+	alice.expect(`bob has left #lounge`)
+	bob.send("QUIT :bye")
+	bob.expect(`ERROR :Closing link\r\n`)
+	//
+	// A wrong password is the end of it.
+	//
+	mallory := server.dialIRC("mallory")
+	mallory.send("PASS wrong")
+	mallory.send("NICK alice")
+	mallory.send("USER alice 0 * :Alice")
+	mallory.expect(`:wtelnet 464 alice :Incorrect password\.\r\nERROR :Closing link\r\n`)
+}
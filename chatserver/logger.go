@@ -0,0 +1,256 @@
+package chatserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// The daemon's logger. Every line has a time, a level and a message, plus
+// fields saying who it's about -- doppelganger_id, user_id, channel_id,
+// remote_addr and so on -- so you can grep (or feed to a log collector) for
+// everything that happened to one user or one channel, instead of picking
+// IDs out of hand-concatenated strings. Lines come out as logfmt
+// (key=value, the default) or as one JSON object per line.
+//
+// Each goroutine keeps its own *Logger with its own fields, made with
+// With(), e.g. a doppelganger's logger has its doppelganger ID and remote
+// address, and gets the user ID added when the user logs in. All of them
+// share one logSink, which is where the output, level and format live. The
+// sink has a mutex because every goroutine writes to it -- just like the
+// standard library's log package, which this replaces. Whoever made the
+// logger (main, for the daemon) changes the sink's settings with Configure,
+// e.g. when the configuration is reloaded.
+//
+// Logger implements go-telnet-mod's Logger interface, so the telnet server
+// logs through it too.
+//
+
+const (
+	logLevelTrace = iota
+	logLevelDebug
+	logLevelInfo
+	logLevelWarn
+	logLevelError
+)
+
+var logLevelNames = []string{"trace", "debug", "info", "warn", "error"}
+
+func parseLogLevel(name string) (int, error) {
+	for level, levelName := range logLevelNames {
+		if name == levelName {
+			return level, nil
+		}
+	}
+	return 0, errors.New("log_level must be one of " + strings.Join(logLevelNames, ", ") + ", got " + strconv.Quote(name))
+}
+
+func checkLogFormat(format string) error {
+	if format != "logfmt" && format != "json" {
+		return errors.New("log_format must be \"logfmt\" or \"json\", got " + strconv.Quote(format))
+	}
+	return nil
+}
+
+type logSink struct {
+	mutex  sync.Mutex
+	out    io.Writer
+	level  int
+	format string
+}
+
+type logField struct {
+	key   string
+	value interface{}
+}
+
+type Logger struct {
+	sink   *logSink
+	fields []logField
+}
+
+func newStructuredLogger(out io.Writer, level int, format string) *Logger {
+	return &Logger{sink: &logSink{out: out, level: level, format: format}}
+}
+
+//
+// A logger writing to out at the default level and format (info, logfmt),
+// for until there's a configuration to Configure it with.
+//
+func NewLogger(out io.Writer) *Logger {
+	return newStructuredLogger(out, logLevelInfo, "logfmt")
+}
+
+//
+// Points the logger (and every logger made from it with With) at out, with
+// the level and format from config, which has already been checked (by
+// LoadConfig, or by New).
+//
+func (logger *Logger) Configure(out io.Writer, config Config) {
+	level, _ := parseLogLevel(config.LogLevel)
+	logger.configure(out, level, config.LogFormat)
+}
+
+//
+// Changes where every logger sharing this one's sink writes to, and what
+// level and format it uses. The caller has already checked level and format
+// with parseLogLevel and checkLogFormat.
+//
+func (logger *Logger) configure(out io.Writer, level int, format string) {
+	logger.sink.mutex.Lock()
+	defer logger.sink.mutex.Unlock()
+	logger.sink.out = out
+	logger.sink.level = level
+	logger.sink.format = format
+}
+
+//
+// Returns a new logger with more fields, given as key, value, key, value...
+// The original logger is unchanged. Errors are logged as their message.
+//
+func (logger *Logger) With(keyValues ...interface{}) *Logger {
+	fields := make([]logField, len(logger.fields), len(logger.fields)+(len(keyValues)+1)/2)
+	copy(fields, logger.fields)
+	for ii := 0; ii < len(keyValues); ii += 2 {
+		key := fmt.Sprint(keyValues[ii])
+		var value interface{} = "(missing)"
+		if ii+1 < len(keyValues) {
+			value = keyValues[ii+1]
+		}
+		err, isError := value.(error)
+		if isError {
+			value = err.Error()
+		}
+		fields = append(fields, logField{key: key, value: value})
+	}
+	return &Logger{sink: logger.sink, fields: fields}
+}
+
+func (logger *Logger) Trace(args ...interface{}) {
+	logger.output(logLevelTrace, fmt.Sprint(args...))
+}
+
+func (logger *Logger) Tracef(format string, args ...interface{}) {
+	logger.output(logLevelTrace, fmt.Sprintf(format, args...))
+}
+
+func (logger *Logger) Debug(args ...interface{}) {
+	logger.output(logLevelDebug, fmt.Sprint(args...))
+}
+
+func (logger *Logger) Debugf(format string, args ...interface{}) {
+	logger.output(logLevelDebug, fmt.Sprintf(format, args...))
+}
+
+func (logger *Logger) Info(args ...interface{}) {
+	logger.output(logLevelInfo, fmt.Sprint(args...))
+}
+
+func (logger *Logger) Infof(format string, args ...interface{}) {
+	logger.output(logLevelInfo, fmt.Sprintf(format, args...))
+}
+
+func (logger *Logger) Warn(args ...interface{}) {
+	logger.output(logLevelWarn, fmt.Sprint(args...))
+}
+
+func (logger *Logger) Warnf(format string, args ...interface{}) {
+	logger.output(logLevelWarn, fmt.Sprintf(format, args...))
+}
+
+//
+// Error can be turned into a call to panic for debugging purposes, but logs
+// errors in production.
+//
+func (logger *Logger) Error(args ...interface{}) {
+	// panic(fmt.Sprint(args...))
+	logger.output(logLevelError, fmt.Sprint(args...))
+}
+
+func (logger *Logger) Errorf(format string, args ...interface{}) {
+	// panic(fmt.Sprintf(format, args...))
+	logger.output(logLevelError, fmt.Sprintf(format, args...))
+}
+
+func (logger *Logger) output(level int, message string) {
+	logger.sink.mutex.Lock()
+	defer logger.sink.mutex.Unlock()
+	if level < logger.sink.level {
+		return
+	}
+	var line strings.Builder
+	timestamp := time.Now().Format("2006-01-02T15:04:05.000Z07:00")
+	if logger.sink.format == "json" {
+		line.WriteString(`{"time":` + jsonValue(timestamp) + `,"level":` + jsonValue(logLevelNames[level]) + `,"msg":` + jsonValue(message))
+		for _, field := range logger.fields {
+			line.WriteString("," + jsonValue(field.key) + ":" + jsonValue(field.value))
+		}
+		line.WriteString("}\n")
+	} else {
+		line.WriteString("time=" + timestamp + " level=" + logLevelNames[level] + " msg=" + logfmtValue(message))
+		for _, field := range logger.fields {
+			line.WriteString(" " + field.key + "=" + logfmtValue(field.value))
+		}
+		line.WriteString("\n")
+	}
+	//
+	// If we can't write the log, there's nowhere to log that to.
+	//
+	io.WriteString(logger.sink.out, line.String())
+}
+
+//
+// Doppelganger IDs are random 63-bit numbers, and most JSON readers turn
+// numbers into 64-bit floats, which would round them. So integers too big
+// for a float to hold exactly are written as strings.
+//
+const largestExactFloatInt = 1 << 53
+
+func jsonValue(value interface{}) string {
+	number, isInt64 := value.(int64)
+	if isInt64 && ((number > largestExactFloatInt) || (number < -largestExactFloatInt)) {
+		value = strconv.FormatInt(number, 10)
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	return string(encoded)
+}
+
+func logfmtValue(value interface{}) string {
+	strn := fmt.Sprint(value)
+	if strn == "" || strings.ContainsAny(strn, " =\"\\\t\r\n") {
+		return strconv.Quote(strn)
+	}
+	return strn
+}
+
+//
+// Lets the standard library's log package (which net/http and friends use)
+// write through our logger at the given level.
+//
+type logWriter struct {
+	logger *Logger
+	level  int
+}
+
+func (writer logWriter) Write(p []byte) (int, error) {
+	writer.logger.output(writer.level, strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+//
+// Something for the standard library's log package (log.SetOutput, or an
+// http.Server's ErrorLog) to write to, so what it logs comes out through us,
+// as warnings.
+//
+func (logger *Logger) Writer() io.Writer {
+	return logWriter{logger: logger, level: logLevelWarn}
+}
@@ -0,0 +1,188 @@
+package chatserver
+
+import (
+	"github.com/reiver/go-oi"
+	"strings"
+)
+
+//
+// Machine mode, for bots and scripts. Typing /machine (at the Username:
+// prompt, or any time after logging in) turns off everything that's only
+// there for a person -- the prompt, echoing what they type, backspacing over
+// the prompt when chat comes in -- and from then on everything the server
+// says is one line per event, starting with a tag that says what it is:
+//
+//	ASK <what>                 what we want next while logging in: username,
+//	                           password, new_account (y or n), new_password
+//	                           or repeat_password
+//	OK <text>                  a command worked
+//	ERR <text>                 a command (or logging in) didn't work
+//	MSG #<channel> <user> <text>
+//	                           someone said something
+//	EMOTE #<channel> <user> <text>
+//	                           someone emoted, thought, sang or went away
+//	                           ("/emote waves" is "EMOTE #lounge bob waves")
+//	NOTICE #<channel> <text>   the chat channel itself said something (a
+//	                           plugin, for instance)
+//	JOIN #<channel> <user>     someone joined the chat channel (us, too)
+//	PART #<channel> <user>     someone left the chat channel (us, too)
+//	WHO #<channel> <user> ...  who's on the chat channel
+//	LIST #<channel> ...        every chat channel, for /list
+//	SKIPPED #<channel> <count> chat we threw away because the bot wasn't
+//	                           keeping up
+//	HELP <text>                a line of /help
+//	SERVER <text>              the server itself (idle warnings, shutting
+//	                           down, and so on)
+//	PING                       the keepalive
+//	MOTD <text>                a line of the MOTD, for sessions that start
+//	                           out in machine mode (see webgateway.go)
+//	SSHKEY <number> <type> <fingerprint>
+//	                           one of the user's SSH keys, for /sshkey (see
+//	                           sshlistener.go)
+//	APITOKEN <number> <name>   one of the user's API tokens, for /apitoken
+//	                           (see apiserver.go)
+//	SET <name> <value>         one of the user's preferences, for /set (see
+//	                           colortheme.go)
+//
+// Bots should ignore tags they don't know, so we can add more. Names go out
+// as they are, so a bot's account and its chat channels shouldn't have spaces
+// in their names. Over Telnet, the negotiation and the MOTD still come first,
+// before the bot gets a chance to type /machine. /machine off turns it off
+// again.
+//
+
+func isMachineModeCommand(command string) bool {
+	return (command == "/machine") || strings.HasPrefix(command, "/machine ")
+}
+
+//
+// Same return values as doCommand.
+//
+func setMachineMode(doppelgangerState *userInfo, command string) (bool, error) {
+	switch trim(command[len("/machine"):]) {
+	case "", "on":
+		if !doppelgangerState.machineMode {
+			//
+			// User's carriage return was not echoed.
+			//
+			err := writeToUser(doppelgangerState, "\r\n", "")
+			if err != nil {
+				return false, err
+			}
+		}
+		doppelgangerState.machineMode = true
+		doppelgangerState.logger.Debug("Machine mode on.")
+		return true, tellUser(doppelgangerState, "OK", "Machine mode on.")
+	case "off":
+		if doppelgangerState.machineModeOnly {
+			//
+			// Whoever's on the other end (the web gateway, say) only
+			// understands tagged lines.
+			//
+			return true, tellUser(doppelgangerState, "ERR", "Machine mode can't be turned off here.")
+		}
+		doppelgangerState.machineMode = false
+		doppelgangerState.logger.Debug("Machine mode off.")
+		return true, tellUser(doppelgangerState, "OK", "\r\nMachine mode off.\r\n")
+	}
+	return true, tellUser(doppelgangerState, "ERR", "\r\nUse /machine to turn machine mode on, or /machine off to turn it off.\r\n")
+}
+
+//
+// Everything the doppelganger tells its user itself, as opposed to chat text
+// from a chat channel, goes through writeToUser or tellUser. text is what a
+// person sees, line breaks and all. In machine mode, line goes out instead --
+// or nothing, if line is empty, which is for the line breaks that are only
+// there because the user's return wasn't echoed.
+//
+func writeToUser(doppelgangerState *userInfo, text string, line string) error {
+	if doppelgangerState.machineMode {
+		if line == "" {
+			return nil
+		}
+		text = line + "\r\n"
+	}
+	_, err := oi.LongWrite(doppelgangerState.writer, []byte(text))
+	return err
+}
+
+//
+// For when the tagged line is just the text, tagged.
+//
+func tellUser(doppelgangerState *userInfo, tag string, text string) error {
+	if trim(text) == "" {
+		return writeToUser(doppelgangerState, text, "")
+	}
+	return writeToUser(doppelgangerState, text, machineLine(tag, text))
+}
+
+//
+// Text a person would see, as one tagged line: line breaks inside it become
+// spaces and the ones around it go.
+//
+func machineLine(tag string, text string) string {
+	text = trim(strings.Replace(text, "\r\n", " ", -1))
+	if text == "" {
+		return tag
+	}
+	return tag + " " + text
+}
+
+//
+// Same, but a line for every line of text, for the ones that wouldn't make
+// sense run together (like /help). Blank lines are left out.
+//
+func machineLines(tag string, text string) string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(text, "\r\n") {
+		if trim(line) != "" {
+			lines = append(lines, tag+" "+line)
+		}
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+//
+// Takes the place of the prompt while the user is logging in. Once they're
+// logged in there isn't one.
+//
+func writeMachinePrompt(doppelgangerState *userInfo) error {
+	switch doppelgangerState.mode {
+	case loginUsernameMode:
+		return writeToUser(doppelgangerState, "", "ASK username")
+	case loginNewUserYNMode:
+		return writeToUser(doppelgangerState, "", "ASK new_account")
+	case loginNewPassword1Mode:
+		return writeToUser(doppelgangerState, "", "ASK new_password")
+	case loginNewPassword2Mode:
+		return writeToUser(doppelgangerState, "", "ASK repeat_password")
+	case loginRegularPasswordMode:
+		return writeToUser(doppelgangerState, "", "ASK password")
+	}
+	return nil
+}
+
+//
+// Chat text from a chat channel, for a user in machine mode. The chat
+// channel (or whoever stands in for it) always fills in machineLine, so we
+// should never need to make one up, but if we do it's still one line.
+//
+func machineTextLine(doppelgangerState *userInfo, theMessage messageFromChatChannelToDoppelganger) string {
+	if theMessage.machineLine != "" {
+		return theMessage.machineLine
+	}
+	return machineLine("NOTICE #"+doppelgangerState.chatChannelName, theMessage.parameter)
+}
+
+//
+// What a member said, after the plugins are done with it, for the chat
+// channel to send to members in machine mode. A plugin that changes what
+// someone said has to change Said as well as Text for them to see it.
+//
+func machineChatLine(message *Message) string {
+	prefix := "#" + message.ChatChannel.Name + " " + message.User.Name
+	if message.Said != "" {
+		return machineLine("MSG "+prefix, message.Said)
+	}
+	return machineLine("EMOTE "+prefix, strings.TrimPrefix(message.Text, message.User.Name+" "))
+}
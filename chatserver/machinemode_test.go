@@ -0,0 +1,64 @@
+package chatserver
+
+import (
+	"testing"
+)
+
+//
+// A bot in machine mode, on a chat channel with a person. Every expect is
+// anchored, so a prompt, an echo or anything else in between would fail it.
+//
+
+func TestMachineMode(t *testing.T) {
+	server := startTestServer(t, nil)
+	alice := server.logIn("alice", "secret")
+	alice.send("/create lounge")
+	alice.expect(`created\.`)
+	alice.send("/join lounge")
+	alice.expect(`You have joined #lounge`)
+	//
+	// Switching before logging in. The Username: prompt is already out,
+	// and /machine is echoed since it wasn't on yet.
+	//
+	bot := server.dial("bot")
+	bot.expect(`Username: `)
+	bot.send("/machine")
+	bot.expect("^/machine\r\nOK Machine mode on\\.\r\nASK username\r\n")
+	bot.send("bot")
+	bot.expect("^ERR That username does not exist on this system\\.\r\nASK new_account\r\n")
+	bot.send("y")
+	bot.expect("^ASK new_password\r\n")
+	bot.send("secret")
+	bot.expect("^ASK repeat_password\r\n")
+	bot.send("secret")
+	bot.expect("^OK Your new account has been created\\. Please log in as you will normally\\.\r\nASK username\r\n")
+	bot.send("bot")
+	bot.expect("^ASK password\r\n")
+	bot.send("secret")
+	bot.expect("^OK You are logged in\\. Use /help for help with commands\\.\r\n")
+	bot.send("/list")
+	bot.expect("^LIST #lounge\r\n")
+	bot.send("/join lounge")
+	bot.expect("^JOIN #lounge bot\r\nWHO #lounge (alice bot|bot alice)\r\n")
+	alice.expect(`bot has joined #lounge`)
+	alice.send("hello")
+	bot.expect("^MSG #lounge alice hello\r\n")
+	alice.send("/emote waves")
+	bot.expect("^EMOTE #lounge alice waves\r\n")
+	bot.send("hi there")
+	bot.expect("^MSG #lounge bot hi there\r\n")
+	alice.expect(`bot says, "hi there"`)
+	bot.send("/frobnicate")
+	bot.expect("^ERR Command \"/frobnicate\" not recognized\\.\r\n")
+	alice.send("/exit")
+	bot.expect("^PART #lounge alice\r\n")
+	bot.send("/exit")
+	bot.expect("^PART #lounge bot\r\n")
+	bot.send("/who")
+	bot.expect("^ERR You are not on a channel\\.\r\n")
+	//
+	// And back to the way people see it.
+	//
+	bot.send("/machine off")
+	bot.expect("^\r\nMachine mode off\\.\r\nbot #\\(no channel\\)> ")
+}
@@ -0,0 +1,227 @@
+package chatserver
+
+import (
+	"sort"
+	"sync"
+)
+
+//
+// A storage that keeps everything in memory and forgets it when the
+// program exits -- for tests, so they don't need a database or a log
+// directory. It behaves like the SQLite one: IDs start at 1 and go up,
+// names are matched exactly, and saving a user or chat channel that's
+// already there replaces it. The conversation logs are kept by chat
+// channel name (the log directory doesn't matter), and conversation
+// returns what's been logged so far.
+//
+// Many goroutines use the storage at once, so one mutex guards the lot.
+//
+
+type memoryStorage struct {
+	mutex             sync.Mutex
+	users             map[string]memoryStorageUser
+	lastUserID        int64
+	chatChannels      map[string]int64
+	lastChatChannelID int64
+	conversations     map[string][]string
+	sshKeys           map[int64][]string
+	apiTokens         map[int64][]string
+	userPrefs         map[int64]map[string]string
+}
+
+type memoryStorageUser struct {
+	userID       int64
+	userName     string
+	passwordHash string
+}
+
+type memoryConversationLog struct {
+	store           *memoryStorage
+	chatChannelName string
+}
+
+func newMemoryStorage() *memoryStorage {
+	store := new(memoryStorage)
+	store.users = make(map[string]memoryStorageUser)
+	store.chatChannels = make(map[string]int64)
+	store.conversations = make(map[string][]string)
+	store.sshKeys = make(map[int64][]string)
+	store.apiTokens = make(map[int64][]string)
+	store.userPrefs = make(map[int64]map[string]string)
+	return store
+}
+
+func (store *memoryStorage) lookUpUser(userName string) (int64, string, string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	user, ok := store.users[userName]
+	if !ok {
+		return 0, "", "", nil
+	}
+	return user.userID, user.userName, user.passwordHash, nil
+}
+
+func (store *memoryStorage) saveUser(userName string, passwordHash string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	user, ok := store.users[userName]
+	if !ok {
+		store.lastUserID++
+		user.userID = store.lastUserID
+		user.userName = userName
+	}
+	user.passwordHash = passwordHash
+	store.users[userName] = user
+	return nil
+}
+
+func (store *memoryStorage) saveChatChannel(chatChannelName string) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	_, ok := store.chatChannels[chatChannelName]
+	if ok {
+		return true, nil
+	}
+	store.lastChatChannelID++
+	store.chatChannels[chatChannelName] = store.lastChatChannelID
+	return false, nil
+}
+
+func (store *memoryStorage) lookUpChatChannel(chatChannelName string) (int64, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.chatChannels[chatChannelName], nil // 0 if it's not there
+}
+
+func (store *memoryStorage) listChatChannels() ([]string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	chatChanList := make([]string, 0, len(store.chatChannels))
+	for chatChannelName := range store.chatChannels {
+		chatChanList = append(chatChanList, chatChannelName)
+	}
+	sort.Strings(chatChanList)
+	return chatChanList, nil
+}
+
+func (store *memoryStorage) listSSHKeys(userID int64) ([]string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return append(make([]string, 0), store.sshKeys[userID]...), nil
+}
+
+func (store *memoryStorage) addSSHKey(userID int64, publicKey string) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for _, existing := range store.sshKeys[userID] {
+		if existing == publicKey {
+			return true, nil
+		}
+	}
+	store.sshKeys[userID] = append(store.sshKeys[userID], publicKey)
+	return false, nil
+}
+
+func (store *memoryStorage) removeSSHKey(userID int64, publicKey string) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	publicKeys := store.sshKeys[userID]
+	for ii, existing := range publicKeys {
+		if existing == publicKey {
+			store.sshKeys[userID] = append(publicKeys[:ii:ii], publicKeys[ii+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (store *memoryStorage) listAPITokens(userID int64) ([]string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return append(make([]string, 0), store.apiTokens[userID]...), nil
+}
+
+func (store *memoryStorage) addAPIToken(userID int64, tokenHash string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.apiTokens[userID] = append(store.apiTokens[userID], tokenHash)
+	return nil
+}
+
+func (store *memoryStorage) removeAPIToken(userID int64, tokenHash string) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	tokenHashes := store.apiTokens[userID]
+	for ii, existing := range tokenHashes {
+		if existing == tokenHash {
+			store.apiTokens[userID] = append(tokenHashes[:ii:ii], tokenHashes[ii+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (store *memoryStorage) lookUpAPIToken(tokenHash string) (int64, string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for userID, tokenHashes := range store.apiTokens {
+		for _, existing := range tokenHashes {
+			if existing == tokenHash {
+				for _, user := range store.users {
+					if user.userID == userID {
+						return userID, user.userName, nil
+					}
+				}
+			}
+		}
+	}
+	return 0, "", nil
+}
+
+func (store *memoryStorage) loadUserPrefs(userID int64) (map[string]string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	prefs := make(map[string]string)
+	for name, value := range store.userPrefs[userID] {
+		prefs[name] = value
+	}
+	return prefs, nil
+}
+
+func (store *memoryStorage) saveUserPref(userID int64, name string, value string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.userPrefs[userID] == nil {
+		store.userPrefs[userID] = make(map[string]string)
+	}
+	store.userPrefs[userID][name] = value
+	return nil
+}
+
+func (store *memoryStorage) openConversationLog(logDir string, chatChannelName string) (conversationLog, error) {
+	return &memoryConversationLog{store, chatChannelName}, nil
+}
+
+func (store *memoryStorage) close() error {
+	return nil
+}
+
+//
+// Everything logged on the chat channel so far, one entry per message.
+//
+func (store *memoryStorage) conversation(chatChannelName string) []string {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return append([]string(nil), store.conversations[chatChannelName]...)
+}
+
+func (conversation *memoryConversationLog) appendMessage(message string) error {
+	conversation.store.mutex.Lock()
+	defer conversation.store.mutex.Unlock()
+	conversation.store.conversations[conversation.chatChannelName] = append(conversation.store.conversations[conversation.chatChannelName], message)
+	return nil
+}
+
+func (conversation *memoryConversationLog) close() error {
+	return nil
+}
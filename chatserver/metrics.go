@@ -0,0 +1,217 @@
+package chatserver
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// The metrics endpoint. This replaces the old heartbeat goroutine, which
+// printed the goroutine count and active channel count to stdout every two
+// seconds. Now nothing is printed; instead, when something (Prometheus, or
+// you with curl) asks for /metrics, we ask the goroutines that own the
+// numbers -- the channel master, and through it every channel master shard,
+// and through them every running chat channel -- and answer in the
+// Prometheus text format.
+//
+// We never read another goroutine's state directly. The only numbers we get
+// without asking are from the telnet server (which has its own mutex), the
+// cluster membership and the event sink (likewise) and the Go runtime.
+//
+
+//
+// How long we wait for the channel master, and then for the shards and chat
+// channels, before giving up. If the channel master is that backed up,
+// that's exactly when you'd want to know, so rather than hang we answer 503
+// (or, if only some shards or chat channels didn't answer, what we have
+// plus wtelnet_metrics_incomplete 1).
+//
+const metricsTimeout = 2 * time.Second
+
+type metricsHandler struct {
+	chatServer *ChatServer
+}
+
+func (handler *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	deadline := time.NewTimer(metricsTimeout)
+	defer deadline.Stop()
+	//
+	// Step 1, ask the channel master. Buffered so that if we give up
+	// waiting, the channel master doesn't block answering us.
+	//
+	var request messageFromMetricsToChannelMaster
+	request.metricsCallback = make(chan channelMasterMetrics, 1)
+	select {
+	case handler.chatServer.chanMasterMetrics <- request:
+	case <-deadline.C:
+		http.Error(w, "channel master did not take the metrics request in time", http.StatusServiceUnavailable)
+		return
+	}
+	var masterMetrics channelMasterMetrics
+	select {
+	case masterMetrics = <-request.metricsCallback:
+	case <-deadline.C:
+		http.Error(w, "channel master did not answer the metrics request in time", http.StatusServiceUnavailable)
+		return
+	}
+	//
+	// Step 2, collect the answers from the shards the channel master
+	// passed the question on to, and then from the chat channels each
+	// shard passed it on to.
+	//
+	shards := make([]shardMetrics, 0, masterMetrics.shardsAsked)
+	incomplete := false
+	for len(shards) < masterMetrics.shardsAsked && !incomplete {
+		select {
+		case shard := <-masterMetrics.shardCallback:
+			shards = append(shards, shard)
+		case <-deadline.C:
+			incomplete = true
+		}
+	}
+	sort.Slice(shards, func(ii, jj int) bool {
+		return shards[ii].shard < shards[jj].shard
+	})
+	chatChannels := make([]chatChannelMetrics, 0)
+	for _, shard := range shards {
+		answered := 0
+		for answered < shard.chatChannelsAsked && !incomplete {
+			select {
+			case chatChannel := <-shard.chatChannelCallback:
+				chatChannels = append(chatChannels, chatChannel)
+				answered++
+			case <-deadline.C:
+				incomplete = true
+			}
+		}
+	}
+	sort.Slice(chatChannels, func(ii, jj int) bool {
+		return chatChannels[ii].chatChannelName < chatChannels[jj].chatChannelName
+	})
+	//
+	// Step 3, add it up. Messages (and dropped messages) on chat channels
+	// that have since closed are counted by their shards, so the totals
+	// never go backwards.
+	//
+	var runningChatChannels int
+	var joinDenials int64
+	var messages int64
+	var dropped int64
+	for _, shard := range shards {
+		runningChatChannels += shard.runningChatChannels
+		joinDenials += shard.joinDenials
+		messages += shard.messagesFromClosedChatChannels
+		dropped += shard.droppedFromClosedChatChannels
+	}
+	for _, chatChannel := range chatChannels {
+		messages += chatChannel.messageCount
+		dropped += chatChannel.droppedMessages
+	}
+	//
+	// Step 4, write it out.
+	//
+	var out bytes.Buffer
+	writeMetric(&out, "wtelnet_connections_active", "gauge", "Connections currently open, logged in or not.", "", int64(handler.chatServer.telnetServer.ActiveConnections()))
+	writeMetric(&out, "wtelnet_connections_rejected_total", "counter", "Connections turned away by the connection limits.", "", handler.chatServer.telnetServer.RejectedConnections())
+	writeMetric(&out, "wtelnet_sessions", "gauge", "Sessions (doppelgangers) registered with the channel master.", "", int64(masterMetrics.sessions))
+	writeMetric(&out, "wtelnet_users_logged_in", "gauge", "Sessions with a logged in user.", "", int64(masterMetrics.loggedInUsers))
+	writeMetric(&out, "wtelnet_logins_total", "counter", "Successful logins, including new accounts.", "", masterMetrics.logins)
+	writeMetric(&out, "wtelnet_login_failures_total", "counter", "Logins refused because of a wrong password.", "", masterMetrics.loginFailures)
+	writeMetric(&out, "wtelnet_join_denials_total", "counter", "Joins refused because the chat channel was full.", "", joinDenials)
+	writeMetric(&out, "wtelnet_write_errors_total", "counter", "Errors writing to clients, from sessions that have ended.", "", masterMetrics.writeErrors)
+	writeMetric(&out, "wtelnet_chat_channels_active", "gauge", "Chat channels with users in them.", "", int64(runningChatChannels))
+	writeMetric(&out, "wtelnet_chat_messages_total", "counter", "Messages said on chat channels.", "", messages)
+	writeMetric(&out, "wtelnet_chat_messages_dropped_total", "counter", "Chat messages thrown away because a member's queue was full.", "", dropped)
+	writeMetric(&out, "wtelnet_slow_member_disconnects_total", "counter", "Members disconnected for not keeping up with their chat channel.", "", masterMetrics.slowMemberDisconnects)
+	writeHeader(&out, "wtelnet_chat_channel_members", "gauge", "Users on each running chat channel.")
+	for _, chatChannel := range chatChannels {
+		writeSample(&out, "wtelnet_chat_channel_members", channelLabel(chatChannel.chatChannelName), int64(chatChannel.members))
+	}
+	writeHeader(&out, "wtelnet_channel_master_queue_length", "gauge", "Messages waiting in the channel master's incoming go channels.")
+	writeSample(&out, "wtelnet_channel_master_queue_length", `queue="doppelganger"`, int64(masterMetrics.doppelgangerQueueLength))
+	writeSample(&out, "wtelnet_channel_master_queue_length", `queue="chat_channel"`, int64(masterMetrics.chatChannelQueueLength))
+	writeHeader(&out, "wtelnet_channel_master_queue_capacity", "gauge", "Buffer size of the channel master's incoming go channels.")
+	writeSample(&out, "wtelnet_channel_master_queue_capacity", `queue="doppelganger"`, int64(masterMetrics.doppelgangerQueueCapacity))
+	writeSample(&out, "wtelnet_channel_master_queue_capacity", `queue="chat_channel"`, int64(masterMetrics.chatChannelQueueCapacity))
+	writeHeader(&out, "wtelnet_channel_master_shard_queue_length", "gauge", "Messages waiting in each channel master shard's incoming go channels.")
+	for _, shard := range shards {
+		writeSample(&out, "wtelnet_channel_master_shard_queue_length", shardLabel(shard.shard, "doppelganger"), int64(shard.doppelgangerQueueLength))
+		writeSample(&out, "wtelnet_channel_master_shard_queue_length", shardLabel(shard.shard, "chat_channel"), int64(shard.chatChannelQueueLength))
+	}
+	writeHeader(&out, "wtelnet_channel_master_shard_queue_capacity", "gauge", "Buffer size of each channel master shard's incoming go channels.")
+	for _, shard := range shards {
+		writeSample(&out, "wtelnet_channel_master_shard_queue_capacity", shardLabel(shard.shard, "doppelganger"), int64(shard.doppelgangerQueueCapacity))
+		writeSample(&out, "wtelnet_channel_master_shard_queue_capacity", shardLabel(shard.shard, "chat_channel"), int64(shard.chatChannelQueueCapacity))
+	}
+	writeHeader(&out, "wtelnet_chat_channel_queue_length", "gauge", "Messages waiting in each chat channel's incoming go channel.")
+	for _, chatChannel := range chatChannels {
+		writeSample(&out, "wtelnet_chat_channel_queue_length", channelLabel(chatChannel.chatChannelName), int64(chatChannel.queueLength))
+	}
+	writeHeader(&out, "wtelnet_chat_channel_queue_capacity", "gauge", "Buffer size of each chat channel's incoming go channel.")
+	for _, chatChannel := range chatChannels {
+		writeSample(&out, "wtelnet_chat_channel_queue_capacity", channelLabel(chatChannel.chatChannelName), int64(chatChannel.queueCapacity))
+	}
+	writeMetric(&out, "wtelnet_goroutines", "gauge", "Goroutines running.", "", int64(runtime.NumGoroutine()))
+	if handler.chatServer.cluster != nil {
+		writeHeader(&out, "wtelnet_cluster_node_up", "gauge", "1 for each cluster node we're connected to (and ourselves), 0 for each we aren't.")
+		for _, node := range clusterStatus(handler.chatServer) {
+			up := int64(0)
+			if node.up {
+				up = 1
+			}
+			writeSample(&out, "wtelnet_cluster_node_up", `node="`+labelValueEscaper.Replace(node.node)+`"`, up)
+		}
+	}
+	if handler.chatServer.events != nil {
+		events := handler.chatServer.events.metrics()
+		writeMetric(&out, "wtelnet_events_delivered_total", "counter", "Events sent to the event sink.", "", events.delivered)
+		writeMetric(&out, "wtelnet_events_dropped_total", "counter", "Events thrown away because the event queue was full.", "", events.dropped)
+		writeMetric(&out, "wtelnet_events_failed_total", "counter", "Events given up on after every retry failed.", "", events.failed)
+		writeMetric(&out, "wtelnet_event_queue_length", "gauge", "Events waiting to be sent to the event sink.", "", int64(events.queueLength))
+		writeMetric(&out, "wtelnet_event_queue_capacity", "gauge", "Most events that can wait to be sent to the event sink.", "", int64(events.queueCapacity))
+	}
+	incompleteValue := int64(0)
+	if incomplete {
+		incompleteValue = 1
+	}
+	writeMetric(&out, "wtelnet_metrics_incomplete", "gauge", "1 if some shards or chat channels did not answer in time.", "", incompleteValue)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(out.Bytes())
+}
+
+func writeHeader(out *bytes.Buffer, name string, metricType string, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func writeSample(out *bytes.Buffer, name string, labels string, value int64) {
+	if labels != "" {
+		fmt.Fprintf(out, "%s{%s} %d\n", name, labels, value)
+	} else {
+		fmt.Fprintf(out, "%s %d\n", name, value)
+	}
+}
+
+func writeMetric(out *bytes.Buffer, name string, metricType string, help string, labels string, value int64) {
+	writeHeader(out, name, metricType, help)
+	writeSample(out, name, labels, value)
+}
+
+//
+// Channel names are typed by users, so they have to be escaped to be label
+// values.
+//
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func channelLabel(chatChannelName string) string {
+	return `channel="` + labelValueEscaper.Replace(chatChannelName) + `"`
+}
+
+func shardLabel(shard int, queue string) string {
+	return `shard="` + strconv.Itoa(shard) + `",queue="` + queue + `"`
+}
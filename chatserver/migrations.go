@@ -0,0 +1,101 @@
+package chatserver
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+//
+// Schema migrations for the SQLite database. The schema_version table has a
+// row for every migration that's been applied to the database, and at
+// startup we apply the ones it hasn't had yet, in order, all in one
+// transaction -- so the database ends up either fully migrated or just the
+// way it was.
+//
+// To change the schema, add a migration to the end of schemaMigrations with
+// the next version number. Never change one that's already in a release:
+// databases out there have already had it applied, and won't again.
+//
+// Migration 1 is the schema the server used to create a new database with
+// (back when it only did that if the file didn't exist), with IF NOT EXISTS
+// so databases from back then -- which have the tables but no
+// schema_version -- start from there without losing anyone.
+//
+
+type schemaMigration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+var schemaMigrations = []schemaMigration{
+	{1, "user and channel tables", []string{
+		"CREATE TABLE IF NOT EXISTS user (userid INTEGER PRIMARY KEY AUTOINCREMENT, username VARCHAR(255) NOT NULL UNIQUE, password VARCHAR(255) NOT NULL);",
+		"CREATE INDEX IF NOT EXISTS idx_usr_nm ON user (username);",
+		"CREATE TABLE IF NOT EXISTS channel (channelid INTEGER PRIMARY KEY AUTOINCREMENT, channelname VARCHAR(255) NOT NULL UNIQUE);",
+		"CREATE INDEX IF NOT EXISTS idx_chan ON channel (channelname);",
+	}},
+	{2, "sshkey table", []string{
+		"CREATE TABLE IF NOT EXISTS sshkey (keyid INTEGER PRIMARY KEY AUTOINCREMENT, userid INTEGER NOT NULL, publickey VARCHAR(1024) NOT NULL, UNIQUE (userid, publickey));",
+		"CREATE INDEX IF NOT EXISTS idx_sshkey_usr ON sshkey (userid);",
+	}},
+	{3, "apitoken table", []string{
+		"CREATE TABLE IF NOT EXISTS apitoken (tokenid INTEGER PRIMARY KEY AUTOINCREMENT, userid INTEGER NOT NULL, tokenhash VARCHAR(64) NOT NULL UNIQUE);",
+		"CREATE INDEX IF NOT EXISTS idx_apitoken_usr ON apitoken (userid);",
+	}},
+	{4, "userpref table", []string{
+		"CREATE TABLE IF NOT EXISTS userpref (prefid INTEGER PRIMARY KEY AUTOINCREMENT, userid INTEGER NOT NULL, name VARCHAR(32) NOT NULL, value VARCHAR(32) NOT NULL, UNIQUE (userid, name));",
+	}},
+}
+
+//
+// Brings the database up to the latest schema version. Returns the versions
+// it was at before and is at now (the same if there was nothing to do). A
+// database from a newer server than this one is an error -- we don't know
+// what it's been changed to, so we'd better not touch it.
+//
+func migrateDatabase(db *sql.DB) (int, int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER PRIMARY KEY, description VARCHAR(255) NOT NULL, applied VARCHAR(32) NOT NULL);")
+	if err != nil {
+		tx.Rollback()
+		return 0, 0, err
+	}
+	var fromVersion int
+	err = tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version;").Scan(&fromVersion)
+	if err != nil {
+		tx.Rollback()
+		return 0, 0, err
+	}
+	latestVersion := schemaMigrations[len(schemaMigrations)-1].version
+	if fromVersion > latestVersion {
+		tx.Rollback()
+		return fromVersion, fromVersion, errors.New("database schema version " + intToStr(fromVersion) + " is newer than this server knows about (" + intToStr(latestVersion) + ")")
+	}
+	for _, migration := range schemaMigrations {
+		if migration.version <= fromVersion {
+			continue
+		}
+		for _, cmd := range migration.statements {
+			_, err = tx.Exec(cmd)
+			if err != nil {
+				tx.Rollback()
+				return fromVersion, fromVersion, errors.New("migration " + intToStr(migration.version) + " (" + migration.description + "): " + err.Error())
+			}
+		}
+		_, err = tx.Exec("INSERT INTO schema_version (version, description, applied) VALUES (?, ?, ?);", migration.version, migration.description, time.Now().UTC().Format(time.RFC3339))
+		if err != nil {
+			tx.Rollback()
+			return fromVersion, fromVersion, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fromVersion, fromVersion, err
+	}
+	return fromVersion, latestVersion, nil
+}
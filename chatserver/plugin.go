@@ -0,0 +1,176 @@
+package chatserver
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+//
+// Plugins: a way to extend the chat without changing the server. A plugin
+// hears about users logging in, joining and leaving chat channels, and
+// everything said on a chat channel, and can rewrite or veto what's said and
+// say things of its own. Plugins are registered when the server starts
+// (Hooks.Plugins, or by name from the config's plugins setting for the ones
+// built in) and never change after that.
+//
+// The hooks are called from the goroutines that own what they're about:
+// OnLogin from the user's doppelganger, OnJoin, OnMessage and OnExit from
+// the chat channel goroutine. That's many goroutines at once, so a plugin
+// has to be safe for concurrent use. It also mustn't take long, because the
+// chat channel (or the user) waits for it. In a cluster, OnJoin, OnMessage
+// and OnExit run on the node the chat channel lives on and OnLogin on the
+// node the user is connected to, so every node should have the same
+// plugins.
+//
+// Plugins are called in the order they were registered, and each one sees
+// what the ones before it did to a message.
+//
+
+type Plugin interface {
+	//
+	// A user has logged in. Returning an error turns them away (back to the
+	// Username: prompt), with the error's message.
+	//
+	OnLogin(user User) error
+	//
+	// A user has joined a chat channel. Whatever it returns is said on the
+	// chat channel by the chat channel itself, after the announcement.
+	//
+	OnJoin(chatChannel ChatChannel, user User) []string
+	//
+	// Someone said something on a chat channel. The plugin can change
+	// message.Text, set message.Veto to keep it from going out at all, and
+	// append to message.Replies, which are said on the chat channel by the
+	// chat channel itself, after the message (or instead of it, if it was
+	// vetoed).
+	//
+	OnMessage(message *Message)
+	//
+	// A user has left a chat channel (with /exit, or by logging off or
+	// being disconnected).
+	//
+	OnExit(chatChannel ChatChannel, user User)
+}
+
+type User struct {
+	ID   int64
+	Name string
+}
+
+type ChatChannel struct {
+	ID   int64
+	Name string
+}
+
+type Message struct {
+	ChatChannel ChatChannel
+	User        User
+	//
+	// The line as everyone on the chat channel sees it, e.g.
+	// `bob says, "hello"` or "bob waves".
+	//
+	Text string
+	//
+	// What the user said, if they said something (by typing a line, or with
+	// /say): just "hello", without their name or the quotes. Empty for
+	// /emote, /think, /sing and /away. Users in machine mode (see
+	// machinemode.go) get this instead of Text, so to change what someone
+	// said, change both.
+	//
+	Said    string
+	Veto    bool
+	Replies []string
+}
+
+//
+// For embedding in a plugin, so it only has to have the hooks it cares
+// about.
+//
+type BasePlugin struct{}
+
+func (BasePlugin) OnLogin(user User) error {
+	return nil
+}
+
+func (BasePlugin) OnJoin(chatChannel ChatChannel, user User) []string {
+	return nil
+}
+
+func (BasePlugin) OnMessage(message *Message) {
+}
+
+func (BasePlugin) OnExit(chatChannel ChatChannel, user User) {
+}
+
+//
+// The plugins that come with the server, which the config's plugins setting
+// can name. Each call makes a new one.
+//
+var builtinPlugins = map[string]func() Plugin{
+	"timebot": NewTimeBot,
+}
+
+func builtinPluginNames() string {
+	names := make([]string, 0, len(builtinPlugins))
+	for name := range builtinPlugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+//
+// The plugins named in the config, followed by the ones the program passed
+// in.
+//
+func registerPlugins(config Config, hooks Hooks) ([]Plugin, error) {
+	plugins := make([]Plugin, 0, len(config.Plugins)+len(hooks.Plugins))
+	for _, name := range config.Plugins {
+		newPlugin, exists := builtinPlugins[name]
+		if !exists {
+			//
+			// Should never happen -- validateConfig checks the names.
+			//
+			return nil, errors.New("no built-in plugin called " + name)
+		}
+		plugins = append(plugins, newPlugin())
+	}
+	for _, plugin := range hooks.Plugins {
+		if plugin == nil {
+			return nil, errors.New("Hooks.Plugins has a nil plugin")
+		}
+		plugins = append(plugins, plugin)
+	}
+	return plugins, nil
+}
+
+func pluginsOnLogin(plugins []Plugin, user User) error {
+	for _, plugin := range plugins {
+		err := plugin.OnLogin(user)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pluginsOnJoin(plugins []Plugin, chatChannel ChatChannel, user User) []string {
+	replies := make([]string, 0)
+	for _, plugin := range plugins {
+		replies = append(replies, plugin.OnJoin(chatChannel, user)...)
+	}
+	return replies
+}
+
+func pluginsOnMessage(plugins []Plugin, message *Message) {
+	for _, plugin := range plugins {
+		plugin.OnMessage(message)
+	}
+}
+
+func pluginsOnExit(plugins []Plugin, chatChannel ChatChannel, user User) {
+	for _, plugin := range plugins {
+		plugin.OnExit(chatChannel, user)
+	}
+}
@@ -0,0 +1,123 @@
+package chatserver
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+// Plugins, through a real server: the example bot, and a plugin that uses
+// every hook.
+//
+
+func TestTimeBot(t *testing.T) {
+	server := startTestServer(t, func(config *Config) {
+		config.Plugins = []string{"timebot"}
+	})
+	alice := server.logIn("alice", "secret")
+	alice.send("/create clock")
+	alice.expect(`created\.`)
+	alice.send("/join clock")
+	alice.expect(`You have joined #clock`)
+	alice.send("!time")
+	alice.expect(`alice says, "!time"`)
+	alice.expect(`timebot says, "It's \d\d:\d\d:\d\d `)
+	alice.send("!uptime")
+	alice.expect(`timebot says, "The server has been up for (\d+[dhm] )*\d+s\."`)
+	//
+	// Only the exact words.
+	//
+	alice.send("what !time is it")
+	alice.expect(`alice says, "what !time is it"`)
+	alice.expectNot(`timebot`, 200*time.Millisecond)
+}
+
+type testPlugin struct {
+	BasePlugin
+	exits chan string
+}
+
+func (plugin *testPlugin) OnLogin(user User) error {
+	if user.Name == "mallory" {
+		return errors.New("Go away, mallory.")
+	}
+	return nil
+}
+
+func (plugin *testPlugin) OnJoin(chatChannel ChatChannel, user User) []string {
+	return []string{"Welcome to #" + chatChannel.Name + ", " + user.Name + "!"}
+}
+
+func (plugin *testPlugin) OnMessage(message *Message) {
+	if strings.Contains(message.Said, "darn") {
+		message.Veto = true
+		message.Replies = append(message.Replies, message.User.Name+" said a bad word.")
+		return
+	}
+	message.Text = strings.Replace(message.Text, "hello", "HELLO", -1)
+}
+
+func (plugin *testPlugin) OnExit(chatChannel ChatChannel, user User) {
+	plugin.exits <- user.Name + " left #" + chatChannel.Name
+}
+
+func TestPluginHooks(t *testing.T) {
+	plugin := new(testPlugin)
+	plugin.exits = make(chan string, 10)
+	server := startTestServerWithPlugins(t, nil, plugin)
+	//
+	// The account gets made, but the plugin won't let mallory in.
+	//
+	mallory := server.dial("mallory")
+	mallory.expect(`Username: `)
+	mallory.send("mallory")
+	mallory.expect(`Create new account\? \(y/n\) `)
+	mallory.send("y")
+	mallory.expect(`Password for new account: `)
+	mallory.send("secret")
+	mallory.expect(`Repeat password: `)
+	mallory.send("secret")
+	mallory.expect(`Username: `)
+	mallory.send("mallory")
+	mallory.expect(`Password: `)
+	mallory.send("secret")
+	mallory.expect(`Go away, mallory\.`)
+	mallory.expect(`Username: `)
+	alice := server.logIn("alice", "secret")
+	alice.send("/create lounge")
+	alice.expect(`created\.`)
+	alice.send("/join lounge")
+	alice.expect(`Welcome to #lounge, alice!`)
+	bob := server.logIn("bob", "secret")
+	bob.send("/join lounge")
+	bob.expect(`Welcome to #lounge, bob!`)
+	alice.expect(`Welcome to #lounge, bob!`)
+	//
+	// Rewritten on the way out, for everyone and in the log.
+	//
+	bob.send("hello there")
+	alice.expect(`bob says, "HELLO there"`)
+	bob.expect(`bob says, "HELLO there"`)
+	readConversationLog(t, server, "lounge", `HELLO there`)
+	//
+	// Vetoed: nobody hears it, the one who said it is told, and the
+	// plugin's reply goes to everyone.
+	//
+	bob.send("darn it")
+	bob.expect(`\(Your message was not sent\.\)`)
+	bob.expect(`bob said a bad word\.`)
+	alice.expect(`bob said a bad word\.`)
+	alice.expectNot(`darn`, 200*time.Millisecond)
+	bob.send("/exit")
+	bob.expect(`You left #lounge`)
+	select {
+	case exit := <-plugin.exits:
+		if exit != "bob left #lounge" {
+			t.Errorf("OnExit: got %q", exit)
+		}
+	case <-time.After(testTimeout):
+		t.Error("OnExit wasn't called")
+	}
+}
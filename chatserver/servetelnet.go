@@ -1,10 +1,29 @@
-package main
+package chatserver
 
 import (
 	"github.com/reiver/go-oi"
 	"go-telnet-mod"
+	"io"
+	"net"
 )
 
+//
+// A Telnet user's connection, as the doppelganger gets it: still the
+// net.Conn (for hanging up and write deadlines), and a terminalTyper too.
+// The telnet server asks every client what kind of terminal it is
+// (AskTerminalType), and the answer comes in with the bytes we read below,
+// so until the client answers -- and forever, if it won't -- the terminal
+// type is "".
+//
+type telnetConn struct {
+	net.Conn
+	ctx telnet.Context
+}
+
+func (conn telnetConn) TerminalType() string {
+	return conn.ctx.TerminalType()
+}
+
 func (handler chatHandler) ServeTELNET(ctx telnet.Context, writer telnet.Writer, reader telnet.Reader) {
 	//
 	// This is the starting point for when a new user connects to the system!
@@ -16,9 +35,30 @@ func (handler chatHandler) ServeTELNET(ctx telnet.Context, writer telnet.Writer,
 	//
 	userGoChannel = make(chan byte)
 	//
-	// Launch doppelganger.
+	// Launch doppelganger. We give it the connection, but only as something
+	// it can close (so it can hang up on the user, e.g. when the server is
+	// shutting down) -- reading stays our job. The remote address is for
+	// checking against the banned IP list. It's counted in the chat
+	// server's doppelgangers so shutting down can wait for it to be gone.
+	//
+	// The connection is wrapped so the doppelganger can find out what kind
+	// of terminal the user has, once their Telnet client gets around to
+	// telling us (see telnetConn).
+	//
+	remoteAddr := ""
+	var connCloser io.Closer
+	if ctx.Conn() != nil {
+		remoteAddr = ctx.Conn().RemoteAddr().String()
+		connCloser = telnetConn{Conn: ctx.Conn(), ctx: ctx}
+	}
+	handler.chatServer.doppelgangers.Add(1)
+	go doppelgangerGoroutine(handler.chatServer, writer, connCloser, remoteAddr, userGoChannel, telnetSession, User{})
+	//
+	// The telnet server hands us its logger (ours -- see New) in the
+	// context. It only has the go-telnet-mod Logger methods, so the remote
+	// address goes in the message.
 	//
-	go doppelgangerGoroutine(writer, userGoChannel)
+	logger := ctx.Logger()
 	//
 	// We are following the system that the creator of go-telnet (Charles
 	// Iliya Krempeaux) used -- we create a 1-byte buffer and read bytes in
@@ -56,7 +96,7 @@ func (handler chatHandler) ServeTELNET(ctx telnet.Context, writer telnet.Writer,
 				//
 				// Should never happen.
 				//
-				logError("Telnet goroutine: userGoChannel == nil")
+				logger.Errorf("Telnet goroutine: userGoChannel == nil (connection from %s)", remoteAddr)
 			}
 			close(userGoChannel)
 			return
@@ -65,7 +105,7 @@ func (handler chatHandler) ServeTELNET(ctx telnet.Context, writer telnet.Writer,
 			//
 			// Should never happen.
 			//
-			logError("Telnet goroutine: buffer should hold only 1 byte but n > 1")
+			logger.Errorf("Telnet goroutine: buffer should hold only 1 byte but n > 1 (connection from %s)", remoteAddr)
 		}
 		if n == 1 {
 			userGoChannel <- p[0]
@@ -0,0 +1,404 @@
+package chatserver
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"os"
+	"strings"
+)
+
+//
+// The storage the server uses: users and chat channels in the SQLite
+// database, and the messages on each chat channel in a conversation log
+// file of its own in the log directory. Each SQL statement is prepared once,
+// when the database is opened, rather than every time it's used. A
+// prepared statement (like the sql.DB itself) can be used by any number of
+// goroutines at once.
+//
+
+type sqliteStorage struct {
+	db                     *sql.DB
+	stmtSelUser            *sql.Stmt
+	stmtInsUser            *sql.Stmt
+	stmtUpdUser            *sql.Stmt
+	stmtSelChatChannel     *sql.Stmt
+	stmtInsChatChannel     *sql.Stmt
+	stmtUpdChatChannel     *sql.Stmt
+	stmtSelChatChannelList *sql.Stmt
+	stmtSelSSHKeys         *sql.Stmt
+	stmtInsSSHKey          *sql.Stmt
+	stmtDelSSHKey          *sql.Stmt
+	stmtSelAPITokens       *sql.Stmt
+	stmtInsAPIToken        *sql.Stmt
+	stmtDelAPIToken        *sql.Stmt
+	stmtSelAPITokenUser    *sql.Stmt
+	stmtSelUserPrefs       *sql.Stmt
+	stmtInsUserPref        *sql.Stmt
+}
+
+//
+// Opens the database (SQLite creates it if it doesn't exist), brings its
+// schema up to date (see migrations.go) and prepares our statements. The
+// journal mode and busy timeout go in the data source name, so the driver
+// sets them on every connection it opens, not just the first. Transactions
+// take the write lock when they begin ("immediate"), so two of them (from
+// two cluster nodes starting at once, say) can't both read and then both
+// try to write -- the second just waits, up to the busy timeout.
+//
+func openSQLiteStorage(config Config, logger *Logger) (*sqliteStorage, error) {
+	dataSourceName := config.DatabasePath + "?_journal_mode=" + config.DatabaseJournalMode + "&_busy_timeout=" + intToStr(config.DatabaseBusyTimeoutMs) + "&_txlock=immediate"
+	db, err := sql.Open("sqlite3", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	var journalMode string
+	err = db.QueryRow("PRAGMA journal_mode;").Scan(&journalMode)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if !strings.EqualFold(journalMode, config.DatabaseJournalMode) {
+		//
+		// SQLite quietly keeps the old journal mode if it can't use the
+		// one we asked for (WAL doesn't work on some network file
+		// systems, for one).
+		//
+		logger.With("database_path", config.DatabasePath, "wanted", config.DatabaseJournalMode, "journal_mode", journalMode).Warn("Database journal mode not changed.")
+	}
+	fromVersion, toVersion, err := migrateDatabase(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if fromVersion != toVersion {
+		logger.With("database_path", config.DatabasePath, "from_version", fromVersion, "to_version", toVersion).Info("Database schema migrated.")
+	}
+	store := new(sqliteStorage)
+	store.db = db
+	statements := []struct {
+		stmt **sql.Stmt
+		cmd  string
+	}{
+		{&store.stmtSelUser, "SELECT userid, username, password FROM user WHERE username = ?;"},
+		{&store.stmtInsUser, "INSERT INTO user (username, password) VALUES (?, ?);"},
+		{&store.stmtUpdUser, "UPDATE user SET username = ?, password = ? WHERE userid = ?;"},
+		{&store.stmtSelChatChannel, "SELECT channelid FROM channel WHERE channelname = ?;"},
+		{&store.stmtInsChatChannel, "INSERT INTO channel (channelname) VALUES (?);"},
+		{&store.stmtUpdChatChannel, "UPDATE channel SET channelname = ? WHERE channelid = ?;"},
+		{&store.stmtSelChatChannelList, "SELECT channelname FROM channel WHERE 1 ORDER BY channelname;"},
+		{&store.stmtSelSSHKeys, "SELECT publickey FROM sshkey WHERE userid = ? ORDER BY keyid;"},
+		{&store.stmtInsSSHKey, "INSERT OR IGNORE INTO sshkey (userid, publickey) VALUES (?, ?);"},
+		{&store.stmtDelSSHKey, "DELETE FROM sshkey WHERE userid = ? AND publickey = ?;"},
+		{&store.stmtSelAPITokens, "SELECT tokenhash FROM apitoken WHERE userid = ? ORDER BY tokenid;"},
+		{&store.stmtInsAPIToken, "INSERT INTO apitoken (userid, tokenhash) VALUES (?, ?);"},
+		{&store.stmtDelAPIToken, "DELETE FROM apitoken WHERE userid = ? AND tokenhash = ?;"},
+		{&store.stmtSelAPITokenUser, "SELECT user.userid, user.username FROM apitoken INNER JOIN user ON user.userid = apitoken.userid WHERE apitoken.tokenhash = ?;"},
+		{&store.stmtSelUserPrefs, "SELECT name, value FROM userpref WHERE userid = ?;"},
+		{&store.stmtInsUserPref, "INSERT OR REPLACE INTO userpref (userid, name, value) VALUES (?, ?, ?);"},
+	}
+	for _, statement := range statements {
+		*statement.stmt, err = db.Prepare(statement.cmd)
+		if err != nil {
+			store.close()
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+func (store *sqliteStorage) close() error {
+	for _, stmt := range []*sql.Stmt{store.stmtSelUser, store.stmtInsUser, store.stmtUpdUser, store.stmtSelChatChannel, store.stmtInsChatChannel, store.stmtUpdChatChannel, store.stmtSelChatChannelList, store.stmtSelSSHKeys, store.stmtInsSSHKey, store.stmtDelSSHKey, store.stmtSelAPITokens, store.stmtInsAPIToken, store.stmtDelAPIToken, store.stmtSelAPITokenUser, store.stmtSelUserPrefs, store.stmtInsUserPref} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return store.db.Close()
+}
+
+func (store *sqliteStorage) lookUpUser(userName string) (int64, string, string, error) {
+	rowsExisting, err := store.stmtSelUser.Query(userName)
+	if err != nil {
+		return 0, "", "", err
+	}
+	defer rowsExisting.Close()
+	var userID int64
+	userID = 0
+	var passwordHash string
+	for rowsExisting.Next() {
+		err = rowsExisting.Scan(&userID, &userName, &passwordHash)
+		if err != nil {
+			return 0, "", "", err
+		}
+	}
+	return userID, userName, passwordHash, rowsExisting.Err()
+}
+
+func (store *sqliteStorage) saveUser(userName string, passwordHash string) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	rowsExisting, err := tx.Stmt(store.stmtSelUser).Query(userName)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	var userID int64
+	userID = 0
+	var storedUserName string
+	var storedPasswordHash string
+	for rowsExisting.Next() {
+		err = rowsExisting.Scan(&userID, &storedUserName, &storedPasswordHash)
+		if err != nil {
+			rowsExisting.Close()
+			tx.Rollback()
+			return err
+		}
+	}
+	rowsExisting.Close()
+	if userID == 0 {
+		_, err = tx.Stmt(store.stmtInsUser).Exec(userName, passwordHash)
+	} else {
+		_, err = tx.Stmt(store.stmtUpdUser).Exec(userName, passwordHash, userID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit() // can be nil
+}
+
+func (store *sqliteStorage) saveChatChannel(chatChannelName string) (bool, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	rowsExisting, err := tx.Stmt(store.stmtSelChatChannel).Query(chatChannelName)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	var channelID int64
+	channelID = 0
+	for rowsExisting.Next() {
+		err = rowsExisting.Scan(&channelID)
+		if err != nil {
+			rowsExisting.Close()
+			tx.Rollback()
+			return false, err
+		}
+	}
+	rowsExisting.Close()
+	var alreadyExists bool
+	if channelID == 0 {
+		alreadyExists = false
+		_, err = tx.Stmt(store.stmtInsChatChannel).Exec(chatChannelName)
+	} else {
+		alreadyExists = true
+		//
+		// If you create the same channel twice, it just updates the name. If
+		// your database is set to do case-independent SELECTs, this could
+		// change the case on the name Maybe not the behavior you expect. We
+		// should probably do a real "rename" command!
+		//
+		_, err = tx.Stmt(store.stmtUpdChatChannel).Exec(chatChannelName, channelID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return alreadyExists, err
+	}
+	err = tx.Commit()
+	return alreadyExists, err // can be nil
+}
+
+func (store *sqliteStorage) lookUpChatChannel(chatChannelName string) (int64, error) {
+	rows, err := store.stmtSelChatChannel.Query(chatChannelName)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var channelID int64
+	channelID = 0
+	for rows.Next() {
+		err = rows.Scan(&channelID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return channelID, rows.Err() // channelID can be 0
+}
+
+func (store *sqliteStorage) listChatChannels() ([]string, error) {
+	rowsExisting, err := store.stmtSelChatChannelList.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rowsExisting.Close()
+	chatChanList := make([]string, 0)
+	var chatChannelName string
+	for rowsExisting.Next() {
+		err = rowsExisting.Scan(&chatChannelName)
+		if err != nil {
+			return nil, err
+		}
+		chatChanList = append(chatChanList, chatChannelName)
+	}
+	return chatChanList, rowsExisting.Err()
+}
+
+func (store *sqliteStorage) listSSHKeys(userID int64) ([]string, error) {
+	rows, err := store.stmtSelSSHKeys.Query(userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	publicKeys := make([]string, 0)
+	var publicKey string
+	for rows.Next() {
+		err = rows.Scan(&publicKey)
+		if err != nil {
+			return nil, err
+		}
+		publicKeys = append(publicKeys, publicKey)
+	}
+	return publicKeys, rows.Err()
+}
+
+//
+// The UNIQUE constraint does the checking: a key the user already has
+// isn't inserted again.
+//
+func (store *sqliteStorage) addSSHKey(userID int64, publicKey string) (bool, error) {
+	result, err := store.stmtInsSSHKey.Exec(userID, publicKey)
+	if err != nil {
+		return false, err
+	}
+	numRows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return numRows == 0, nil
+}
+
+func (store *sqliteStorage) removeSSHKey(userID int64, publicKey string) (bool, error) {
+	result, err := store.stmtDelSSHKey.Exec(userID, publicKey)
+	if err != nil {
+		return false, err
+	}
+	numRows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return numRows > 0, nil
+}
+
+func (store *sqliteStorage) listAPITokens(userID int64) ([]string, error) {
+	rows, err := store.stmtSelAPITokens.Query(userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokenHashes := make([]string, 0)
+	var tokenHash string
+	for rows.Next() {
+		err = rows.Scan(&tokenHash)
+		if err != nil {
+			return nil, err
+		}
+		tokenHashes = append(tokenHashes, tokenHash)
+	}
+	return tokenHashes, rows.Err()
+}
+
+func (store *sqliteStorage) addAPIToken(userID int64, tokenHash string) error {
+	_, err := store.stmtInsAPIToken.Exec(userID, tokenHash)
+	return err
+}
+
+func (store *sqliteStorage) removeAPIToken(userID int64, tokenHash string) (bool, error) {
+	result, err := store.stmtDelAPIToken.Exec(userID, tokenHash)
+	if err != nil {
+		return false, err
+	}
+	numRows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return numRows > 0, nil
+}
+
+func (store *sqliteStorage) lookUpAPIToken(tokenHash string) (int64, string, error) {
+	var userID int64
+	var userName string
+	err := store.stmtSelAPITokenUser.QueryRow(tokenHash).Scan(&userID, &userName)
+	if err == sql.ErrNoRows {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	return userID, userName, nil
+}
+
+func (store *sqliteStorage) loadUserPrefs(userID int64) (map[string]string, error) {
+	rows, err := store.stmtSelUserPrefs.Query(userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	prefs := make(map[string]string)
+	var name string
+	var value string
+	for rows.Next() {
+		err = rows.Scan(&name, &value)
+		if err != nil {
+			return nil, err
+		}
+		prefs[name] = value
+	}
+	return prefs, rows.Err()
+}
+
+func (store *sqliteStorage) saveUserPref(userID int64, name string, value string) error {
+	_, err := store.stmtInsUserPref.Exec(userID, name, value)
+	return err
+}
+
+//
+// If the file doesn't exist, create it. If it does exist, append to the
+// file.
+//
+func (store *sqliteStorage) openConversationLog(logDir string, chatChannelName string) (conversationLog, error) {
+	fhFile, err := os.OpenFile(conversationLogPath(logDir, chatChannelName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &conversationLogFile{fhFile}, nil
+}
+
+type conversationLogFile struct {
+	fhFile *os.File
+}
+
+func (logFile *conversationLogFile) appendMessage(message string) error {
+	msgAsBytes := []byte(message)
+	numWritten := 0
+	for numWritten < len(msgAsBytes) {
+		//
+		// In practice Write should rarely write only part of it, but it is
+		// possible, and there are variations by operating system as to
+		// whether it processes all the bytes in the Write() call or not,
+		// so make sure they all get written out.
+		//
+		numBytes, err := logFile.fhFile.Write(msgAsBytes[numWritten:])
+		if err != nil {
+			return err
+		}
+		numWritten += numBytes
+	}
+	return nil
+}
+
+func (logFile *conversationLogFile) close() error {
+	return logFile.fhFile.Close()
+}
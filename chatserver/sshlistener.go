@@ -0,0 +1,525 @@
+package chatserver
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"github.com/reiver/go-oi"
+	"go-telnet-mod"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// The SSH listener: the same chat as Telnet, over SSH, for any ssh client.
+// The difference is logging in. SSH does that before the session starts,
+// with the password of an existing account (checked against the same bcrypt
+// hash as over Telnet) or with a public key the user has added with /sshkey.
+// Accounts can't be made over SSH -- that's done over Telnet first.
+//
+// Once SSH has let them in, the session's byte stream goes to a doppelganger
+// the same as a Telnet connection's does, already logged in. With a
+// terminal (ssh asks for one unless told not to with -T), it's a person's
+// session: prompt, echo, and chat wrapped to the terminal's width, which we
+// keep up with as the window is resized. There's no Telnet to negotiate.
+// Without a terminal, it's machine mode (see machinemode.go) for good, for
+// bots. Only "shell" is supported, not running commands.
+//
+
+//
+// What an ssh client sends with "pty-req" (RFC 4254 section 6.2), and with
+// "window-change" (section 6.7), which is the same without the first and
+// last fields.
+//
+type sshPtyRequest struct {
+	Term    string
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+	Modes   string
+}
+
+type sshWindowChange struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
+
+type sshHandler struct {
+	chatServer *ChatServer
+}
+
+//
+// One SSH session: the doppelganger's writer, and what it hangs up. The
+// session's goroutine and the doppelganger both use it, hence the mutex.
+//
+type sshSession struct {
+	conn    net.Conn
+	channel ssh.Channel
+	hungUp  chan struct{}
+	hangUp  sync.Once
+	mutex   sync.Mutex
+	//
+	// Set by "pty-req" and "window-change".
+	//
+	hasTerminal   bool
+	terminalType  string
+	terminalWidth int
+	//
+	// For client_write_timeout (see Write).
+	//
+	writeDeadline time.Time
+}
+
+//
+// Loads the host key, or makes one if there isn't one yet, and sets up the
+// SSH server config. Only the first call does anything.
+//
+func (chatServer *ChatServer) loadSSHConfig() error {
+	chatServer.mutex.Lock()
+	defer chatServer.mutex.Unlock()
+	if chatServer.sshConfig != nil {
+		return nil
+	}
+	hostKey, err := loadSSHHostKey(chatServer.config.SSHHostKeyFile, chatServer.logger)
+	if err != nil {
+		return err
+	}
+	sshConfig := new(ssh.ServerConfig)
+	sshConfig.ServerVersion = "SSH-2.0-wtelnet"
+	sshConfig.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		return sshPasswordLogin(chatServer, conn, string(password))
+	}
+	sshConfig.PublicKeyCallback = func(conn ssh.ConnMetadata, publicKey ssh.PublicKey) (*ssh.Permissions, error) {
+		return sshPublicKeyLogin(chatServer, conn, publicKey)
+	}
+	sshConfig.AddHostKey(hostKey)
+	chatServer.sshConfig = sshConfig
+	return nil
+}
+
+//
+// The host key is an ed25519 key in a PEM file (PKCS #8, which ssh-keygen
+// can read too). We make it the first time, so there's nothing to set up,
+// but after that it has to stay the same or every ssh client will complain
+// that the server has changed.
+//
+func loadSSHHostKey(keyFile string, logger *Logger) (ssh.Signer, error) {
+	pemBytes, err := os.ReadFile(keyFile)
+	if err == nil {
+		return ssh.ParsePrivateKey(pemBytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	derBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	pemBytes = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: derBytes})
+	err = os.WriteFile(keyFile, pemBytes, 0600)
+	if err != nil {
+		return nil, err
+	}
+	logger.With("ssh_host_key_file", keyFile).Info("Made a new SSH host key.")
+	return ssh.ParsePrivateKey(pemBytes)
+}
+
+var errSSHLoginFailed = errors.New("login failed")
+
+//
+// The ssh.Permissions that say who logged in, for the session to pick up.
+//
+func sshPermissions(userID int64, userName string) *ssh.Permissions {
+	permissions := new(ssh.Permissions)
+	permissions.Extensions = map[string]string{
+		"user_id":   strconv.FormatInt(userID, 10),
+		"user_name": userName,
+	}
+	return permissions
+}
+
+func sshPasswordLogin(chatServer *ChatServer, conn ssh.ConnMetadata, password string) (*ssh.Permissions, error) {
+	logger := chatServer.logger.With("goroutine", "ssh", "remote_addr", conn.RemoteAddr().String(), "user_name", conn.User())
+	userID, userName, err := login(chatServer.store, conn.User(), password)
+	if err != nil {
+		logger.With("error", err).Error("Looking up user failed.")
+		return nil, errSSHLoginFailed
+	}
+	if userID == 0 {
+		logger.Warn("SSH login failed: no such user or incorrect password.")
+		return nil, errSSHLoginFailed
+	}
+	return sshPermissions(userID, userName), nil
+}
+
+//
+// The ssh client offers its keys one at a time; any one the user has added
+// with /sshkey lets them in.
+//
+func sshPublicKeyLogin(chatServer *ChatServer, conn ssh.ConnMetadata, publicKey ssh.PublicKey) (*ssh.Permissions, error) {
+	logger := chatServer.logger.With("goroutine", "ssh", "remote_addr", conn.RemoteAddr().String(), "user_name", conn.User())
+	userID, userName, _, err := chatServer.store.lookUpUser(conn.User())
+	if err != nil {
+		logger.With("error", err).Error("Looking up user failed.")
+		return nil, errSSHLoginFailed
+	}
+	if userID == 0 {
+		logger.Debug("SSH public key refused: no such user.")
+		return nil, errSSHLoginFailed
+	}
+	keys, err := chatServer.store.listSSHKeys(userID)
+	if err != nil {
+		logger.With("error", err).Error("Listing SSH keys failed.")
+		return nil, errSSHLoginFailed
+	}
+	offered := authorizedKeyString(publicKey)
+	for _, key := range keys {
+		if key == offered {
+			return sshPermissions(userID, userName), nil
+		}
+	}
+	logger.With("fingerprint", ssh.FingerprintSHA256(publicKey)).Debug("SSH public key refused: not one of the user's.")
+	return nil, errSSHLoginFailed
+}
+
+//
+// A public key the way we store it: the authorized_keys line, without the
+// comment.
+//
+func authorizedKeyString(publicKey ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey)))
+}
+
+//
+// One connection. The telnet server (see New) is only doing the connection
+// handling, same as for IRC. SSH allows any number of sessions on a
+// connection; we take the first and turn the rest away.
+//
+func (handler sshHandler) ServeTELNET(ctx telnet.Context, writer telnet.Writer, reader telnet.Reader) {
+	conn := ctx.Conn()
+	if conn == nil {
+		//
+		// Should never happen.
+		//
+		ctx.Logger().Errorf("SSH goroutine: no connection")
+		return
+	}
+	chatServer := handler.chatServer
+	chatServer.mutex.Lock()
+	sshConfig := chatServer.sshConfig
+	chatServer.mutex.Unlock()
+	serverConn, newChannels, requests, err := ssh.NewServerConn(conn, sshConfig)
+	if err != nil {
+		chatServer.logger.With("goroutine", "ssh", "remote_addr", conn.RemoteAddr().String(), "error", err).Debug("SSH handshake failed.")
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(requests)
+	userID, err := strconv.ParseInt(serverConn.Permissions.Extensions["user_id"], 10, 64)
+	if err != nil {
+		//
+		// Should never happen -- our callbacks always set it.
+		//
+		ctx.Logger().Errorf("SSH goroutine: bad user_id from login (connection from %s)", conn.RemoteAddr().String())
+		return
+	}
+	user := User{ID: userID, Name: serverConn.Permissions.Extensions["user_name"]}
+	sessionStarted := false
+	for newChannel := range newChannels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		if sessionStarted {
+			newChannel.Reject(ssh.Prohibited, "only one session per connection")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		sessionStarted = true
+		session := newSSHSession(conn, channel)
+		go func() {
+			session.serve(chatServer, channelRequests, user)
+			serverConn.Close()
+		}()
+	}
+}
+
+func newSSHSession(conn net.Conn, channel ssh.Channel) *sshSession {
+	session := new(sshSession)
+	session.conn = conn
+	session.channel = channel
+	session.hungUp = make(chan struct{})
+	session.hasTerminal = false
+	session.terminalWidth = 0
+	return session
+}
+
+//
+// The session's requests, until the session is over. "shell" starts the
+// doppelganger; everything before it is setting up.
+//
+func (session *sshSession) serve(chatServer *ChatServer, requests <-chan *ssh.Request, user User) {
+	shellStarted := false
+	for request := range requests {
+		switch request.Type {
+		case "pty-req":
+			var ptyRequest sshPtyRequest
+			err := ssh.Unmarshal(request.Payload, &ptyRequest)
+			if (err != nil) || shellStarted {
+				request.Reply(false, nil)
+			} else {
+				session.mutex.Lock()
+				session.hasTerminal = true
+				session.terminalType = ptyRequest.Term
+				session.terminalWidth = int(ptyRequest.Columns)
+				session.mutex.Unlock()
+				request.Reply(true, nil)
+			}
+		case "window-change":
+			var windowChange sshWindowChange
+			err := ssh.Unmarshal(request.Payload, &windowChange)
+			if err == nil {
+				session.mutex.Lock()
+				session.terminalWidth = int(windowChange.Columns)
+				session.mutex.Unlock()
+			}
+			request.Reply(err == nil, nil)
+		case "shell":
+			if shellStarted {
+				request.Reply(false, nil)
+			} else {
+				shellStarted = true
+				request.Reply(true, nil)
+				go session.run(chatServer, user)
+			}
+		default:
+			//
+			// Environment variables, running commands, port forwarding
+			// and so on.
+			//
+			request.Reply(false, nil)
+		}
+	}
+	session.Close()
+}
+
+//
+// The same as the Telnet handler (see servetelnet.go): every byte the user
+// types goes to the doppelganger, and ^C or ^D is the end. The doppelganger
+// can also go away on its own (a plugin refusing the login, say) without
+// reading what we send, so we don't wait on it once it's hung up.
+//
+func (session *sshSession) run(chatServer *ChatServer, user User) {
+	//
+	// NO buffer here, same as for Telnet.
+	//
+	userGoChannel := make(chan byte)
+	session.mutex.Lock()
+	sessionKind := machineSession
+	if session.hasTerminal {
+		sessionKind = terminalSession
+	}
+	session.mutex.Unlock()
+	chatServer.doppelgangers.Add(1)
+	go func() {
+		doppelgangerGoroutine(chatServer, session, session, session.conn.RemoteAddr().String(), userGoChannel, sessionKind, user)
+		session.Close()
+	}()
+	defer close(userGoChannel)
+	buffer := make([]byte, 256)
+	for {
+		numBytes, err := session.channel.Read(buffer)
+		for _, usrByte := range buffer[:numBytes] {
+			select {
+			case userGoChannel <- usrByte:
+			case <-session.hungUp:
+				return
+			}
+			if (usrByte == 3) || (usrByte == 4) { // user typed ^C or ^D
+				//
+				// Same as Telnet, put the ssh client's goodbye on a new
+				// line.
+				//
+				oi.LongWrite(session.channel, []byte("\r\n"))
+				session.Close()
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+//
+// Writes from the doppelganger. Writing to an SSH channel waits for the
+// client to make room, which the deadline on the connection doesn't cover,
+// so if there's a deadline we hang up when it passes instead.
+//
+func (session *sshSession) Write(p []byte) (int, error) {
+	session.mutex.Lock()
+	deadline := session.writeDeadline
+	session.mutex.Unlock()
+	timedOut := false
+	if !deadline.IsZero() {
+		timer := time.AfterFunc(time.Until(deadline), func() {
+			session.mutex.Lock()
+			timedOut = true
+			session.mutex.Unlock()
+			session.conn.Close()
+		})
+		defer timer.Stop()
+	}
+	numBytes, err := session.channel.Write(p)
+	if err != nil {
+		session.mutex.Lock()
+		if timedOut {
+			err = os.ErrDeadlineExceeded
+		}
+		session.mutex.Unlock()
+	}
+	return numBytes, err
+}
+
+//
+// So client_write_timeout works the same as for Telnet connections.
+//
+func (session *sshSession) SetWriteDeadline(t time.Time) error {
+	session.mutex.Lock()
+	session.writeDeadline = t
+	session.mutex.Unlock()
+	return nil
+}
+
+//
+// For wrapping chat (see wrapToTerminal).
+//
+func (session *sshSession) TerminalWidth() int {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.terminalWidth
+}
+
+//
+// For deciding whether the user's terminal can show colors (see
+// colortheme.go). "xterm-256color", say, or "dumb".
+//
+func (session *sshSession) TerminalType() string {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.terminalType
+}
+
+//
+// The doppelganger hanging up, or the session over. The exit status is so
+// the ssh client exits cleanly.
+//
+func (session *sshSession) Close() error {
+	var err error
+	session.hangUp.Do(func() {
+		close(session.hungUp)
+		session.channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+		err = session.channel.Close()
+	})
+	return err
+}
+
+//
+// /sshkey: the public keys that let the user log in over SSH.
+//
+//	/sshkey                 list them (as SSHKEY <number> <type> <fingerprint>
+//	                        in machine mode)
+//	/sshkey add <key>       add one, pasted from the .pub file
+//	/sshkey remove <number> remove one, numbered as in the list
+//
+// Same return values as doCommand.
+//
+func sshKeyCommand(doppelgangerState *userInfo, operand string) (bool, error) {
+	store := doppelgangerState.chatServer.store
+	subcommand := operand
+	argument := ""
+	ii := strings.Index(operand, " ")
+	if ii > 0 {
+		subcommand = operand[:ii]
+		argument = trim(operand[ii:])
+	}
+	switch subcommand {
+	case "", "list":
+		keys, err := store.listSSHKeys(doppelgangerState.userID)
+		if err != nil {
+			doppelgangerState.logger.With("error", err).Error("Listing SSH keys failed.")
+			return true, tellUser(doppelgangerState, "ERR", "\r\nA database error has occurred.\r\n")
+		}
+		if len(keys) == 0 {
+			return true, tellUser(doppelgangerState, "OK", "\r\nYou have no SSH keys. Use /sshkey add <public key> to add one.\r\n")
+		}
+		text := "\r\n"
+		lines := make([]string, 0)
+		for jj, key := range keys {
+			description := "(unreadable)"
+			publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+			if err == nil {
+				description = publicKey.Type() + " " + ssh.FingerprintSHA256(publicKey)
+			}
+			text += strconv.Itoa(jj+1) + ". " + description + "\r\n"
+			lines = append(lines, "SSHKEY "+strconv.Itoa(jj+1)+" "+description)
+		}
+		return true, writeToUser(doppelgangerState, text, strings.Join(lines, "\r\n"))
+	case "add":
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(argument))
+		if err != nil {
+			return true, tellUser(doppelgangerState, "ERR", "\r\nThat's not an SSH public key. Paste the whole line from your .pub file.\r\n")
+		}
+		alreadyHad, err := store.addSSHKey(doppelgangerState.userID, authorizedKeyString(publicKey))
+		if err != nil {
+			doppelgangerState.logger.With("error", err).Error("Adding SSH key failed.")
+			return true, tellUser(doppelgangerState, "ERR", "\r\nA database error has occurred.\r\n")
+		}
+		if alreadyHad {
+			return true, tellUser(doppelgangerState, "ERR", "\r\nYou already have that SSH key.\r\n")
+		}
+		doppelgangerState.logger.With("fingerprint", ssh.FingerprintSHA256(publicKey)).Info("SSH key added.")
+		return true, tellUser(doppelgangerState, "OK", "\r\nSSH key "+ssh.FingerprintSHA256(publicKey)+" added.\r\n")
+	case "remove":
+		keys, err := store.listSSHKeys(doppelgangerState.userID)
+		if err != nil {
+			doppelgangerState.logger.With("error", err).Error("Listing SSH keys failed.")
+			return true, tellUser(doppelgangerState, "ERR", "\r\nA database error has occurred.\r\n")
+		}
+		number, err := strconv.Atoi(argument)
+		if (err != nil) || (number < 1) || (number > len(keys)) {
+			return true, tellUser(doppelgangerState, "ERR", "\r\nUse /sshkey remove <number>, with a number from /sshkey.\r\n")
+		}
+		removed, err := store.removeSSHKey(doppelgangerState.userID, keys[number-1])
+		if err != nil {
+			doppelgangerState.logger.With("error", err).Error("Removing SSH key failed.")
+			return true, tellUser(doppelgangerState, "ERR", "\r\nA database error has occurred.\r\n")
+		}
+		if !removed {
+			//
+			// Removed from another session since we listed them.
+			//
+			return true, tellUser(doppelgangerState, "ERR", "\r\nThat SSH key is already gone.\r\n")
+		}
+		doppelgangerState.logger.Info("SSH key removed.")
+		return true, tellUser(doppelgangerState, "OK", "\r\nSSH key "+strconv.Itoa(number)+" removed.\r\n")
+	}
+	return true, tellUser(doppelgangerState, "ERR", "\r\nUse /sshkey to list your SSH keys, /sshkey add <public key> to add one, or /sshkey remove <number> to remove one.\r\n")
+}
@@ -0,0 +1,175 @@
+package chatserver
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//
+// ssh clients (golang.org/x/crypto/ssh's) and a Telnet user on the same chat
+// channel: logging in with a password and with a key added over Telnet, with
+// a terminal and without one. The ssh client is a testClient too, driven
+// expect-style on what comes out of the session.
+//
+
+//
+// A session's stdin and stdout, as the connection for a testClient.
+//
+type sshTestSession struct {
+	session *ssh.Session
+	stdin   io.Writer
+	stdout  io.Reader
+}
+
+func (conn *sshTestSession) Read(p []byte) (int, error) {
+	return conn.stdout.Read(p)
+}
+
+func (conn *sshTestSession) Write(p []byte) (int, error) {
+	return conn.stdin.Write(p)
+}
+
+func (conn *sshTestSession) Close() error {
+	return conn.session.Close()
+}
+
+//
+// Logs in as userName with auth and starts a shell, with a terminal columns
+// wide (or none if columns is 0).
+//
+func (server *testServer) dialSSH(listener net.Listener, userName string, auth ssh.AuthMethod, columns int) (*testClient, error) {
+	sshConfig := new(ssh.ClientConfig)
+	sshConfig.User = userName
+	sshConfig.Auth = []ssh.AuthMethod{auth}
+	sshConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	sshConfig.Timeout = testTimeout
+	client, err := ssh.Dial("tcp", listener.Addr().String(), sshConfig)
+	if err != nil {
+		return nil, err
+	}
+	server.t.Cleanup(func() {
+		client.Close()
+	})
+	session, err := client.NewSession()
+	if err != nil {
+		server.t.Fatal(err)
+	}
+	if columns > 0 {
+		err = session.RequestPty("xterm", 24, columns, ssh.TerminalModes{})
+		if err != nil {
+			server.t.Fatal(err)
+		}
+	}
+	conn := new(sshTestSession)
+	conn.session = session
+	conn.stdin, err = session.StdinPipe()
+	if err != nil {
+		server.t.Fatal(err)
+	}
+	conn.stdout, err = session.StdoutPipe()
+	if err != nil {
+		server.t.Fatal(err)
+	}
+	err = session.Shell()
+	if err != nil {
+		server.t.Fatal(err)
+	}
+	return server.startClient(userName+" over ssh", conn, 4096), nil
+}
+
+func TestSSHListener(t *testing.T) {
+	hostKeyFile := filepath.Join(t.TempDir(), "ssh_host_ed25519_key")
+	server := startTestServer(t, func(config *Config) {
+		config.SSHHostKeyFile = hostKeyFile
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.chatServer.ServeSSH(listener)
+	alice := server.logIn("alice", "secret")
+	alice.send("/create lounge")
+	alice.expect(`created\.`)
+	alice.send("/join lounge")
+	alice.expect(`You have joined #lounge`)
+	bob := server.logIn("bob", "secret")
+	//
+	// Accounts aren't made over SSH, and wrong passwords don't get in.
+	//
+	_, err = server.dialSSH(listener, "nobody", ssh.Password("secret"), 40)
+	if err == nil {
+		t.Fatal("logged in over SSH as a user who doesn't exist")
+	}
+	_, err = server.dialSSH(listener, "bob", ssh.Password("wrong"), 40)
+	if err == nil {
+		t.Fatal("logged in over SSH with the wrong password")
+	}
+	//
+	// A password, and a terminal 40 columns wide that chat is wrapped to.
+	//
+	terminal, err := server.dialSSH(listener, "bob", ssh.Password("secret"), 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	terminal.expect(`You are logged in\.`)
+	terminal.send("/join lounge")
+	terminal.expect(`You have joined #lounge`)
+	alice.send("the quick brown fox jumps over the lazy dog again and again")
+	terminal.expect(`alice says, "the quick brown fox jumps\r\nover the lazy dog again and again"\r\n`)
+	err = terminal.conn.(*sshTestSession).session.WindowChange(24, 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	terminal.send("/who")
+	terminal.expect(`alice`)
+	terminal.send("hi from ssh")
+	alice.expect(`bob says, "hi from ssh"`)
+	alice.send("the quick brown fox jumps over the lazy dog again and again")
+	terminal.expect(`alice says, "the quick brown fox jumps over the lazy dog again and again"\r\n`)
+	terminal.send("\x04")
+	alice.expect(`bob has left #lounge`)
+	//
+	// A key, added over Telnet, and no terminal: machine mode.
+	//
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.dialSSH(listener, "bob", ssh.PublicKeys(signer), 0)
+	if err == nil {
+		t.Fatal("logged in over SSH with a key that hasn't been added")
+	}
+	bob.send("/sshkey add " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))) + " bob@laptop")
+	bob.expect(`SSH key SHA256:\S+ added\.`)
+	bob.send("/sshkey")
+	bob.expect(`1\. ssh-ed25519 SHA256:\S+\r\n`)
+	bot, err := server.dialSSH(listener, "bob", ssh.PublicKeys(signer), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot.expect("OK You are logged in\\. Use /help for help with commands\\.\r\n")
+	bot.send("/sshkey")
+	bot.expect("^SSHKEY 1 ssh-ed25519 SHA256:\\S+\r\n")
+	bot.send("/join lounge")
+	bot.expect("^JOIN #lounge bob\r\nWHO #lounge (alice bob|bob alice)\r\n")
+	alice.send("hello")
+	bot.expect("^MSG #lounge alice hello\r\n")
+	bot.send("hi from a bot")
+	alice.expect(`bob says, "hi from a bot"`)
+	bob.send("/sshkey remove 1")
+	bob.expect(`SSH key 1 removed\.`)
+	_, err = server.dialSSH(listener, "bob", ssh.PublicKeys(signer), 0)
+	if err == nil {
+		t.Fatal("logged in over SSH with a key that has been removed")
+	}
+}
@@ -0,0 +1,370 @@
+package chatserver
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// The stall watchdog. The design (see "Deadlocks" in the README) relies on
+// buffered go channels to break the cycles between doppelgangers, chat
+// channels and the channel master, but a send on a full buffer still blocks
+// until somebody takes something off it -- forever, if that somebody is
+// itself blocked sending back to us. When that happens in production, the
+// symptom is just "everything froze", with nothing in the log.
+//
+// So every send between our goroutines (and every write to a client) goes
+// through a stallWatch belonging to the sending goroutine. If the send can go
+// through right away, which is nearly always, that's all that happens. If it
+// would block, the stallWatch records what we're blocked on (the "edge",
+// e.g. chat channel -> doppelganger, and the ID of the other end) and since
+// when, and clears it once the send goes through. The watchdog goroutine
+// looks at every stallWatch a few times per threshold and logs any goroutine
+// that's been blocked longer than the threshold, and logs again when it gets
+// unstuck. It can also dump every goroutine's stack to a file, which is what
+// you need to figure out the cycle.
+//
+// This is the one place where goroutines share state other than by sending
+// messages: the stallWatch fields are written by their owner and read by the
+// watchdog, so they're atomics, and the list of stallWatches has a mutex. The
+// watchdog can't ask the goroutines how they're doing, because the ones it
+// cares about are stuck.
+//
+
+const (
+	stallEdgeChannelMasterToDoppelganger = iota + 1
+	stallEdgeChannelMasterToChatChannel
+	stallEdgeChatChannelToDoppelganger
+	stallEdgeChatChannelToChannelMaster
+	stallEdgeDoppelgangerToChannelMaster
+	stallEdgeDoppelgangerToChatChannel
+	stallEdgeDoppelgangerToClient
+	stallEdgeChannelMasterToShard
+	stallEdgeClusterPeerToDoppelganger
+	stallEdgeToClusterConnection
+	stallEdgeClusterLinkToMember
+)
+
+var stallEdgeNames = map[int32]string{
+	stallEdgeChannelMasterToDoppelganger: "channel_master->doppelganger",
+	stallEdgeChannelMasterToChatChannel:  "channel_master->chat_channel",
+	stallEdgeChatChannelToDoppelganger:   "chat_channel->doppelganger",
+	stallEdgeChatChannelToChannelMaster:  "chat_channel->channel_master",
+	stallEdgeDoppelgangerToChannelMaster: "doppelganger->channel_master",
+	stallEdgeDoppelgangerToChatChannel:   "doppelganger->chat_channel",
+	stallEdgeDoppelgangerToClient:        "doppelganger->client",
+	stallEdgeChannelMasterToShard:        "channel_master->shard",
+	stallEdgeClusterPeerToDoppelganger:   "cluster_peer->doppelganger",
+	stallEdgeToClusterConnection:         "cluster->connection",
+	stallEdgeClusterLinkToMember:         "cluster_link->cluster_member",
+}
+
+//
+// We don't dump stacks more often than this, however many goroutines get
+// stuck -- one stuck goroutine usually means a pile of others stuck behind
+// it, and one dump shows all of them.
+//
+const stallStackDumpInterval = 1 * time.Minute
+
+type stallWatch struct {
+	logger       *Logger
+	edge         int32
+	toID         int64
+	blockedSince int64 // UnixNano; 0 when not blocked
+}
+
+type stallWatchdog struct {
+	mutex   sync.Mutex
+	watches map[*stallWatch]bool
+}
+
+func newStallWatchdog() *stallWatchdog {
+	return &stallWatchdog{watches: make(map[*stallWatch]bool)}
+}
+
+//
+// Every goroutine that sends to another one gets a stallWatch when it starts
+// and gives it back with unwatch when it exits. The logger says who it is.
+//
+func (watchdog *stallWatchdog) watch(logger *Logger) *stallWatch {
+	watch := &stallWatch{logger: logger}
+	watchdog.mutex.Lock()
+	defer watchdog.mutex.Unlock()
+	watchdog.watches[watch] = true
+	return watch
+}
+
+func (watchdog *stallWatchdog) unwatch(watch *stallWatch) {
+	watchdog.mutex.Lock()
+	defer watchdog.mutex.Unlock()
+	delete(watchdog.watches, watch)
+}
+
+func (watchdog *stallWatchdog) allWatches() []*stallWatch {
+	watchdog.mutex.Lock()
+	defer watchdog.mutex.Unlock()
+	watches := make([]*stallWatch, 0, len(watchdog.watches))
+	for watch := range watchdog.watches {
+		watches = append(watches, watch)
+	}
+	return watches
+}
+
+//
+// The doppelganger changes its logger when the user logs in; this keeps the
+// stallWatch's in step. The watchdog could be reading the logger at the same
+// time, hence the lock.
+//
+func (watchdog *stallWatchdog) relabel(watch *stallWatch, logger *Logger) {
+	watchdog.mutex.Lock()
+	defer watchdog.mutex.Unlock()
+	watch.logger = logger
+}
+
+func (watch *stallWatch) blocked(edge int32, toID int64) {
+	atomic.StoreInt32(&watch.edge, edge)
+	atomic.StoreInt64(&watch.toID, toID)
+	atomic.StoreInt64(&watch.blockedSince, time.Now().UnixNano())
+}
+
+func (watch *stallWatch) unblocked() {
+	atomic.StoreInt64(&watch.blockedSince, 0)
+}
+
+//
+// Sends, one per kind of go channel. Each tries the send without blocking
+// first, and only if that fails marks us blocked and waits.
+//
+
+func (watch *stallWatch) sendFromChannelMasterToDoppelganger(callback chan messageFromChannelMasterToDoppelganger, theMessage messageFromChannelMasterToDoppelganger, doppelgangerID int64) {
+	select {
+	case callback <- theMessage:
+		return
+	default:
+	}
+	watch.blocked(stallEdgeChannelMasterToDoppelganger, doppelgangerID)
+	callback <- theMessage
+	watch.unblocked()
+}
+
+func (watch *stallWatch) sendFromChannelMasterToChatChannel(callback chan messageFromChannelMasterToChatChannel, theMessage messageFromChannelMasterToChatChannel, chatChannelID int64) {
+	select {
+	case callback <- theMessage:
+		return
+	default:
+	}
+	watch.blocked(stallEdgeChannelMasterToChatChannel, chatChannelID)
+	callback <- theMessage
+	watch.unblocked()
+}
+
+func (watch *stallWatch) sendFromChannelMasterToShard(callback chan messageFromChannelMasterToShard, theMessage messageFromChannelMasterToShard, shardIndex int) {
+	select {
+	case callback <- theMessage:
+		return
+	default:
+	}
+	watch.blocked(stallEdgeChannelMasterToShard, int64(shardIndex))
+	callback <- theMessage
+	watch.unblocked()
+}
+
+func (watch *stallWatch) sendFromChatChannelToDoppelganger(callback chan messageFromChatChannelToDoppelganger, theMessage messageFromChatChannelToDoppelganger, doppelgangerID int64) {
+	select {
+	case callback <- theMessage:
+		return
+	default:
+	}
+	watch.blocked(stallEdgeChatChannelToDoppelganger, doppelgangerID)
+	callback <- theMessage
+	watch.unblocked()
+}
+
+func (watch *stallWatch) sendFromChatChannelToChannelMaster(callback chan messageFromChatChannelToChannelMaster, theMessage messageFromChatChannelToChannelMaster) {
+	select {
+	case callback <- theMessage:
+		return
+	default:
+	}
+	watch.blocked(stallEdgeChatChannelToChannelMaster, 0)
+	callback <- theMessage
+	watch.unblocked()
+}
+
+func (watch *stallWatch) sendFromDoppelgangerToChannelMaster(callback chan messageFromDoppelgangerToChannelMaster, theMessage messageFromDoppelgangerToChannelMaster) {
+	select {
+	case callback <- theMessage:
+		return
+	default:
+	}
+	watch.blocked(stallEdgeDoppelgangerToChannelMaster, 0)
+	callback <- theMessage
+	watch.unblocked()
+}
+
+func (watch *stallWatch) sendFromDoppelgangerToChatChannel(callback chan messageFromDoppelgangerToChatChannel, theMessage messageFromDoppelgangerToChatChannel, chatChannelID int64) {
+	select {
+	case callback <- theMessage:
+		return
+	default:
+	}
+	watch.blocked(stallEdgeDoppelgangerToChatChannel, chatChannelID)
+	callback <- theMessage
+	watch.unblocked()
+}
+
+//
+// The cluster's (see cluster.go). A clusterPeer goroutine answers
+// doppelgangers on whichever of their go channels the shard or the chat
+// channel would have used, hence two helpers for the one edge. Sends to a
+// cluster connection only wait on the connection's writer, which never
+// stops taking frames, so they're only ever slow, not stuck; but slow is
+// worth knowing about too.
+//
+
+func (watch *stallWatch) sendFromClusterPeerToDoppelganger(callback chan messageFromChannelMasterToDoppelganger, theMessage messageFromChannelMasterToDoppelganger, doppelgangerID int64) {
+	select {
+	case callback <- theMessage:
+		return
+	default:
+	}
+	watch.blocked(stallEdgeClusterPeerToDoppelganger, doppelgangerID)
+	callback <- theMessage
+	watch.unblocked()
+}
+
+func (watch *stallWatch) sendFromClusterPeerToChatChannelCallback(callback chan messageFromChatChannelToDoppelganger, theMessage messageFromChatChannelToDoppelganger, doppelgangerID int64) {
+	select {
+	case callback <- theMessage:
+		return
+	default:
+	}
+	watch.blocked(stallEdgeClusterPeerToDoppelganger, doppelgangerID)
+	callback <- theMessage
+	watch.unblocked()
+}
+
+func (watch *stallWatch) sendToClusterConnection(outgoing chan clusterFrame, frame clusterFrame) {
+	select {
+	case outgoing <- frame:
+		return
+	default:
+	}
+	watch.blocked(stallEdgeToClusterConnection, frame.Session)
+	outgoing <- frame
+	watch.unblocked()
+}
+
+func (watch *stallWatch) sendFromClusterLinkToMember(memberGoChan chan clusterFrame, frame clusterFrame, session int64) {
+	select {
+	case memberGoChan <- frame:
+		return
+	default:
+	}
+	watch.blocked(stallEdgeClusterLinkToMember, session)
+	memberGoChan <- frame
+	watch.unblocked()
+}
+
+//
+// DO IT
+// Goroutine for the stall watchdog. Only started if stall_threshold_seconds
+// isn't 0. If stackDumpDir isn't empty, stacks are dumped there. Exits when
+// stop is closed (by ChatServer.Shutdown).
+//
+func stallWatchdogGoroutine(watchdog *stallWatchdog, threshold time.Duration, stackDumpDir string, logger *Logger, stop chan struct{}) {
+	logger = logger.With("goroutine", "stall_watchdog")
+	//
+	// Maps each stallWatch we've logged as stuck to the blockedSince we
+	// logged, so we log each stall once, and log again when it's over.
+	//
+	reported := make(map[*stallWatch]int64)
+	var lastDump time.Time
+	ticker := time.NewTicker(threshold / 4)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-stop:
+			return
+		case now = <-ticker.C:
+		}
+		watches := watchdog.allWatches()
+		stillWatched := make(map[*stallWatch]bool, len(watches))
+		newStalls := 0
+		for _, watch := range watches {
+			stillWatched[watch] = true
+			blockedSince := atomic.LoadInt64(&watch.blockedSince)
+			reportedSince, wasReported := reported[watch]
+			if wasReported && (blockedSince != reportedSince) {
+				watchdog.mutex.Lock()
+				watch.logger.With("stalled_for", time.Duration(now.UnixNano()-reportedSince).Round(time.Millisecond).String()).Info("No longer stalled.")
+				watchdog.mutex.Unlock()
+				delete(reported, watch)
+				wasReported = false
+			}
+			if (blockedSince == 0) || wasReported {
+				continue
+			}
+			blockedFor := time.Duration(now.UnixNano() - blockedSince)
+			if blockedFor < threshold {
+				continue
+			}
+			edge := atomic.LoadInt32(&watch.edge)
+			fields := []interface{}{"edge", stallEdgeNames[edge], "blocked_for", blockedFor.Round(time.Millisecond).String()}
+			toID := atomic.LoadInt64(&watch.toID)
+			if toID != 0 {
+				fields = append(fields, "to_id", toID)
+			}
+			watchdog.mutex.Lock()
+			watch.logger.With(fields...).Warn("Stalled: blocked sending.")
+			watchdog.mutex.Unlock()
+			reported[watch] = blockedSince
+			newStalls++
+		}
+		//
+		// Forget goroutines that have exited since we reported them.
+		//
+		for watch := range reported {
+			if !stillWatched[watch] {
+				delete(reported, watch)
+			}
+		}
+		if (newStalls > 0) && (stackDumpDir != "") && (now.Sub(lastDump) >= stallStackDumpInterval) {
+			lastDump = now
+			path, err := dumpGoroutineStacks(stackDumpDir, now)
+			if err != nil {
+				logger.With("error", err).Error("Could not dump goroutine stacks.")
+			} else {
+				logger.With("file", path, "stalled", len(reported)).Warn("Dumped goroutine stacks.")
+			}
+		}
+	}
+}
+
+//
+// Writes every goroutine's stack to a new file in dir and returns its path.
+// runtime.Stack wants a buffer big enough up front, so we keep doubling it
+// until the stacks fit.
+//
+func dumpGoroutineStacks(dir string, now time.Time) (string, error) {
+	buffer := make([]byte, 1<<20)
+	for {
+		size := runtime.Stack(buffer, true)
+		if size < len(buffer) {
+			buffer = buffer[:size]
+			break
+		}
+		buffer = make([]byte, 2*len(buffer))
+	}
+	path := filepath.Join(dir, "wtelnet-stacks-"+now.Format("20060102T150405.000")+".txt")
+	err := ioutil.WriteFile(path, buffer, 0644)
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,68 @@
+package chatserver
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+// A send that blocks on a full go channel for longer than the threshold is
+// logged as a stall, with a stack dump, and logged again once it goes
+// through.
+//
+func TestStallWatchdog(t *testing.T) {
+	const threshold = 40 * time.Millisecond
+	out := new(testLog)
+	logger := NewLogger(out)
+	dir := t.TempDir()
+	watchdog := newStallWatchdog()
+	stop := make(chan struct{})
+	watchdogDone := make(chan bool)
+	go func() {
+		stallWatchdogGoroutine(watchdog, threshold, dir, logger, stop)
+		close(watchdogDone)
+	}()
+	defer func() {
+		close(stop)
+		<-watchdogDone
+	}()
+	watch := watchdog.watch(logger.With("goroutine", "stuck"))
+	defer watchdog.unwatch(watch)
+	full := make(chan messageFromChannelMasterToDoppelganger, 1)
+	full <- messageFromChannelMasterToDoppelganger{}
+	sent := make(chan bool)
+	go func() {
+		watch.sendFromChannelMasterToDoppelganger(full, messageFromChannelMasterToDoppelganger{}, 42)
+		close(sent)
+	}()
+	waitForLog(t, out, `msg="Stalled: blocked sending." goroutine=stuck edge=channel_master->doppelganger`)
+	waitForLog(t, out, `msg="Dumped goroutine stacks."`)
+	<-full
+	<-sent
+	waitForLog(t, out, `msg="No longer stalled." goroutine=stuck`)
+	if !strings.Contains(out.String(), "to_id=42") {
+		t.Errorf("stall logged without the other end's ID:\n%s", out.String())
+	}
+	files, err := ioutil.ReadDir(dir)
+	if (err != nil) || (len(files) != 1) || !strings.HasPrefix(files[0].Name(), "wtelnet-stacks-") {
+		t.Fatalf("stack dump directory: %v, %v", files, err)
+	}
+	stacks, err := ioutil.ReadFile(filepath.Join(dir, files[0].Name()))
+	if (err != nil) || !strings.Contains(string(stacks), "sendFromChannelMasterToDoppelganger") {
+		t.Errorf("stack dump doesn't have the stuck send in it: %v", err)
+	}
+}
+
+func waitForLog(t *testing.T, out *testLog, wanted string) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !strings.Contains(out.String(), wanted) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %q in the log:\n%s", wanted, out.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
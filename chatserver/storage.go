@@ -0,0 +1,96 @@
+package chatserver
+
+//
+// Everything the server keeps that outlives a connection goes through a
+// storage: user accounts, chat channels, and the messages on each chat
+// channel (the conversation logs). ChatServer.store is the one the server
+// uses -- the SQLite database plus a log file per chat channel
+// (sqlitestorage.go). memoryStorage (memorystorage.go) keeps it all in
+// memory, for tests.
+//
+// Every doppelganger and every chat channel goroutine uses the storage, all
+// at the same time, so a storage has to be safe for that. A conversation
+// log is only ever used by the chat channel goroutine that opened it.
+//
+// The storage just stores things: it doesn't know about passwords (it gets
+// and gives back the bcrypt hash), or what the server does when a chat
+// channel doesn't exist.
+//
+
+type storage interface {
+	//
+	// Returns the user ID, the user name as stored (which is the
+	// authoritative spelling of it) and the password hash. The user ID is
+	// 0 if there's no user by that name.
+	//
+	lookUpUser(userName string) (int64, string, string, error)
+	//
+	// Adds the user, or if there already is one by that name, gives them
+	// the new password hash.
+	//
+	saveUser(userName string, passwordHash string) error
+	//
+	// Adds the chat channel. The boolean return value indicates if the
+	// channel already existed, which isn't an error.
+	//
+	saveChatChannel(chatChannelName string) (bool, error)
+	//
+	// Returns 0 if there's no chat channel by that name.
+	//
+	lookUpChatChannel(chatChannelName string) (int64, error)
+	//
+	// All the chat channel names, in order.
+	//
+	listChatChannels() ([]string, error)
+	//
+	// The user's SSH public keys (see sshlistener.go), in the order they
+	// were added, each in authorized_keys form without the comment.
+	//
+	listSSHKeys(userID int64) ([]string, error)
+	//
+	// Adds an SSH public key to the user's. The boolean return value
+	// indicates if they already had it, which isn't an error.
+	//
+	addSSHKey(userID int64, publicKey string) (bool, error)
+	//
+	// Takes an SSH public key away from the user. The boolean return value
+	// indicates if they had it.
+	//
+	removeSSHKey(userID int64, publicKey string) (bool, error)
+	//
+	// The hashes of the user's API tokens (see apiserver.go), in the order
+	// they were made. The tokens themselves are never stored.
+	//
+	listAPITokens(userID int64) ([]string, error)
+	addAPIToken(userID int64, tokenHash string) error
+	//
+	// Takes an API token away from the user. The boolean return value
+	// indicates if they had it.
+	//
+	removeAPIToken(userID int64, tokenHash string) (bool, error)
+	//
+	// Whose API token it is: the user ID and user name, or 0 and "" if it
+	// isn't anybody's.
+	//
+	lookUpAPIToken(tokenHash string) (int64, string, error)
+	//
+	// The user's preferences (see colortheme.go), by name. Preferences
+	// they've never set aren't in it.
+	//
+	loadUserPrefs(userID int64) (map[string]string, error)
+	//
+	// Sets one of the user's preferences, replacing what it was.
+	//
+	saveUserPref(userID int64, name string, value string) error
+	//
+	// Opens the conversation log for a chat channel, creating it if it
+	// isn't there yet, so messages are added to the end of it.
+	//
+	openConversationLog(logDir string, chatChannelName string) (conversationLog, error)
+	close() error
+}
+
+type conversationLog interface {
+	appendMessage(message string) error
+	close() error
+}
@@ -0,0 +1,267 @@
+package chatserver
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//
+// The same checks against every storage, so the in-memory one the tests use
+// behaves like the SQLite one the server uses.
+//
+
+func TestStorage(t *testing.T) {
+	logger := newStructuredLogger(ioutil.Discard, logLevelError, "logfmt")
+	t.Run("sqlite", func(t *testing.T) {
+		dir := t.TempDir()
+		config := DefaultConfig()
+		config.DatabasePath = filepath.Join(dir, "test.db")
+		store, err := openSQLiteStorage(config, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.close()
+		checkStorage(t, store, dir)
+		log, err := ioutil.ReadFile(conversationLogPath(dir, "lobby"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(log) != "hello\nagain\n" {
+			t.Errorf("conversation log file is %q", log)
+		}
+	})
+	t.Run("memory", func(t *testing.T) {
+		store := newMemoryStorage()
+		defer store.close()
+		checkStorage(t, store, "")
+		if got := store.conversation("lobby"); !reflect.DeepEqual(got, []string{"hello\n", "again\n"}) {
+			t.Errorf("conversation is %q", got)
+		}
+	})
+}
+
+func checkStorage(t *testing.T, store storage, logDir string) {
+	userID, _, _, err := store.lookUpUser("alice")
+	if err != nil || userID != 0 {
+		t.Fatalf("lookUpUser before saveUser: %d, %v", userID, err)
+	}
+	for _, userName := range []string{"alice", "bob"} {
+		err = store.saveUser(userName, "hash-"+userName)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	aliceID, userName, passwordHash, err := store.lookUpUser("alice")
+	if err != nil || aliceID == 0 || userName != "alice" || passwordHash != "hash-alice" {
+		t.Fatalf("lookUpUser: %d, %q, %q, %v", aliceID, userName, passwordHash, err)
+	}
+	bobID, _, _, err := store.lookUpUser("bob")
+	if err != nil || bobID == 0 || bobID == aliceID {
+		t.Fatalf("lookUpUser for a second user: %d (first %d), %v", bobID, aliceID, err)
+	}
+	//
+	// Saving a user that's already there changes the password, not the ID.
+	//
+	err = store.saveUser("alice", "new-hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, _, passwordHash, err = store.lookUpUser("alice")
+	if err != nil || userID != aliceID || passwordHash != "new-hash" {
+		t.Fatalf("lookUpUser after a new password: %d (was %d), %q, %v", userID, aliceID, passwordHash, err)
+	}
+
+	chatChannelID, err := store.lookUpChatChannel("lobby")
+	if err != nil || chatChannelID != 0 {
+		t.Fatalf("lookUpChatChannel before saveChatChannel: %d, %v", chatChannelID, err)
+	}
+	for _, chatChannelName := range []string{"lobby", "games", "news"} {
+		alreadyExisted, err := store.saveChatChannel(chatChannelName)
+		if err != nil || alreadyExisted {
+			t.Fatalf("saveChatChannel(%q): %v, %v", chatChannelName, alreadyExisted, err)
+		}
+	}
+	alreadyExisted, err := store.saveChatChannel("lobby")
+	if err != nil || !alreadyExisted {
+		t.Fatalf("saveChatChannel twice: %v, %v", alreadyExisted, err)
+	}
+	lobbyID, err := store.lookUpChatChannel("lobby")
+	if err != nil || lobbyID == 0 {
+		t.Fatalf("lookUpChatChannel: %d, %v", lobbyID, err)
+	}
+	gamesID, err := store.lookUpChatChannel("games")
+	if err != nil || gamesID == 0 || gamesID == lobbyID {
+		t.Fatalf("lookUpChatChannel for a second chat channel: %d (first %d), %v", gamesID, lobbyID, err)
+	}
+	chatChanList, err := store.listChatChannels()
+	if err != nil || strings.Join(chatChanList, ",") != "games,lobby,news" {
+		t.Fatalf("listChatChannels: %q, %v", chatChanList, err)
+	}
+
+	for _, publicKey := range []string{"ssh-ed25519 AAAA1", "ssh-ed25519 AAAA2", "ssh-ed25519 AAAA1"} {
+		_, err = store.addSSHKey(aliceID, publicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	alreadyHad, err := store.addSSHKey(aliceID, "ssh-ed25519 AAAA2")
+	if err != nil || !alreadyHad {
+		t.Fatalf("addSSHKey twice: %v, %v", alreadyHad, err)
+	}
+	publicKeys, err := store.listSSHKeys(aliceID)
+	if err != nil || strings.Join(publicKeys, ",") != "ssh-ed25519 AAAA1,ssh-ed25519 AAAA2" {
+		t.Fatalf("listSSHKeys: %q, %v", publicKeys, err)
+	}
+	publicKeys, err = store.listSSHKeys(bobID)
+	if err != nil || len(publicKeys) != 0 {
+		t.Fatalf("listSSHKeys for another user: %q, %v", publicKeys, err)
+	}
+	removed, err := store.removeSSHKey(aliceID, "ssh-ed25519 AAAA1")
+	if err != nil || !removed {
+		t.Fatalf("removeSSHKey: %v, %v", removed, err)
+	}
+	removed, err = store.removeSSHKey(bobID, "ssh-ed25519 AAAA2")
+	if err != nil || removed {
+		t.Fatalf("removeSSHKey for another user's key: %v, %v", removed, err)
+	}
+	publicKeys, err = store.listSSHKeys(aliceID)
+	if err != nil || strings.Join(publicKeys, ",") != "ssh-ed25519 AAAA2" {
+		t.Fatalf("listSSHKeys after removeSSHKey: %q, %v", publicKeys, err)
+	}
+
+	userID, userName, err = store.lookUpAPIToken("hash1")
+	if err != nil || userID != 0 || userName != "" {
+		t.Fatalf("lookUpAPIToken before addAPIToken: %d, %q, %v", userID, userName, err)
+	}
+	for _, tokenHash := range []string{"hash1", "hash2"} {
+		err = store.addAPIToken(aliceID, tokenHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	userID, userName, err = store.lookUpAPIToken("hash2")
+	if err != nil || userID != aliceID || userName != "alice" {
+		t.Fatalf("lookUpAPIToken: %d, %q, %v", userID, userName, err)
+	}
+	tokenHashes, err := store.listAPITokens(aliceID)
+	if err != nil || strings.Join(tokenHashes, ",") != "hash1,hash2" {
+		t.Fatalf("listAPITokens: %q, %v", tokenHashes, err)
+	}
+	removed, err = store.removeAPIToken(bobID, "hash1")
+	if err != nil || removed {
+		t.Fatalf("removeAPIToken for another user's token: %v, %v", removed, err)
+	}
+	removed, err = store.removeAPIToken(aliceID, "hash1")
+	if err != nil || !removed {
+		t.Fatalf("removeAPIToken: %v, %v", removed, err)
+	}
+	userID, _, err = store.lookUpAPIToken("hash1")
+	if err != nil || userID != 0 {
+		t.Fatalf("lookUpAPIToken after removeAPIToken: %d, %v", userID, err)
+	}
+
+	prefs, err := store.loadUserPrefs(aliceID)
+	if err != nil || len(prefs) != 0 {
+		t.Fatalf("loadUserPrefs before saveUserPref: %v, %v", prefs, err)
+	}
+	for _, pref := range [][2]string{{"color", "on"}, {"theme", "light"}, {"theme", "dark"}} {
+		err = store.saveUserPref(aliceID, pref[0], pref[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	prefs, err = store.loadUserPrefs(aliceID)
+	if err != nil || len(prefs) != 2 || prefs["color"] != "on" || prefs["theme"] != "dark" {
+		t.Fatalf("loadUserPrefs: %v, %v", prefs, err)
+	}
+	prefs, err = store.loadUserPrefs(bobID)
+	if err != nil || len(prefs) != 0 {
+		t.Fatalf("loadUserPrefs for another user: %v, %v", prefs, err)
+	}
+
+	for _, message := range []string{"hello\n", "again\n"} {
+		convoLog, err := store.openConversationLog(logDir, "lobby")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = convoLog.appendMessage(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = convoLog.close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+//
+// A database from before there were migrations (the tables, but no
+// schema_version) keeps its users, and is at the latest version afterwards.
+// Opening it again changes nothing, and a database from a newer server
+// isn't touched.
+//
+func TestMigrateDatabase(t *testing.T) {
+	logger := newStructuredLogger(ioutil.Discard, logLevelError, "logfmt")
+	config := DefaultConfig()
+	config.DatabasePath = filepath.Join(t.TempDir(), "old.db")
+	db, err := sql.Open("sqlite3", config.DatabasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{
+		"CREATE TABLE user (userid INTEGER PRIMARY KEY AUTOINCREMENT, username VARCHAR(255) NOT NULL UNIQUE, password VARCHAR(255) NOT NULL);",
+		"CREATE INDEX idx_usr_nm ON user (username);",
+		"CREATE TABLE channel (channelid INTEGER PRIMARY KEY AUTOINCREMENT, channelname VARCHAR(255) NOT NULL UNIQUE);",
+		"CREATE INDEX idx_chan ON channel (channelname);",
+		"INSERT INTO user (username, password) VALUES ('alice', 'hash');",
+	} {
+		_, err = db.Exec(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	latestVersion := schemaMigrations[len(schemaMigrations)-1].version
+	for ii := 0; ii < 2; ii++ {
+		store, err := openSQLiteStorage(config, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		userID, _, passwordHash, err := store.lookUpUser("alice")
+		if err != nil || userID != 1 || passwordHash != "hash" {
+			t.Errorf("lookUpUser after migrating: %d, %q, %v", userID, passwordHash, err)
+		}
+		var version, rows int
+		err = store.db.QueryRow("SELECT MAX(version), COUNT(*) FROM schema_version;").Scan(&version, &rows)
+		if err != nil || version != latestVersion || rows != len(schemaMigrations) {
+			t.Errorf("schema_version has %d rows up to version %d (want %d up to %d), %v", rows, version, len(schemaMigrations), latestVersion, err)
+		}
+		var journalMode string
+		err = store.db.QueryRow("PRAGMA journal_mode;").Scan(&journalMode)
+		if err != nil || journalMode != "wal" {
+			t.Errorf("journal mode %q, %v", journalMode, err)
+		}
+		store.close()
+	}
+
+	db, err = sql.Open("sqlite3", config.DatabasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO schema_version (version, description, applied) VALUES (?, 'from the future', '');", latestVersion+1)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := openSQLiteStorage(config, logger)
+	if err == nil {
+		store.close()
+		t.Fatal("opened a database with a newer schema version")
+	}
+}
@@ -0,0 +1,55 @@
+package chatserver
+
+import (
+	"strings"
+	"time"
+)
+
+//
+// An example plugin (see plugin.go): a bot that answers "!time" with the
+// server's time and "!uptime" with how long the server has been up, on
+// whatever chat channel it was asked on. Turn it on with
+// "plugins": ["timebot"] in the config file, or -plugin timebot.
+//
+
+type timeBot struct {
+	BasePlugin
+	started time.Time
+}
+
+//
+// Uptime counts from when the bot is made, which is when the server starts.
+//
+func NewTimeBot() Plugin {
+	bot := new(timeBot)
+	bot.started = time.Now()
+	return bot
+}
+
+func (bot *timeBot) OnMessage(message *Message) {
+	switch strings.ToLower(trim(message.Said)) {
+	case "!time":
+		message.Replies = append(message.Replies, `timebot says, "It's `+time.Now().Format("15:04:05 MST, Monday January 2 2006")+`."`)
+	case "!uptime":
+		message.Replies = append(message.Replies, `timebot says, "The server has been up for `+formatUptime(time.Since(bot.started))+`."`)
+	}
+}
+
+func formatUptime(uptime time.Duration) string {
+	seconds := int(uptime / time.Second)
+	days := seconds / 86400
+	hours := (seconds / 3600) % 24
+	minutes := (seconds / 60) % 60
+	seconds = seconds % 60
+	result := ""
+	if days > 0 {
+		result = intToStr(days) + "d "
+	}
+	if (days > 0) || (hours > 0) {
+		result += intToStr(hours) + "h "
+	}
+	if (days > 0) || (hours > 0) || (minutes > 0) {
+		result += intToStr(minutes) + "m "
+	}
+	return result + intToStr(seconds) + "s"
+}
@@ -0,0 +1,424 @@
+package chatserver
+
+import (
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// The web gateway: chat for people who won't install a Telnet client. It's
+// plain HTTP, with server-sent events for what the server says, so it needs
+// nothing but the standard library on our end and nothing but a browser on
+// theirs:
+//
+//	GET /        the chat client (webclient.html)
+//	GET /events  starts a session and streams its events, one JSON object
+//	             per server-sent event, until the session is over
+//	POST /send   {"session": "...", "line": "..."} -- a line the user typed
+//
+// Every session is a doppelganger, the same as for a Telnet connection,
+// except that it starts out in machine mode (see machinemode.go). So web
+// users log in the same way, type the same commands, and are on the same
+// chat channels as everyone on Telnet. The gateway just turns each tagged
+// line from the doppelganger into a JSON event:
+//
+//	{"type": "session", "session": "..."}   always first
+//	{"type": "ask", "what": "password"}
+//	{"type": "msg", "channel": "lounge", "user": "alice", "text": "hello"}
+//	{"type": "emote", "channel": "lounge", "user": "alice", "text": "waves"}
+//	{"type": "notice", "channel": "lounge", "text": "..."}
+//	{"type": "join", "channel": "lounge", "user": "bob"}      (and "part")
+//	{"type": "who", "channel": "lounge", "users": ["alice", "bob"]}
+//	{"type": "list", "channels": ["lounge", "kitchen"]}
+//	{"type": "skipped", "channel": "lounge", "count": 3}
+//	{"type": "ok", "text": "..."}     (and "err", "server", "help", "motd")
+//	{"type": "ping"}
+//
+// The session is over when the browser goes away (closing the event stream
+// is the same as a Telnet user hanging up) or when the doppelganger hangs up
+// on it (the server shutting down, the admin console kicking them, and so
+// on). The Telnet connection limits don't apply here, but banned IPs do.
+//
+
+//go:embed webclient.html
+var webClientPage []byte
+
+//
+// How many lines a session can have waiting to go to its doppelganger. A
+// person can't type faster than the doppelganger takes them, so if this
+// fills up something's wrong, and /send says so rather than waiting.
+//
+const webSessionInput = 16
+
+//
+// Longest line /send takes, request and all.
+//
+const webMaxSend = 8192
+
+type webGateway struct {
+	chatServer *ChatServer
+	//
+	// The sessions, by ID, for /send to find them. Every request is on a
+	// goroutine of its own, hence the mutex.
+	//
+	mutex    sync.Mutex
+	sessions map[string]*webSession
+}
+
+//
+// One browser's session. It's the doppelganger's writer (each line it
+// writes becomes an event on the stream) and the connection it can hang up
+// (Close). The events request's goroutine owns the session otherwise: it
+// takes the lines /send puts on input and types them to the doppelganger.
+//
+type webSession struct {
+	id     string
+	input  chan string
+	hungUp chan struct{}
+	hangUp sync.Once
+	//
+	// The doppelganger writes while the events request is going on, and the
+	// events request marks the session closed when it's over (the response
+	// can't be written to after that).
+	//
+	mutex      sync.Mutex
+	response   http.ResponseWriter
+	controller *http.ResponseController
+	partial    []byte
+	closed     bool
+}
+
+var errWebSessionClosed = errors.New("web session closed")
+
+type webEvent struct {
+	Type     string   `json:"type"`
+	Session  string   `json:"session,omitempty"`
+	What     string   `json:"what,omitempty"`
+	Channel  string   `json:"channel,omitempty"`
+	User     string   `json:"user,omitempty"`
+	Users    []string `json:"users,omitempty"`
+	Channels []string `json:"channels,omitempty"`
+	Count    int64    `json:"count,omitempty"`
+	Text     string   `json:"text,omitempty"`
+}
+
+type webSendRequest struct {
+	Session string `json:"session"`
+	Line    string `json:"line"`
+}
+
+//
+// The web gateway, for the program to put on an HTTP server of its choosing
+// (the daemon puts it at the root of web_listen). It expects to be at the
+// root of wherever it is -- the client uses relative URLs, so a prefix
+// stripped with http.StripPrefix works too.
+//
+func (chatServer *ChatServer) WebHandler() http.Handler {
+	gateway := new(webGateway)
+	gateway.chatServer = chatServer
+	gateway.sessions = make(map[string]*webSession)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", gateway.serveClient)
+	mux.HandleFunc("/events", gateway.serveEvents)
+	mux.HandleFunc("/send", gateway.serveSend)
+	return mux
+}
+
+func (gateway *webGateway) serveClient(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(webClientPage)
+}
+
+//
+// The events request is the session: it lasts as long as the session does,
+// and plays the part the Telnet handler plays for a Telnet connection (see
+// servetelnet.go).
+//
+func (gateway *webGateway) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	chatServer := gateway.chatServer
+	if chatServer.isShutDown() {
+		http.Error(w, "The server is shutting down.", http.StatusServiceUnavailable)
+		return
+	}
+	session, err := newWebSession(w)
+	if err != nil {
+		chatServer.logger.With("goroutine", "web", "error", err).Error("Making a web session ID failed.")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	gateway.mutex.Lock()
+	gateway.sessions[session.id] = session
+	gateway.mutex.Unlock()
+	defer func() {
+		gateway.mutex.Lock()
+		delete(gateway.sessions, session.id)
+		gateway.mutex.Unlock()
+	}()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	var first webEvent
+	first.Type = "session"
+	first.Session = session.id
+	err = session.writeEvent(first)
+	if err != nil {
+		return
+	}
+	//
+	// NO buffer here, same as for Telnet.
+	//
+	userGoChannel := make(chan byte)
+	chatServer.doppelgangers.Add(1)
+	go doppelgangerGoroutine(chatServer, session, session, r.RemoteAddr, userGoChannel, machineSession, User{})
+	typing := true
+	for typing {
+		select {
+		case line := <-session.input:
+			typing = session.typeLine(r, userGoChannel, line)
+		case <-session.hungUp:
+			typing = false
+		case <-r.Context().Done():
+			typing = false
+		}
+	}
+	//
+	// Once we return the response is gone, so from here on the
+	// doppelganger's writes fail, same as on a closed connection. Closing
+	// userGoChannel tells it the user is gone.
+	//
+	session.mutex.Lock()
+	session.closed = true
+	session.mutex.Unlock()
+	close(userGoChannel)
+}
+
+//
+// Hands a line to the doppelganger a byte at a time, the way the Telnet
+// handler does, followed by a return. Control characters are left out --
+// ^C and ^D would make the doppelganger think the user had hung up, without
+// us knowing. Returns false if the session is over.
+//
+func (session *webSession) typeLine(r *http.Request, userGoChannel chan byte, line string) bool {
+	keystrokes := make([]byte, 0, len(line)+1)
+	for ii := 0; ii < len(line); ii++ {
+		if (line[ii] >= 32) && (line[ii] != 127) {
+			keystrokes = append(keystrokes, line[ii])
+		}
+	}
+	keystrokes = append(keystrokes, 13)
+	for _, keystroke := range keystrokes {
+		select {
+		case userGoChannel <- keystroke:
+		case <-session.hungUp:
+			return false
+		case <-r.Context().Done():
+			return false
+		}
+	}
+	return true
+}
+
+func (gateway *webGateway) serveSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	var request webSendRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, webMaxSend)).Decode(&request)
+	if err != nil {
+		http.Error(w, "Expected {\"session\": ..., \"line\": ...}", http.StatusBadRequest)
+		return
+	}
+	gateway.mutex.Lock()
+	session, exists := gateway.sessions[request.Session]
+	gateway.mutex.Unlock()
+	if !exists {
+		http.Error(w, "No such session", http.StatusNotFound)
+		return
+	}
+	//
+	// Nobody ever closes input, and we don't wait on it.
+	//
+	select {
+	case session.input <- request.Line:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Too many lines waiting", http.StatusServiceUnavailable)
+	}
+}
+
+func newWebSession(w http.ResponseWriter) (*webSession, error) {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+	session := new(webSession)
+	session.id = hex.EncodeToString(randomBytes)
+	session.input = make(chan string, webSessionInput)
+	session.hungUp = make(chan struct{})
+	session.response = w
+	session.controller = http.NewResponseController(w)
+	session.partial = make([]byte, 0)
+	session.closed = false
+	return session, nil
+}
+
+//
+// The doppelganger's writer. It's in machine mode, so everything it writes
+// is whole lines, but not necessarily one per write; we keep whatever comes
+// after the last line break for next time.
+//
+func (session *webSession) Write(p []byte) (int, error) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.closed {
+		return 0, errWebSessionClosed
+	}
+	session.partial = append(session.partial, p...)
+	for {
+		end := strings.Index(string(session.partial), "\r\n")
+		if end < 0 {
+			break
+		}
+		line := string(session.partial[:end])
+		session.partial = session.partial[end+2:]
+		if line == "" {
+			continue
+		}
+		err := session.writeEventLocked(webEventFromMachineLine(line))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+//
+// So client_write_timeout works the same as for Telnet connections.
+//
+func (session *webSession) SetWriteDeadline(t time.Time) error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.closed {
+		return errWebSessionClosed
+	}
+	return session.controller.SetWriteDeadline(t)
+}
+
+//
+// The doppelganger hanging up. The events request notices and ends.
+//
+func (session *webSession) Close() error {
+	session.hangUp.Do(func() {
+		close(session.hungUp)
+	})
+	return nil
+}
+
+func (session *webSession) writeEvent(event webEvent) error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.writeEventLocked(event)
+}
+
+func (session *webSession) writeEventLocked(event webEvent) error {
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		//
+		// Should never happen.
+		//
+		return err
+	}
+	_, err = session.response.Write([]byte("data: " + string(encoded) + "\n\n"))
+	if err != nil {
+		return err
+	}
+	return session.controller.Flush()
+}
+
+//
+// Turns a tagged line from machine mode (see machinemode.go) into an event.
+// Tags we don't know come through with their text, so the client can show
+// them anyway.
+//
+func webEventFromMachineLine(line string) webEvent {
+	var event webEvent
+	fields := strings.SplitN(line, " ", 2)
+	event.Type = strings.ToLower(fields[0])
+	rest := ""
+	if len(fields) > 1 {
+		rest = fields[1]
+	}
+	switch fields[0] {
+	case "ASK":
+		event.What = rest
+	case "MSG", "EMOTE":
+		fields = splitMachineLine(rest, 3)
+		event.Channel = fields[0]
+		event.User = fields[1]
+		event.Text = fields[2]
+	case "NOTICE":
+		fields = splitMachineLine(rest, 2)
+		event.Channel = fields[0]
+		event.Text = fields[1]
+	case "JOIN", "PART":
+		fields = splitMachineLine(rest, 2)
+		event.Channel = fields[0]
+		event.User = fields[1]
+	case "WHO":
+		fields = strings.Fields(rest)
+		if len(fields) > 0 {
+			event.Channel = strings.TrimPrefix(fields[0], "#")
+			event.Users = fields[1:]
+		}
+	case "LIST":
+		event.Channels = make([]string, 0)
+		for _, chatChannelName := range strings.Fields(rest) {
+			event.Channels = append(event.Channels, strings.TrimPrefix(chatChannelName, "#"))
+		}
+	case "SKIPPED":
+		fields = splitMachineLine(rest, 2)
+		event.Channel = fields[0]
+		event.Count, _ = strconv.ParseInt(fields[1], 10, 64)
+	default:
+		event.Text = rest
+	}
+	return event
+}
+
+//
+// Splits a tagged line's text into n fields, the last one being whatever's
+// left, with the # taken off the chat channel name at the start. Missing
+// fields are empty.
+//
+func splitMachineLine(text string, n int) []string {
+	fields := strings.SplitN(text, " ", n)
+	for len(fields) < n {
+		fields = append(fields, "")
+	}
+	fields[0] = strings.TrimPrefix(fields[0], "#")
+	return fields
+}
+
+func (chatServer *ChatServer) isShutDown() bool {
+	chatServer.mutex.Lock()
+	defer chatServer.mutex.Unlock()
+	return chatServer.shutDown
+}
@@ -0,0 +1,154 @@
+package chatserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+//
+// A browser on the web gateway and a Telnet user on the same chat channel.
+// The web client is a testClient too, except that what it expects is JSON
+// events, one per line.
+//
+
+//
+// The event stream and the send endpoint, as the connection for a
+// testClient: reading gets the events, and each line written is posted.
+//
+type webTestStream struct {
+	url      string
+	session  string
+	response *http.Response
+	reader   *bufio.Reader
+	unread   []byte
+}
+
+func (stream *webTestStream) Read(p []byte) (int, error) {
+	for len(stream.unread) == 0 {
+		line, err := stream.reader.ReadString('\n')
+		if strings.HasPrefix(line, "data: ") {
+			stream.unread = []byte(strings.TrimSuffix(line[len("data: "):], "\n") + "\n")
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	numBytes := copy(p, stream.unread)
+	stream.unread = stream.unread[numBytes:]
+	return numBytes, nil
+}
+
+func (stream *webTestStream) Write(p []byte) (int, error) {
+	var request webSendRequest
+	request.Session = stream.session
+	request.Line = strings.TrimSuffix(string(p), "\r\n")
+	body, err := json.Marshal(request)
+	if err != nil {
+		return 0, err
+	}
+	response, err := http.Post(stream.url+"/send", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		return 0, errors.New(response.Status)
+	}
+	return len(p), nil
+}
+
+//
+// Closing the event stream is hanging up.
+//
+func (stream *webTestStream) Close() error {
+	return stream.response.Body.Close()
+}
+
+//
+// The stream is closed when the test is over. That has to happen before
+// the test web server's Close, which waits for every request to finish, so
+// url's server has to have been started first.
+//
+func (server *testServer) dialWeb(name string, url string) *testClient {
+	response, err := http.Get(url + "/events")
+	if err != nil {
+		server.t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		server.t.Fatal("GET /events: ", response.Status)
+	}
+	stream := new(webTestStream)
+	stream.url = url
+	stream.response = response
+	stream.reader = bufio.NewReader(response.Body)
+	client := server.startClient(name, stream, 4096)
+	stream.session = regexp.MustCompile(`"session":"([0-9a-f]+)"`).FindStringSubmatch(client.expect(`^\{"type":"session","session":"[0-9a-f]+"\}\n`))[1]
+	return client
+}
+
+func TestWebGateway(t *testing.T) {
+	server := startTestServer(t, nil)
+	web := httptest.NewServer(server.chatServer.WebHandler())
+	t.Cleanup(web.Close)
+	alice := server.logIn("alice", "secret")
+	alice.send("/create lounge")
+	alice.expect(`created\.`)
+	alice.send("/join lounge")
+	alice.expect(`You have joined #lounge`)
+	//
+	// The client page itself.
+	//
+	response, err := http.Get(web.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if (response.StatusCode != http.StatusOK) || !strings.HasPrefix(response.Header.Get("Content-Type"), "text/html") {
+		t.Fatal("GET /: ", response.Status, response.Header.Get("Content-Type"))
+	}
+	//
+	// Logging in, creating the account first, the same as over Telnet.
+	//
+	browser := server.dialWeb("browser", web.URL)
+	browser.expect(`\{"type":"ask","what":"username"\}\n`)
+	browser.send("web")
+	browser.expect(`^\{"type":"err","text":"That username does not exist on this system\."\}\n\{"type":"ask","what":"new_account"\}\n`)
+	browser.send("y")
+	browser.expect(`^\{"type":"ask","what":"new_password"\}\n`)
+	browser.send("secret")
+	browser.expect(`^\{"type":"ask","what":"repeat_password"\}\n`)
+	browser.send("secret")
+	browser.expect(`^\{"type":"ok","text":"Your new account has been created\. Please log in as you will normally\."\}\n\{"type":"ask","what":"username"\}\n`)
+	browser.send("web")
+	browser.expect(`^\{"type":"ask","what":"password"\}\n`)
+	browser.send("secret")
+	browser.expect(`^\{"type":"ok","text":"You are logged in\. Use /help for help with commands\."\}\n`)
+	browser.send("/machine off")
+	browser.expect(`^\{"type":"err","text":"Machine mode can't be turned off here\."\}\n`)
+	browser.send("/list")
+	browser.expect(`^\{"type":"list","channels":\["lounge"\]\}\n`)
+	browser.send("/join lounge")
+	browser.expect(`^\{"type":"join","channel":"lounge","user":"web"\}\n\{"type":"who","channel":"lounge","users":\["(alice","web|web","alice)"\]\}\n`)
+	alice.expect(`web has joined #lounge`)
+	//
+	// Both ways.
+	//
+	alice.send("hello")
+	browser.expect(`^\{"type":"msg","channel":"lounge","user":"alice","text":"hello"\}\n`)
+	alice.send("/emote waves")
+	browser.expect(`^\{"type":"emote","channel":"lounge","user":"alice","text":"waves"\}\n`)
+	browser.send("hi from the web")
+	browser.expect(`^\{"type":"msg","channel":"lounge","user":"web","text":"hi from the web"\}\n`)
+	alice.expect(`web says, "hi from the web"`)
+	//
+	// Closing the browser tab is hanging up.
+	//
+	browser.conn.Close()
+	alice.expect(`web has left #lounge`)
+}
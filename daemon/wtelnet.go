@@ -1,174 +1,368 @@
 package main
 
 import (
-	"database/sql"
-	"fmt"
-	_ "github.com/mattn/go-sqlite3"
-	"go-telnet-mod"
+	"chatserver"
+	"context"
+	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 )
 
-func createDatabase(dbFilePath string) error {
-	db, err := sql.Open("sqlite3", dbFilePath)
-	if err != nil {
-		return err
+//
+// The wtelnet daemon. The chat server itself is the chatserver package; all
+// main does is load the configuration, make a chatserver.ChatServer with it,
+// open the listeners the configuration asks for and hand them over, and
+// turn signals into Reload and Shutdown calls.
+//
+
+//
+// The daemon's own log (errors and such, as opposed to the conversation
+// logs). Returns nil, nil if it should go to stderr.
+//
+func openDaemonLog(config chatserver.Config) (*os.File, error) {
+	if config.DaemonLogFile == "" {
+		return nil, nil
 	}
-	tx, err := db.Begin()
-	if err != nil {
-		return err
+	return os.OpenFile(filepath.Join(config.LogDir, config.DaemonLogFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+//
+// Points the daemon log at the daemon log file (or stderr if there isn't
+// one) with the configured level and format. The configuration has already
+// been validated, so the level parses.
+//
+func configureLogging(logger *chatserver.Logger, config chatserver.Config, daemonLog *os.File) {
+	var out io.Writer = os.Stderr
+	if daemonLog != nil {
+		out = daemonLog
 	}
-	cmd := "CREATE TABLE user (userid INTEGER PRIMARY KEY AUTOINCREMENT, username VARCHAR(255) NOT NULL UNIQUE, password VARCHAR(255) NOT NULL);"
-	stmtCreate, err := tx.Prepare(cmd)
-	if err != nil {
-		return err
+	logger.Configure(out, config)
+}
+
+//
+// Serves connections on one listener (plain Telnet, or TELNETS if
+// tlsListener is not nil) until the listener fails for good or the chat
+// server is shut down. Sends on listenerDone when it stops so main knows
+// when every listener has stopped.
+//
+func serveListener(chatServer *chatserver.ChatServer, logger *chatserver.Logger, listener net.Listener, tlsListener *chatserver.TLSListenerConfig, listenerDone chan<- bool) {
+	addr := listener.Addr().String()
+	var err error
+	if tlsListener == nil {
+		err = chatServer.Serve(listener)
+	} else {
+		err = chatServer.ServeTLS(listener, tlsListener.CertFile, tlsListener.KeyFile)
 	}
-	_, err = stmtCreate.Exec()
-	if err != nil {
-		return err
+	if (err != nil) && (err != chatserver.ErrServerClosed) {
+		logger.With("listen", addr, "error", err).Error("Listener stopped.")
 	}
-	cmd = "CREATE INDEX idx_usr_nm ON user (username);"
-	stmtIndex, err := tx.Prepare(cmd)
+	listenerDone <- true
+}
+
+//
+// SIGHUP. Re-read the configuration the same way we did at startup (same
+// flags, same config file) and hand it to the chat server, which takes the
+// reloadable parts. If anything is wrong with the new configuration we say
+// so and keep running with what we have. The daemon log belongs to main, so
+// we reopen it here (which also makes SIGHUP work for log rotation).
+// Returns the daemon log now in effect.
+//
+func reloadConfiguration(chatServer *chatserver.ChatServer, logger *chatserver.Logger, daemonLog *os.File) *os.File {
+	logger.Info("Received SIGHUP, reloading configuration.")
+	newConfig, err := chatserver.LoadConfig(os.Args[1:])
 	if err != nil {
-		return err
+		logger.With("error", err).Error("Not reloading: Problem with configuration.")
+		return daemonLog
 	}
-	_, err = stmtIndex.Exec()
+	newDaemonLog, err := openDaemonLog(newConfig)
 	if err != nil {
-		return err
+		logger.With("error", err).Error("Not reloading: Problem opening daemon log file.")
+		return daemonLog
 	}
-	cmd = "CREATE TABLE channel (channelid INTEGER PRIMARY KEY AUTOINCREMENT, channelname VARCHAR(255) NOT NULL UNIQUE);"
-	stmtCreate, err = tx.Prepare(cmd)
+	err = chatServer.Reload(newConfig)
 	if err != nil {
-		return err
+		if newDaemonLog != nil {
+			newDaemonLog.Close()
+		}
+		logger.With("error", err).Error("Not reloading: Problem with configuration.")
+		return daemonLog
 	}
-	_, err = stmtCreate.Exec()
-	if err != nil {
-		return err
+	configureLogging(logger, newConfig, newDaemonLog)
+	if daemonLog != nil {
+		daemonLog.Close()
 	}
-	cmd = "CREATE INDEX idx_chan ON channel (channelname);"
-	stmtIndex, err = tx.Prepare(cmd)
+	return newDaemonLog
+}
+
+//
+// Gives the users shutdown_drain_seconds to leave before the chat server
+// closes their chat channels on them.
+//
+func shutdownChatServer(chatServer *chatserver.ChatServer, config chatserver.Config) {
+	drainContext, cancel := context.WithTimeout(context.Background(), time.Duration(config.ShutdownDrainSeconds)*time.Second)
+	defer cancel()
+	chatServer.Shutdown(drainContext)
+}
+
+func main() {
+	//
+	// Step 0, read our configuration. Nothing else starts until we know the
+	// configuration is good. Until then we log to stderr at the default
+	// level. Anything logged with the standard library's log package (by
+	// net/http, for example) goes through our logger too.
+	//
+	logger := chatserver.NewLogger(os.Stderr)
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer())
+	config, err := chatserver.LoadConfig(os.Args[1:])
 	if err != nil {
-		return err
+		logger.With("error", err).Error("Not starting server: Problem with configuration.")
+		return
 	}
-	_, err = stmtIndex.Exec()
+	daemonLog, err := openDaemonLog(config)
 	if err != nil {
-		return err
+		logger.With("error", err).Error("Not starting server: Problem opening daemon log file.")
+		return
 	}
-	err = tx.Commit()
-	if err != nil {
-		return err
+	configureLogging(logger, config, daemonLog)
+	//
+	// Closure so we close whichever daemon log is open at the end --
+	// reloading the configuration reopens it.
+	//
+	defer func() {
+		if daemonLog != nil {
+			daemonLog.Close()
+		}
+	}()
+	if config.MigrateOnly {
+		err = chatserver.MigrateDatabase(config, logger)
+		if err != nil {
+			logger.With("error", err).Error("Not starting server: Problem starting database.")
+			return
+		}
+		logger.With("database_path", config.DatabasePath).Info("Database schema is up to date; exiting (-migrate-only).")
+		return
 	}
-	return nil
-}
-
-func openDatabase(dbFilePath string) (*sql.DB, error) {
-	exists, err := fileExists(dbFilePath)
+	//
+	// Step 1, the chat server: the database, the channel master and
+	// everything behind it.
+	//
+	chatServer, err := chatserver.New(config, chatserver.Hooks{Logger: logger})
 	if err != nil {
-		return nil, err
+		logger.With("error", err).Error("Not starting server: Problem starting chat server.")
+		return
 	}
-	if !exists {
-		err = createDatabase(dbFilePath)
+	//
+	// Step 2, open our ports. Open every port before serving any of them,
+	// so if one of them can't be opened (say, the port is taken), we don't
+	// start at all rather than running with some of the listeners missing.
+	//
+	listeners := make([]net.Listener, 0)
+	for _, addr := range config.Listen {
+		listener, err := net.Listen("tcp", addr)
 		if err != nil {
-			return nil, err
+			logger.With("listen", addr, "error", err).Error("Not starting server: Problem listening.")
+			shutdownChatServer(chatServer, config)
+			return
 		}
-		fmt.Println("Database created.") // Only happens once.
+		listeners = append(listeners, listener)
 	}
-	db, err := sql.Open("sqlite3", dbFilePath)
-	return db, err
-}
-
-func fileExists(filepath string) (bool, error) {
-	fhFile, err := os.Open(filepath)
-	if err != nil {
-		theMessage := err.Error()
-		if theMessage[len(theMessage)-25:] == "no such file or directory" {
-			return false, nil
+	for _, tlsListener := range config.ListenTLS {
+		listener, err := net.Listen("tcp", tlsListener.Addr)
+		if err != nil {
+			logger.With("listen", tlsListener.Addr, "error", err).Error("Not starting server: Problem listening.")
+			shutdownChatServer(chatServer, config)
+			return
 		}
-		return false, err
+		listeners = append(listeners, listener)
 	}
-	err = fhFile.Close()
-	if err != nil {
-		return false, err
+	//
+	// The other cluster nodes connect to us here.
+	//
+	var clusterListener net.Listener
+	if config.ClusterNode != "" {
+		clusterListener, err = net.Listen("tcp", config.ClusterListen)
+		if err != nil {
+			logger.With("cluster_listen", config.ClusterListen, "error", err).Error("Not starting server: Problem listening for cluster nodes.")
+			shutdownChatServer(chatServer, config)
+			return
+		}
 	}
-	return true, nil
-}
-
-func main() {
 	//
-	// Step 1, connect to our database. Create it if it doesn't exist.
+	// The metrics endpoint is opened with the others, for the same reason.
+	// It's plain HTTP from the standard library, in its own goroutines.
 	//
-	var err error
-	global.db, err = openDatabase("waynetelnet.db")
-	if err != nil {
-		log.Println(err)
-		log.Println("Not starting server: Problem starting database.")
-		return
+	var metricsServer *http.Server
+	if config.MetricsListen != "" {
+		metricsListener, err := net.Listen("tcp", config.MetricsListen)
+		if err != nil {
+			logger.With("listen", config.MetricsListen, "error", err).Error("Not starting server: Problem listening for metrics.")
+			shutdownChatServer(chatServer, config)
+			return
+		}
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", chatServer.MetricsHandler())
+		metricsServer = &http.Server{Handler: metricsMux, ErrorLog: log.New(logger.With("goroutine", "metrics").Writer(), "", 0)}
+		go func() {
+			err := metricsServer.Serve(metricsListener)
+			if err != http.ErrServerClosed {
+				logger.With("listen", config.MetricsListen, "error", err).Error("Metrics endpoint stopped.")
+			}
+		}()
 	}
-
 	//
-	// Step 2, create channelMaster goroutine, the master goroutine for
-	// coordinating joining channels. But first we create the channel other
-	// goroutines will use to talk with the channelMaster. This has to be a
-	// global (one of our very few globals) so the telnet handler that
-	// answers incomming connections, and its doppelganger, will be able
-	// to grab it and talk to the channelMaster.
+	// Likewise the web gateway. It's closed after the chat server is shut
+	// down, not before, so web users get the goodbye like everyone else.
 	//
-	// Buffer here needs to be big enough for all the users simultaneously
-	// on the system -- if you know typical usage is lower, you can lower
-	// the buffer size here.
+	var webServer *http.Server
+	if config.WebListen != "" {
+		webListener, err := net.Listen("tcp", config.WebListen)
+		if err != nil {
+			logger.With("listen", config.WebListen, "error", err).Error("Not starting server: Problem listening for the web gateway.")
+			shutdownChatServer(chatServer, config)
+			return
+		}
+		webServer = &http.Server{Handler: chatServer.WebHandler(), ErrorLog: log.New(logger.With("goroutine", "web").Writer(), "", 0)}
+		go func() {
+			err := webServer.Serve(webListener)
+			if err != http.ErrServerClosed {
+				logger.With("listen", config.WebListen, "error", err).Error("Web gateway stopped.")
+			}
+		}()
+	}
 	//
-	global.chanMasterFromDoppelgangerGoChan = make(chan messageFromDoppelgangerToChannelMaster, 16384)
+	// The API goes the same way as the metrics endpoint: closed before the
+	// chat server is shut down, since nobody's waiting on it for a goodbye.
 	//
-	// Buffer here needs to be big enough for all the channels that will be
-	// simultaneously in use -- if you know typical usage is lower, you can
-	// lower the buffer size here.
+	var apiServer *http.Server
+	if config.APIListen != "" {
+		apiListener, err := net.Listen("tcp", config.APIListen)
+		if err != nil {
+			logger.With("listen", config.APIListen, "error", err).Error("Not starting server: Problem listening for the API.")
+			shutdownChatServer(chatServer, config)
+			return
+		}
+		apiServer = &http.Server{Handler: chatServer.APIHandler(), ErrorLog: log.New(logger.With("goroutine", "api").Writer(), "", 0)}
+		go func() {
+			err := apiServer.Serve(apiListener)
+			if err != http.ErrServerClosed {
+				logger.With("listen", config.APIListen, "error", err).Error("API stopped.")
+			}
+		}()
+	}
 	//
-	global.chanMasterFromChatChannelGoChan = make(chan messageFromChatChannelToChannelMaster, 512)
+	// And the IRC gateway, which the chat server closes itself when it
+	// shuts down, same as the Telnet listeners.
 	//
-	// NO buffer here because there is no cycle between the "heartbeat"
-	// goroutine and the channel master goroutine.
+	if config.IRCListen != "" {
+		ircListener, err := net.Listen("tcp", config.IRCListen)
+		if err != nil {
+			logger.With("listen", config.IRCListen, "error", err).Error("Not starting server: Problem listening for the IRC gateway.")
+			shutdownChatServer(chatServer, config)
+			return
+		}
+		go func() {
+			err := chatServer.ServeIRC(ircListener)
+			if err != nil && err != chatserver.ErrServerClosed {
+				logger.With("listen", config.IRCListen, "error", err).Error("IRC gateway stopped.")
+			}
+		}()
+	}
 	//
-	global.chanMasterHeartbeat = make(chan bool)
-	go heartbeatGoroutine()
+	// And SSH. The host key is read (or made) when we start serving, so a
+	// problem with it shows up in the log.
 	//
-	// Note that the channel for sending messages from chat channel
-	// goroutines to the channel master is NOT a global. We have no choice
-	// but to make the channel for messages from the doppelgangers global
-	// because we have no control over parameters to goroutines launched by
-	// the telnet package in response to incoming user connections, so we
-	// have to use a global to get that channel to them (or the
-	// doppelgangers they spawn). But this situation is not the case for
-	// the chat channel goroutines we launch ourselves, where we have total
-	// control. So, in the interest of minimizing globals, we don't make
-	// that channel global.
+	if config.SSHListen != "" {
+		sshListener, err := net.Listen("tcp", config.SSHListen)
+		if err != nil {
+			logger.With("listen", config.SSHListen, "error", err).Error("Not starting server: Problem listening for SSH.")
+			shutdownChatServer(chatServer, config)
+			return
+		}
+		go func() {
+			err := chatServer.ServeSSH(sshListener)
+			if err != nil && err != chatserver.ErrServerClosed {
+				logger.With("listen", config.SSHListen, "error", err).Error("SSH listener stopped.")
+			}
+		}()
+	}
 	//
-	// Launch channelMaster.
+	// Likewise the admin console. A socket file left over from a daemon
+	// that didn't shut down cleanly would stop us listening, so we remove
+	// it first.
 	//
-	go channelMasterGoroutine(global.chanMasterFromDoppelgangerGoChan, global.chanMasterFromChatChannelGoChan, global.chanMasterHeartbeat)
+	if config.AdminSocket != "" {
+		os.Remove(config.AdminSocket)
+		adminListener, err := net.Listen("unix", config.AdminSocket)
+		if err != nil {
+			logger.With("admin_socket", config.AdminSocket, "error", err).Error("Not starting server: Problem listening for the admin console.")
+			shutdownChatServer(chatServer, config)
+			return
+		}
+		err = os.Chmod(config.AdminSocket, 0600)
+		if err != nil {
+			adminListener.Close()
+			logger.With("admin_socket", config.AdminSocket, "error", err).Error("Not starting server: Could not restrict permissions on the admin console socket.")
+			shutdownChatServer(chatServer, config)
+			return
+		}
+		go func() {
+			err := chatServer.ServeAdmin(adminListener)
+			if err != nil && err != chatserver.ErrServerClosed {
+				logger.With("admin_socket", config.AdminSocket, "error", err).Error("Admin console stopped.")
+			}
+		}()
+	}
+	if clusterListener != nil {
+		go chatServer.ServeCluster(clusterListener)
+	}
+	listenerDone := make(chan bool, len(listeners))
+	for ii, listener := range listeners {
+		if ii < len(config.Listen) {
+			go serveListener(chatServer, logger, listener, nil, listenerDone)
+		} else {
+			go serveListener(chatServer, logger, listener, &config.ListenTLS[ii-len(config.Listen)], listenerDone)
+		}
+	}
 	//
-	// Step 3, open our port to listen to incoming Telnet connections.
+	// Step 3, wait. We stay up until we're told to shut down (SIGINT, e.g.
+	// ^C, or SIGTERM, e.g. from the service manager) or until every
+	// listener has given up. SIGHUP reloads the configuration.
 	//
-	var handler chatHandler
-
-	keepGoing := true
-	for keepGoing {
-		keepGoing = false
-		err = telnet.ListenAndServe(":5555", handler)
-		if nil != err {
-			//
-			// The exact text of the error message is:
-			// "accept tcp [::]:5555: accept: too many open files"
-			//
-			ii := strings.Index(err.Error(), "too many open files")
-			if ii > 0 {
-				keepGoing = true
-				log.Println("We got the accept tcp [::]:5555: accept: too many open files error!!! Trying to keep going!!!")
-				time.Sleep(10 * time.Second)
-			} else {
-				log.Println(err)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	listenersRunning := len(listeners)
+	for listenersRunning > 0 {
+		select {
+		case <-listenerDone:
+			listenersRunning--
+		case theSignal := <-signals:
+			if theSignal == syscall.SIGHUP {
+				daemonLog = reloadConfiguration(chatServer, logger, daemonLog)
+				continue
+			}
+			logger.With("signal", theSignal.String()).Info("Shutting down.")
+			if metricsServer != nil {
+				metricsServer.Close()
+			}
+			if apiServer != nil {
+				apiServer.Close()
 			}
+			shutdownChatServer(chatServer, config)
+			if webServer != nil {
+				webServer.Close()
+			}
+			return
 		}
 	}
+	shutdownChatServer(chatServer, config)
+	if webServer != nil {
+		webServer.Close()
+	}
 }
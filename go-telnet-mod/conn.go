@@ -101,6 +101,18 @@ func (clientConn *Conn) Close() error {
 	return clientConn.conn.Close()
 }
 
+// ReportTerminalType makes the client tell the server it is a 'name' terminal
+// (for example "XTERM" or "DUMB") when the server asks, using the
+// TERMINAL-TYPE option (RFC 1091). The asking happens in the data stream, so
+// the answer goes out as Read comes across it. Call ReportTerminalType
+// before the first Read.
+//
+// Without it, the client won't say what kind of terminal it is.
+func (clientConn *Conn) ReportTerminalType(name string) {
+	clientConn.dataReader.replies = clientConn.conn
+	clientConn.dataReader.reportTerminalType = name
+}
+
 // Read receives `n` bytes sent from the server to the client,
 // and "returns" into `p`.
 //
@@ -1,13 +1,35 @@
 package telnet
 
+import (
+	"net"
+)
+
 type Context interface {
 	Logger() Logger
 
 	InjectLogger(Logger) Context
+
+	// Conn returns the underlying network connection for the TELNET (or TELNETS)
+	// session, or nil if none was injected.
+	//
+	// Handlers normally only use the Writer and Reader they are given; Conn is for
+	// things those can't do, such as closing the connection from another goroutine
+	// or finding out the client's address.
+	Conn() net.Conn
+
+	InjectConn(net.Conn) Context
+
+	// TerminalType returns the kind of terminal the client said it is, such as
+	// "XTERM" or "DUMB", or "" if it hasn't said (yet, or at all). Only a
+	// Server with AskTerminalType set asks; the answer arrives as the Reader
+	// reads, so it can change from "" to the client's answer at any time.
+	TerminalType() string
 }
 
 type internalContext struct {
-	logger Logger
+	logger       Logger
+	conn         net.Conn
+	terminalType *internalTerminalType
 }
 
 func NewContext() Context {
@@ -25,3 +47,17 @@ func (ctx *internalContext) InjectLogger(logger Logger) Context {
 
 	return ctx
 }
+
+func (ctx *internalContext) Conn() net.Conn {
+	return ctx.conn
+}
+
+func (ctx *internalContext) InjectConn(conn net.Conn) Context {
+	ctx.conn = conn
+
+	return ctx
+}
+
+func (ctx *internalContext) TerminalType() string {
+	return ctx.terminalType.get()
+}
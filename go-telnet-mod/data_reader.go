@@ -52,9 +52,25 @@ var (
 // ... to this:
 //
 //	[]byte{1, 55, 2, 155, 3, 255, 4, 40, 255, 30, 20}
+//
+// The only TELNET option it takes part in is TERMINAL-TYPE (see
+// terminal_type.go), and only if it has somewhere to send its replies.
 type internalDataReader struct {
 	wrapped  io.Reader
 	buffered *bufio.Reader
+
+	// replies is where TERMINAL-TYPE negotiation gets answered; the raw
+	// connection, since commands mustn't be escaped. If nil, the reader
+	// never answers anything.
+	replies io.Writer
+
+	// On the server side: where the terminal type the client reports goes.
+	// If nil, the server isn't asking.
+	terminalType *internalTerminalType
+
+	// On the client side: the terminal type to report when the server asks.
+	// If empty, we won't say.
+	reportTerminalType string
 }
 
 // newDataReader creates a new DataReader reading from 'r'.
@@ -77,6 +93,16 @@ func (r *internalDataReader) Read(data []byte) (n int, err error) {
 	const SB = 250
 	const SE = 240
 
+	const NOP = 241
+	const DM = 242
+	const BRK = 243
+	const IP = 244
+	const AO = 245
+	const AYT = 246
+	const EC = 247
+	const EL = 248
+	const GA = 249
+
 	const WILL = 251
 	const WONT = 252
 	const DO = 253
@@ -102,10 +128,21 @@ func (r *internalDataReader) Read(data []byte) (n int, err error) {
 
 			switch peeked[0] {
 			case WILL, WONT, DO, DONT:
+				peeked, err = r.buffered.Peek(2)
+				if nil != err {
+					return n, err
+				}
+				command, option := peeked[0], peeked[1]
+
 				_, err = r.buffered.Discard(2)
 				if nil != err {
 					return n, err
 				}
+
+				err = r.negotiate(command, option)
+				if nil != err {
+					return n, err
+				}
 			case IAC:
 				p[0] = IAC
 				n++
@@ -116,6 +153,12 @@ func (r *internalDataReader) Read(data []byte) (n int, err error) {
 					return n, err
 				}
 			case SB:
+				_, err = r.buffered.Discard(1)
+				if nil != err {
+					return n, err
+				}
+
+				var subnegotiation []byte
 				for {
 					var b2 byte
 					b2, err = r.buffered.ReadByte()
@@ -144,12 +187,30 @@ func (r *internalDataReader) Read(data []byte) (n int, err error) {
 							break
 						}
 					}
+
+					if len(subnegotiation) < 2+maxTerminalTypeLength {
+						subnegotiation = append(subnegotiation, b2)
+					}
+				}
+
+				err = r.subnegotiate(subnegotiation)
+				if nil != err {
+					return n, err
 				}
 			case SE:
 				_, err = r.buffered.Discard(1)
 				if nil != err {
 					return n, err
 				}
+			case NOP, DM, BRK, IP, AO, AYT, EC, EL, GA:
+				// Two byte commands. Clients send these on their own, for
+				// example IAC NOP or IAC AYT as a keepalive, so they must
+				// not be treated as corrupted data. They carry no data, so
+				// we drop them.
+				_, err = r.buffered.Discard(1)
+				if nil != err {
+					return n, err
+				}
 			default:
 				// If we get in here, this is not following the TELNET protocol.
 				//@TODO: Make a better error.
@@ -166,3 +227,40 @@ func (r *internalDataReader) Read(data []byte) (n int, err error) {
 
 	return n, nil
 }
+
+// negotiate answers an option command ('command' is WILL, WONT, DO or DONT)
+// if it's about TERMINAL-TYPE and we're taking part. Everything else is
+// ignored, the same as it always was.
+func (r *internalDataReader) negotiate(command byte, option byte) error {
+	const WILL = 251
+	const DO = 253
+
+	if nil == r.replies || optionTerminalType != option {
+		return nil
+	}
+
+	switch {
+	case WILL == command && nil != r.terminalType:
+		return writeNegotiation(r.replies, sendTerminalType)
+	case DO == command && "" != r.reportTerminalType:
+		return writeNegotiation(r.replies, willTerminalType)
+	}
+
+	return nil
+}
+
+// subnegotiate handles what came between IAC SB and IAC SE, un-escaped.
+func (r *internalDataReader) subnegotiate(subnegotiation []byte) error {
+	if len(subnegotiation) < 2 || optionTerminalType != subnegotiation[0] {
+		return nil
+	}
+
+	switch {
+	case terminalTypeIS == subnegotiation[1] && nil != r.terminalType:
+		r.terminalType.set(string(subnegotiation[2:]))
+	case terminalTypeSEND == subnegotiation[1] && nil != r.replies && "" != r.reportTerminalType:
+		return writeNegotiation(r.replies, terminalTypeSubnegotiation(r.reportTerminalType))
+	}
+
+	return nil
+}
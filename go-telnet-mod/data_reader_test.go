@@ -3,6 +3,7 @@ package telnet
 import (
 	"bytes"
 	"io"
+	"strings"
 
 	"testing"
 )
@@ -280,6 +281,27 @@ func TestDataReader(t *testing.T) {
 			Bytes:    []byte{67, 255, 250, 71, 255, 255, 240, 72, 255, 240, 68}, // 'C' IAC SB 'G' 255 255 240 'H' IAC SE = IAC 'G' SB IAC IAC SE 'H' IAC SE 'D'
 			Expected: []byte{67, 68},
 		},
+
+		{
+			Bytes:    []byte{255, 241}, // IAC NOP
+			Expected: []byte{},
+		},
+		{
+			Bytes:    []byte{255, 246}, // IAC AYT
+			Expected: []byte{},
+		},
+		{
+			Bytes:    []byte{67, 255, 241, 68}, // 'C' IAC NOP 'D'
+			Expected: []byte{67, 68},
+		},
+		{
+			Bytes:    []byte{67, 255, 246, 68}, // 'C' IAC AYT 'D'
+			Expected: []byte{67, 68},
+		},
+		{
+			Bytes:    []byte{67, 255, 249, 255, 241, 255, 255, 68}, // 'C' IAC GA IAC NOP 255 255 'D' = 'C' IAC GA IAC NOP IAC 'D'
+			Expected: []byte{67, 255, 68},
+		},
 	}
 
 	//@TODO: Add random tests.
@@ -308,3 +330,99 @@ func TestDataReader(t *testing.T) {
 		}
 	}
 }
+
+func TestDataReaderAsksTerminalType(t *testing.T) {
+
+	tests := []struct {
+		Bytes        []byte
+		Expected     []byte
+		Replies      []byte
+		TerminalType string
+	}{
+		{
+			Bytes:        []byte{255, 251, 24, 67}, // IAC WILL TERMINAL-TYPE 'C'
+			Expected:     []byte{67},
+			Replies:      []byte{255, 250, 24, 1, 255, 240}, // IAC SB TERMINAL-TYPE SEND IAC SE
+			TerminalType: "",
+		},
+		{
+			Bytes:        []byte{255, 252, 24, 67}, // IAC WONT TERMINAL-TYPE 'C'
+			Expected:     []byte{67},
+			Replies:      []byte{},
+			TerminalType: "",
+		},
+		{
+			Bytes:        []byte{255, 251, 1, 67}, // IAC WILL ECHO 'C'
+			Expected:     []byte{67},
+			Replies:      []byte{},
+			TerminalType: "",
+		},
+		{
+			Bytes:        append(append([]byte{67, 255, 250, 24, 0}, "XTERM"...), 255, 240, 68), // 'C' IAC SB TERMINAL-TYPE IS "XTERM" IAC SE 'D'
+			Expected:     []byte{67, 68},
+			Replies:      []byte{},
+			TerminalType: "XTERM",
+		},
+		{
+			Bytes:        append(append([]byte{255, 250, 24, 0}, "DUMB"...), 255, 255, 255, 240, 67), // IAC SB TERMINAL-TYPE IS "DUMB" 255 255 IAC SE 'C'
+			Expected:     []byte{67},
+			Replies:      []byte{},
+			TerminalType: "DUMB\xff",
+		},
+		{
+			Bytes:        append(append([]byte{255, 250, 24, 0}, bytes.Repeat([]byte("X"), 100)...), 255, 240, 67), // IAC SB TERMINAL-TYPE IS "XXX..." IAC SE 'C'
+			Expected:     []byte{67},
+			Replies:      []byte{},
+			TerminalType: strings.Repeat("X", 40),
+		},
+	}
+
+	for testNumber, test := range tests {
+
+		reader := newDataReader(bytes.NewReader(test.Bytes))
+		var replies bytes.Buffer
+		reader.replies = &replies
+		reader.terminalType = new(internalTerminalType)
+
+		buffer := make([]byte, len(test.Expected))
+		n, err := reader.Read(buffer)
+		if nil != err {
+			t.Errorf("For test #%d, did not expected an error, but actually got one: (%T) %v", testNumber, err, err)
+			continue
+		}
+
+		if expected, actual := string(test.Expected), string(buffer[:n]); expected != actual {
+			t.Errorf("For test #%d, expected %q, but actually got %q.", testNumber, expected, actual)
+		}
+		if expected, actual := string(test.Replies), replies.String(); expected != actual {
+			t.Errorf("For test #%d, expected the reply %q, but actually got %q.", testNumber, expected, actual)
+		}
+		if expected, actual := test.TerminalType, reader.terminalType.get(); expected != actual {
+			t.Errorf("For test #%d, expected the terminal type %q, but actually got %q.", testNumber, expected, actual)
+		}
+	}
+}
+
+func TestDataReaderReportsTerminalType(t *testing.T) {
+
+	// IAC DO TERMINAL-TYPE, IAC SB TERMINAL-TYPE SEND IAC SE, 'C'
+	reader := newDataReader(bytes.NewReader([]byte{255, 253, 24, 255, 250, 24, 1, 255, 240, 67}))
+	var replies bytes.Buffer
+	reader.replies = &replies
+	reader.reportTerminalType = "VT100"
+
+	buffer := make([]byte, 1)
+	n, err := reader.Read(buffer)
+	if nil != err {
+		t.Fatalf("Did not expected an error, but actually got one: (%T) %v", err, err)
+	}
+	if expected, actual := "C", string(buffer[:n]); expected != actual {
+		t.Errorf("Expected %q, but actually got %q.", expected, actual)
+	}
+
+	// IAC WILL TERMINAL-TYPE, IAC SB TERMINAL-TYPE IS "VT100" IAC SE
+	expected := append(append([]byte{255, 251, 24, 255, 250, 24, 0}, "VT100"...), 255, 240)
+	if actual := replies.Bytes(); string(expected) != string(actual) {
+		t.Errorf("Expected the replies %v, but actually got %v.", expected, actual)
+	}
+}
@@ -0,0 +1,247 @@
+package telnet
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	defaultServerFullMessage         = "Sorry, the server is full right now. Please try again later.\r\n"
+	defaultTooManyConnectionsMessage = "Sorry, there are too many connections from your address right now. Please try again later.\r\n"
+
+	// How long we give a rejected client to take the rejection message
+	// before we hang up anyway.
+	rejectWriteTimeout = 5 * time.Second
+
+	// Backoff after a temporary Accept error (such as running out of file
+	// descriptors) starts here and doubles up to the server's MaxAcceptBackoff.
+	minAcceptBackoff     = 5 * time.Millisecond
+	defaultAcceptBackoff = 1 * time.Second
+
+	// Per-IP rate limiting state for addresses we haven't heard from in this
+	// long is forgotten.
+	perIPForgetAfter = 10 * time.Minute
+)
+
+// internalTokenBucket is a plain token bucket: it holds up to 'burst' tokens
+// and refills at 'rate' tokens per second.
+type internalTokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket for the time that's passed and takes a token if
+// there is one.
+func (bucket *internalTokenBucket) take(now time.Time, rate float64, burst int) bool {
+	bucket.refill(now, rate, burst)
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+
+	return true
+}
+
+// wait returns how long until the bucket will have a token.
+func (bucket *internalTokenBucket) wait(now time.Time, rate float64, burst int) time.Duration {
+	bucket.refill(now, rate, burst)
+
+	if bucket.tokens >= 1 {
+		return 0
+	}
+
+	return time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+}
+
+func (bucket *internalTokenBucket) refill(now time.Time, rate float64, burst int) {
+	if bucket.last.IsZero() {
+		bucket.tokens = float64(burst)
+	} else {
+		bucket.tokens += now.Sub(bucket.last).Seconds() * rate
+		if bucket.tokens > float64(burst) {
+			bucket.tokens = float64(burst)
+		}
+	}
+	bucket.last = now
+}
+
+// internalRejection says why a connection was turned away, if it was.
+type internalRejection int
+
+const (
+	internalNotRejected internalRejection = iota
+	internalRejectedServerFull
+	internalRejectedTooManyFromIP
+)
+
+// connectionHost is the key for the per-IP limits: the remote address
+// without the port.
+func connectionHost(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if nil == addr {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if nil != err {
+		return addr.String()
+	}
+
+	return host
+}
+
+// admit checks a newly accepted connection against MaxConnections,
+// MaxConnectionsPerIP and the per-IP rate limit. If the connection is let in,
+// it is counted, and release must be called when it's done.
+func (server *Server) admit(host string, now time.Time) internalRejection {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if 0 < server.MaxConnections && server.MaxConnections <= server.activeConnections {
+		server.rejectedConnections++
+		return internalRejectedServerFull
+	}
+
+	if 0 < server.MaxConnectionsPerIP && server.MaxConnectionsPerIP <= server.activeConnectionsPerIP[host] {
+		server.rejectedConnections++
+		return internalRejectedTooManyFromIP
+	}
+
+	if 0 < server.PerIPRate {
+		if nil == server.perIPBuckets {
+			server.perIPBuckets = map[string]*internalTokenBucket{}
+		}
+		server.forgetIdleBuckets(now)
+
+		bucket, ok := server.perIPBuckets[host]
+		if !ok {
+			bucket = &internalTokenBucket{}
+			server.perIPBuckets[host] = bucket
+		}
+
+		burst := server.PerIPBurst
+		if burst < 1 {
+			burst = 1
+		}
+		if !bucket.take(now, server.PerIPRate, burst) {
+			server.rejectedConnections++
+			return internalRejectedTooManyFromIP
+		}
+	}
+
+	if nil == server.activeConnectionsPerIP {
+		server.activeConnectionsPerIP = map[string]int{}
+	}
+	server.activeConnections++
+	server.activeConnectionsPerIP[host]++
+
+	return internalNotRejected
+}
+
+// release undoes admit once the connection is finished.
+func (server *Server) release(host string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.activeConnections--
+	server.activeConnectionsPerIP[host]--
+	if server.activeConnectionsPerIP[host] <= 0 {
+		delete(server.activeConnectionsPerIP, host)
+	}
+}
+
+// forgetIdleBuckets keeps the per-IP rate limiting state from growing
+// forever. Must be called with the mutex held.
+func (server *Server) forgetIdleBuckets(now time.Time) {
+	if now.Sub(server.lastBucketSweep) < perIPForgetAfter {
+		return
+	}
+	server.lastBucketSweep = now
+
+	for host, bucket := range server.perIPBuckets {
+		if perIPForgetAfter <= now.Sub(bucket.last) {
+			delete(server.perIPBuckets, host)
+		}
+	}
+}
+
+// throttleAccept waits, if need be, so that we accept no more than AcceptRate
+// connections per second. Connections that arrive faster than that wait in
+// the listener's backlog.
+func (server *Server) throttleAccept() {
+	if server.AcceptRate <= 0 {
+		return
+	}
+
+	burst := server.AcceptBurst
+	if burst < 1 {
+		burst = 1
+	}
+
+	for {
+		now := time.Now()
+
+		server.mutex.Lock()
+		delay := server.acceptBucket.wait(now, server.AcceptRate, burst)
+		if 0 == delay {
+			server.acceptBucket.take(now, server.AcceptRate, burst)
+		}
+		server.mutex.Unlock()
+
+		if 0 == delay {
+			return
+		}
+		time.Sleep(delay)
+	}
+}
+
+// reject tells a client why it's being turned away and hangs up. It runs in
+// its own goroutine so a client that won't read can't hold up Accept.
+func (server *Server) reject(conn net.Conn, rejection internalRejection) {
+	defer conn.Close()
+
+	message := server.ServerFullMessage
+	if "" == message {
+		message = defaultServerFullMessage
+	}
+	if internalRejectedTooManyFromIP == rejection {
+		message = server.TooManyConnectionsMessage
+		if "" == message {
+			message = defaultTooManyConnectionsMessage
+		}
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	conn.Write([]byte(message))
+}
+
+// isTemporary says whether an Accept error is worth waiting out (such as
+// running out of file descriptors) rather than giving up on the listener.
+func isTemporary(err error) bool {
+	type temporary interface {
+		Temporary() bool
+	}
+
+	tempErr, ok := err.(temporary)
+	return ok && tempErr.Temporary()
+}
+
+// acceptBackoff returns how long to wait after the 'failures'th temporary
+// Accept error in a row.
+func (server *Server) acceptBackoff(failures int) time.Duration {
+	max := server.MaxAcceptBackoff
+	if max <= 0 {
+		max = defaultAcceptBackoff
+	}
+
+	delay := minAcceptBackoff
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if max < delay {
+		delay = max
+	}
+
+	return delay
+}
@@ -0,0 +1,264 @@
+package telnet
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"testing"
+	"time"
+)
+
+func TestServerMaxConnections(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("Could not listen: (%T) %v", err, err)
+	}
+
+	handler := internalTestBlockingHandler{started: make(chan struct{}, 10), release: make(chan struct{})}
+	server := &Server{Handler: handler, MaxConnections: 2, ServerFullMessage: "FULL\r\n"}
+	go server.Serve(listener)
+	defer server.Close()
+	defer close(handler.release)
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if nil != err {
+			t.Fatalf("Could not connect: (%T) %v", err, err)
+		}
+		defer conn.Close()
+
+		select {
+		case <-handler.started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Handler was never called for connection #%d.", i)
+		}
+	}
+
+	if expected, actual := 2, server.ActiveConnections(); expected != actual {
+		t.Errorf("Expected %d active connections, but actually got %d.", expected, actual)
+	}
+
+	if expected, actual := "FULL\r\n", internalTestReadAll(t, listener.Addr().String()); expected != actual {
+		t.Errorf("Expected the third connection to get %q, but actually got %q.", expected, actual)
+	}
+
+	select {
+	case <-handler.started:
+		t.Errorf("Did not expect the handler to be called for a rejected connection.")
+	default:
+	}
+
+	if expected, actual := int64(1), server.RejectedConnections(); expected != actual {
+		t.Errorf("Expected %d rejected connections, but actually got %d.", expected, actual)
+	}
+}
+
+func TestServerMaxConnectionsPerIP(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("Could not listen: (%T) %v", err, err)
+	}
+
+	handler := internalTestBlockingHandler{started: make(chan struct{}, 10), release: make(chan struct{})}
+	server := &Server{Handler: handler, MaxConnectionsPerIP: 1}
+	go server.Serve(listener)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if nil != err {
+		t.Fatalf("Could not connect: (%T) %v", err, err)
+	}
+
+	select {
+	case <-handler.started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Handler was never called.")
+	}
+
+	if actual := internalTestReadAll(t, listener.Addr().String()); defaultTooManyConnectionsMessage != actual {
+		t.Errorf("Expected the second connection to get %q, but actually got %q.", defaultTooManyConnectionsMessage, actual)
+	}
+
+	// Once the first connection is done, there's room again.
+	conn.Close()
+	close(handler.release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for 0 != server.ActiveConnections() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Connection was never released.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, err = net.Dial("tcp", listener.Addr().String())
+	if nil != err {
+		t.Fatalf("Could not connect: (%T) %v", err, err)
+	}
+	defer conn.Close()
+
+	select {
+	case <-handler.started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Handler was never called after the first connection closed.")
+	}
+}
+
+func TestServerPerIPRate(t *testing.T) {
+
+	server := &Server{PerIPRate: 1, PerIPBurst: 2}
+
+	now := time.Now()
+
+	tests := []struct {
+		Host     string
+		At       time.Duration
+		Expected internalRejection
+	}{
+		{Host: "192.0.2.1", At: 0, Expected: internalNotRejected},
+		{Host: "192.0.2.1", At: 0, Expected: internalNotRejected},
+		{Host: "192.0.2.1", At: 0, Expected: internalRejectedTooManyFromIP},
+		{Host: "192.0.2.2", At: 0, Expected: internalNotRejected},
+		{Host: "192.0.2.1", At: 500 * time.Millisecond, Expected: internalRejectedTooManyFromIP},
+		{Host: "192.0.2.1", At: 1500 * time.Millisecond, Expected: internalNotRejected},
+		{Host: "192.0.2.1", At: 1500 * time.Millisecond, Expected: internalRejectedTooManyFromIP},
+	}
+
+	for testNumber, test := range tests {
+		actual := server.admit(test.Host, now.Add(test.At))
+		if internalNotRejected == actual {
+			server.release(test.Host)
+		}
+
+		if expected := test.Expected; expected != actual {
+			t.Errorf("For test #%d, expected %d, but actually got %d.", testNumber, expected, actual)
+		}
+	}
+}
+
+func TestServerAcceptBackoff(t *testing.T) {
+
+	server := &Server{MaxAcceptBackoff: 100 * time.Millisecond}
+
+	tests := []struct {
+		Failures int
+		Expected time.Duration
+	}{
+		{Failures: 1, Expected: 5 * time.Millisecond},
+		{Failures: 2, Expected: 10 * time.Millisecond},
+		{Failures: 3, Expected: 20 * time.Millisecond},
+		{Failures: 5, Expected: 80 * time.Millisecond},
+		{Failures: 6, Expected: 100 * time.Millisecond},
+		{Failures: 100, Expected: 100 * time.Millisecond},
+	}
+
+	for testNumber, test := range tests {
+		if expected, actual := test.Expected, server.acceptBackoff(test.Failures); expected != actual {
+			t.Errorf("For test #%d, expected %v, but actually got %v.", testNumber, expected, actual)
+		}
+	}
+}
+
+func TestServerServeSurvivesTemporaryErrors(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("Could not listen: (%T) %v", err, err)
+	}
+
+	flaky := &internalTestFlakyListener{Listener: listener, failures: 3}
+
+	handler := internalTestBlockingHandler{started: make(chan struct{}, 10), release: make(chan struct{})}
+	server := &Server{Handler: handler, MaxAcceptBackoff: 10 * time.Millisecond}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(flaky)
+	}()
+	defer server.Close()
+	defer close(handler.release)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if nil != err {
+		t.Fatalf("Could not connect: (%T) %v", err, err)
+	}
+	defer conn.Close()
+
+	select {
+	case <-handler.started:
+	case err := <-serveErr:
+		t.Fatalf("Expected Serve to keep going after temporary errors, but it returned: (%T) %v", err, err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Handler was never called.")
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+
+	var bucket internalTokenBucket
+
+	now := time.Now()
+
+	if !bucket.take(now, 10, 1) {
+		t.Errorf("Expected a new bucket to start full.")
+	}
+	if bucket.take(now, 10, 1) {
+		t.Errorf("Expected an empty bucket to refuse.")
+	}
+	if expected, actual := 100*time.Millisecond, bucket.wait(now, 10, 1); expected != actual {
+		t.Errorf("Expected to wait %v, but actually got %v.", expected, actual)
+	}
+	if !bucket.take(now.Add(100*time.Millisecond), 10, 1) {
+		t.Errorf("Expected the bucket to have refilled.")
+	}
+}
+
+// internalTestReadAll connects and reads until the server hangs up.
+func internalTestReadAll(t *testing.T, addr string) string {
+	conn, err := net.Dial("tcp", addr)
+	if nil != err {
+		t.Fatalf("Could not connect: (%T) %v", err, err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, err := ioutil.ReadAll(conn)
+	if nil != err && !strings.Contains(err.Error(), "reset") {
+		t.Fatalf("Could not read: (%T) %v", err, err)
+	}
+
+	return string(p)
+}
+
+type internalTestBlockingHandler struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (handler internalTestBlockingHandler) ServeTELNET(ctx Context, w Writer, r Reader) {
+	handler.started <- struct{}{}
+	<-handler.release
+}
+
+type internalTestTemporaryError struct{}
+
+func (internalTestTemporaryError) Error() string   { return "internal test temporary error" }
+func (internalTestTemporaryError) Temporary() bool { return true }
+
+// internalTestFlakyListener fails its first few Accepts with a temporary error.
+type internalTestFlakyListener struct {
+	net.Listener
+	failures int
+}
+
+func (listener *internalTestFlakyListener) Accept() (net.Conn, error) {
+	if 0 < listener.failures {
+		listener.failures--
+		return nil, internalTestTemporaryError{}
+	}
+
+	return listener.Listener.Accept()
+}
@@ -2,9 +2,16 @@ package telnet
 
 import (
 	"crypto/tls"
+	"errors"
 	"net"
+	"sync"
+	"time"
 )
 
+// ErrServerClosed is returned by the Server's Serve, ListenAndServe and ListenAndServeTLS
+// methods after a call to Close.
+var ErrServerClosed = errors.New("telnet: Server closed")
+
 // ListenAndServe listens on the TCP network address `addr` and then spawns a call to the ServeTELNET
 // method on the `handler` to serve each incoming connection.
 //
@@ -71,6 +78,63 @@ type Server struct {
 	TLSConfig *tls.Config // optional TLS configuration; used by ListenAndServeTLS.
 
 	Logger Logger
+
+	// KeepAlivePeriod is the TCP keep-alive period for accepted connections.
+	// If zero, the operating system (or Go) default is left alone. If
+	// negative, TCP keep-alive is turned off.
+	KeepAlivePeriod time.Duration
+
+	// MaxConnections is the most connections served at once, across all
+	// listeners. Connections past that are sent ServerFullMessage and closed.
+	// Zero means no limit.
+	MaxConnections int
+
+	// MaxConnectionsPerIP is the most connections served at once from one
+	// remote IP address. Zero means no limit.
+	MaxConnectionsPerIP int
+
+	// PerIPRate limits how fast one remote IP address can open new
+	// connections, in connections per second, allowing bursts of up to
+	// PerIPBurst. Connections over either per-IP limit are sent
+	// TooManyConnectionsMessage and closed. Zero means no limit.
+	PerIPRate  float64
+	PerIPBurst int
+
+	// AcceptRate limits how fast connections are accepted at all, in
+	// connections per second, allowing bursts of up to AcceptBurst. Instead
+	// of being turned away, connections over the rate wait their turn in
+	// the listener's backlog. Zero means no limit.
+	AcceptRate  float64
+	AcceptBurst int
+
+	// MaxAcceptBackoff is the longest Serve waits before accepting again
+	// after a temporary error, such as running out of file descriptors.
+	// The wait starts small and doubles with each error in a row. Defaults
+	// to 1 second.
+	MaxAcceptBackoff time.Duration
+
+	// ServerFullMessage and TooManyConnectionsMessage are what rejected
+	// clients are told before they're hung up on. There are polite
+	// defaults.
+	ServerFullMessage         string
+	TooManyConnectionsMessage string
+
+	// AskTerminalType makes the server ask each client what kind of
+	// terminal it is (the TERMINAL-TYPE option, RFC 1091) as soon as it
+	// connects. The handler finds the answer with its Context's
+	// TerminalType, once the client has given it.
+	AskTerminalType bool
+
+	mutex     sync.Mutex
+	listeners map[net.Listener]struct{}
+	closed    bool
+
+	activeConnections      int
+	rejectedConnections    int64
+	activeConnectionsPerIP map[string]int
+	perIPBuckets           map[string]*internalTokenBucket
+	lastBucketSweep        time.Time
+	acceptBucket           internalTokenBucket
 }
 
 // ListenAndServe listens on the TCP network address 'server.Addr' and then spawns a call to the ServeTELNET
@@ -101,6 +165,10 @@ type Server struct {
 //	}
 func (server *Server) ListenAndServe() error {
 
+	if server.isClosed() {
+		return ErrServerClosed
+	}
+
 	addr := server.Addr
 	if "" == addr {
 		addr = ":telnet"
@@ -119,6 +187,11 @@ func (server *Server) Serve(listener net.Listener) error {
 
 	defer listener.Close()
 
+	if !server.trackListener(listener) {
+		return ErrServerClosed
+	}
+	defer server.untrackListener(listener)
+
 	logger := server.logger()
 
 	handler := server.Handler
@@ -129,24 +202,72 @@ func (server *Server) Serve(listener net.Listener) error {
 		handler = EchoHandler
 	}
 
+	failures := 0
 	for {
+		// Don't take connections faster than AcceptRate.
+		server.throttleAccept()
+
 		// Wait for a new TELNET client connection.
 		logger.Debugf("Listening at %q.", listener.Addr())
 		conn, err := listener.Accept()
 		if err != nil {
-			//@TODO: Could try to recover from certain kinds of errors. Maybe waiting a while before trying again.
+			if server.isClosed() {
+				return ErrServerClosed
+			}
+			// Temporary errors (such as running out of file descriptors)
+			// usually clear up once some connections close, so wait a
+			// while and try again rather than giving up on the listener.
+			if isTemporary(err) {
+				failures++
+				delay := server.acceptBackoff(failures)
+				logger.Warnf("Accept error: %v; retrying in %v.", err, delay)
+				time.Sleep(delay)
+				continue
+			}
 			return err
 		}
+		failures = 0
 		logger.Debugf("Received new connection from %q.", conn.RemoteAddr())
 
+		// Turn the connection away if we're over any of the limits.
+		host := connectionHost(conn)
+		if rejection := server.admit(host, time.Now()); internalNotRejected != rejection {
+			logger.Warnf("Rejected connection from %q (%d connections active).", conn.RemoteAddr(), server.ActiveConnections())
+			go server.reject(conn, rejection)
+			continue
+		}
+
+		if err := server.setKeepAlive(conn); nil != err {
+			logger.Warnf("Could not set TCP keep-alive for connection from %q: %v", conn.RemoteAddr(), err)
+		}
+
 		// Handle the new TELNET client connection by spawning
 		// a new goroutine.
-		go server.handle(conn, handler)
+		go server.handle(conn, host, handler)
 		logger.Debugf("Spawned handler to handle connection from %q.", conn.RemoteAddr())
 	}
 }
 
-func (server *Server) handle(c net.Conn, handler Handler) {
+// ActiveConnections returns how many connections the server is currently
+// serving.
+func (server *Server) ActiveConnections() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.activeConnections
+}
+
+// RejectedConnections returns how many connections the server has turned
+// away because of MaxConnections, MaxConnectionsPerIP or PerIPRate.
+func (server *Server) RejectedConnections() int64 {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.rejectedConnections
+}
+
+func (server *Server) handle(c net.Conn, host string, handler Handler) {
+	defer server.release(host)
 	defer c.Close()
 
 	logger := server.logger()
@@ -159,15 +280,123 @@ func (server *Server) handle(c net.Conn, handler Handler) {
 		}
 	}()
 
-	var ctx Context = NewContext().InjectLogger(logger)
+	dataReader := newDataReader(c)
+
+	if server.AskTerminalType {
+		dataReader.replies = c
+		dataReader.terminalType = new(internalTerminalType)
+
+		if err := writeNegotiation(c, doTerminalType); nil != err {
+			logger.Debugf("Could not ask %q for its terminal type: %v", c.RemoteAddr(), err)
+		}
+	}
+
+	var ctx Context = &internalContext{logger: logger, conn: c, terminalType: dataReader.terminalType}
 
 	var w Writer = newDataWriter(c)
-	var r Reader = newDataReader(c)
+	var r Reader = dataReader
 
 	handler.ServeTELNET(ctx, w, r)
 	c.Close()
 }
 
+// Close stops the server from accepting new connections, by closing every
+// net.Listener that Serve (or ListenAndServe, or ListenAndServeTLS) is using.
+// Those calls then return ErrServerClosed.
+//
+// Close does not close connections that were already accepted; the handler
+// serving each connection is responsible for those.
+func (server *Server) Close() error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.closed = true
+
+	var err error
+	for listener := range server.listeners {
+		if closeErr := listener.Close(); nil != closeErr && nil == err {
+			err = closeErr
+		}
+		delete(server.listeners, listener)
+	}
+
+	return err
+}
+
+func (server *Server) isClosed() bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.closed
+}
+
+// trackListener remembers the listener so Close can close it. Returns false if
+// the server has already been closed.
+func (server *Server) trackListener(listener net.Listener) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.closed {
+		return false
+	}
+	if nil == server.listeners {
+		server.listeners = map[net.Listener]struct{}{}
+	}
+	server.listeners[listener] = struct{}{}
+
+	return true
+}
+
+func (server *Server) untrackListener(listener net.Listener) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	delete(server.listeners, listener)
+}
+
+// setKeepAlive applies KeepAlivePeriod to an accepted connection. Connections
+// that aren't TCP (for example, already wrapped in TLS) are left alone.
+func (server *Server) setKeepAlive(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	switch {
+	case server.KeepAlivePeriod < 0:
+		return tcpConn.SetKeepAlive(false)
+	case server.KeepAlivePeriod > 0:
+		if err := tcpConn.SetKeepAlive(true); nil != err {
+			return err
+		}
+		return tcpConn.SetKeepAlivePeriod(server.KeepAlivePeriod)
+	}
+
+	return nil
+}
+
+// internalKeepAliveListener applies the server's KeepAlivePeriod to each
+// connection as it is accepted. ListenAndServeTLS uses it underneath the TLS
+// listener, since by the time Serve sees a TLS connection the TCP connection
+// is out of reach.
+type internalKeepAliveListener struct {
+	net.Listener
+	server *Server
+}
+
+func (listener internalKeepAliveListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if nil != err {
+		return conn, err
+	}
+
+	if err := listener.server.setKeepAlive(conn); nil != err {
+		listener.server.logger().Warnf("Could not set TCP keep-alive for connection from %q: %v", conn.RemoteAddr(), err)
+	}
+
+	return conn, nil
+}
+
 func (server *Server) logger() Logger {
 	logger := server.Logger
 	if nil == logger {
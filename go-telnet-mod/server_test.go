@@ -0,0 +1,182 @@
+package telnet
+
+import (
+	"io"
+	"net"
+
+	"testing"
+	"time"
+)
+
+func TestServerClose(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("Could not listen: (%T) %v", err, err)
+	}
+
+	server := &Server{Handler: EchoHandler}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	// Make sure Serve is actually accepting before we close it.
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if nil != err {
+		t.Fatalf("Could not connect: (%T) %v", err, err)
+	}
+	conn.Close()
+
+	if err := server.Close(); nil != err {
+		t.Errorf("Did not expect an error from Close, but actually got one: (%T) %v", err, err)
+	}
+
+	select {
+	case err := <-serveErr:
+		if ErrServerClosed != err {
+			t.Errorf("Expected Serve to return ErrServerClosed, but actually got: (%T) %v", err, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve did not return after Close.")
+	}
+
+	if err := server.ListenAndServe(); ErrServerClosed != err {
+		t.Errorf("Expected ListenAndServe on a closed server to return ErrServerClosed, but actually got: (%T) %v", err, err)
+	}
+}
+
+func TestServerInjectsConn(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("Could not listen: (%T) %v", err, err)
+	}
+
+	gotConn := make(chan net.Conn, 1)
+	server := &Server{Handler: internalTestContextHandler{gotConn: gotConn}}
+	go server.Serve(listener)
+	defer server.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if nil != err {
+		t.Fatalf("Could not connect: (%T) %v", err, err)
+	}
+	defer client.Close()
+
+	select {
+	case conn := <-gotConn:
+		if nil == conn {
+			t.Fatalf("Expected the handler's context to have a conn, but it was nil.")
+		}
+		if expected, actual := client.LocalAddr().String(), conn.RemoteAddr().String(); expected != actual {
+			t.Errorf("Expected conn remote address %q, but actually got %q.", expected, actual)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Handler was never called.")
+	}
+}
+
+func TestServerSetKeepAlive(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("Could not listen: (%T) %v", err, err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if nil != err {
+		t.Fatalf("Could not connect: (%T) %v", err, err)
+	}
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	if nil != err {
+		t.Fatalf("Could not accept: (%T) %v", err, err)
+	}
+	defer conn.Close()
+
+	for _, period := range []time.Duration{0, 30 * time.Second, -1} {
+		server := &Server{KeepAlivePeriod: period}
+		if err := server.setKeepAlive(conn); nil != err {
+			t.Errorf("For KeepAlivePeriod %v, did not expect an error, but actually got one: (%T) %v", period, err, err)
+		}
+	}
+
+	// Not TCP, so it should be left alone.
+	pipeServer, pipeClient := net.Pipe()
+	defer pipeServer.Close()
+	defer pipeClient.Close()
+
+	server := &Server{KeepAlivePeriod: 30 * time.Second}
+	if err := server.setKeepAlive(pipeServer); nil != err {
+		t.Errorf("Did not expect an error for a non-TCP conn, but actually got one: (%T) %v", err, err)
+	}
+}
+
+type internalTestContextHandler struct {
+	gotConn chan net.Conn
+}
+
+func (handler internalTestContextHandler) ServeTELNET(ctx Context, w Writer, r Reader) {
+	handler.gotConn <- ctx.Conn()
+}
+
+func TestServerAsksTerminalType(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("Could not listen: (%T) %v", err, err)
+	}
+
+	server := &Server{Handler: internalTestTerminalTypeHandler{}, AskTerminalType: true}
+	go server.Serve(listener)
+	defer server.Close()
+
+	client, err := DialTo(listener.Addr().String())
+	if nil != err {
+		t.Fatalf("Could not connect: (%T) %v", err, err)
+	}
+	defer client.Close()
+	client.ReportTerminalType("XTERM")
+
+	// The handler can't know the terminal type until the client has
+	// answered, which happens as our Read comes across the questions, so
+	// keep poking it until it does.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				client.Write([]byte("."))
+			}
+		}
+	}()
+
+	client.conn.(net.Conn).SetReadDeadline(time.Now().Add(5 * time.Second))
+	var buffer [5]byte
+	n, err := io.ReadFull(client, buffer[:])
+	if nil != err {
+		t.Fatalf("Could not read the terminal type back: (%T) %v", err, err)
+	}
+	if expected, actual := "XTERM", string(buffer[:n]); expected != actual {
+		t.Errorf("Expected the terminal type %q, but actually got %q.", expected, actual)
+	}
+}
+
+type internalTestTerminalTypeHandler struct{}
+
+func (handler internalTestTerminalTypeHandler) ServeTELNET(ctx Context, w Writer, r Reader) {
+	var buffer [1]byte
+	for ctx.TerminalType() == "" {
+		if _, err := r.Read(buffer[:]); nil != err {
+			return
+		}
+	}
+	w.Write([]byte(ctx.TerminalType()))
+}
@@ -3,7 +3,7 @@ package telsh
 
 import (
 	"github.com/reiver/go-oi"
-	"github.com/reiver/go-telnet"
+	"go-telnet-mod"
 
 	"io"
 	"sort"
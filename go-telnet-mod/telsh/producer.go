@@ -2,7 +2,7 @@ package telsh
 
 
 import (
-	"github.com/reiver/go-telnet"
+	"go-telnet-mod"
 )
 
 
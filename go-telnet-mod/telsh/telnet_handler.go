@@ -3,7 +3,7 @@ package telsh
 
 import (
 	"github.com/reiver/go-oi"
-	"github.com/reiver/go-telnet"
+	"go-telnet-mod"
 
 	"bytes"
 	"io"
@@ -229,12 +229,14 @@ func (telnetHandler *ShellHandler) ServeTELNET(ctx telnet.Context, writer telnet
 
 //@TODO: Wire up the stdin, stdout, stderr of the handler.
 
+			var copying []<-chan struct{}
+
 			if stdoutPipe, err := handler.StdoutPipe(); nil != err {
 //@TODO:                              
 			} else if nil == stdoutPipe {
 //@TODO:                              
 			} else {
-				connect(ctx, writer, stdoutPipe)
+				copying = append(copying, connect(ctx, writer, stdoutPipe))
 			}
 
 
@@ -243,13 +245,19 @@ func (telnetHandler *ShellHandler) ServeTELNET(ctx telnet.Context, writer telnet
 			} else if nil == stderrPipe {
 //@TODO:                              
 			} else {
-				connect(ctx, writer, stderrPipe)
+				copying = append(copying, connect(ctx, writer, stderrPipe))
 			}
 
 
 			if err := handler.Run(); nil != err {
 //@TODO:                                    
 			}
+
+			// Let the command's output finish going out before the prompt does.
+			for _, done := range copying {
+				<-done
+			}
+
 			line.Reset()
 			if _, err := oi.LongWrite(writer, promptBytes); nil != err {
 				return
@@ -270,11 +278,17 @@ func (telnetHandler *ShellHandler) ServeTELNET(ctx telnet.Context, writer telnet
 
 
 
-func connect(ctx telnet.Context, writer io.Writer, reader io.Reader) {
+// connect copies from reader to writer in its own goroutine, and closes the
+// returned channel once reader is done (which for a Handler's pipes is once
+// Run has returned).
+func connect(ctx telnet.Context, writer io.Writer, reader io.Reader) <-chan struct{} {
 
 	logger := ctx.Logger()
 
+	done := make(chan struct{})
+
 	go func(logger telnet.Logger){
+		defer close(done)
 
 		var buffer [1]byte // Seems like the length of the buffer needs to be small, otherwise will have to wait for buffer to fill up.
 		p := buffer[:]
@@ -294,4 +308,6 @@ func connect(ctx telnet.Context, writer io.Writer, reader io.Reader) {
 			//logger.Tracef("Sent: %q.", p)
 		}
 	}(logger)
+
+	return done
 }
@@ -2,10 +2,14 @@ package telsh
 
 
 import (
-	"github.com/reiver/go-telnet"
+	"github.com/reiver/go-oi"
+	"go-telnet-mod"
 
 	"bytes"
+	"io"
 	"strings"
+	"sync"
+	"time"
 
 	"testing"
 )
@@ -108,3 +112,53 @@ func TestServeTELNETCommandNotFound(t *testing.T) {
 		}
 	}
 }
+
+
+func TestServeTELNETCommandOutputBeforePrompt(t *testing.T) {
+
+	shellHandler := NewShellHandler()
+
+	shellHandler.MustRegisterHandlerFunc("greet", func(stdin io.ReadCloser, stdout io.WriteCloser, stderr io.WriteCloser, args ...string) error {
+		oi.LongWriteString(stdout, "hello "+strings.Join(args, " ")+"\r\n")
+
+		return nil
+	})
+
+
+	ctx := telnet.NewContext()
+
+	var writer internalTestSlowWriter
+
+	shellHandler.ServeTELNET(ctx, &writer, strings.NewReader("greet there\r\ngreet again\r\n"))
+
+	if expected, actual := shellHandler.WelcomeMessage+shellHandler.Prompt+"hello there\r\n"+shellHandler.Prompt+"hello again\r\n"+shellHandler.Prompt+shellHandler.ExitMessage, writer.String(); expected != actual {
+		t.Errorf("Expected %q, but actually got %q.", expected, actual)
+	}
+}
+
+
+// internalTestSlowWriter is slow to take command output (which the shell
+// copies one byte at a time), so if the shell didn't wait for a command's
+// output to be written, the next prompt would come out first.
+type internalTestSlowWriter struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (writer *internalTestSlowWriter) Write(p []byte) (int, error) {
+	if 1 == len(p) {
+		time.Sleep(time.Millisecond)
+	}
+
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	return writer.buffer.Write(p)
+}
+
+func (writer *internalTestSlowWriter) String() string {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	return writer.buffer.String()
+}
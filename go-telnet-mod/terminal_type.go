@@ -0,0 +1,82 @@
+package telnet
+
+import (
+	"io"
+	"sync"
+)
+
+// The TERMINAL-TYPE option (RFC 1091) lets a server ask a client what kind of
+// terminal it is. The server sends IAC DO TERMINAL-TYPE; a client that is
+// willing answers IAC WILL TERMINAL-TYPE; the server then asks with IAC SB
+// TERMINAL-TYPE SEND IAC SE, and the client replies with IAC SB
+// TERMINAL-TYPE IS <name> IAC SE, where <name> is something like "XTERM" or
+// "DUMB". A client that won't say (IAC WONT TERMINAL-TYPE, or no answer at
+// all) leaves the terminal type unknown.
+//
+// Only the first name is asked for. RFC 1091 lets a server keep asking, to
+// get every name the client goes by, but the first one is the client's
+// favorite, and that's all we need.
+const (
+	optionTerminalType = 24
+
+	terminalTypeIS   = 0
+	terminalTypeSEND = 1
+)
+
+// Terminal type names are at most 40 characters (RFC 1091). Anything past
+// that in a reply is dropped, so a client can't make us hold on to an
+// endless subnegotiation.
+const maxTerminalTypeLength = 40
+
+var (
+	doTerminalType   = []byte{255, 253, optionTerminalType}
+	willTerminalType = []byte{255, 251, optionTerminalType}
+	sendTerminalType = []byte{255, 250, optionTerminalType, terminalTypeSEND, 255, 240}
+)
+
+// An internalTerminalType keeps the terminal type a client reported. The
+// data reader sets it, as the reply comes in, from whichever goroutine is
+// reading; the handler can look at it from any other goroutine.
+type internalTerminalType struct {
+	mutex sync.Mutex
+	name  string
+}
+
+func (terminalType *internalTerminalType) set(name string) {
+	terminalType.mutex.Lock()
+	defer terminalType.mutex.Unlock()
+
+	terminalType.name = name
+}
+
+func (terminalType *internalTerminalType) get() string {
+	if nil == terminalType {
+		return ""
+	}
+
+	terminalType.mutex.Lock()
+	defer terminalType.mutex.Unlock()
+
+	return terminalType.name
+}
+
+// terminalTypeSubnegotiation builds the client's IS reply for 'name',
+// escaping any IAC in it.
+func terminalTypeSubnegotiation(name string) []byte {
+	reply := []byte{255, 250, optionTerminalType, terminalTypeIS}
+	for _, b := range []byte(name) {
+		reply = append(reply, b)
+		if 255 == b {
+			reply = append(reply, b)
+		}
+	}
+
+	return append(reply, 255, 240)
+}
+
+// writeNegotiation sends TELNET commands as they are, without the escaping
+// the Writer does to data.
+func writeNegotiation(w io.Writer, command []byte) error {
+	_, err := w.Write(command)
+	return err
+}
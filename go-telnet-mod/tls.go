@@ -44,6 +44,10 @@ func ListenAndServeTLS(addr string, certFile string, keyFile string, handler Han
 // which by default listens to port 992.
 func (server *Server) ListenAndServeTLS(certFile string, keyFile string) error {
 
+	if server.isClosed() {
+		return ErrServerClosed
+	}
+
 	addr := server.Addr
 	if "" == addr {
 		addr = ":telnets"
@@ -54,6 +58,16 @@ func (server *Server) ListenAndServeTLS(certFile string, keyFile string) error {
 		return err
 	}
 
+	return server.ServeTLS(listener, certFile, keyFile)
+}
+
+// ServeTLS acts identically to Serve, except that it uses the TELNET protocol
+// over TLS on the already open net.Listener `listener`.
+//
+// This lets one Server (and so one set of connection limits) serve several
+// TELNETS listeners, or a mix of TELNET and TELNETS listeners.
+func (server *Server) ServeTLS(listener net.Listener, certFile string, keyFile string) error {
+
 	// Apparently have to make a copy of the TLS config this way, rather than by
 	// simple assignment, to prevent some unexported fields from being copied over.
 	//
@@ -94,11 +108,12 @@ func (server *Server) ListenAndServeTLS(certFile string, keyFile string) error {
 		var err error
 		tlsConfig.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
 		if nil != err {
+			listener.Close()
 			return err
 		}
 	}
 
-	tlsListener := tls.NewListener(listener, tlsConfig)
+	tlsListener := tls.NewListener(internalKeepAliveListener{Listener: listener, server: server}, tlsConfig)
 
 	return server.Serve(tlsListener)
 }
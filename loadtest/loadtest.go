@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// Load generator for wtelnet. It does what the test program the 3,000 user
+// figure came from did -- lots of simulated users, each logging in, joining
+// a chat channel and saying something every think time -- but it reads
+// everything the server sends as it arrives, and at the end it says how
+// long things took and what went wrong, so a run can be repeated and
+// compared with the last one.
+//
+// Example, the original test: 3,000 users, 5 to a chat channel, 10 seconds
+// of think time, logging in over a minute and then chatting for five:
+//
+//   go run loadtest.go simuser.go -users 3000 -think 10s -ramp 1m -duration 5m
+//
+// Each user is one connection, so it needs a file descriptor for each, same
+// as the server does; see the build instructions in the README.
+//
+
+type loadOptions struct {
+	server            string
+	users             int
+	perChatChannel    int
+	chatChannels      int
+	userPrefix        string
+	chatChannelPrefix string
+	password          string
+	think             time.Duration
+	jitter            float64
+	ramp              time.Duration
+	duration          time.Duration
+	timeout           time.Duration
+	progress          time.Duration
+}
+
+//
+// Running totals for the progress lines. The users' goroutines and their
+// readers add to these as they go; the progress goroutine only reads them.
+// The final report is made from what each user returns, not from these.
+//
+type loadCounters struct {
+	connected int64
+	loggedIn  int64
+	joined    int64
+	sent      int64
+	received  int64
+	skipped   int64
+	failed    int64
+	finished  int64
+}
+
+func (counters *loadCounters) add(counter *int64, amount int64) {
+	atomic.AddInt64(counter, amount)
+}
+
+func (counters *loadCounters) get(counter *int64) int64 {
+	return atomic.LoadInt64(counter)
+}
+
+func parseOptions(arguments []string) (*loadOptions, error) {
+	options := new(loadOptions)
+	flagSet := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	flagSet.StringVar(&options.server, "server", "127.0.0.1:5555", "address of the wtelnet server")
+	flagSet.IntVar(&options.users, "users", 100, "number of simulated users")
+	flagSet.IntVar(&options.perChatChannel, "per-channel", 5, "users on each chat channel (the server allows 6 by default)")
+	flagSet.StringVar(&options.userPrefix, "user-prefix", "loaduser", "user names are this followed by a number; accounts are created if they don't exist")
+	flagSet.StringVar(&options.chatChannelPrefix, "channel-prefix", "load", "chat channel names are this followed by a number; channels are created if they don't exist")
+	flagSet.StringVar(&options.password, "password", "loadtest", "password for all the simulated users")
+	flagSet.DurationVar(&options.think, "think", 10*time.Second, "average time between messages from each user")
+	flagSet.Float64Var(&options.jitter, "jitter", 0.5, "think time varies at random by up to this fraction either way")
+	flagSet.DurationVar(&options.ramp, "ramp", 30*time.Second, "time over which the users connect, evenly spaced")
+	flagSet.DurationVar(&options.duration, "duration", time.Minute, "how long everyone chats once the last user has connected")
+	flagSet.DurationVar(&options.timeout, "timeout", 30*time.Second, "how long to wait for the server to answer a login or join")
+	flagSet.DurationVar(&options.progress, "progress", 5*time.Second, "time between progress lines; 0 for none")
+	err := flagSet.Parse(arguments)
+	if err != nil {
+		return nil, err
+	}
+	if flagSet.NArg() != 0 {
+		return nil, errors.New("unexpected argument: " + flagSet.Arg(0))
+	}
+	if options.users <= 0 {
+		return nil, errors.New("-users must be positive")
+	}
+	if options.perChatChannel <= 0 {
+		return nil, errors.New("-per-channel must be positive")
+	}
+	if len(options.password) < 4 {
+		return nil, errors.New("-password must be at least 4 characters, same as the server wants")
+	}
+	if (options.jitter < 0) || (options.jitter > 1) {
+		return nil, errors.New("-jitter must be between 0 and 1")
+	}
+	if (options.think <= 0) || (options.timeout <= 0) {
+		return nil, errors.New("-think and -timeout must be positive")
+	}
+	if (options.ramp < 0) || (options.duration < 0) || (options.progress < 0) {
+		return nil, errors.New("-ramp, -duration and -progress can't be negative")
+	}
+	options.chatChannels = (options.users + options.perChatChannel - 1) / options.perChatChannel
+	return options, nil
+}
+
+func main() {
+	options, err := parseOptions(os.Args[1:])
+	if err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	//
+	// First a user of our own makes sure the chat channels are there, so the
+	// simulated users don't race each other to create them.
+	//
+	counters := new(loadCounters)
+	setupUser := newSimulatedUser(0, options, new(loadCounters), time.Now())
+	setupUser.userName = options.userPrefix + "setup"
+	setupUser.chatChannelsToCreate = make([]string, options.chatChannels)
+	for ii := 0; ii < options.chatChannels; ii++ {
+		setupUser.chatChannelsToCreate[ii] = options.chatChannelPrefix + strconv.Itoa(ii)
+	}
+	setup := setupUser.run()
+	if setup.err != nil {
+		fmt.Fprintln(os.Stderr, "setup failed ("+setup.phase+"):", setup.err)
+		os.Exit(1)
+	}
+	fmt.Printf("%d users on %d chat channels at %s, think time %s, ramp %s, duration %s\n", options.users, options.chatChannels, options.server, options.think, options.ramp, options.duration)
+	//
+	// Then the users, evenly spaced over the ramp. They all stop together.
+	//
+	start := time.Now()
+	stopAt := start.Add(options.ramp).Add(options.duration)
+	results := make([]userResult, options.users)
+	var wait sync.WaitGroup
+	for ii := 0; ii < options.users; ii++ {
+		wait.Add(1)
+		go func(number int) {
+			defer wait.Done()
+			time.Sleep(time.Duration(int64(options.ramp) * int64(number) / int64(options.users)))
+			user := newSimulatedUser(number+1, options, counters, stopAt)
+			results[number] = user.run()
+			if results[number].err != nil {
+				counters.add(&counters.failed, 1)
+			}
+			counters.add(&counters.finished, 1)
+		}(ii)
+	}
+	done := make(chan bool)
+	go func() {
+		wait.Wait()
+		close(done)
+	}()
+	if options.progress > 0 {
+		ticker := time.NewTicker(options.progress)
+		defer ticker.Stop()
+	waiting:
+		for {
+			select {
+			case <-ticker.C:
+				printProgress(counters, time.Since(start))
+			case <-done:
+				break waiting
+			}
+		}
+	} else {
+		<-done
+	}
+	elapsed := time.Since(start)
+	if printReport(results, elapsed) {
+		os.Exit(1)
+	}
+}
+
+func printProgress(counters *loadCounters, elapsed time.Duration) {
+	fmt.Printf("%6s  connected %d, logged in %d, joined %d, sent %d, received %d, skipped %d, failed %d, finished %d\n",
+		elapsed.Truncate(time.Second),
+		counters.get(&counters.connected),
+		counters.get(&counters.loggedIn),
+		counters.get(&counters.joined),
+		counters.get(&counters.sent),
+		counters.get(&counters.received),
+		counters.get(&counters.skipped),
+		counters.get(&counters.failed),
+		counters.get(&counters.finished))
+}
+
+//
+// Prints the totals, the latency percentiles and the errors, and says
+// whether there were any errors.
+//
+func printReport(results []userResult, elapsed time.Duration) bool {
+	var connected, loggedIn, joined, sent, received, skipped int64
+	loginTimes := make([]time.Duration, 0, len(results))
+	joinTimes := make([]time.Duration, 0, len(results))
+	deliveries := make([]time.Duration, 0)
+	errorCounts := make(map[string]int)
+	for _, result := range results {
+		if result.connected {
+			connected++
+		}
+		if result.loggedIn {
+			loggedIn++
+			loginTimes = append(loginTimes, result.loginTime)
+		}
+		if result.joined {
+			joined++
+			joinTimes = append(joinTimes, result.joinTime)
+		}
+		sent += result.sent
+		received += result.received
+		skipped += result.skipped
+		deliveries = append(deliveries, result.deliveries...)
+		if result.err != nil {
+			errorCounts[result.phase+": "+innermostError(result.err).Error()]++
+		}
+	}
+	fmt.Println()
+	fmt.Printf("Elapsed:    %s\n", elapsed.Truncate(time.Millisecond))
+	fmt.Printf("Users:      %d connected, %d logged in, %d joined (of %d)\n", connected, loggedIn, joined, len(results))
+	fmt.Printf("Messages:   %d sent, %d received, %d skipped by the server", sent, received, skipped)
+	if elapsed > 0 {
+		fmt.Printf(", %.1f sent/s", float64(sent)/elapsed.Seconds())
+	}
+	fmt.Println()
+	fmt.Println()
+	fmt.Printf("%-22s %8s %10s %10s %10s %10s\n", "Latency", "count", "p50", "p90", "p99", "max")
+	printLatencies("connect + login", loginTimes)
+	printLatencies("join", joinTimes)
+	printLatencies("message delivery", deliveries)
+	fmt.Println()
+	if len(errorCounts) == 0 {
+		fmt.Println("Errors:     none")
+		return false
+	}
+	fmt.Println("Errors:")
+	descriptions := make([]string, 0, len(errorCounts))
+	for description := range errorCounts {
+		descriptions = append(descriptions, description)
+	}
+	sort.Slice(descriptions, func(ii, jj int) bool {
+		if errorCounts[descriptions[ii]] != errorCounts[descriptions[jj]] {
+			return errorCounts[descriptions[ii]] > errorCounts[descriptions[jj]]
+		}
+		return descriptions[ii] < descriptions[jj]
+	})
+	for _, description := range descriptions {
+		fmt.Printf("%8d  %s\n", errorCounts[description], description)
+	}
+	return true
+}
+
+func printLatencies(name string, latencies []time.Duration) {
+	if len(latencies) == 0 {
+		fmt.Printf("%-22s %8d\n", name, 0)
+		return
+	}
+	sort.Slice(latencies, func(ii, jj int) bool {
+		return latencies[ii] < latencies[jj]
+	})
+	fmt.Printf("%-22s %8d %10s %10s %10s %10s\n", name, len(latencies),
+		formatLatency(percentile(latencies, 50)),
+		formatLatency(percentile(latencies, 90)),
+		formatLatency(percentile(latencies, 99)),
+		formatLatency(latencies[len(latencies)-1]))
+}
+
+//
+// Nearest rank, on an already sorted slice.
+//
+func percentile(sorted []time.Duration, percent int) time.Duration {
+	rank := (len(sorted)*percent + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func formatLatency(latency time.Duration) string {
+	if latency < time.Millisecond {
+		return latency.Truncate(time.Microsecond).String()
+	}
+	return latency.Truncate(100 * time.Microsecond).String()
+}
+
+//
+// "read tcp 127.0.0.1:40000->127.0.0.1:5555: read: connection reset by peer"
+// is different for every connection; "connection reset by peer" is what we
+// want to count.
+//
+func innermostError(err error) error {
+	for {
+		inner := errors.Unwrap(err)
+		if inner == nil {
+			return err
+		}
+		err = inner
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/reiver/go-oi"
+	"go-telnet-mod"
+	"io"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//
+// One simulated user. It's a telnet.Caller, so go-telnet-mod's Client runs
+// it on the connection: CallTELNET logs in (creating the account the first
+// time), joins its chat channel and then says something every think time
+// until it's time to stop.
+//
+// Everything the server sends is read by a goroutine of its own, the whole
+// time, byte by byte as it comes in. The original test program only read
+// when it was waiting for something, so during the chat the server's output
+// piled up in the socket buffers, which may well have had something to do
+// with the "connection reset by peer" errors. The reader also does the
+// measuring: every chat message carries the time it was sent, so whoever
+// sees it come back (the sender included) knows how long it took.
+//
+
+//
+// What we say, after the "'" that means "say": this marker, the time it was
+// sent in Unix nanoseconds, and a sequence number. It comes back as
+// `name says, "lt 1234567890 7"`.
+//
+const sayMarker = "lt "
+
+var saidMarker = []byte(`says, "` + sayMarker)
+
+var skippedMarker = []byte(" skipped]")
+
+//
+// How much of the server's output we keep around for expect when nothing
+// is waiting for it -- during the chat, nobody is.
+//
+const maxPendingOutput = 64 * 1024
+const keptPendingOutput = 4 * 1024
+
+type simulatedUser struct {
+	number          int
+	userName        string
+	password        string
+	chatChannelName string
+	options         *loadOptions
+	counters        *loadCounters
+	random          *rand.Rand
+	stopAt          time.Time
+	dialedAt        time.Time
+	//
+	// For the setup user, which only creates the chat channels and leaves.
+	//
+	chatChannelsToCreate []string
+	//
+	// Shared between the user's goroutine and its reader goroutine.
+	// arrived gets a (non-blocking) poke whenever something comes in, so
+	// expect can look again.
+	//
+	mutex      sync.Mutex
+	pending    []byte
+	readErr    error
+	arrived    chan bool
+	readerDone chan bool
+	//
+	// The reader goroutine's own, until it closes readerDone.
+	//
+	line       []byte
+	deliveries []time.Duration
+	received   int64
+	skipped    int64
+	//
+	// The user's goroutine's own.
+	//
+	result userResult
+}
+
+//
+// What one simulated user reports when it's done.
+//
+type userResult struct {
+	connected  bool
+	loggedIn   bool
+	joined     bool
+	loginTime  time.Duration
+	joinTime   time.Duration
+	sent       int64
+	received   int64
+	skipped    int64
+	deliveries []time.Duration
+	phase      string
+	err        error
+}
+
+func newSimulatedUser(number int, options *loadOptions, counters *loadCounters, stopAt time.Time) *simulatedUser {
+	user := new(simulatedUser)
+	user.number = number
+	user.userName = options.userPrefix + strconv.Itoa(number)
+	user.password = options.password
+	user.chatChannelName = options.chatChannelPrefix + strconv.Itoa(number%options.chatChannels)
+	user.options = options
+	user.counters = counters
+	user.random = rand.New(rand.NewSource(time.Now().UnixNano() + int64(number)))
+	user.stopAt = stopAt
+	user.arrived = make(chan bool, 1)
+	user.readerDone = make(chan bool)
+	user.result.phase = "connect"
+	return user
+}
+
+//
+// Connects and runs the user until it's done (or the connection is), and
+// returns how it went.
+//
+func (user *simulatedUser) run() userResult {
+	user.dialedAt = time.Now()
+	conn, err := telnet.DialTo(user.options.server)
+	if err != nil {
+		user.result.err = err
+		return user.result
+	}
+	user.result.connected = true
+	user.counters.add(&user.counters.connected, 1)
+	user.result.phase = "login"
+	client := &telnet.Client{Caller: user}
+	client.Call(conn)
+	//
+	// Client.Call closes the connection when CallTELNET returns, so the
+	// reader is done (or about to be) and its numbers are ours now.
+	//
+	<-user.readerDone
+	user.result.received = user.received
+	user.result.skipped = user.skipped
+	user.result.deliveries = user.deliveries
+	return user.result
+}
+
+func (user *simulatedUser) CallTELNET(ctx telnet.Context, w telnet.Writer, r telnet.Reader) {
+	go user.readAll(r)
+	err := user.converse(w)
+	if err != nil {
+		user.result.err = err
+	}
+	//
+	// ^D logs us out. We give the server a moment to hang up on us, which
+	// also lets the reader see the last of the output.
+	//
+	oi.LongWrite(w, []byte{4})
+	select {
+	case <-user.readerDone:
+	case <-time.After(user.options.timeout):
+	}
+}
+
+func (user *simulatedUser) converse(w telnet.Writer) error {
+	err := user.logIn(w)
+	if err != nil {
+		return err
+	}
+	//
+	// The login time counts from before we dialed.
+	//
+	user.result.loginTime = time.Since(user.dialedAt)
+	user.result.loggedIn = true
+	user.counters.add(&user.counters.loggedIn, 1)
+	if user.chatChannelsToCreate != nil {
+		user.result.phase = "create"
+		for _, chatChannelName := range user.chatChannelsToCreate {
+			err = user.send(w, "/create #"+chatChannelName)
+			if err != nil {
+				return err
+			}
+			_, err = user.expect("created.", "Channel already exists.")
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	user.result.phase = "join"
+	joinStart := time.Now()
+	err = user.send(w, "/join "+user.chatChannelName)
+	if err != nil {
+		return err
+	}
+	which, err := user.expect("You have joined #", "denied", "does not exist", "shutting down")
+	if err != nil {
+		return err
+	}
+	if which != 0 {
+		return errors.New("join refused (" + []string{"", "denied", "does not exist", "shutting down"}[which] + ")")
+	}
+	user.result.joinTime = time.Since(joinStart)
+	user.result.joined = true
+	user.counters.add(&user.counters.joined, 1)
+	user.result.phase = "chat"
+	for sequence := 1; ; sequence++ {
+		think := user.thinkTime()
+		if time.Now().Add(think).After(user.stopAt) {
+			return nil
+		}
+		select {
+		case <-time.After(think):
+		case <-user.readerDone:
+			return user.readError()
+		}
+		err = user.send(w, "'"+sayMarker+strconv.FormatInt(time.Now().UnixNano(), 10)+" "+strconv.Itoa(sequence))
+		if err != nil {
+			return err
+		}
+		user.result.sent++
+		user.counters.add(&user.counters.sent, 1)
+	}
+}
+
+func (user *simulatedUser) logIn(w telnet.Writer) error {
+	_, err := user.expect("Username: ")
+	if err != nil {
+		return err
+	}
+	err = user.send(w, user.userName)
+	if err != nil {
+		return err
+	}
+	which, err := user.expect("Password: ", "Create new account? (y/n) ")
+	if err != nil {
+		return err
+	}
+	if which == 1 {
+		//
+		// First time: make the account, and then we're asked for the
+		// user name again.
+		//
+		err = user.send(w, "y")
+		if err != nil {
+			return err
+		}
+		_, err = user.expect("Password for new account: ")
+		if err != nil {
+			return err
+		}
+		err = user.send(w, user.password)
+		if err != nil {
+			return err
+		}
+		_, err = user.expect("Repeat password: ")
+		if err != nil {
+			return err
+		}
+		err = user.send(w, user.password)
+		if err != nil {
+			return err
+		}
+		which, err = user.expect("has been created.", "error occurred while creating your account: ")
+		if err != nil {
+			return err
+		}
+		if which != 0 {
+			//
+			// Most likely the database was busy with everyone else's new
+			// accounts. The server says why on the rest of the line.
+			//
+			_, reason, err := user.expectAfter("\r\n")
+			if err != nil {
+				return err
+			}
+			return errors.New("account not created: " + reason)
+		}
+		_, err = user.expect("Username: ")
+		if err != nil {
+			return err
+		}
+		err = user.send(w, user.userName)
+		if err != nil {
+			return err
+		}
+		_, err = user.expect("Password: ")
+		if err != nil {
+			return err
+		}
+	}
+	err = user.send(w, user.password)
+	if err != nil {
+		return err
+	}
+	which, err = user.expect("You are logged in.", "Username: ")
+	if err != nil {
+		return err
+	}
+	if which != 0 {
+		return errors.New("wrong password (was the account made with a different -password?)")
+	}
+	return nil
+}
+
+//
+// Think time is the -think time give or take -jitter of it, at random, so
+// the users don't all talk at once.
+//
+func (user *simulatedUser) thinkTime() time.Duration {
+	think := float64(user.options.think)
+	think += think * user.options.jitter * (2*user.random.Float64() - 1)
+	if think < 0 {
+		think = 0
+	}
+	return time.Duration(think)
+}
+
+func (user *simulatedUser) send(w telnet.Writer, line string) error {
+	_, err := oi.LongWrite(w, []byte(line+"\r\n"))
+	return err
+}
+
+//
+// Waits (at most -timeout) for any of the given strings to show up in what
+// the server has sent since the last thing we waited for, and says which
+// one did. Whatever came before it is thrown away.
+//
+func (user *simulatedUser) expect(wanted ...string) (int, error) {
+	which, _, err := user.expectAfter(wanted...)
+	return which, err
+}
+
+//
+// Same as expect, but also returns whatever came before.
+//
+func (user *simulatedUser) expectAfter(wanted ...string) (int, string, error) {
+	timeout := time.NewTimer(user.options.timeout)
+	defer timeout.Stop()
+	for {
+		user.mutex.Lock()
+		which := -1
+		at := -1
+		for ii, text := range wanted {
+			index := bytes.Index(user.pending, []byte(text))
+			if index >= 0 && (at < 0 || index < at) {
+				which = ii
+				at = index
+			}
+		}
+		if which >= 0 {
+			before := string(user.pending[:at])
+			user.pending = user.pending[at+len(wanted[which]):]
+			user.mutex.Unlock()
+			return which, before, nil
+		}
+		readErr := user.readErr
+		user.mutex.Unlock()
+		if readErr != nil {
+			return -1, "", readErr
+		}
+		select {
+		case <-user.arrived:
+		case <-timeout.C:
+			return -1, "", errors.New("timed out waiting for " + strconv.Quote(wanted[0]))
+		}
+	}
+}
+
+func (user *simulatedUser) readError() error {
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+	if user.readErr == io.EOF {
+		return errors.New("server hung up")
+	}
+	return user.readErr
+}
+
+//
+// The reader goroutine. One byte at a time, because go-telnet-mod's Reader
+// doesn't return until it has filled the buffer it's given.
+//
+func (user *simulatedUser) readAll(r telnet.Reader) {
+	defer close(user.readerDone)
+	var buffer [1]byte
+	p := buffer[:]
+	for {
+		n, err := r.Read(p)
+		if n > 0 {
+			user.mutex.Lock()
+			user.pending = append(user.pending, p[0])
+			if len(user.pending) > maxPendingOutput {
+				user.pending = append(user.pending[:0], user.pending[len(user.pending)-keptPendingOutput:]...)
+			}
+			user.mutex.Unlock()
+			if p[0] == '\n' {
+				user.lineReceived(time.Now())
+				user.line = user.line[:0]
+			} else {
+				user.line = append(user.line, p[0])
+			}
+			select {
+			case user.arrived <- true:
+			default:
+			}
+		}
+		if err != nil {
+			user.mutex.Lock()
+			user.readErr = err
+			user.mutex.Unlock()
+			select {
+			case user.arrived <- true:
+			default:
+			}
+			return
+		}
+	}
+}
+
+//
+// A whole line from the server. If it's one of our chat messages (anyone's),
+// we note how long it took to get here; if it's the server saying it threw
+// some away because we weren't keeping up, we count them.
+//
+func (user *simulatedUser) lineReceived(now time.Time) {
+	index := bytes.Index(user.line, saidMarker)
+	if index >= 0 {
+		rest := user.line[index+len(saidMarker):]
+		end := bytes.IndexByte(rest, ' ')
+		if end > 0 {
+			sentAt, err := strconv.ParseInt(string(rest[:end]), 10, 64)
+			if err == nil {
+				user.deliveries = append(user.deliveries, now.Sub(time.Unix(0, sentAt)))
+				user.received++
+				user.counters.add(&user.counters.received, 1)
+			}
+		}
+		return
+	}
+	if bytes.HasSuffix(bytes.TrimRight(user.line, "\r"), skippedMarker) {
+		start := bytes.LastIndexByte(user.line, '[')
+		if start >= 0 {
+			count, err := strconv.ParseInt(string(bytes.Fields(user.line[start+1:])[0]), 10, 64)
+			if err == nil {
+				user.skipped += count
+				user.counters.add(&user.counters.skipped, count)
+			}
+		}
+	}
+}